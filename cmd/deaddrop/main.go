@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
@@ -10,16 +12,25 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/znz-systems/deaddrop/internal/attachment"
 	"github.com/znz-systems/deaddrop/internal/auth"
+	"github.com/znz-systems/deaddrop/internal/blob"
+	"github.com/znz-systems/deaddrop/internal/certs"
+	"github.com/znz-systems/deaddrop/internal/channel"
 	"github.com/znz-systems/deaddrop/internal/config"
 	"github.com/znz-systems/deaddrop/internal/conversation"
 	"github.com/znz-systems/deaddrop/internal/database"
 	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/filter"
 	"github.com/znz-systems/deaddrop/internal/inbound"
 	"github.com/znz-systems/deaddrop/internal/mail"
 	"github.com/znz-systems/deaddrop/internal/mailbox"
 	"github.com/znz-systems/deaddrop/internal/message"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/notify"
 	"github.com/znz-systems/deaddrop/internal/ratelimit"
+	"github.com/znz-systems/deaddrop/internal/rawmail"
+	"github.com/znz-systems/deaddrop/internal/spam"
 	"github.com/znz-systems/deaddrop/internal/store/postgres"
 	"github.com/znz-systems/deaddrop/internal/web"
 	"github.com/znz-systems/deaddrop/internal/web/handlers"
@@ -58,6 +69,48 @@ func main() {
 	mailboxStore := postgres.NewMailboxStore(db)
 	streamStore := postgres.NewStreamStore(db)
 	conversationStore := postgres.NewConversationStore(db)
+	attachmentStore := postgres.NewAttachmentStore(db)
+	spamStore := postgres.NewSpamStore(db)
+	filterRuleStore := postgres.NewFilterRuleStore(db)
+	inboundQueueStore := postgres.NewInboundQueueStore(db)
+	outboundQueueStore := postgres.NewOutboundQueueStore(db)
+	dkimKeyStore := postgres.NewDKIMKeyStore(db)
+	notificationStore := postgres.NewNotificationStore(db)
+	channelStore := postgres.NewChannelStore(db)
+
+	// Blob storage
+	var blobStore blob.Store
+	if cfg.BlobStore == "s3" {
+		blobStore, err = blob.NewS3Store(blob.S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Bucket:    cfg.S3Bucket,
+			Region:    cfg.S3Region,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+		})
+	} else {
+		blobStore, err = blob.NewFSStore(cfg.BlobDir)
+	}
+	if err != nil {
+		slog.Error("failed to set up blob storage", "backend", cfg.BlobStore, "error", err)
+		os.Exit(1)
+	}
+	rawArchive := rawmail.NewArchive(blobStore)
+
+	// Maintenance commands
+	if len(os.Args) > 1 && os.Args[1] == "reparse" {
+		flags := flag.NewFlagSet("reparse", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "report changed messages without updating them")
+		_ = flags.Parse(os.Args[2:])
+
+		res, err := inbound.Reparse(context.Background(), conversationStore, rawArchive, *dryRun)
+		slog.Info("reparse finished", "scanned", res.Scanned, "changed", res.Changed, "failed", res.Failed, "dry_run", *dryRun)
+		if err != nil {
+			slog.Error("reparse failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Services
 	authService := auth.NewService(userStore, sessionStore, cfg.SessionMaxAge)
@@ -73,25 +126,52 @@ func main() {
 	} else {
 		dnsResolver = &domain.NetResolver{}
 	}
-	domainService := domain.NewService(domainStore, dnsResolver)
+	domainService := domain.NewService(domainStore, dkimKeyStore, dnsResolver)
+
+	attachmentService := attachment.NewService(attachmentStore, blobStore)
 
 	var msgNotifier message.Notifier
 	var convNotifier conversation.Notifier
 	var sender conversation.Sender
+	var notificationService *notify.Service
 	if cfg.SMTPEnabled {
 		smtpClient := mail.NewSMTPClient(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPass, cfg.SMTPFrom)
-		mailService := mail.NewService(smtpClient, userStore)
+		smtpClient.SetTransport(mail.NewDomainTransports(domainStore, models.OutboundTransport(cfg.OutboundTransport),
+			mail.NewRelayTransport(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPass),
+			mail.NewDirectTransport(dnsResolver, cfg.OutboundHELOName)))
+		smtpClient.SetDKIMSigner(mail.NewDKIMSigner(dkimKeyStore))
+		emailTemplates, err := fs.Sub(templates.FS, "email")
+		if err != nil {
+			slog.Error("failed to open notification templates", "error", err)
+			os.Exit(1)
+		}
+		notifications, err := mail.LoadNotifications(emailTemplates, cfg.NotificationTemplateDir, cfg.BaseURL)
+		if err != nil {
+			slog.Error("failed to load notification templates", "dir", cfg.NotificationTemplateDir, "error", err)
+			os.Exit(1)
+		}
+		mailService := mail.NewService(smtpClient, userStore, attachmentService, notifications)
+		notificationService = notify.NewService(notificationStore, userStore, mailService)
 		msgNotifier = mailService
-		convNotifier = mailService
+		convNotifier = notificationService
 		sender = mailService
 	} else {
+		// Settings can still be edited; nothing is sent.
+		notificationService = notify.NewService(notificationStore, userStore, nil)
 		msgNotifier = &message.NoopNotifier{}
 		convNotifier = &conversation.NoopNotifier{}
 		sender = &conversation.NoopSender{}
 	}
+	// Notification channels post new conversations whether or not SMTP is
+	// configured.
+	channelService := channel.NewService(channelStore, channel.NewRegistry(), cfg.BaseURL, cfg.ChannelAllowPrivateNetworks)
+	convNotifier = conversation.Notifiers{convNotifier, channelService}
 	messageService := message.NewService(messageStore, domainStore, msgNotifier)
 	mailboxService := mailbox.NewService(mailboxStore, domainStore)
-	conversationService := conversation.NewService(conversationStore, mailboxStore, convNotifier, sender)
+	spamService := spam.NewService(spamStore, dnsResolver, cfg.SpamDNSBLZones, cfg.SpamThreshold)
+	filterService := filter.NewService(filterRuleStore, mailboxStore, conversationStore, streamStore, rawArchive)
+	conversationService := conversation.NewService(conversationStore, outboundQueueStore, mailboxStore, convNotifier, sender, spamService, filterService)
+	inboundQueue := inbound.NewQueue(inboundQueueStore)
 
 	// Rate limiter
 	limiter := ratelimit.NewLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
@@ -104,23 +184,50 @@ func main() {
 	domainHandler := handlers.NewDomainHandler(domainService, messageStore, mailboxStore, streamStore, renderer, cfg.BaseURL, cfg.SecureCookies)
 	messageHandler := handlers.NewMessageHandler(messageService, messageStore, domainStore, renderer)
 	apiHandler := handlers.NewAPIHandler(streamStore, conversationService)
-	mailboxHandler := handlers.NewMailboxHandler(mailboxService, conversationService, domainService, streamStore, conversationStore, renderer, cfg.BaseURL, cfg.SecureCookies)
+	mailboxHandler := handlers.NewMailboxHandler(mailboxService, conversationService, filterService, domainService, attachmentService,
+		attachment.ReplyLimits{MaxFileBytes: cfg.OutboundAttachmentMaxBytes, MaxTotalBytes: cfg.OutboundAttachmentsMaxBytes},
+		inboundQueue, rawArchive, streamStore, conversationStore, renderer, cfg.BaseURL, cfg.SecureCookies)
+	notificationHandler := handlers.NewNotificationHandler(notificationService, mailboxService, renderer, cfg.SecureCookies)
+	channelHandler := handlers.NewChannelHandler(channelService, mailboxService, renderer, cfg.SecureCookies)
 
 	// Router
 	router := web.NewRouter(web.RouterDeps{
-		AuthHandler:    authHandler,
-		DomainHandler:  domainHandler,
-		MessageHandler: messageHandler,
-		APIHandler:     apiHandler,
-		MailboxHandler: mailboxHandler,
-		AuthService:    authService,
-		Renderer:       renderer,
-		Limiter:        limiter,
-		StaticFS:       static.FS,
-		SecureCookies:  cfg.SecureCookies,
-		DB:             db,
+		AuthHandler:         authHandler,
+		DomainHandler:       domainHandler,
+		MessageHandler:      messageHandler,
+		APIHandler:          apiHandler,
+		MailboxHandler:      mailboxHandler,
+		NotificationHandler: notificationHandler,
+		ChannelHandler:      channelHandler,
+		AuthService:         authService,
+		Renderer:            renderer,
+		Limiter:             limiter,
+		StaticFS:            static.FS,
+		SecureCookies:       cfg.SecureCookies,
+		DB:                  db,
 	})
 
+	// Inbound SMTP certificate, re-read from disk on SIGHUP
+	var inboundCert *certs.Reloader
+	if cfg.InboundSMTPEnabled && cfg.InboundSMTPTLSCertFile != "" {
+		inboundCert, err = certs.NewReloader(cfg.InboundSMTPTLSCertFile, cfg.InboundSMTPTLSKeyFile)
+		if err != nil {
+			slog.Error("failed to load inbound SMTP TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := inboundCert.Reload(); err != nil {
+					slog.Error("failed to reload inbound SMTP TLS certificate", "error", err)
+					continue
+				}
+				slog.Info("inbound SMTP TLS certificate reloaded")
+			}
+		}()
+	}
+
 	// Session cleanup goroutine
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour)
@@ -132,9 +239,95 @@ func main() {
 		}
 	}()
 
-	// Inbound SMTP server
-	if cfg.InboundSMTPEnabled {
-		smtpSrv := inbound.NewServer(cfg.InboundSMTPAddr, cfg.InboundSMTPDomain, streamStore, conversationService)
+	// Outbound delivery workers
+	for range cfg.OutboundWorkers {
+		go conversationService.DeliverQueued(context.Background())
+	}
+
+	// Notification digests, and notifications held back by quiet hours
+	if cfg.SMTPEnabled {
+		go func() {
+			ticker := time.NewTicker(1 * time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := notificationService.SendDigests(context.Background()); err != nil {
+					slog.Error("failed to send notification digests", "error", err)
+				}
+			}
+		}()
+	}
+
+	// Notification channel deliveries, and pruning of their log
+	go channelService.DeliverQueued(context.Background())
+	if cfg.ChannelLogRetentionDays > 0 {
+		go func() {
+			ticker := time.NewTicker(1 * time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				before := time.Now().AddDate(0, 0, -cfg.ChannelLogRetentionDays)
+				if _, err := channelService.PruneLog(context.Background(), before); err != nil {
+					slog.Error("failed to prune channel delivery log", "error", err)
+				}
+			}
+		}()
+	}
+
+	// Spam purge goroutine
+	if cfg.SpamRetentionDays > 0 {
+		go func() {
+			ticker := time.NewTicker(1 * time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				before := time.Now().AddDate(0, 0, -cfg.SpamRetentionDays)
+				n, err := spam.Purge(context.Background(), conversationStore, blobStore, before)
+				if err != nil {
+					slog.Error("failed to purge spam", "error", err)
+				} else if n > 0 {
+					slog.Info("purged spam conversations", "count", n)
+				}
+			}
+		}()
+	}
+
+	// Inbound SMTP and LMTP server
+	var smtpSrv *inbound.Server
+	if cfg.InboundSMTPEnabled || cfg.InboundLMTPAddr != "" {
+		inboundCfg := inbound.Config{
+			Addr:            cfg.InboundSMTPAddr,
+			Domain:          cfg.InboundSMTPDomain,
+			ImplicitTLSAddr: cfg.InboundSMTPSAddr,
+			TrustedProxies:  cfg.InboundTrustedProxies,
+			LMTPAddr:        cfg.InboundLMTPAddr,
+			Resolver:        dnsResolver,
+			Workers:         cfg.InboundWorkers,
+			MaxMessageBytes: cfg.InboundMaxMessageBytes,
+			Limits: inbound.Limits{
+				MaxConnections:      cfg.InboundMaxConnections,
+				MaxConnectionsPerIP: cfg.InboundMaxConnectionsPerIP,
+				MessagesPerMinute:   cfg.InboundMessagesPerMinute,
+				MessageBurst:        cfg.InboundMessageBurst,
+				Allow:               cfg.InboundAllowIPs,
+				Deny:                cfg.InboundDenyIPs,
+			},
+			LMTPRecipientHeader: cfg.InboundLMTPRecipientHeader,
+		}
+		if cfg.GreylistEnabled {
+			greylist := inbound.NewGreylist(postgres.NewGreylistStore(db), cfg.GreylistDelay, cfg.GreylistWhitelistIPs, cfg.GreylistWhitelistDomains)
+			inboundCfg.Greylist = greylist
+			go func() {
+				ticker := time.NewTicker(1 * time.Hour)
+				defer ticker.Stop()
+				for range ticker.C {
+					if _, err := greylist.Prune(context.Background()); err != nil {
+						slog.Error("failed to prune greylist", "error", err)
+					}
+				}
+			}()
+		}
+		if inboundCert != nil {
+			inboundCfg.TLSConfig = inboundCert.TLSConfig()
+		}
+		smtpSrv = inbound.NewServer(inboundCfg, streamStore, inboundQueue, conversationService, attachmentService, rawArchive)
 		go func() {
 			if err := smtpSrv.Start(); err != nil {
 				slog.Error("inbound SMTP server error", "error", err)
@@ -173,4 +366,9 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		slog.Error("shutdown error", "error", err)
 	}
+	if smtpSrv != nil {
+		if err := smtpSrv.Shutdown(ctx); err != nil {
+			slog.Error("inbound SMTP shutdown error", "error", err)
+		}
+	}
 }
@@ -0,0 +1,238 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/blob"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+var (
+	ErrTooLarge       = errors.New("attachment exceeds the stream's size limit")
+	ErrTypeNotAllowed = errors.New("attachment type is not allowed on this stream")
+
+	ErrReplyFileTooLarge = errors.New("attachment exceeds the size limit for replies")
+	ErrReplyTooLarge     = errors.New("attachments exceed the total size limit for replies")
+)
+
+// ReplyLimits bounds the files attached to a reply. 0 disables a limit.
+type ReplyLimits struct {
+	MaxFileBytes  int64
+	MaxTotalBytes int64
+}
+
+// Check reports whether files of the given sizes may be attached to one
+// reply.
+func (l ReplyLimits) Check(sizes []int64) error {
+	var total int64
+	for _, size := range sizes {
+		if l.MaxFileBytes > 0 && size > l.MaxFileBytes {
+			return ErrReplyFileTooLarge
+		}
+		total += size
+	}
+	if l.MaxTotalBytes > 0 && total > l.MaxTotalBytes {
+		return ErrReplyTooLarge
+	}
+	return nil
+}
+
+// File is an attachment extracted from a message, before it is stored.
+type File struct {
+	Filename    string
+	ContentType string
+	ContentID   string // Content-ID of an inline part, for cid: references
+
+	// Data is the content. Content too large to keep in memory is spooled
+	// to the temporary file at Path instead, of Size bytes.
+	Data []byte
+	Path string
+	Size int64
+
+	// Source, if set, opens content of Size bytes that someone else
+	// holds, such as an uploaded file.
+	Source func() (io.ReadCloser, error)
+}
+
+// Len returns the size of the content.
+func (f File) Len() int64 {
+	if f.Path != "" || f.Source != nil {
+		return f.Size
+	}
+	return int64(len(f.Data))
+}
+
+// Open returns a reader for the content.
+func (f File) Open() (io.ReadCloser, error) {
+	switch {
+	case f.Source != nil:
+		return f.Source()
+	case f.Path != "":
+		return os.Open(f.Path)
+	}
+	return io.NopCloser(bytes.NewReader(f.Data)), nil
+}
+
+// Service stores attachment metadata in Postgres and content in a blob store.
+type Service struct {
+	attachments store.AttachmentStore
+	blobs       blob.Store
+}
+
+// NewService creates a new attachment Service.
+func NewService(attachments store.AttachmentStore, blobs blob.Store) *Service {
+	return &Service{
+		attachments: attachments,
+		blobs:       blobs,
+	}
+}
+
+// CheckLimits reports whether f may be stored on the given stream.
+func CheckLimits(stream *models.Stream, f File) error {
+	if stream.MaxAttachmentBytes > 0 && f.Len() > stream.MaxAttachmentBytes {
+		return ErrTooLarge
+	}
+	if !TypeAllowed(stream.AllowedAttachmentTypes, f.ContentType) {
+		return ErrTypeNotAllowed
+	}
+	return nil
+}
+
+// TypeAllowed matches a content type against a comma-separated allowlist
+// such as "image/*, application/pdf". An empty allowlist accepts any type.
+func TypeAllowed(allowed, contentType string) bool {
+	allowed = strings.TrimSpace(allowed)
+	if allowed == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	for _, pattern := range strings.Split(allowed, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+			continue
+		case pattern == "*/*" || pattern == mediaType:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// Save stores f for the given conversation message. The caller is expected
+// to have checked the stream's limits with CheckLimits.
+func (s *Service) Save(ctx context.Context, messageID int64, f File) (*models.Attachment, error) {
+	a, err := s.Stage(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	a.ConversationMessageID = messageID
+	if err := s.attachments.CreateAttachment(ctx, a); err != nil {
+		_ = s.blobs.Delete(ctx, a.StorageKey)
+		return nil, fmt.Errorf("create attachment: %w", err)
+	}
+	return a, nil
+}
+
+// Stage stores the content of f and returns its metadata, for a message
+// that is yet to be created to record, as an outbound message does when
+// it is queued. Discard removes the content if the message is not
+// created after all.
+func (s *Service) Stage(ctx context.Context, f File) (*models.Attachment, error) {
+	contentType := strings.TrimSpace(f.ContentType)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	a := &models.Attachment{
+		Filename:    sanitizeFilename(f.Filename),
+		ContentType: contentType,
+		SizeBytes:   f.Len(),
+		StorageKey:  storageKey(time.Now()),
+		ContentID:   f.ContentID,
+	}
+
+	content, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open attachment content: %w", err)
+	}
+	defer content.Close()
+	if err := s.blobs.Put(ctx, a.StorageKey, content); err != nil {
+		return nil, fmt.Errorf("store attachment content: %w", err)
+	}
+	return a, nil
+}
+
+// Discard removes the content of staged attachments.
+func (s *Service) Discard(ctx context.Context, attachments []models.Attachment) {
+	for _, a := range attachments {
+		if err := s.blobs.Delete(ctx, a.StorageKey); err != nil {
+			slog.Warn("failed to discard attachment content", "key", a.StorageKey, "error", err)
+		}
+	}
+}
+
+// ListByConversation returns the attachments of every message in a
+// conversation, keyed by conversation message ID.
+func (s *Service) ListByConversation(ctx context.Context, conversationID int64) (map[int64][]models.Attachment, error) {
+	attachments, err := s.attachments.GetAttachmentsByConversationID(ctx, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("list attachments: %w", err)
+	}
+	byMessage := make(map[int64][]models.Attachment)
+	for _, a := range attachments {
+		byMessage[a.ConversationMessageID] = append(byMessage[a.ConversationMessageID], a)
+	}
+	return byMessage, nil
+}
+
+// GetByPublicID retrieves attachment metadata by public UUID.
+func (s *Service) GetByPublicID(ctx context.Context, publicID uuid.UUID) (*models.Attachment, error) {
+	return s.attachments.GetAttachmentByPublicID(ctx, publicID)
+}
+
+// Open returns a reader for the attachment's content.
+func (s *Service) Open(ctx context.Context, a *models.Attachment) (io.ReadCloser, error) {
+	return s.blobs.Get(ctx, a.StorageKey)
+}
+
+func storageKey(now time.Time) string {
+	return fmt.Sprintf("attachments/%s/%s", now.UTC().Format("2006/01"), uuid.New())
+}
+
+// sanitizeFilename strips any directory components and control characters so
+// the name is safe to use in a Content-Disposition header.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "attachment"
+	}
+	return name
+}
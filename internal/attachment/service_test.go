@@ -0,0 +1,201 @@
+package attachment
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/blob"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+type mockAttachmentStore struct {
+	attachments []models.Attachment
+	fail        bool
+}
+
+func (m *mockAttachmentStore) CreateAttachment(_ context.Context, a *models.Attachment) error {
+	if m.fail {
+		return errors.New("db down")
+	}
+	a.ID = int64(len(m.attachments) + 1)
+	a.PublicID = uuid.New()
+	m.attachments = append(m.attachments, *a)
+	return nil
+}
+
+func (m *mockAttachmentStore) GetAttachmentByPublicID(_ context.Context, publicID uuid.UUID) (*models.Attachment, error) {
+	for i := range m.attachments {
+		if m.attachments[i].PublicID == publicID {
+			return &m.attachments[i], nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (m *mockAttachmentStore) GetAttachmentsByConversationID(_ context.Context, _ int64) ([]models.Attachment, error) {
+	return m.attachments, nil
+}
+
+func TestTypeAllowed(t *testing.T) {
+	tests := []struct {
+		allowed, contentType string
+		want                 bool
+	}{
+		{"", "application/x-msdownload", true},
+		{"image/*, application/pdf", "image/png", true},
+		{"image/*, application/pdf", "application/pdf; name=a.pdf", true},
+		{"image/*, application/pdf", "application/zip", false},
+		{"IMAGE/*", "image/jpeg", true},
+		{"*/*", "text/plain", true},
+	}
+	for _, tt := range tests {
+		if got := TypeAllowed(tt.allowed, tt.contentType); got != tt.want {
+			t.Errorf("TypeAllowed(%q, %q) = %v, want %v", tt.allowed, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	stream := &models.Stream{MaxAttachmentBytes: 4, AllowedAttachmentTypes: "image/*"}
+
+	if err := CheckLimits(stream, File{ContentType: "image/png", Data: []byte("abcd")}); err != nil {
+		t.Errorf("expected attachment within limits to pass, got %v", err)
+	}
+	if err := CheckLimits(stream, File{ContentType: "image/png", Data: []byte("abcde")}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+	if err := CheckLimits(stream, File{ContentType: "application/pdf", Data: []byte("a")}); !errors.Is(err, ErrTypeNotAllowed) {
+		t.Errorf("expected ErrTypeNotAllowed, got %v", err)
+	}
+}
+
+func TestReplyLimits(t *testing.T) {
+	limits := ReplyLimits{MaxFileBytes: 4, MaxTotalBytes: 6}
+
+	if err := limits.Check([]int64{4, 2}); err != nil {
+		t.Errorf("expected files within limits to pass, got %v", err)
+	}
+	if err := limits.Check([]int64{5}); !errors.Is(err, ErrReplyFileTooLarge) {
+		t.Errorf("expected ErrReplyFileTooLarge, got %v", err)
+	}
+	if err := limits.Check([]int64{4, 3}); !errors.Is(err, ErrReplyTooLarge) {
+		t.Errorf("expected ErrReplyTooLarge, got %v", err)
+	}
+	if err := (ReplyLimits{}).Check([]int64{1 << 40}); err != nil {
+		t.Errorf("expected no limits to accept anything, got %v", err)
+	}
+}
+
+func TestStage_StoresContentUntilDiscarded(t *testing.T) {
+	blobs, _ := blob.NewFSStore(t.TempDir())
+	as := &mockAttachmentStore{}
+	svc := NewService(as, blobs)
+	ctx := context.Background()
+
+	a, err := svc.Stage(ctx, File{Filename: "notes.txt", Data: []byte("hello")})
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+	if len(as.attachments) != 0 {
+		t.Error("expected no metadata to be created for a staged file")
+	}
+	if a.ContentType != "application/octet-stream" || a.SizeBytes != 5 || a.StorageKey == "" {
+		t.Errorf("unexpected metadata: %+v", a)
+	}
+	rc, err := svc.Open(ctx, a)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	rc.Close()
+
+	svc.Discard(ctx, []models.Attachment{*a})
+	if _, err := svc.Open(ctx, a); err == nil {
+		t.Error("expected discarded content to be gone")
+	}
+}
+
+func TestStage_StreamsSource(t *testing.T) {
+	blobs, _ := blob.NewFSStore(t.TempDir())
+	svc := NewService(&mockAttachmentStore{}, blobs)
+	ctx := context.Background()
+
+	f := File{Filename: "notes.txt", ContentType: "text/plain", Size: 5, Source: func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("hello")), nil
+	}}
+	a, err := svc.Stage(ctx, f)
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+	if a.SizeBytes != 5 {
+		t.Errorf("expected size 5, got %d", a.SizeBytes)
+	}
+	rc, err := svc.Open(ctx, a)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer rc.Close()
+	if got, _ := io.ReadAll(rc); string(got) != "hello" {
+		t.Errorf("expected source content to be stored, got %q", got)
+	}
+}
+
+func TestSave_StoresMetadataAndContent(t *testing.T) {
+	blobs, _ := blob.NewFSStore(t.TempDir())
+	as := &mockAttachmentStore{}
+	svc := NewService(as, blobs)
+
+	a, err := svc.Save(context.Background(), 7, File{
+		Filename:    "../../etc/invoice.pdf",
+		ContentType: "application/pdf",
+		Data:        []byte("%PDF"),
+	})
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if a.ConversationMessageID != 7 || a.SizeBytes != 4 {
+		t.Errorf("unexpected metadata: %+v", a)
+	}
+	if a.Filename != "invoice.pdf" {
+		t.Errorf("expected directory components stripped, got %q", a.Filename)
+	}
+
+	rc, err := svc.Open(context.Background(), a)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer rc.Close()
+	data, _ := io.ReadAll(rc)
+	if string(data) != "%PDF" {
+		t.Errorf("expected stored content, got %q", data)
+	}
+}
+
+func TestSave_RemovesBlobWhenMetadataFails(t *testing.T) {
+	blobs, _ := blob.NewFSStore(t.TempDir())
+	svc := NewService(&mockAttachmentStore{fail: true}, blobs)
+
+	if _, err := svc.Save(context.Background(), 1, File{Filename: "a.txt", Data: []byte("x")}); err == nil {
+		t.Fatal("expected error when metadata insert fails")
+	}
+}
+
+func TestListByConversation_GroupsByMessage(t *testing.T) {
+	as := &mockAttachmentStore{attachments: []models.Attachment{
+		{ID: 1, ConversationMessageID: 10},
+		{ID: 2, ConversationMessageID: 11},
+		{ID: 3, ConversationMessageID: 10},
+	}}
+	svc := NewService(as, nil)
+
+	byMessage, err := svc.ListByConversation(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("ListByConversation: %v", err)
+	}
+	if len(byMessage[10]) != 2 || len(byMessage[11]) != 1 {
+		t.Errorf("unexpected grouping: %v", byMessage)
+	}
+}
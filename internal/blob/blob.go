@@ -0,0 +1,18 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Get when no object exists under the key.
+var ErrNotFound = errors.New("blob not found")
+
+// Store persists opaque binary objects such as attachments under
+// slash-separated keys.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
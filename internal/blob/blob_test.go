@@ -0,0 +1,126 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFSStore_RoundTrip(t *testing.T) {
+	s, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFSStore: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "attachments/a/b.bin", strings.NewReader("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	rc, err := s.Get(ctx, "attachments/a/b.bin")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "hello" {
+		t.Errorf("expected hello, got %q", got)
+	}
+
+	if err := s.Delete(ctx, "attachments/a/b.bin"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "attachments/a/b.bin"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestFSStore_RejectsTraversal(t *testing.T) {
+	s, _ := NewFSStore(t.TempDir())
+	if err := s.Put(context.Background(), "../escape", strings.NewReader("x")); err == nil {
+		t.Fatal("expected error for key escaping the root")
+	}
+}
+
+// fakeS3 is a minimal in-memory stand-in for an S3-compatible service.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	auth    []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	if r.Header.Get("x-amz-date") == "" || r.Header.Get("x-amz-content-sha256") == "" {
+		http.Error(w, "missing signing headers", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = b
+	case http.MethodGet:
+		b, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Store_RoundTrip(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s, err := NewS3Store(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "deaddrop",
+		Region:    "eu-west-1",
+		AccessKey: "AKID",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "attachments/report.pdf", strings.NewReader("%PDF-1.4")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := fake.objects["/deaddrop/attachments/report.pdf"]; !ok {
+		t.Fatalf("expected path-style object key, got %v", fake.objects)
+	}
+	if !strings.HasPrefix(fake.auth[0], "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(fake.auth[0], "/eu-west-1/s3/aws4_request") {
+		t.Errorf("unexpected Authorization header %q", fake.auth[0])
+	}
+
+	rc, err := s.Get(ctx, "attachments/report.pdf")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "%PDF-1.4" {
+		t.Errorf("expected stored bytes back, got %q", got)
+	}
+
+	if err := s.Delete(ctx, "attachments/report.pdf"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "attachments/report.pdf"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSelfSigned(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, r *Reloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, dir, "old.example.com")
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	if got := servedCommonName(t, r); got != "old.example.com" {
+		t.Fatalf("expected old.example.com, got %s", got)
+	}
+
+	writeSelfSigned(t, dir, "new.example.com")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := servedCommonName(t, r); got != "new.example.com" {
+		t.Fatalf("expected new.example.com after reload, got %s", got)
+	}
+}
+
+func TestReloader_KeepsCertificateOnFailedReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, dir, "good.example.com")
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected reload of a broken certificate to fail")
+	}
+	if got := servedCommonName(t, r); got != "good.example.com" {
+		t.Fatalf("expected previous certificate to stay in use, got %s", got)
+	}
+}
+
+func TestNewReloader_MissingFiles(t *testing.T) {
+	if _, err := NewReloader("/nonexistent/cert.pem", "/nonexistent/key.pem"); err == nil {
+		t.Fatal("expected error for missing files")
+	}
+}
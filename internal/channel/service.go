@@ -0,0 +1,383 @@
+// Package channel announces new conversations on channels other than
+// email: webhooks, chat rooms and push notification services. Each
+// mailbox can have several channels; every event is queued for each of
+// them and delivered by workers, which retry as the channel's policy says
+// and keep a log of what was sent.
+package channel
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
+	"github.com/znz-systems/deaddrop/internal/worker"
+)
+
+// Event types.
+const (
+	EventNewConversation = "conversation.created"
+	EventTest            = "channel.test"
+)
+
+const (
+	// requestTimeout is how long a channel has to answer.
+	requestTimeout = 15 * time.Second
+
+	// deliveryLease covers a few request timeouts. A delivery still
+	// claimed after it is sent again, so a channel may see an event twice.
+	deliveryLease = 2 * time.Minute
+
+	// maxRetryDelay caps the wait between attempts, however long the
+	// channel's retry interval and attempt count would make it.
+	maxRetryDelay = 6 * time.Hour
+
+	// bodyLength is how many characters of a message events carry.
+	bodyLength = 500
+)
+
+// Limits on the retry policy a channel can have.
+const (
+	MaxAttempts      = 20
+	MinRetryInterval = time.Second
+	MaxRetryInterval = time.Hour
+)
+
+var (
+	ErrUnknownType     = errors.New("unknown channel type")
+	ErrInvalidURL      = errors.New("channel URL must be an http or https URL")
+	ErrInvalidPolicy   = errors.New("invalid retry policy")
+	ErrInvalidSettings = errors.New("invalid channel settings")
+)
+
+// Event is what a channel is told. Webhooks receive it as JSON, and their
+// templates are executed with it.
+type Event struct {
+	Type           string    `json:"event"`
+	Mailbox        string    `json:"mailbox"`
+	MailboxID      string    `json:"mailbox_id"`
+	ConversationID string    `json:"conversation_id,omitempty"`
+	Subject        string    `json:"subject"`
+	SenderName     string    `json:"sender_name"`
+	SenderAddress  string    `json:"sender_address"`
+	Body           string    `json:"body"` // the start of the message
+	URL            string    `json:"url"`  // the conversation in the dashboard
+	Time           time.Time `json:"time"`
+}
+
+// Title is the headline of a message about the event.
+func (e *Event) Title() string {
+	if e.Type == EventTest {
+		return "Test notification from " + e.Mailbox
+	}
+	return "New conversation in " + e.Mailbox
+}
+
+func (e *Event) subject() string {
+	if e.Subject == "" {
+		return "(no subject)"
+	}
+	return e.Subject
+}
+
+func (e *Event) from() string {
+	switch {
+	case e.SenderName != "" && e.SenderAddress != "":
+		return e.SenderName + " <" + e.SenderAddress + ">"
+	case e.SenderName != "":
+		return e.SenderName
+	default:
+		return e.SenderAddress
+	}
+}
+
+// Service manages notification channels and delivers events to them. It
+// implements conversation.Notifier.
+type Service struct {
+	channels store.ChannelStore
+	registry Registry
+	client   *http.Client
+	baseURL  string
+
+	// wake is signalled when an event is queued.
+	wake chan struct{}
+}
+
+// NewService creates a Service that delivers to the targets in registry,
+// with links into the dashboard at baseURL. Unless allowPrivate is set,
+// channels cannot reach loopback, private or link-local addresses, so that
+// users cannot use them to probe the network DeadDrop runs in.
+func NewService(channels store.ChannelStore, registry Registry, baseURL string, allowPrivate bool) *Service {
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	if !allowPrivate {
+		dialer.Control = refusePrivate
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &Service{
+		channels: channels,
+		registry: registry,
+		client:   &http.Client{Transport: transport, Timeout: requestTimeout},
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// refusePrivate is a net.Dialer Control function that refuses connections
+// to addresses that are not public.
+func refusePrivate(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("channel: refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// Create validates a new channel for a mailbox and stores it.
+func (s *Service) Create(ctx context.Context, ch *models.NotificationChannel) error {
+	target, ok := s.registry[ch.Type]
+	if !ok {
+		return ErrUnknownType
+	}
+	u, err := url.Parse(ch.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidURL
+	}
+	if ch.MaxAttempts < 1 || ch.MaxAttempts > MaxAttempts ||
+		ch.RetryInterval < MinRetryInterval || ch.RetryInterval > MaxRetryInterval {
+		return ErrInvalidPolicy
+	}
+	if err := target.Validate(ch); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSettings, err)
+	}
+	if ch.Name == "" {
+		ch.Name = u.Host
+	}
+	ch.Enabled = true
+	return s.channels.CreateChannel(ctx, ch)
+}
+
+// List returns a mailbox's channels.
+func (s *Service) List(ctx context.Context, mailboxID int64) ([]models.NotificationChannel, error) {
+	return s.channels.GetChannelsByMailboxID(ctx, mailboxID)
+}
+
+// GetByPublicID retrieves a channel by public UUID.
+func (s *Service) GetByPublicID(ctx context.Context, publicID uuid.UUID) (*models.NotificationChannel, error) {
+	return s.channels.GetChannelByPublicID(ctx, publicID)
+}
+
+// SetEnabled turns a channel on or off. Events queued for a channel that
+// is turned off are still delivered.
+func (s *Service) SetEnabled(ctx context.Context, id int64, enabled bool) error {
+	return s.channels.UpdateChannelEnabled(ctx, id, enabled)
+}
+
+// Delete deletes a channel with its delivery log.
+func (s *Service) Delete(ctx context.Context, id int64) error {
+	return s.channels.DeleteChannel(ctx, id)
+}
+
+// Deliveries returns a channel's latest deliveries, newest first.
+func (s *Service) Deliveries(ctx context.Context, channelID int64, limit int) ([]models.ChannelDelivery, error) {
+	return s.channels.GetChannelDeliveries(ctx, channelID, limit)
+}
+
+// NotifyNewConversation queues the new conversation for each of the
+// mailbox's enabled channels. Implements conversation.Notifier.
+func (s *Service) NotifyNewConversation(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	channels, err := s.channels.GetChannelsByMailboxID(ctx, mailbox.ID)
+	if err != nil {
+		return fmt.Errorf("channel: list channels: %w", err)
+	}
+	created := msg.CreatedAt
+	if created.IsZero() {
+		created = time.Now()
+	}
+	e := &Event{
+		Type:           EventNewConversation,
+		Mailbox:        mailbox.Name,
+		MailboxID:      mailbox.PublicID.String(),
+		ConversationID: conv.PublicID.String(),
+		Subject:        conv.Subject,
+		SenderName:     msg.SenderName,
+		SenderAddress:  msg.SenderAddress,
+		Body:           truncate(msg.Body, bodyLength),
+		URL:            fmt.Sprintf("%s/mailboxes/%s/conversations/%s", s.baseURL, mailbox.PublicID, conv.PublicID),
+		Time:           created.UTC(),
+	}
+	var errs []error
+	for i := range channels {
+		if channels[i].Enabled {
+			errs = append(errs, s.enqueue(ctx, &channels[i], e))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NotifyReply implements conversation.Notifier. Channels only announce new
+// conversations.
+func (s *Service) NotifyReply(_ context.Context, _ *models.Mailbox, _ *models.Conversation, _ *models.ConversationMessage) error {
+	return nil
+}
+
+// Test queues a test event for a channel, whether it is enabled or not.
+func (s *Service) Test(ctx context.Context, mailbox *models.Mailbox, ch *models.NotificationChannel) error {
+	return s.enqueue(ctx, ch, &Event{
+		Type:       EventTest,
+		Mailbox:    mailbox.Name,
+		MailboxID:  mailbox.PublicID.String(),
+		Subject:    "Test notification",
+		SenderName: "DeadDrop",
+		Body:       "This channel is set up to receive new conversations in " + mailbox.Name + ".",
+		URL:        fmt.Sprintf("%s/mailboxes/%s", s.baseURL, mailbox.PublicID),
+		Time:       time.Now().UTC(),
+	})
+}
+
+func (s *Service) enqueue(ctx context.Context, ch *models.NotificationChannel, e *Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	d := &models.ChannelDelivery{ChannelID: ch.ID, EventType: e.Type, Event: payload}
+	if err := s.channels.EnqueueChannelDelivery(ctx, d); err != nil {
+		slog.ErrorContext(ctx, "failed to queue channel delivery", "channel_id", ch.ID, "event", e.Type, "error", err)
+		return fmt.Errorf("channel: queue delivery: %w", err)
+	}
+	worker.Signal(s.wake)
+	return nil
+}
+
+// DeliverQueued delivers queued events until ctx is cancelled.
+func (s *Service) DeliverQueued(ctx context.Context) {
+	worker.Run(ctx, s.wake, s.deliverNext)
+}
+
+// deliverNext claims and delivers one due event. It reports whether there
+// was one.
+func (s *Service) deliverNext(ctx context.Context) bool {
+	d, err := s.channels.ClaimChannelDelivery(ctx, deliveryLease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to claim channel delivery", "error", err)
+		}
+		return false
+	}
+
+	code, err := s.send(ctx, d)
+	ch := d.Channel
+	switch {
+	case err == nil:
+		err = s.channels.CompleteChannelDelivery(ctx, d.ID, code)
+	case isPermanent(err) || d.Attempts >= ch.MaxAttempts:
+		slog.Error("giving up on channel delivery",
+			"delivery_id", d.ID, "channel_id", ch.ID, "type", ch.Type, "attempts", d.Attempts, "error", err)
+		err = s.channels.FailChannelDelivery(ctx, d.ID, code, err.Error())
+	default:
+		delay := retryBackoff(ch).Delay(d.Attempts)
+		slog.Warn("failed to deliver to channel, will retry",
+			"delivery_id", d.ID, "channel_id", ch.ID, "type", ch.Type, "attempts", d.Attempts, "retry_in", delay, "error", err)
+		err = s.channels.RetryChannelDelivery(ctx, d.ID, time.Now().Add(delay), code, err.Error())
+	}
+	if err != nil {
+		// The claim expires and the event is delivered again.
+		slog.Error("failed to update channel delivery", "delivery_id", d.ID, "error", err)
+	}
+	return true
+}
+
+// send makes one attempt at a delivery and returns the HTTP status code
+// of the response, or 0 if there was none.
+func (s *Service) send(ctx context.Context, d *models.ChannelDelivery) (int, error) {
+	target, ok := s.registry[d.Channel.Type]
+	if !ok {
+		return 0, permanent(ErrUnknownType)
+	}
+	var e Event
+	if err := json.Unmarshal(d.Event, &e); err != nil {
+		return 0, permanent(fmt.Errorf("decode event: %w", err))
+	}
+	req, err := target.Request(ctx, d.Channel, d, &e)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "DeadDrop")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return resp.StatusCode, nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	// Other client errors mean the request is wrong and will stay wrong.
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		err = permanent(err)
+	}
+	return resp.StatusCode, err
+}
+
+// PruneLog deletes deliveries that were delivered or failed before the
+// given time and returns how many were deleted.
+func (s *Service) PruneLog(ctx context.Context, before time.Time) (int, error) {
+	return s.channels.DeleteChannelDeliveries(ctx, before)
+}
+
+// retryBackoff returns the channel's retry schedule, which starts at its
+// own retry interval.
+func retryBackoff(ch *models.NotificationChannel) worker.Backoff {
+	return worker.Backoff{Base: ch.RetryInterval, Max: maxRetryDelay}
+}
+
+// permanentError is a failure that retrying will not change.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// truncate returns the start of s, up to n characters.
+func truncate(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if r := []rune(s); len(r) > n {
+		return strings.TrimSpace(string(r[:n])) + "…"
+	}
+	return s
+}
@@ -0,0 +1,592 @@
+package channel
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// memChannelStore is an in-memory ChannelStore. Pending deliveries are
+// claimed in order, whether they are due or not.
+type memChannelStore struct {
+	channels   []*models.NotificationChannel
+	deliveries []*models.ChannelDelivery
+	nextID     int64
+}
+
+func (m *memChannelStore) CreateChannel(_ context.Context, ch *models.NotificationChannel) error {
+	m.nextID++
+	ch.ID = m.nextID
+	ch.PublicID = uuid.New()
+	c := *ch
+	m.channels = append(m.channels, &c)
+	return nil
+}
+
+func (m *memChannelStore) GetChannelsByMailboxID(_ context.Context, mailboxID int64) ([]models.NotificationChannel, error) {
+	var out []models.NotificationChannel
+	for _, ch := range m.channels {
+		if ch.MailboxID == mailboxID {
+			out = append(out, *ch)
+		}
+	}
+	return out, nil
+}
+
+func (m *memChannelStore) GetChannelByPublicID(_ context.Context, publicID uuid.UUID) (*models.NotificationChannel, error) {
+	for _, ch := range m.channels {
+		if ch.PublicID == publicID {
+			c := *ch
+			return &c, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memChannelStore) UpdateChannelEnabled(_ context.Context, id int64, enabled bool) error {
+	for _, ch := range m.channels {
+		if ch.ID == id {
+			ch.Enabled = enabled
+		}
+	}
+	return nil
+}
+
+func (m *memChannelStore) DeleteChannel(_ context.Context, id int64) error {
+	for i, ch := range m.channels {
+		if ch.ID == id {
+			m.channels = append(m.channels[:i], m.channels[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *memChannelStore) EnqueueChannelDelivery(_ context.Context, d *models.ChannelDelivery) error {
+	m.nextID++
+	d.ID = m.nextID
+	d.Status = models.ChannelDeliveryPending
+	d.CreatedAt = time.Now()
+	d.NextAttemptAt = d.CreatedAt
+	c := *d
+	m.deliveries = append(m.deliveries, &c)
+	return nil
+}
+
+func (m *memChannelStore) ClaimChannelDelivery(_ context.Context, _ time.Duration) (*models.ChannelDelivery, error) {
+	for _, d := range m.deliveries {
+		if d.Status != models.ChannelDeliveryPending {
+			continue
+		}
+		d.Status = models.ChannelDeliveryProcessing
+		d.Attempts++
+		claimed := *d
+		for _, ch := range m.channels {
+			if ch.ID == d.ChannelID {
+				c := *ch
+				claimed.Channel = &c
+			}
+		}
+		return &claimed, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memChannelStore) find(id int64) *models.ChannelDelivery {
+	for _, d := range m.deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	return &models.ChannelDelivery{}
+}
+
+func (m *memChannelStore) CompleteChannelDelivery(_ context.Context, id int64, responseCode int) error {
+	d := m.find(id)
+	d.Status, d.ResponseCode, d.LastError = models.ChannelDeliveryDelivered, responseCode, ""
+	now := time.Now()
+	d.DeliveredAt = &now
+	return nil
+}
+
+func (m *memChannelStore) RetryChannelDelivery(_ context.Context, id int64, next time.Time, responseCode int, lastError string) error {
+	d := m.find(id)
+	d.Status, d.NextAttemptAt, d.ResponseCode, d.LastError = models.ChannelDeliveryPending, next, responseCode, lastError
+	return nil
+}
+
+func (m *memChannelStore) FailChannelDelivery(_ context.Context, id int64, responseCode int, lastError string) error {
+	d := m.find(id)
+	d.Status, d.ResponseCode, d.LastError = models.ChannelDeliveryFailed, responseCode, lastError
+	return nil
+}
+
+func (m *memChannelStore) GetChannelDeliveries(_ context.Context, channelID int64, limit int) ([]models.ChannelDelivery, error) {
+	var out []models.ChannelDelivery
+	for i := len(m.deliveries) - 1; i >= 0 && len(out) < limit; i-- {
+		if m.deliveries[i].ChannelID == channelID {
+			out = append(out, *m.deliveries[i])
+		}
+	}
+	return out, nil
+}
+
+func (m *memChannelStore) DeleteChannelDeliveries(_ context.Context, before time.Time) (int, error) {
+	var kept []*models.ChannelDelivery
+	for _, d := range m.deliveries {
+		if d.Status != models.ChannelDeliveryPending && d.Status != models.ChannelDeliveryProcessing && d.CreatedAt.Before(before) {
+			continue
+		}
+		kept = append(kept, d)
+	}
+	n := len(m.deliveries) - len(kept)
+	m.deliveries = kept
+	return n, nil
+}
+
+// standIn is a local HTTP server standing in for a channel's service. It
+// records the requests it gets and answers with the queued status codes,
+// then 200.
+type standIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []recordedRequest
+	codes    []int
+}
+
+type recordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+func newStandIn(t *testing.T, codes ...int) *standIn {
+	s := &standIn{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, recordedRequest{Method: r.Method, Path: r.URL.EscapedPath(), Header: r.Header, Body: body})
+		code := http.StatusOK
+		if len(s.codes) > 0 {
+			code, s.codes = s.codes[0], s.codes[1:]
+		}
+		s.mu.Unlock()
+		w.WriteHeader(code)
+		io.WriteString(w, http.StatusText(code))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *standIn) last(t *testing.T) recordedRequest {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("expected a request to the stand-in")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+var testMailbox = &models.Mailbox{ID: 7, PublicID: uuid.New(), Name: "Support"}
+
+func newTestService(store *memChannelStore) *Service {
+	return NewService(store, NewRegistry(), "https://deaddrop.example/", true)
+}
+
+// addChannel creates a channel on testMailbox, failing the test if it is
+// rejected.
+func addChannel(t *testing.T, svc *Service, ch models.NotificationChannel) *models.NotificationChannel {
+	t.Helper()
+	ch.MailboxID = testMailbox.ID
+	if ch.MaxAttempts == 0 {
+		ch.MaxAttempts = 3
+	}
+	if ch.RetryInterval == 0 {
+		ch.RetryInterval = time.Second
+	}
+	if err := svc.Create(context.Background(), &ch); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return &ch
+}
+
+// announce tells svc about a new conversation and delivers everything due.
+func announce(t *testing.T, svc *Service) *models.Conversation {
+	t.Helper()
+	conv := &models.Conversation{PublicID: uuid.New(), Subject: "Broken <login> & more"}
+	msg := &models.ConversationMessage{
+		SenderName:    "Ann",
+		SenderAddress: "ann@example.com",
+		Body:          "I can't log in.\nPlease help.",
+		CreatedAt:     time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := svc.NotifyNewConversation(context.Background(), testMailbox, conv, msg); err != nil {
+		t.Fatalf("NotifyNewConversation: %v", err)
+	}
+	for svc.deliverNext(context.Background()) {
+	}
+	return conv
+}
+
+func TestWebhook_DefaultPayloadSigned(t *testing.T) {
+	srv := newStandIn(t)
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelWebhook, URL: srv.URL + "/hook", Token: "s3cret"})
+
+	conv := announce(t, svc)
+
+	req := srv.last(t)
+	if req.Method != http.MethodPost || req.Path != "/hook" {
+		t.Fatalf("expected POST /hook, got %s %s", req.Method, req.Path)
+	}
+	if req.Header.Get("X-DeadDrop-Event") != EventNewConversation || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.Body)
+	if got, want := req.Header.Get("X-DeadDrop-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("expected signature %s, got %s", want, got)
+	}
+	var e Event
+	if err := json.Unmarshal(req.Body, &e); err != nil {
+		t.Fatalf("payload is not an event: %v", err)
+	}
+	wantURL := "https://deaddrop.example/mailboxes/" + testMailbox.PublicID.String() + "/conversations/" + conv.PublicID.String()
+	if e.Mailbox != "Support" || e.SenderAddress != "ann@example.com" || e.URL != wantURL || e.ConversationID != conv.PublicID.String() {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if d := store.deliveries[0]; d.Status != models.ChannelDeliveryDelivered || d.ResponseCode != http.StatusOK || d.Attempts != 1 {
+		t.Errorf("expected delivery to be logged as delivered, got %+v", d)
+	}
+}
+
+func TestWebhook_Template(t *testing.T) {
+	srv := newStandIn(t)
+	svc := newTestService(&memChannelStore{})
+	addChannel(t, svc, models.NotificationChannel{
+		Type:     models.ChannelWebhook,
+		URL:      srv.URL,
+		Template: `{"summary": {{json .Subject}}, "who": {{json .SenderName}}}`,
+	})
+
+	announce(t, svc)
+
+	req := srv.last(t)
+	var payload map[string]string
+	if err := json.Unmarshal(req.Body, &payload); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	if len(payload) != 2 || payload["summary"] != "Broken <login> & more" || payload["who"] != "Ann" {
+		t.Errorf("unexpected payload %s", req.Body)
+	}
+	if req.Header.Get("X-DeadDrop-Signature") != "" {
+		t.Error("expected no signature without a token")
+	}
+}
+
+func TestWebhook_InvalidTemplateOutputFails(t *testing.T) {
+	srv := newStandIn(t)
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelWebhook, URL: srv.URL, Template: `{"summary": {{.Subject}}}`})
+
+	announce(t, svc)
+
+	if len(srv.requests) != 0 {
+		t.Errorf("expected nothing to be sent, got %d requests", len(srv.requests))
+	}
+	if d := store.deliveries[0]; d.Status != models.ChannelDeliveryFailed || d.Attempts != 1 || !strings.Contains(d.LastError, "valid JSON") {
+		t.Errorf("expected delivery to fail at once, got %+v", d)
+	}
+}
+
+func TestSlack(t *testing.T) {
+	srv := newStandIn(t)
+	svc := newTestService(&memChannelStore{})
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelSlack, URL: srv.URL + "/services/T0/B0/x"})
+
+	conv := announce(t, svc)
+
+	req := srv.last(t)
+	var payload struct{ Text string }
+	if err := json.Unmarshal(req.Body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	wantLink := "<https://deaddrop.example/mailboxes/" + testMailbox.PublicID.String() + "/conversations/" + conv.PublicID.String() +
+		"|Broken &lt;login&gt; &amp; more>"
+	for _, want := range []string{"*New conversation in Support*", wantLink, "from Ann &lt;ann@example.com&gt;", ">I can't log in.\n>Please help."} {
+		if !strings.Contains(payload.Text, want) {
+			t.Errorf("expected text to contain %q, got %q", want, payload.Text)
+		}
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	srv := newStandIn(t)
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelMatrix, URL: srv.URL + "/", Token: "syt_abc", Room: "!room:example.org"})
+
+	announce(t, svc)
+
+	req := srv.last(t)
+	wantPath := "/_matrix/client/v3/rooms/%21room:example.org/send/m.room.message/deaddrop-" + strconv.FormatInt(store.deliveries[0].ID, 10)
+	if req.Method != http.MethodPut || req.Path != wantPath {
+		t.Fatalf("expected PUT %s, got %s %s", wantPath, req.Method, req.Path)
+	}
+	if req.Header.Get("Authorization") != "Bearer syt_abc" {
+		t.Errorf("expected access token, got %q", req.Header.Get("Authorization"))
+	}
+	var msg map[string]string
+	if err := json.Unmarshal(req.Body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["msgtype"] != "m.text" || !strings.Contains(msg["formatted_body"], "Broken &lt;login&gt; &amp; more</a>") ||
+		!strings.Contains(msg["body"], "Broken <login> & more from Ann <ann@example.com>") {
+		t.Errorf("unexpected message %v", msg)
+	}
+}
+
+func TestNtfy(t *testing.T) {
+	srv := newStandIn(t)
+	svc := newTestService(&memChannelStore{})
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelNtfy, URL: srv.URL + "/deaddrop-alerts", Token: "tk_1"})
+
+	conv := announce(t, svc)
+
+	req := srv.last(t)
+	if req.Method != http.MethodPost || req.Path != "/deaddrop-alerts" {
+		t.Fatalf("expected POST to the topic, got %s %s", req.Method, req.Path)
+	}
+	if !strings.HasSuffix(req.Header.Get("Click"), conv.PublicID.String()) || req.Header.Get("Authorization") != "Bearer tk_1" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+	if title := req.Header.Get("Title"); title != "New conversation in Support" {
+		t.Errorf("unexpected title %q", title)
+	}
+	if !strings.HasPrefix(string(req.Body), "Broken <login> & more\nFrom Ann <ann@example.com>") {
+		t.Errorf("unexpected message %q", req.Body)
+	}
+}
+
+func TestGotify(t *testing.T) {
+	srv := newStandIn(t)
+	svc := newTestService(&memChannelStore{})
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelGotify, URL: srv.URL, Token: "AbCd"})
+
+	announce(t, svc)
+
+	req := srv.last(t)
+	if req.Method != http.MethodPost || req.Path != "/message" || req.Header.Get("X-Gotify-Key") != "AbCd" {
+		t.Fatalf("expected POST /message with the app token, got %s %s %v", req.Method, req.Path, req.Header)
+	}
+	var msg struct {
+		Title    string
+		Message  string
+		Priority int
+	}
+	if err := json.Unmarshal(req.Body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Title != "New conversation in Support" || msg.Priority != 5 || !strings.Contains(msg.Message, "Broken <login> & more") {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestDeliver_RetriesThenSucceeds(t *testing.T) {
+	srv := newStandIn(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelWebhook, URL: srv.URL, MaxAttempts: 5, RetryInterval: time.Minute})
+
+	if err := svc.NotifyNewConversation(context.Background(), testMailbox, &models.Conversation{}, &models.ConversationMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	svc.deliverNext(context.Background())
+	d := store.deliveries[0]
+	if d.Status != models.ChannelDeliveryPending || d.ResponseCode != http.StatusServiceUnavailable ||
+		d.NextAttemptAt.Before(before.Add(time.Minute)) || !strings.Contains(d.LastError, "503") {
+		t.Fatalf("expected delivery to wait for a retry, got %+v", d)
+	}
+
+	for svc.deliverNext(context.Background()) {
+	}
+	if d.Status != models.ChannelDeliveryDelivered || d.Attempts != 3 || len(srv.requests) != 3 {
+		t.Fatalf("expected delivery on the third attempt, got %+v after %d requests", d, len(srv.requests))
+	}
+	first, last := srv.requests[0], srv.requests[2]
+	if string(first.Body) != string(last.Body) || first.Header.Get("X-DeadDrop-Delivery") != last.Header.Get("X-DeadDrop-Delivery") {
+		t.Error("expected retries to send the same delivery")
+	}
+}
+
+func TestDeliver_GivesUpAfterMaxAttempts(t *testing.T) {
+	srv := newStandIn(t, 500, 500, 500, 500)
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelSlack, URL: srv.URL, MaxAttempts: 3})
+
+	announce(t, svc)
+
+	if d := store.deliveries[0]; d.Status != models.ChannelDeliveryFailed || d.Attempts != 3 || d.ResponseCode != 500 {
+		t.Errorf("expected delivery to fail after 3 attempts, got %+v", d)
+	}
+	if len(srv.requests) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(srv.requests))
+	}
+}
+
+func TestDeliver_ClientErrorNotRetried(t *testing.T) {
+	srv := newStandIn(t, http.StatusNotFound)
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelNtfy, URL: srv.URL, MaxAttempts: 5})
+
+	announce(t, svc)
+
+	if d := store.deliveries[0]; d.Status != models.ChannelDeliveryFailed || d.Attempts != 1 || d.ResponseCode != http.StatusNotFound {
+		t.Errorf("expected delivery to fail at once, got %+v", d)
+	}
+}
+
+func TestNotify_SkipsDisabledChannels(t *testing.T) {
+	srv := newStandIn(t)
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	on := addChannel(t, svc, models.NotificationChannel{Type: models.ChannelWebhook, URL: srv.URL + "/on"})
+	off := addChannel(t, svc, models.NotificationChannel{Type: models.ChannelWebhook, URL: srv.URL + "/off"})
+	other := models.NotificationChannel{Type: models.ChannelWebhook, URL: srv.URL + "/other", MaxAttempts: 1, RetryInterval: time.Second, MailboxID: testMailbox.ID + 1}
+	if err := svc.Create(context.Background(), &other); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SetEnabled(context.Background(), off.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	announce(t, svc)
+	if len(srv.requests) != 1 || srv.requests[0].Path != "/on" {
+		t.Fatalf("expected only the enabled channel of the mailbox to be told, got %+v", srv.requests)
+	}
+
+	// A disabled channel can still be tested.
+	if err := svc.Test(context.Background(), testMailbox, off); err != nil {
+		t.Fatal(err)
+	}
+	for svc.deliverNext(context.Background()) {
+	}
+	if req := srv.last(t); req.Path != "/off" || req.Header.Get("X-DeadDrop-Event") != EventTest {
+		t.Errorf("expected a test event to /off, got %s %s", req.Path, req.Header.Get("X-DeadDrop-Event"))
+	}
+
+	logged, err := svc.Deliveries(context.Background(), on.ID, 10)
+	if err != nil || len(logged) != 1 || logged[0].EventType != EventNewConversation {
+		t.Errorf("expected one logged delivery for the enabled channel, got %+v, %v", logged, err)
+	}
+}
+
+func TestCreate_Validation(t *testing.T) {
+	svc := newTestService(&memChannelStore{})
+	base := models.NotificationChannel{Type: models.ChannelWebhook, URL: "https://hooks.example/x", MaxAttempts: 5, RetryInterval: time.Minute}
+
+	tests := []struct {
+		name   string
+		modify func(*models.NotificationChannel)
+		want   error
+	}{
+		{"unknown type", func(ch *models.NotificationChannel) { ch.Type = "pager" }, ErrUnknownType},
+		{"no scheme", func(ch *models.NotificationChannel) { ch.URL = "hooks.example/x" }, ErrInvalidURL},
+		{"ftp", func(ch *models.NotificationChannel) { ch.URL = "ftp://hooks.example/x" }, ErrInvalidURL},
+		{"no attempts", func(ch *models.NotificationChannel) { ch.MaxAttempts = 0 }, ErrInvalidPolicy},
+		{"too many attempts", func(ch *models.NotificationChannel) { ch.MaxAttempts = MaxAttempts + 1 }, ErrInvalidPolicy},
+		{"retry too soon", func(ch *models.NotificationChannel) { ch.RetryInterval = time.Millisecond }, ErrInvalidPolicy},
+		{"bad template", func(ch *models.NotificationChannel) { ch.Template = "{{.Subject" }, ErrInvalidSettings},
+		{"matrix without room", func(ch *models.NotificationChannel) { ch.Type, ch.Token = models.ChannelMatrix, "t" }, ErrInvalidSettings},
+		{"matrix without token", func(ch *models.NotificationChannel) { ch.Type, ch.Room = models.ChannelMatrix, "!r:x" }, ErrInvalidSettings},
+		{"gotify without token", func(ch *models.NotificationChannel) { ch.Type = models.ChannelGotify }, ErrInvalidSettings},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := base
+			tt.modify(&ch)
+			if err := svc.Create(context.Background(), &ch); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	ch := base
+	if err := svc.Create(context.Background(), &ch); err != nil {
+		t.Fatal(err)
+	}
+	if ch.Name != "hooks.example" || !ch.Enabled {
+		t.Errorf("expected an enabled channel named after the host, got %+v", ch)
+	}
+}
+
+func TestDeliver_RefusesPrivateAddresses(t *testing.T) {
+	srv := newStandIn(t)
+	store := &memChannelStore{}
+	svc := NewService(store, NewRegistry(), "https://deaddrop.example", false)
+	addChannel(t, svc, models.NotificationChannel{Type: models.ChannelWebhook, URL: srv.URL, MaxAttempts: 1})
+
+	announce(t, svc)
+
+	if len(srv.requests) != 0 {
+		t.Fatal("expected the loopback stand-in not to be reached")
+	}
+	if d := store.deliveries[0]; d.Status != models.ChannelDeliveryFailed || !strings.Contains(d.LastError, "non-public address") {
+		t.Errorf("expected delivery to fail with the refusal, got %+v", d)
+	}
+}
+
+func TestPruneLog(t *testing.T) {
+	store := &memChannelStore{}
+	svc := newTestService(store)
+	ch := addChannel(t, svc, models.NotificationChannel{Type: models.ChannelWebhook, URL: "https://hooks.example"})
+	for _, status := range []models.ChannelDeliveryStatus{models.ChannelDeliveryDelivered, models.ChannelDeliveryFailed, models.ChannelDeliveryPending} {
+		store.EnqueueChannelDelivery(context.Background(), &models.ChannelDelivery{ChannelID: ch.ID})
+		store.deliveries[len(store.deliveries)-1].Status = status
+	}
+
+	n, err := svc.PruneLog(context.Background(), time.Now().Add(time.Second))
+	if err != nil || n != 2 || len(store.deliveries) != 1 || store.deliveries[0].Status != models.ChannelDeliveryPending {
+		t.Errorf("expected finished deliveries to be pruned, got %d, %v, %+v", n, err, store.deliveries)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	ch := &models.NotificationChannel{RetryInterval: time.Minute}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{20, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(ch).Delay(tt.attempts); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
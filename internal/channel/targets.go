@@ -0,0 +1,269 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// A Target posts events to one type of channel. It builds the HTTP request
+// the service behind the channel expects; the Service sends it and retries
+// it as the channel's policy says.
+type Target interface {
+	// Validate reports what is missing or wrong in a channel's settings.
+	Validate(ch *models.NotificationChannel) error
+
+	// Request returns the request that delivers an event. d identifies
+	// the delivery, which stays the same across retries.
+	Request(ctx context.Context, ch *models.NotificationChannel, d *models.ChannelDelivery, e *Event) (*http.Request, error)
+}
+
+// Registry maps channel types to the targets that deliver to them.
+type Registry map[models.ChannelType]Target
+
+// NewRegistry returns a registry of the built-in targets.
+func NewRegistry() Registry {
+	return Registry{
+		models.ChannelWebhook: WebhookTarget{},
+		models.ChannelSlack:   SlackTarget{},
+		models.ChannelMatrix:  MatrixTarget{},
+		models.ChannelNtfy:    NtfyTarget{},
+		models.ChannelGotify:  GotifyTarget{},
+	}
+}
+
+// WebhookTarget posts events as JSON to any URL. A channel's Template, if
+// set, renders the body with text/template and the event as data, and
+// must produce JSON; the json function quotes a value. With a Token, the
+// body is signed with HMAC-SHA256 in the X-DeadDrop-Signature header.
+type WebhookTarget struct{}
+
+func (WebhookTarget) Validate(ch *models.NotificationChannel) error {
+	if ch.Template == "" {
+		return nil
+	}
+	if _, err := parsePayloadTemplate(ch.Template); err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	return nil
+}
+
+func (WebhookTarget) Request(ctx context.Context, ch *models.NotificationChannel, d *models.ChannelDelivery, e *Event) (*http.Request, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if ch.Template != "" {
+		tmpl, err := parsePayloadTemplate(ch.Template)
+		if err != nil {
+			return nil, permanent(fmt.Errorf("invalid template: %w", err))
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, e); err != nil {
+			return nil, permanent(fmt.Errorf("render template: %w", err))
+		}
+		if !json.Valid(b.Bytes()) {
+			return nil, permanent(errors.New("template did not produce valid JSON"))
+		}
+		body = b.Bytes()
+	}
+
+	req, err := jsonRequest(ctx, http.MethodPost, ch.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-DeadDrop-Event", e.Type)
+	req.Header.Set("X-DeadDrop-Delivery", strconv.FormatInt(d.ID, 10))
+	if ch.Token != "" {
+		mac := hmac.New(sha256.New, []byte(ch.Token))
+		mac.Write(body)
+		req.Header.Set("X-DeadDrop-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return req, nil
+}
+
+func parsePayloadTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Option("missingkey=error").Parse(text)
+}
+
+// SlackTarget posts a message to a Slack incoming webhook. Mattermost
+// accepts the same messages.
+type SlackTarget struct{}
+
+func (SlackTarget) Validate(*models.NotificationChannel) error { return nil }
+
+func (SlackTarget) Request(ctx context.Context, ch *models.NotificationChannel, _ *models.ChannelDelivery, e *Event) (*http.Request, error) {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	text := "*" + escape(e.Title()) + "*\n"
+	if e.URL != "" {
+		text += "<" + e.URL + "|" + escape(e.subject()) + ">"
+	} else {
+		text += escape(e.subject())
+	}
+	if from := e.from(); from != "" {
+		text += " from " + escape(from)
+	}
+	if e.Body != "" {
+		text += "\n>" + strings.ReplaceAll(escape(e.Body), "\n", "\n>")
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return nil, err
+	}
+	return jsonRequest(ctx, http.MethodPost, ch.URL, body)
+}
+
+// MatrixTarget sends a message to a Matrix room through the client-server
+// API of the homeserver at the channel's URL, as the user whose access
+// token is the channel's Token. The delivery ID is the transaction ID, so
+// the homeserver ignores a retry of a message it already has.
+type MatrixTarget struct{}
+
+func (MatrixTarget) Validate(ch *models.NotificationChannel) error {
+	if ch.Room == "" {
+		return errors.New("a room is required")
+	}
+	if ch.Token == "" {
+		return errors.New("an access token is required")
+	}
+	return nil
+}
+
+func (MatrixTarget) Request(ctx context.Context, ch *models.NotificationChannel, d *models.ChannelDelivery, e *Event) (*http.Request, error) {
+	plain := e.Title() + "\n" + e.subject()
+	formatted := "<strong>" + html.EscapeString(e.Title()) + "</strong><br>"
+	if e.URL != "" {
+		formatted += `<a href="` + html.EscapeString(e.URL) + `">` + html.EscapeString(e.subject()) + "</a>"
+	} else {
+		formatted += html.EscapeString(e.subject())
+	}
+	if from := e.from(); from != "" {
+		plain += " from " + from
+		formatted += " from " + html.EscapeString(from)
+	}
+	if e.Body != "" {
+		plain += "\n\n" + e.Body
+		formatted += "<blockquote>" + strings.ReplaceAll(html.EscapeString(e.Body), "\n", "<br>") + "</blockquote>"
+	}
+	if e.URL != "" {
+		plain += "\n\n" + e.URL
+	}
+	body, err := json.Marshal(map[string]string{
+		"msgtype":        "m.text",
+		"body":           plain,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimRight(ch.URL, "/") + "/_matrix/client/v3/rooms/" + url.PathEscape(ch.Room) +
+		"/send/m.room.message/deaddrop-" + strconv.FormatInt(d.ID, 10)
+	req, err := jsonRequest(ctx, http.MethodPut, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ch.Token)
+	return req, nil
+}
+
+// NtfyTarget publishes a push notification to the ntfy topic at the
+// channel's URL, with the Token as access token if the topic needs one.
+type NtfyTarget struct{}
+
+func (NtfyTarget) Validate(*models.NotificationChannel) error { return nil }
+
+func (NtfyTarget) Request(ctx context.Context, ch *models.NotificationChannel, _ *models.ChannelDelivery, e *Event) (*http.Request, error) {
+	message := e.subject()
+	if from := e.from(); from != "" {
+		message += "\nFrom " + from
+	}
+	if e.Body != "" {
+		message += "\n\n" + e.Body
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ch.URL, strings.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	// ntfy decodes RFC 2047 encoded header values.
+	req.Header.Set("Title", mime.BEncoding.Encode("utf-8", e.Title()))
+	req.Header.Set("Tags", "envelope")
+	if e.URL != "" {
+		req.Header.Set("Click", e.URL)
+	}
+	if ch.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+ch.Token)
+	}
+	return req, nil
+}
+
+// GotifyTarget sends a push notification through the Gotify server at the
+// channel's URL, as the application whose token is the channel's Token.
+type GotifyTarget struct{}
+
+func (GotifyTarget) Validate(ch *models.NotificationChannel) error {
+	if ch.Token == "" {
+		return errors.New("an application token is required")
+	}
+	return nil
+}
+
+func (GotifyTarget) Request(ctx context.Context, ch *models.NotificationChannel, _ *models.ChannelDelivery, e *Event) (*http.Request, error) {
+	message := e.subject()
+	if from := e.from(); from != "" {
+		message += "\nFrom " + from
+	}
+	if e.Body != "" {
+		message += "\n\n" + e.Body
+	}
+	payload := map[string]any{
+		"title":    e.Title(),
+		"message":  message,
+		"priority": 5,
+	}
+	if e.URL != "" {
+		payload["extras"] = map[string]any{
+			"client::notification": map[string]any{"click": map[string]string{"url": e.URL}},
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := jsonRequest(ctx, http.MethodPost, strings.TrimRight(ch.URL, "/")+"/message", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Gotify-Key", ch.Token)
+	return req, nil
+}
+
+func jsonRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
@@ -2,8 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -16,6 +19,25 @@ type Config struct {
 	SMTPPass     string
 	SMTPFrom     string
 	SMTPEnabled  bool
+	// OutboundWorkers is the number of workers sending queued replies.
+	OutboundWorkers int
+	// OutboundTransport is how mail from domains that have not chosen is
+	// delivered: "relay" through SMTP_HOST or "direct" to the MX hosts.
+	// OutboundHELOName is the name direct delivery introduces itself as.
+	OutboundTransport string
+	OutboundHELOName  string
+	// OutboundAttachmentMaxBytes limits each file attached to a reply,
+	// OutboundAttachmentsMaxBytes all of them together.
+	OutboundAttachmentMaxBytes  int64
+	OutboundAttachmentsMaxBytes int64
+	// NotificationTemplateDir holds templates that replace the built-in
+	// notification email templates of the same name.
+	NotificationTemplateDir string
+	// ChannelAllowPrivateNetworks lets notification channels post to
+	// loopback and private addresses. ChannelLogRetentionDays is how long
+	// finished channel deliveries are logged; 0 keeps them forever.
+	ChannelAllowPrivateNetworks bool
+	ChannelLogRetentionDays     int
 
 	RateLimitRPS   float64
 	RateLimitBurst int
@@ -28,7 +50,61 @@ type Config struct {
 	InboundSMTPDomain  string
 	InboundSMTPEnabled bool
 
+	// InboundSMTPTLSCertFile and InboundSMTPTLSKeyFile enable STARTTLS on
+	// the inbound listener. They default to the site's HTTPS certificate.
+	InboundSMTPTLSCertFile string
+	InboundSMTPTLSKeyFile  string
+	// InboundSMTPSAddr is an optional implicit-TLS listener, e.g. ":465".
+	InboundSMTPSAddr string
+	// InboundTrustedProxies may send a PROXY protocol header naming the
+	// real client on the SMTP listeners.
+	InboundTrustedProxies []netip.Prefix
+	// InboundLMTPAddr is an optional LMTP listener for an MTA in front, a
+	// Unix socket path or TCP address. InboundLMTPRecipientHeader names
+	// the header it sets to the original recipient, if trusted.
+	InboundLMTPAddr            string
+	InboundLMTPRecipientHeader string
+	// InboundWorkers is the number of workers filing accepted messages.
+	InboundWorkers int
+	// InboundMaxMessageBytes is the largest inbound message accepted.
+	InboundMaxMessageBytes int64
+
+	// InboundMaxConnections and InboundMaxConnectionsPerIP cap concurrent
+	// SMTP connections; InboundMessagesPerMinute and InboundMessageBurst
+	// limit the messages one address may send. 0 disables a limit.
+	// InboundAllowIPs are exempt from the per-IP limits and greylisting;
+	// InboundDenyIPs are refused.
+	InboundMaxConnections      int
+	InboundMaxConnectionsPerIP int
+	InboundMessagesPerMinute   float64
+	InboundMessageBurst        int
+	InboundAllowIPs            []netip.Prefix
+	InboundDenyIPs             []netip.Prefix
+
+	// GreylistEnabled turns on greylisting of new senders for
+	// GreylistDelay, except from the whitelisted networks and sender
+	// domains.
+	GreylistEnabled          bool
+	GreylistDelay            time.Duration
+	GreylistWhitelistIPs     []netip.Prefix
+	GreylistWhitelistDomains []string
+
 	DNSOverrideFile string
+
+	// SpamThreshold is the score at which messages go to the spam folder.
+	// SpamDNSBLZones are checked for the sender's IP; none by default.
+	// Spam untouched for SpamRetentionDays is purged; 0 keeps it forever.
+	SpamThreshold     float64
+	SpamDNSBLZones    []string
+	SpamRetentionDays int
+
+	BlobStore   string // "fs" or "s3"
+	BlobDir     string
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
 }
 
 func Load() (*Config, error) {
@@ -60,13 +136,137 @@ func Load() (*Config, error) {
 	}
 
 	smtpHost := getEnv("SMTP_HOST", "")
-	smtpEnabled := getEnv("SMTP_ENABLED", "true") != "false" && smtpHost != ""
+	outboundTransport := getEnv("OUTBOUND_TRANSPORT", "relay")
+	if outboundTransport != "relay" && outboundTransport != "direct" {
+		return nil, fmt.Errorf("invalid OUTBOUND_TRANSPORT %q: must be relay or direct", outboundTransport)
+	}
+	smtpEnabled := getEnv("SMTP_ENABLED", "true") != "false" && (smtpHost != "" || outboundTransport == "direct")
+
+	hostname, _ := os.Hostname()
+	outboundHELOName := getEnv("OUTBOUND_HELO_NAME", hostname)
+	if outboundHELOName == "" {
+		outboundHELOName = "localhost"
+	}
+
+	outboundWorkers, err := getIntEnv("OUTBOUND_WORKERS", 2)
+	if err != nil || outboundWorkers < 1 {
+		return nil, fmt.Errorf("invalid OUTBOUND_WORKERS: %q", os.Getenv("OUTBOUND_WORKERS"))
+	}
+
+	outboundAttachmentMB, err := getIntEnv("OUTBOUND_ATTACHMENT_MAX_MB", 10)
+	if err != nil || outboundAttachmentMB < 1 {
+		return nil, fmt.Errorf("invalid OUTBOUND_ATTACHMENT_MAX_MB: %q", os.Getenv("OUTBOUND_ATTACHMENT_MAX_MB"))
+	}
+	outboundAttachmentsMB, err := getIntEnv("OUTBOUND_ATTACHMENTS_MAX_MB", 20)
+	if err != nil || outboundAttachmentsMB < 1 {
+		return nil, fmt.Errorf("invalid OUTBOUND_ATTACHMENTS_MAX_MB: %q", os.Getenv("OUTBOUND_ATTACHMENTS_MAX_MB"))
+	}
 
 	inboundAddr := getEnv("INBOUND_SMTP_ADDR", "")
 	inboundDomain := getEnv("INBOUND_SMTP_DOMAIN", "localhost")
 
+	// The site's HTTPS certificate, as served by the proxy in front of the
+	// dashboard, is reused for inbound SMTP unless it has its own.
+	tlsCert := getEnv("TLS_CERT_FILE", "")
+	tlsKey := getEnv("TLS_KEY_FILE", "")
+	if (tlsCert == "") != (tlsKey == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	inboundTLSCert := getEnv("INBOUND_SMTP_TLS_CERT_FILE", tlsCert)
+	inboundTLSKey := getEnv("INBOUND_SMTP_TLS_KEY_FILE", tlsKey)
+	if (inboundTLSCert == "") != (inboundTLSKey == "") {
+		return nil, fmt.Errorf("INBOUND_SMTP_TLS_CERT_FILE and INBOUND_SMTP_TLS_KEY_FILE must be set together")
+	}
+	inboundSMTPSAddr := getEnv("INBOUND_SMTPS_ADDR", "")
+	if inboundSMTPSAddr != "" && inboundTLSCert == "" {
+		return nil, fmt.Errorf("INBOUND_SMTPS_ADDR requires a TLS certificate")
+	}
+
+	inboundProxies, _, err := getNetworkListEnv("INBOUND_TRUSTED_PROXIES", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid INBOUND_TRUSTED_PROXIES: %w", err)
+	}
+
+	inboundLMTPAddr := getEnv("INBOUND_LMTP_ADDR", "")
+	inboundLMTPHeader := getEnv("INBOUND_LMTP_RECIPIENT_HEADER", "")
+	switch strings.ToLower(inboundLMTPHeader) {
+	case "", "x-original-to", "delivered-to":
+	default:
+		return nil, fmt.Errorf("invalid INBOUND_LMTP_RECIPIENT_HEADER %q: must be X-Original-To or Delivered-To", inboundLMTPHeader)
+	}
+
+	inboundWorkers, err := getIntEnv("INBOUND_WORKERS", 4)
+	if err != nil || inboundWorkers < 1 {
+		return nil, fmt.Errorf("invalid INBOUND_WORKERS: %q", os.Getenv("INBOUND_WORKERS"))
+	}
+
+	inboundMaxMessageMB, err := getIntEnv("INBOUND_MAX_MESSAGE_MB", 25)
+	if err != nil || inboundMaxMessageMB < 1 {
+		return nil, fmt.Errorf("invalid INBOUND_MAX_MESSAGE_MB: %q", os.Getenv("INBOUND_MAX_MESSAGE_MB"))
+	}
+
+	inboundMaxConns, err := getIntEnv("INBOUND_MAX_CONNECTIONS", 100)
+	if err != nil || inboundMaxConns < 0 {
+		return nil, fmt.Errorf("invalid INBOUND_MAX_CONNECTIONS: %q", os.Getenv("INBOUND_MAX_CONNECTIONS"))
+	}
+	inboundMaxConnsPerIP, err := getIntEnv("INBOUND_MAX_CONNECTIONS_PER_IP", 10)
+	if err != nil || inboundMaxConnsPerIP < 0 {
+		return nil, fmt.Errorf("invalid INBOUND_MAX_CONNECTIONS_PER_IP: %q", os.Getenv("INBOUND_MAX_CONNECTIONS_PER_IP"))
+	}
+	inboundRate, err := getFloatEnv("INBOUND_MESSAGES_PER_MINUTE", 30)
+	if err != nil || inboundRate < 0 {
+		return nil, fmt.Errorf("invalid INBOUND_MESSAGES_PER_MINUTE: %q", os.Getenv("INBOUND_MESSAGES_PER_MINUTE"))
+	}
+	inboundBurst, err := getIntEnv("INBOUND_MESSAGE_BURST", 10)
+	if err != nil || inboundBurst < 0 {
+		return nil, fmt.Errorf("invalid INBOUND_MESSAGE_BURST: %q", os.Getenv("INBOUND_MESSAGE_BURST"))
+	}
+	inboundAllow, _, err := getNetworkListEnv("INBOUND_ALLOW_IPS", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid INBOUND_ALLOW_IPS: %w", err)
+	}
+	inboundDeny, _, err := getNetworkListEnv("INBOUND_DENY_IPS", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid INBOUND_DENY_IPS: %w", err)
+	}
+
+	greylistDelay, err := getIntEnv("GREYLIST_DELAY_SECONDS", 300)
+	if err != nil || greylistDelay < 1 {
+		return nil, fmt.Errorf("invalid GREYLIST_DELAY_SECONDS: %q", os.Getenv("GREYLIST_DELAY_SECONDS"))
+	}
+	greylistIPs, greylistDomains, err := getNetworkListEnv("GREYLIST_WHITELIST", true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GREYLIST_WHITELIST: %w", err)
+	}
+
 	dnsOverrideFile := getEnv("DNS_OVERRIDE_FILE", "")
 
+	spamThreshold, err := getFloatEnv("SPAM_THRESHOLD", 5.0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPAM_THRESHOLD: %w", err)
+	}
+	spamRetentionDays, err := getIntEnv("SPAM_RETENTION_DAYS", 30)
+	if err != nil || spamRetentionDays < 0 {
+		return nil, fmt.Errorf("invalid SPAM_RETENTION_DAYS: %q", os.Getenv("SPAM_RETENTION_DAYS"))
+	}
+	var spamDNSBLZones []string
+	for _, zone := range strings.Split(getEnv("SPAM_DNSBL_ZONES", ""), ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			spamDNSBLZones = append(spamDNSBLZones, zone)
+		}
+	}
+
+	channelLogRetentionDays, err := getIntEnv("CHANNEL_LOG_RETENTION_DAYS", 30)
+	if err != nil || channelLogRetentionDays < 0 {
+		return nil, fmt.Errorf("invalid CHANNEL_LOG_RETENTION_DAYS: %q", os.Getenv("CHANNEL_LOG_RETENTION_DAYS"))
+	}
+
+	blobStore := getEnv("BLOB_STORE", "fs")
+	if blobStore != "fs" && blobStore != "s3" {
+		return nil, fmt.Errorf("invalid BLOB_STORE %q: must be fs or s3", blobStore)
+	}
+
 	return &Config{
 		Port:           port,
 		DatabaseURL:    dbURL,
@@ -76,6 +276,14 @@ func Load() (*Config, error) {
 		SMTPPass:       getEnv("SMTP_PASS", ""),
 		SMTPFrom:       getEnv("SMTP_FROM", ""),
 		SMTPEnabled:    smtpEnabled,
+		OutboundWorkers: outboundWorkers,
+		OutboundTransport: outboundTransport,
+		OutboundHELOName:  outboundHELOName,
+		OutboundAttachmentMaxBytes:  int64(outboundAttachmentMB) << 20,
+		OutboundAttachmentsMaxBytes: int64(outboundAttachmentsMB) << 20,
+		NotificationTemplateDir:     getEnv("NOTIFICATION_TEMPLATE_DIR", ""),
+		ChannelAllowPrivateNetworks: getEnv("CHANNEL_ALLOW_PRIVATE_NETWORKS", "false") == "true",
+		ChannelLogRetentionDays:     channelLogRetentionDays,
 		RateLimitRPS:   rps,
 		RateLimitBurst: burst,
 		SessionMaxAge:  sessionMaxAge,
@@ -84,7 +292,35 @@ func Load() (*Config, error) {
 		InboundSMTPAddr:    inboundAddr,
 		InboundSMTPDomain:  inboundDomain,
 		InboundSMTPEnabled: inboundAddr != "",
+		InboundSMTPTLSCertFile: inboundTLSCert,
+		InboundSMTPTLSKeyFile:  inboundTLSKey,
+		InboundSMTPSAddr:       inboundSMTPSAddr,
+		InboundTrustedProxies:      inboundProxies,
+		InboundLMTPAddr:            inboundLMTPAddr,
+		InboundLMTPRecipientHeader: inboundLMTPHeader,
+		InboundWorkers:         inboundWorkers,
+		InboundMaxMessageBytes: int64(inboundMaxMessageMB) << 20,
+		InboundMaxConnections:      inboundMaxConns,
+		InboundMaxConnectionsPerIP: inboundMaxConnsPerIP,
+		InboundMessagesPerMinute:   inboundRate,
+		InboundMessageBurst:        inboundBurst,
+		InboundAllowIPs:            inboundAllow,
+		InboundDenyIPs:             inboundDeny,
+		GreylistEnabled:            getEnv("GREYLIST_ENABLED", "false") == "true",
+		GreylistDelay:              time.Duration(greylistDelay) * time.Second,
+		GreylistWhitelistIPs:       greylistIPs,
+		GreylistWhitelistDomains:   greylistDomains,
 		DNSOverrideFile:    dnsOverrideFile,
+		SpamThreshold:      spamThreshold,
+		SpamDNSBLZones:     spamDNSBLZones,
+		SpamRetentionDays:  spamRetentionDays,
+		BlobStore:          blobStore,
+		BlobDir:            getEnv("BLOB_DIR", "data/blobs"),
+		S3Endpoint:         getEnv("S3_ENDPOINT", ""),
+		S3Bucket:           getEnv("S3_BUCKET", ""),
+		S3Region:           getEnv("S3_REGION", "us-east-1"),
+		S3AccessKey:        getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:        getEnv("S3_SECRET_KEY", ""),
 	}, nil
 }
 
@@ -110,3 +346,35 @@ func getFloatEnv(key string, fallback float64) (float64, error) {
 	}
 	return strconv.ParseFloat(v, 64)
 }
+
+// getNetworkListEnv parses a comma-separated list of IP addresses and CIDR
+// networks. If domains is true, other entries are returned as domain names;
+// otherwise they are an error.
+func getNetworkListEnv(key string, domains bool) ([]netip.Prefix, []string, error) {
+	var prefixes []netip.Prefix
+	var names []string
+	for _, entry := range strings.Split(getEnv(key, ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		if !domains {
+			return nil, nil, fmt.Errorf("%q is not an IP address or network", entry)
+		}
+		names = append(names, strings.ToLower(entry))
+	}
+	return prefixes, names, nil
+}
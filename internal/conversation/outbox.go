@@ -0,0 +1,157 @@
+package conversation
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/worker"
+)
+
+// Replies, auto-replies and forwards are not sent while the request that
+// wrote them waits. They are recorded with their message and queued, and
+// workers hand them to the Sender, retrying with exponential backoff while
+// the relay is unreachable or answers with a temporary error. A permanent
+// rejection, or too many failed attempts, marks the message failed until
+// the user retries it. Forwards have no message to retry from, so they are
+// logged and dropped instead.
+
+const (
+	// maxSendAttempts is how often an email is tried before it is marked
+	// failed and left for the user to retry.
+	maxSendAttempts = 10
+
+	// sendLease is longer than the relay's own timeouts, so an email is
+	// only handed to another worker once the first cannot still be talking
+	// to the relay.
+	sendLease = 10 * time.Minute
+)
+
+// sendBackoff rides out a relay that is down or greylisting us for about
+// six hours before the email is marked failed.
+var sendBackoff = worker.Backoff{Base: time.Minute, Max: 2 * time.Hour}
+
+// ErrNotQueued is returned when retrying a message that has no queued
+// delivery, because it was sent or is being sent.
+var ErrNotQueued = errors.New("message is not waiting for delivery")
+
+// queue records outbound email, with the outbound message it delivers if
+// any, and wakes a worker to send it.
+func (s *Service) queue(ctx context.Context, email OutboundEmail, msg *models.ConversationMessage) error {
+	job := &models.OutboundJob{
+		To:            email.To,
+		FromAddress:   email.FromAddress,
+		FromName:      email.FromName,
+		ReplyTo:       email.ReplyTo,
+		Subject:       email.Subject,
+		Body:          email.Body,
+		MessageID:     email.MessageID,
+		InReplyTo:     email.InReplyTo,
+		References:    email.References,
+		AutoSubmitted: email.AutoSubmitted,
+		Attachments:   email.Attachments,
+	}
+	if err := s.outbox.EnqueueOutbound(ctx, job, msg); err != nil {
+		return err
+	}
+	s.wakeSender()
+	return nil
+}
+
+func (s *Service) wakeSender() {
+	worker.Signal(s.wake)
+}
+
+// RetryDelivery sends a failed or deferred outbound message again now,
+// with a fresh set of attempts.
+func (s *Service) RetryDelivery(ctx context.Context, messageID int64) error {
+	err := s.outbox.RequeueOutbound(ctx, messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotQueued
+	}
+	if err != nil {
+		return err
+	}
+	s.wakeSender()
+	return nil
+}
+
+// DeliverQueued sends queued email until ctx is cancelled.
+func (s *Service) DeliverQueued(ctx context.Context) {
+	worker.Run(ctx, s.wake, s.sendNext)
+}
+
+// sendNext claims and sends one due email. It reports whether there was
+// one.
+func (s *Service) sendNext(ctx context.Context) bool {
+	job, err := s.outbox.ClaimOutbound(ctx, sendLease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to claim queued outbound email", "error", err)
+		}
+		return false
+	}
+
+	_, err = s.sender.SendReply(ctx, OutboundEmail{
+		To:            job.To,
+		FromAddress:   job.FromAddress,
+		FromName:      job.FromName,
+		ReplyTo:       job.ReplyTo,
+		Subject:       job.Subject,
+		Body:          job.Body,
+		MessageID:     job.MessageID,
+		InReplyTo:     job.InReplyTo,
+		References:    job.References,
+		Attachments:   job.Attachments,
+		AutoSubmitted: job.AutoSubmitted,
+	})
+	switch {
+	case err == nil:
+		err = s.outbox.CompleteOutbound(ctx, job.ID)
+	case permanentError(err) || job.Attempts >= maxSendAttempts:
+		slog.Error("giving up on outbound email",
+			"job_id", job.ID, "to", job.To, "attempts", job.Attempts, "error", err)
+		err = s.outbox.FailOutbound(ctx, job.ID, err.Error())
+	default:
+		delay := sendBackoff.Delay(job.Attempts)
+		slog.Warn("failed to send outbound email, will retry",
+			"job_id", job.ID, "to", job.To, "attempts", job.Attempts, "retry_in", delay, "error", err)
+		err = s.outbox.RetryOutbound(ctx, job.ID, time.Now().Add(delay), err.Error())
+	}
+	if err != nil {
+		// The claim expires and the email is tried again.
+		slog.Error("failed to update queued outbound email", "job_id", job.ID, "error", err)
+	}
+	return true
+}
+
+// permanentError reports whether err is a 5xx SMTP reply, which retrying
+// will not change.
+func permanentError(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
+
+// newMessageID returns a Message-ID in the domain of the from address.
+// Queued email gets its Message-ID before it is sent, so that the message
+// can be threaded and matched to bounces whether or not it has gone yet,
+// and a retry sends it under the same ID.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndexByte(from, '@'); at >= 0 && at+1 < len(from) {
+		domain = strings.ToLower(from[at+1:])
+	}
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("<%d.%x@%s>", time.Now().UTC().UnixNano(), suffix, domain)
+}
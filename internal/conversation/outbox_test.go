@@ -0,0 +1,265 @@
+package conversation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/filter"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// memOutbox is an in-memory OutboundQueueStore that records the messages
+// it delivers in a mockConversationStore. Pending jobs are claimed in
+// order, whether they are due or not.
+type memOutbox struct {
+	convs  *mockConversationStore
+	jobs   []*models.OutboundJob
+	nextID int64
+}
+
+func newMemOutbox(convs *mockConversationStore) *memOutbox {
+	return &memOutbox{convs: convs}
+}
+
+func (q *memOutbox) EnqueueOutbound(ctx context.Context, job *models.OutboundJob, msg *models.ConversationMessage) error {
+	if msg != nil {
+		if err := q.convs.CreateMessage(ctx, msg); err != nil {
+			return err
+		}
+		job.ConversationMessageID = msg.ID
+	}
+	q.nextID++
+	job.ID = q.nextID
+	job.Status = models.OutboundPending
+	job.CreatedAt = time.Now()
+	job.NextAttemptAt = job.CreatedAt
+	j := *job
+	q.jobs = append(q.jobs, &j)
+	return nil
+}
+
+func (q *memOutbox) ClaimOutbound(_ context.Context, _ time.Duration) (*models.OutboundJob, error) {
+	for _, j := range q.jobs {
+		if j.Status == models.OutboundPending {
+			j.Status = models.OutboundProcessing
+			j.Attempts++
+			claimed := *j
+			return &claimed, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (q *memOutbox) find(id int64) (int, *models.OutboundJob) {
+	for i, j := range q.jobs {
+		if j.ID == id {
+			return i, j
+		}
+	}
+	return -1, nil
+}
+
+// setStatus updates the delivery status of the message a job delivers.
+func (q *memOutbox) setStatus(j *models.OutboundJob, status models.DeliveryStatus, lastError string) {
+	for _, msgs := range q.convs.messages {
+		for i := range msgs {
+			if msgs[i].ID == j.ConversationMessageID && j.ConversationMessageID != 0 {
+				msgs[i].DeliveryStatus, msgs[i].DeliveryError = status, lastError
+			}
+		}
+	}
+}
+
+func (q *memOutbox) CompleteOutbound(_ context.Context, id int64) error {
+	if i, j := q.find(id); j != nil {
+		q.setStatus(j, models.DeliverySent, "")
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+	}
+	return nil
+}
+
+func (q *memOutbox) RetryOutbound(_ context.Context, id int64, next time.Time, lastError string) error {
+	if _, j := q.find(id); j != nil {
+		j.Status, j.NextAttemptAt, j.LastError = models.OutboundPending, next, lastError
+		q.setStatus(j, models.DeliveryDeferred, lastError)
+	}
+	return nil
+}
+
+func (q *memOutbox) FailOutbound(_ context.Context, id int64, lastError string) error {
+	i, j := q.find(id)
+	switch {
+	case j == nil:
+	case j.ConversationMessageID == 0:
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+	default:
+		j.Status, j.LastError = models.OutboundFailed, lastError
+		q.setStatus(j, models.DeliveryFailed, lastError)
+	}
+	return nil
+}
+
+func (q *memOutbox) RequeueOutbound(_ context.Context, messageID int64) error {
+	for _, j := range q.jobs {
+		if j.ConversationMessageID == messageID && j.Status != models.OutboundProcessing {
+			j.Status, j.Attempts, j.NextAttemptAt = models.OutboundPending, 0, time.Now()
+			q.setStatus(j, models.DeliveryQueued, "")
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// deliverQueued sends everything in the outbox that will be sent.
+func deliverQueued(svc *Service) {
+	for svc.sendNext(context.Background()) {
+	}
+}
+
+// failingSender fails every send with err.
+type failingSender struct {
+	err   error
+	calls int
+}
+
+func (s *failingSender) SendReply(_ context.Context, _ OutboundEmail) (string, error) {
+	s.calls++
+	return "", s.err
+}
+
+func newOutboxTest(t *testing.T, sender Sender) (*Service, *mockConversationStore, *memOutbox, *models.Conversation) {
+	t.Helper()
+	cs := newMockConversationStore()
+	outbox := newMemOutbox(cs)
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	svc := NewService(cs, outbox, ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Enabled: true}
+	conv, err := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Need help", nil)
+	if err != nil {
+		t.Fatalf("StartConversation: %v", err)
+	}
+	return svc, cs, outbox, conv
+}
+
+// outboundStatus returns the delivery status and error of the message.
+func outboundStatus(cs *mockConversationStore, msg *models.ConversationMessage) (models.DeliveryStatus, string) {
+	for _, m := range cs.messages[msg.ConversationID] {
+		if m.ID == msg.ID {
+			return m.DeliveryStatus, m.DeliveryError
+		}
+	}
+	return "", ""
+}
+
+func TestReply_QueuedUntilDelivered(t *testing.T) {
+	sender := &recordingSender{}
+	svc, cs, outbox, conv := newOutboxTest(t, sender)
+
+	msg, err := svc.Reply(context.Background(), conv.ID, "On it", nil)
+	if err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+	if len(sender.calls) != 0 {
+		t.Fatalf("expected reply not to be sent inline, got %d sends", len(sender.calls))
+	}
+	if status, _ := outboundStatus(cs, msg); status != models.DeliveryQueued {
+		t.Fatalf("expected reply to be queued, got %q", status)
+	}
+
+	deliverQueued(svc)
+	if len(sender.calls) != 1 || len(outbox.jobs) != 0 {
+		t.Fatalf("expected reply to be sent once and dequeued, got %d sends and %d jobs", len(sender.calls), len(outbox.jobs))
+	}
+	if status, _ := outboundStatus(cs, msg); status != models.DeliverySent {
+		t.Errorf("expected reply to be sent, got %q", status)
+	}
+}
+
+func TestDeliverQueued_RetriesThenFails(t *testing.T) {
+	sender := &failingSender{err: errors.New("dial tcp: connection refused")}
+	svc, cs, outbox, conv := newOutboxTest(t, sender)
+
+	msg, err := svc.Reply(context.Background(), conv.ID, "On it", nil)
+	if err != nil {
+		t.Fatalf("expected reply to be accepted while the relay is down, got %v", err)
+	}
+
+	before := time.Now()
+	svc.sendNext(context.Background())
+	job := outbox.jobs[0]
+	if job.Status != models.OutboundPending || job.Attempts != 1 || job.NextAttemptAt.Before(before.Add(sendBackoff.Base)) {
+		t.Fatalf("expected failed send to wait for a retry, got %+v", job)
+	}
+	if status, reason := outboundStatus(cs, msg); status != models.DeliveryDeferred || reason == "" {
+		t.Fatalf("expected reply to be deferred with the error, got %q %q", status, reason)
+	}
+
+	deliverQueued(svc)
+	if job.Status != models.OutboundFailed || sender.calls != maxSendAttempts {
+		t.Fatalf("expected job to fail after %d attempts, got %+v after %d", maxSendAttempts, job, sender.calls)
+	}
+	if status, _ := outboundStatus(cs, msg); status != models.DeliveryFailed {
+		t.Fatalf("expected reply to be failed, got %q", status)
+	}
+
+	if err := svc.RetryDelivery(context.Background(), msg.ID+1); !errors.Is(err, ErrNotQueued) {
+		t.Errorf("expected ErrNotQueued for a message without a job, got %v", err)
+	}
+	if err := svc.RetryDelivery(context.Background(), msg.ID); err != nil {
+		t.Fatalf("RetryDelivery: %v", err)
+	}
+	if status, _ := outboundStatus(cs, msg); status != models.DeliveryQueued {
+		t.Errorf("expected retried reply to be queued, got %q", status)
+	}
+	sender.err = nil
+	deliverQueued(svc)
+	if len(outbox.jobs) != 0 {
+		t.Fatalf("expected retried reply to be sent, got %+v", outbox.jobs)
+	}
+	if status, _ := outboundStatus(cs, msg); status != models.DeliverySent {
+		t.Errorf("expected reply to be sent, got %q", status)
+	}
+}
+
+func TestDeliverQueued_PermanentRejectionNotRetried(t *testing.T) {
+	sender := &failingSender{err: &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}}
+	svc, cs, outbox, conv := newOutboxTest(t, sender)
+
+	msg, err := svc.Reply(context.Background(), conv.ID, "On it", nil)
+	if err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+	deliverQueued(svc)
+	if sender.calls != 1 || outbox.jobs[0].Status != models.OutboundFailed {
+		t.Fatalf("expected rejected reply to fail without retrying, got %d sends and %+v", sender.calls, outbox.jobs[0])
+	}
+	if status, reason := outboundStatus(cs, msg); status != models.DeliveryFailed || !strings.Contains(reason, "User unknown") {
+		t.Errorf("expected reply to be failed with the rejection, got %q %q", status, reason)
+	}
+}
+
+func TestDeliverQueued_FailedForwardDropped(t *testing.T) {
+	cs := newMockConversationStore()
+	outbox := newMemOutbox(cs)
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	sender := &failingSender{err: &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}}
+	rules := &stubFilter{result: filter.Result{Forward: []string{"boss@example.com"}}}
+	svc := NewService(cs, outbox, ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, rules)
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Enabled: true}
+	if _, err := svc.StartConversation(context.Background(), stream, "Hello", "alice@example.com", "Alice", "Hi there", nil); err != nil {
+		t.Fatalf("StartConversation: %v", err)
+	}
+	deliverQueued(svc)
+	if sender.calls != 1 || len(outbox.jobs) != 0 {
+		t.Errorf("expected rejected forward to be dropped, got %d sends and %+v", sender.calls, outbox.jobs)
+	}
+}
@@ -2,22 +2,37 @@ package conversation
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/filter"
 	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/spam"
 	"github.com/znz-systems/deaddrop/internal/store"
 )
 
 var (
-	ErrStreamDisabled     = errors.New("stream is disabled")
-	ErrConversationClosed = errors.New("conversation is closed")
+	ErrStreamDisabled          = errors.New("stream is disabled")
+	ErrConversationClosed      = errors.New("conversation is closed")
+	ErrConversationQuarantined = errors.New("conversation is quarantined")
+	ErrConversationSpam        = errors.New("conversation is marked as spam")
+
+	// ErrDiscarded is returned when a filter rule discards the message. The
+	// sender should not be told.
+	ErrDiscarded = errors.New("message discarded by filter rule")
 )
 
-// Notifier sends notifications when new conversations arrive.
+// Notifier sends notifications when new conversations arrive, and when
+// replies arrive on open ones.
 type Notifier interface {
 	NotifyNewConversation(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error
+	NotifyReply(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error
 }
 
 type NoopNotifier struct{}
@@ -26,77 +41,584 @@ func (n *NoopNotifier) NotifyNewConversation(_ context.Context, _ *models.Mailbo
 	return nil
 }
 
-// Sender sends outbound reply emails.
+func (n *NoopNotifier) NotifyReply(_ context.Context, _ *models.Mailbox, _ *models.Conversation, _ *models.ConversationMessage) error {
+	return nil
+}
+
+// Notifiers passes notifications on to each of its notifiers, so that a
+// mailbox can be notified by email and on other channels.
+type Notifiers []Notifier
+
+func (n Notifiers) NotifyNewConversation(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	var errs []error
+	for _, notifier := range n {
+		errs = append(errs, notifier.NotifyNewConversation(ctx, mailbox, conv, msg))
+	}
+	return errors.Join(errs...)
+}
+
+func (n Notifiers) NotifyReply(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	var errs []error
+	for _, notifier := range n {
+		errs = append(errs, notifier.NotifyReply(ctx, mailbox, conv, msg))
+	}
+	return errors.Join(errs...)
+}
+
+// OutboundEmail is a reply handed to a Sender for delivery.
+type OutboundEmail struct {
+	To          string
+	FromAddress string
+	FromName    string
+	ReplyTo     string
+	Subject     string
+	Body        string
+
+	// MessageID is the Message-ID to send the email with. If it is empty
+	// the Sender makes one up.
+	MessageID string
+
+	// InReplyTo and References thread a reply under the messages of its
+	// conversation. References is a space-separated list of message IDs.
+	InReplyTo  string
+	References string
+
+	// Attachments are stored files to send with the email.
+	Attachments []models.Attachment
+
+	// AutoSubmitted is the RFC 3834 Auto-Submitted value for mail the
+	// system sends on its own, such as auto-replies and forwards. It is
+	// empty for replies a person wrote.
+	AutoSubmitted string
+}
+
+// Sender sends outbound reply emails. It returns the Message-ID of the sent
+// email so that replies to it can be threaded. A 5xx *textproto.Error is
+// taken as a permanent rejection; other errors are retried.
 type Sender interface {
-	SendReply(ctx context.Context, to, fromAddress, fromName, subject, body string) error
+	SendReply(ctx context.Context, email OutboundEmail) (string, error)
 }
 
 type NoopSender struct{}
 
-func (n *NoopSender) SendReply(_ context.Context, _, _, _, _, _ string) error {
+func (n *NoopSender) SendReply(_ context.Context, _ OutboundEmail) (string, error) {
+	return "", nil
+}
+
+// SpamFilter scores messages that would start a new conversation and learns
+// from the user marking conversations as spam or not.
+type SpamFilter interface {
+	Check(ctx context.Context, userID int64, msg spam.Message) spam.Verdict
+	Train(ctx context.Context, userID int64, msg spam.Message, isSpam bool, previous string) error
+}
+
+type NoopSpamFilter struct{}
+
+func (n *NoopSpamFilter) Check(_ context.Context, _ int64, _ spam.Message) spam.Verdict {
+	return spam.Verdict{}
+}
+
+func (n *NoopSpamFilter) Train(_ context.Context, _ int64, _ spam.Message, _ bool, _ string) error {
 	return nil
 }
 
+// Filter applies a mailbox's filter rules to a message that starts a new
+// conversation.
+type Filter interface {
+	Apply(ctx context.Context, mailboxID int64, msg filter.Message) (filter.Result, error)
+}
+
+type NoopFilter struct{}
+
+func (n *NoopFilter) Apply(_ context.Context, _ int64, _ filter.Message) (filter.Result, error) {
+	return filter.Result{}, nil
+}
+
+// InboundEmail is a parsed email delivered to an email stream.
+type InboundEmail struct {
+	Subject       string
+	SenderAddress string
+	SenderName    string
+	Body          string
+
+	// BodyHTML is the HTML rendition of the email, if it has one, as
+	// received. It is sanitised when displayed.
+	BodyHTML string
+
+	// MessageID, InReplyTo and References are RFC 5322 message identifiers
+	// including angle brackets.
+	MessageID  string
+	InReplyTo  []string
+	References []string
+
+	// Recipient is the envelope address the email was delivered to. It is
+	// recorded on new conversations.
+	Recipient string
+
+	// ReplyToken is the token taken from the recipient sub-address, if any.
+	ReplyToken string
+
+	// RawKey is the archive key of the original message source, if stored.
+	RawKey string
+
+	// InboundJobID is the inbound queue job filing the email. A job's
+	// message is only stored once, however often the job is tried.
+	InboundJobID int64
+
+	// Helo is the name the delivering client gave in HELO or EHLO.
+	Helo string
+
+	// TLS is the TLS version the message arrived over, or "none".
+	TLS string
+
+	// AuthResults and AuthVerdict record the SPF/DKIM/DMARC evaluation.
+	AuthResults string
+	AuthVerdict string
+
+	// Quarantine holds the email in a new quarantined conversation instead
+	// of threading it or notifying anyone.
+	Quarantine bool
+
+	// Automated is the kind of machine-generated mail this is, one of the
+	// models.Automated* values, or empty for mail a person sent. Automated
+	// mail never triggers an auto-reply or a notification and does not
+	// reopen a closed conversation.
+	Automated string
+
+	// Header and RemoteIP feed the spam filter; Header also the filter
+	// rules.
+	Header   mail.Header
+	RemoteIP net.IP
+}
+
 type Service struct {
 	conversations store.ConversationStore
+	outbox        store.OutboundQueueStore
 	mailboxes     store.MailboxStore
 	notifier      Notifier
 	sender        Sender
+	spam          SpamFilter
+	filters       Filter
+
+	// wake is signalled when email is queued.
+	wake chan struct{}
 }
 
 func NewService(
 	conversations store.ConversationStore,
+	outbox store.OutboundQueueStore,
 	mailboxes store.MailboxStore,
 	notifier Notifier,
 	sender Sender,
+	spamFilter SpamFilter,
+	filters Filter,
 ) *Service {
 	return &Service{
 		conversations: conversations,
+		outbox:        outbox,
 		mailboxes:     mailboxes,
 		notifier:      notifier,
 		sender:        sender,
+		spam:          spamFilter,
+		filters:       filters,
+		wake:          make(chan struct{}, 1),
 	}
 }
 
 // StartConversation creates a new conversation from an inbound message.
-// The caller provides the stream directly (already looked up).
-func (s *Service) StartConversation(ctx context.Context, stream *models.Stream, subject, senderAddress, senderName, body string) (*models.Conversation, error) {
+// The caller provides the stream directly (already looked up). Messages the
+// spam filter flags start in the spam folder instead; the others go through
+// the mailbox's filter rules, which may discard them with ErrDiscarded.
+func (s *Service) StartConversation(ctx context.Context, stream *models.Stream, subject, senderAddress, senderName, body string, remoteIP net.IP) (*models.Conversation, error) {
 	if !stream.Enabled {
 		return nil, ErrStreamDisabled
 	}
 
-	conv, err := s.conversations.CreateConversation(ctx, stream.MailboxID, stream.ID, subject)
+	msg := &models.ConversationMessage{
+		Direction:     models.MessageInbound,
+		SenderAddress: senderAddress,
+		SenderName:    senderName,
+		Body:          body,
+	}
+	if s.checkSpam(ctx, stream.MailboxID, msg, spam.Message{
+		Subject:       subject,
+		Body:          body,
+		SenderAddress: senderAddress,
+		SenderName:    senderName,
+		IP:            remoteIP,
+	}) {
+		return s.hold(ctx, stream, subject, "", msg, models.ConversationSpam)
+	}
+	return s.applyRules(ctx, stream, subject, "", msg, nil)
+}
+
+// FiledMessage returns the message an inbound queue job already filed, or
+// nil if it has filed none.
+func (s *Service) FiledMessage(ctx context.Context, jobID int64) (*models.ConversationMessage, error) {
+	msg, err := s.conversations.GetMessageByInboundJobID(ctx, jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return msg, err
+}
+
+// ReceiveEmail files an inbound email into the stream's mailbox. If the email
+// is a reply to an existing conversation, identified by its In-Reply-To or
+// References headers or by a reply token in its address or subject, it is
+// appended to that conversation and the conversation is reopened, and the
+// owner is notified of the reply. Otherwise a new conversation is started,
+// in the spam folder if the spam filter flags the email, or as the mailbox's
+// filter rules decide. It returns the conversation and the stored inbound
+// message, or ErrDiscarded if a rule discarded the email.
+func (s *Service) ReceiveEmail(ctx context.Context, stream *models.Stream, email InboundEmail) (*models.Conversation, *models.ConversationMessage, error) {
+	if !stream.Enabled {
+		return nil, nil, ErrStreamDisabled
+	}
+
+	msg := &models.ConversationMessage{
+		Direction:     models.MessageInbound,
+		SenderAddress: email.SenderAddress,
+		SenderName:    email.SenderName,
+		Body:          email.Body,
+		BodyHTML:      email.BodyHTML,
+		MessageID:     email.MessageID,
+		RawKey:        email.RawKey,
+		InboundJobID:  email.InboundJobID,
+		Helo:          email.Helo,
+		TLS:           email.TLS,
+		AuthResults:   email.AuthResults,
+		AuthVerdict:   email.AuthVerdict,
+		Automated:     email.Automated,
+	}
+	if email.RemoteIP != nil {
+		msg.RemoteIP = email.RemoteIP.String()
+	}
+
+	if email.Quarantine {
+		conv, err := s.hold(ctx, stream, email.Subject, email.Recipient, msg, models.ConversationQuarantined)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conv, msg, nil
+	}
+
+	conv, err := s.findThread(ctx, stream, email)
 	if err != nil {
+		return nil, nil, err
+	}
+	if conv == nil {
+		isSpam := s.checkSpam(ctx, stream.MailboxID, msg, spam.Message{
+			Subject:       email.Subject,
+			Body:          email.Body,
+			SenderAddress: email.SenderAddress,
+			SenderName:    email.SenderName,
+			Header:        email.Header,
+			IP:            email.RemoteIP,
+		})
+		if isSpam {
+			conv, err = s.hold(ctx, stream, email.Subject, email.Recipient, msg, models.ConversationSpam)
+		} else {
+			conv, err = s.applyRules(ctx, stream, email.Subject, email.Recipient, msg, email.Header)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return conv, msg, nil
+	}
+
+	msg.ConversationID = conv.ID
+	if err := s.conversations.CreateMessage(ctx, msg); err != nil {
+		return nil, nil, fmt.Errorf("create message: %w", err)
+	}
+
+	if conv.Status == models.ConversationClosed && msg.Automated == "" {
+		if err := s.conversations.UpdateConversationStatus(ctx, conv.ID, string(models.ConversationOpen)); err != nil {
+			return nil, nil, fmt.Errorf("reopen conversation: %w", err)
+		}
+		conv.Status = models.ConversationOpen
+	}
+	if conv.Status == models.ConversationOpen && msg.Automated == "" {
+		s.notify(conv, msg, true)
+	}
+
+	return conv, msg, nil
+}
+
+// findThread looks up the conversation an inbound email replies to. It
+// returns nil if the email does not belong to a conversation in the stream's
+// mailbox, or one a filter rule moved elsewhere from the stream.
+func (s *Service) findThread(ctx context.Context, stream *models.Stream, email InboundEmail) (*models.Conversation, error) {
+	mailboxID := stream.MailboxID
+
+	// In-Reply-To names the direct parent; References lists the thread
+	// oldest-first, so the most recent ancestors are tried first.
+	refs := make([]string, 0, len(email.InReplyTo)+len(email.References))
+	refs = append(refs, email.InReplyTo...)
+	for i := len(email.References) - 1; i >= 0; i-- {
+		refs = append(refs, email.References[i])
+	}
+
+	if len(refs) > 0 {
+		conv, err := s.conversations.GetConversationByMessageID(ctx, mailboxID, refs)
+		if err == nil {
+			return conv, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("find thread by message id: %w", err)
+		}
+	}
+
+	// The token in the reply address is tried before the one in the
+	// subject, which the sender can edit.
+	for _, token := range []string{email.ReplyToken, SubjectToken(email.Subject)} {
+		publicID, ok := ParseReplyToken(token)
+		if !ok {
+			continue
+		}
+		conv, err := s.conversations.GetConversationByPublicID(ctx, publicID)
+		if err == nil && (conv.MailboxID == mailboxID || conv.StreamID == stream.ID) {
+			return conv, nil
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("find thread by reply token: %w", err)
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *Service) start(ctx context.Context, stream *models.Stream, subject, recipient string, msg *models.ConversationMessage) (*models.Conversation, error) {
+	conv := &models.Conversation{MailboxID: stream.MailboxID, StreamID: stream.ID, Subject: subject, Recipient: recipient}
+	if err := s.conversations.CreateConversation(ctx, conv, msg); err != nil {
 		return nil, fmt.Errorf("create conversation: %w", err)
 	}
 
-	msg, err := s.conversations.CreateMessage(ctx, conv.ID, string(models.MessageInbound), senderAddress, senderName, body)
-	if err != nil {
-		return nil, fmt.Errorf("create message: %w", err)
+	if msg.Automated != "" {
+		return conv, nil
 	}
 
-	// Fire-and-forget notification
+	s.notify(conv, msg, false)
+	return conv, nil
+}
+
+// notify tells the owner of the conversation's mailbox about a new
+// conversation, or a reply on one, without holding up delivery.
+func (s *Service) notify(conv *models.Conversation, msg *models.ConversationMessage, reply bool) {
 	go func() {
-		mb, _ := s.mailboxes.GetMailboxByID(context.Background(), stream.MailboxID)
-		if mb != nil {
-			_ = s.notifier.NotifyNewConversation(context.Background(), mb, conv, msg)
+		ctx := context.Background()
+		mb, _ := s.mailboxes.GetMailboxByID(ctx, conv.MailboxID)
+		if mb == nil {
+			return
+		}
+		if reply {
+			_ = s.notifier.NotifyReply(ctx, mb, conv, msg)
+		} else {
+			_ = s.notifier.NotifyNewConversation(ctx, mb, conv, msg)
 		}
 	}()
+}
 
+// hold files msg in a new conversation with the given status, which sends
+// no notification.
+func (s *Service) hold(ctx context.Context, stream *models.Stream, subject, recipient string, msg *models.ConversationMessage, status models.ConversationStatus) (*models.Conversation, error) {
+	conv := &models.Conversation{MailboxID: stream.MailboxID, StreamID: stream.ID, Subject: subject, Recipient: recipient, Status: status}
+	if err := s.conversations.CreateConversation(ctx, conv, msg); err != nil {
+		return nil, fmt.Errorf("create conversation: %w", err)
+	}
 	return conv, nil
 }
 
-// Reply adds an outbound message to an existing conversation and sends the email.
-func (s *Service) Reply(ctx context.Context, conversationID int64, body string) (*models.ConversationMessage, error) {
+// applyRules runs the mailbox's filter rules on a message that starts a new
+// conversation and files it accordingly. Failing to load the rules files the
+// message as if none matched.
+func (s *Service) applyRules(ctx context.Context, stream *models.Stream, subject, recipient string, msg *models.ConversationMessage, header mail.Header) (*models.Conversation, error) {
+	res, err := s.filters.Apply(ctx, stream.MailboxID, filter.Message{
+		Sender:     msg.SenderAddress,
+		Recipient:  recipient,
+		Subject:    subject,
+		Body:       msg.Body,
+		Header:     header,
+		StreamType: stream.Type,
+	})
+	if err != nil {
+		slog.Error("failed to apply filter rules", "mailbox_id", stream.MailboxID, "error", err)
+		return s.start(ctx, stream, subject, recipient, msg)
+	}
+
+	for _, to := range res.Forward {
+		if err := s.forward(ctx, stream.MailboxID, to, subject, msg); err != nil {
+			slog.Error("failed to queue forward", "mailbox_id", stream.MailboxID, "to", to, "error", err)
+		}
+	}
+	if res.Discard {
+		return nil, ErrDiscarded
+	}
+
+	if res.Moved() {
+		if target := s.moveTarget(ctx, stream.MailboxID, res.MoveTo); target != nil {
+			// The conversation keeps its stream but lives in the target
+			// mailbox.
+			moved := *stream
+			moved.MailboxID = target.ID
+			stream = &moved
+		}
+	}
+
+	var conv *models.Conversation
+	if res.Status == "" || res.Status == models.ConversationOpen {
+		conv, err = s.start(ctx, stream, subject, recipient, msg)
+	} else {
+		conv, err = s.hold(ctx, stream, subject, recipient, msg, res.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Tags) > 0 {
+		if err := s.conversations.SetConversationTags(ctx, conv.ID, res.Tags); err != nil {
+			return nil, fmt.Errorf("set tags: %w", err)
+		}
+		conv.Tags = res.Tags
+	}
+
+	// Never answer machines: replying to a bounce or another auto-reply
+	// risks a mail loop (RFC 3834).
+	if res.AutoReply != "" && conv.Status != models.ConversationSpam && msg.Automated == "" {
+		if _, err := s.send(ctx, conv, res.AutoReply, "auto-replied", nil); err != nil {
+			slog.Error("failed to queue auto-reply", "conversation_id", conv.ID, "error", err)
+		}
+	}
+	return conv, nil
+}
+
+// moveTarget returns the mailbox a rule moves conversations to, or nil if it
+// no longer exists or belongs to someone else.
+func (s *Service) moveTarget(ctx context.Context, mailboxID int64, target uuid.UUID) *models.Mailbox {
+	mb, err := s.mailboxes.GetMailboxByID(ctx, mailboxID)
+	if err != nil {
+		return nil
+	}
+	t, err := s.mailboxes.GetMailboxByPublicID(ctx, target)
+	if err != nil || t.UserID != mb.UserID {
+		slog.Warn("ignoring filter rule move to unknown mailbox", "mailbox_id", mailboxID, "target", target)
+		return nil
+	}
+	return t
+}
+
+// forward queues a copy of an inbound message to another address, from the
+// mailbox's address and with replies going to the original sender.
+func (s *Service) forward(ctx context.Context, mailboxID int64, to, subject string, msg *models.ConversationMessage) error {
+	mb, err := s.mailboxes.GetMailboxByID(ctx, mailboxID)
+	if err != nil {
+		return fmt.Errorf("get mailbox: %w", err)
+	}
+
+	from := msg.SenderAddress
+	if msg.SenderName != "" {
+		from = msg.SenderName + " <" + msg.SenderAddress + ">"
+	}
+	return s.queue(ctx, OutboundEmail{
+		To:          to,
+		FromAddress: mb.FromAddress,
+		FromName:    mb.Name,
+		ReplyTo:     msg.SenderAddress,
+		Subject:     "Fwd: " + subject,
+		Body:        "---------- Forwarded message ----------\nFrom: " + from + "\nSubject: " + subject + "\n\n" + msg.Body,
+		MessageID:   newMessageID(mb.FromAddress),
+
+		AutoSubmitted: "auto-generated",
+	}, nil)
+}
+
+// checkSpam scores a message about to start a conversation in the mailbox
+// for its owner, records the score on msg and reports whether it is spam.
+func (s *Service) checkSpam(ctx context.Context, mailboxID int64, msg *models.ConversationMessage, content spam.Message) bool {
+	mb, err := s.mailboxes.GetMailboxByID(ctx, mailboxID)
+	if err != nil {
+		return false
+	}
+	verdict := s.spam.Check(ctx, mb.UserID, content)
+	msg.SpamScore = verdict.Score
+	msg.SpamRules = verdict.Summary()
+	return verdict.Spam
+}
+
+// MarkSpam trains the mailbox owner's spam filter with the conversation's
+// first inbound message and moves the conversation to the spam folder, or,
+// when isSpam is false, back to the inbox.
+func (s *Service) MarkSpam(ctx context.Context, userID, conversationID int64, isSpam bool) error {
+	conv, err := s.conversations.GetConversationByID(ctx, conversationID)
+	if err != nil {
+		return fmt.Errorf("get conversation: %w", err)
+	}
+	msgs, err := s.conversations.GetMessagesByConversationID(ctx, conv.ID)
+	if err != nil {
+		return fmt.Errorf("get messages: %w", err)
+	}
+
+	for _, m := range msgs {
+		if m.Direction != models.MessageInbound {
+			continue
+		}
+		err := s.spam.Train(ctx, userID, spam.Message{
+			Subject:       conv.Subject,
+			Body:          m.Body,
+			SenderAddress: m.SenderAddress,
+			SenderName:    m.SenderName,
+		}, isSpam, conv.SpamLabel)
+		if err != nil {
+			return fmt.Errorf("train spam filter: %w", err)
+		}
+		break
+	}
+
+	label := spam.LabelHam
+	if isSpam {
+		label = spam.LabelSpam
+	}
+	if err := s.conversations.UpdateConversationSpamLabel(ctx, conv.ID, label); err != nil {
+		return fmt.Errorf("update spam label: %w", err)
+	}
+
+	switch {
+	case isSpam:
+		return s.conversations.UpdateConversationStatus(ctx, conv.ID, string(models.ConversationSpam))
+	case conv.Status == models.ConversationSpam:
+		return s.conversations.UpdateConversationStatus(ctx, conv.ID, string(models.ConversationOpen))
+	}
+	return nil
+}
+
+// Release moves a quarantined conversation into the inbox.
+func (s *Service) Release(ctx context.Context, conversationID int64) error {
+	return s.conversations.UpdateConversationStatus(ctx, conversationID, string(models.ConversationOpen))
+}
+
+// Reply adds an outbound message to an existing conversation and queues the
+// email, with attachments whose content has been stored already. Its
+// DeliveryStatus follows the delivery.
+func (s *Service) Reply(ctx context.Context, conversationID int64, body string, attachments []models.Attachment) (*models.ConversationMessage, error) {
 	conv, err := s.conversations.GetConversationByID(ctx, conversationID)
 	if err != nil {
 		return nil, fmt.Errorf("get conversation: %w", err)
 	}
 
-	if conv.Status == models.ConversationClosed {
+	switch conv.Status {
+	case models.ConversationClosed:
 		return nil, ErrConversationClosed
+	case models.ConversationQuarantined:
+		return nil, ErrConversationQuarantined
+	case models.ConversationSpam:
+		return nil, ErrConversationSpam
 	}
+	return s.send(ctx, conv, body, "", attachments)
+}
 
+// send records body as an outbound message and queues it, with its
+// attachments, for the conversation's original sender. autoSubmitted marks
+// mail sent without a person writing it.
+func (s *Service) send(ctx context.Context, conv *models.Conversation, body, autoSubmitted string, attachments []models.Attachment) (*models.ConversationMessage, error) {
 	mb, err := s.mailboxes.GetMailboxByID(ctx, conv.MailboxID)
 	if err != nil {
 		return nil, fmt.Errorf("get mailbox: %w", err)
@@ -119,33 +641,102 @@ func (s *Service) Reply(ctx context.Context, conversationID int64, body string)
 		return nil, errors.New("no inbound sender address to reply to")
 	}
 
-	// Send the email
 	subject := conv.Subject
 	if subject != "" {
 		subject = "Re: " + subject
 	}
-	if err := s.sender.SendReply(ctx, replyTo, mb.FromAddress, mb.Name, subject, body); err != nil {
-		return nil, fmt.Errorf("send reply: %w", err)
+	subject = tagSubject(subject, conv.PublicID)
+	inReplyTo, references := threadHeaders(msgs)
+	msg := &models.ConversationMessage{
+		ConversationID: conv.ID,
+		Direction:      models.MessageOutbound,
+		SenderAddress:  mb.FromAddress,
+		SenderName:     mb.Name,
+		Body:           body,
+		MessageID:      newMessageID(mb.FromAddress),
+		DeliveryStatus: models.DeliveryQueued,
 	}
+	err = s.queue(ctx, OutboundEmail{
+		To:          replyTo,
+		FromAddress: mb.FromAddress,
+		FromName:    mb.Name,
+		ReplyTo:     ReplyAddress(mb.FromAddress, conv.PublicID),
+		Subject:     subject,
+		Body:        body,
+		MessageID:   msg.MessageID,
+		InReplyTo:   inReplyTo,
+		References:  references,
+		Attachments: attachments,
 
-	msg, err := s.conversations.CreateMessage(ctx, conv.ID, string(models.MessageOutbound), mb.FromAddress, mb.Name, body)
+		AutoSubmitted: autoSubmitted,
+	}, msg)
 	if err != nil {
-		return nil, fmt.Errorf("create outbound message: %w", err)
+		return nil, fmt.Errorf("queue reply: %w", err)
 	}
 
 	return msg, nil
 }
 
+// maxReferences bounds the References header of long conversations.
+const maxReferences = 20
+
+// threadHeaders returns the In-Reply-To and References values of a new
+// message in the conversation with the given messages, oldest first: the
+// newest message, and the IDs of all of them, keeping the first and the
+// latest if there are too many. Outbound messages that never arrived are
+// left out.
+func threadHeaders(msgs []models.ConversationMessage) (inReplyTo, references string) {
+	var ids []string
+	for _, m := range msgs {
+		if m.MessageID == "" || m.DeliveryStatus == models.DeliveryFailed || m.DeliveryStatus == models.DeliveryBounced {
+			continue
+		}
+		ids = append(ids, m.MessageID)
+	}
+	if len(ids) == 0 {
+		return "", ""
+	}
+	inReplyTo = ids[len(ids)-1]
+	if len(ids) > maxReferences {
+		ids = append(ids[:1], ids[len(ids)-maxReferences+1:]...)
+	}
+	return inReplyTo, strings.Join(ids, " ")
+}
+
+// RecordBounce marks the outbound message with the given Message-ID in the
+// mailbox as bounced. It reports whether such a message was found.
+func (s *Service) RecordBounce(ctx context.Context, mailboxID int64, messageID, reason string) (bool, error) {
+	err := s.conversations.MarkMessageBounced(ctx, mailboxID, messageID, reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("mark message bounced: %w", err)
+	}
+	return true, nil
+}
+
 // Close marks a conversation as closed.
 func (s *Service) Close(ctx context.Context, conversationID int64) error {
 	return s.conversations.UpdateConversationStatus(ctx, conversationID, string(models.ConversationClosed))
 }
 
+// MarkRead records that the owner opened a conversation, which leaves it
+// out of their next notification digest.
+func (s *Service) MarkRead(ctx context.Context, conversationID int64) error {
+	return s.conversations.MarkConversationRead(ctx, conversationID)
+}
+
 // List returns conversations for a mailbox with pagination.
 func (s *Service) List(ctx context.Context, mailboxID int64, limit, offset int) ([]models.Conversation, error) {
 	return s.conversations.GetConversationsByMailboxID(ctx, mailboxID, limit, offset)
 }
 
+// ListSpam returns the conversations in a mailbox's spam folder.
+func (s *Service) ListSpam(ctx context.Context, mailboxID int64, limit, offset int) ([]models.Conversation, error) {
+	return s.conversations.GetConversationsByStatus(ctx, mailboxID, string(models.ConversationSpam), limit, offset)
+}
+
 // GetMessages returns all messages in a conversation.
 func (s *Service) GetMessages(ctx context.Context, conversationID int64) ([]models.ConversationMessage, error) {
 	return s.conversations.GetMessagesByConversationID(ctx, conversationID)
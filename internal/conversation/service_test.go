@@ -2,12 +2,18 @@ package conversation
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/filter"
 	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/spam"
 )
 
 // --- Mock stores ---
@@ -32,22 +38,20 @@ func newMockConversationStore() *mockConversationStore {
 	}
 }
 
-func (m *mockConversationStore) CreateConversation(_ context.Context, mailboxID, streamID int64, subject string) (*models.Conversation, error) {
-	c := &models.Conversation{
-		ID:        m.nextID,
-		PublicID:  uuid.New(),
-		MailboxID: mailboxID,
-		StreamID:  streamID,
-		Subject:   subject,
-		Status:    models.ConversationOpen,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+func (m *mockConversationStore) CreateConversation(ctx context.Context, c *models.Conversation, first *models.ConversationMessage) error {
+	c.ID = m.nextID
+	c.PublicID = uuid.New()
+	if c.Status == "" {
+		c.Status = models.ConversationOpen
 	}
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
 	m.nextID++
 	m.conversations[c.ID] = c
 	m.byPublicID[c.PublicID] = c
-	m.byMailbox[mailboxID] = append(m.byMailbox[mailboxID], *c)
-	return c, nil
+	m.byMailbox[c.MailboxID] = append(m.byMailbox[c.MailboxID], *c)
+	first.ConversationID = c.ID
+	return m.CreateMessage(ctx, first)
 }
 
 func (m *mockConversationStore) GetConversationByID(_ context.Context, id int64) (*models.Conversation, error) {
@@ -78,6 +82,60 @@ func (m *mockConversationStore) GetConversationsByMailboxID(_ context.Context, m
 	return all[offset:end], nil
 }
 
+func (m *mockConversationStore) GetConversationsByStatus(_ context.Context, mailboxID int64, status string, _, _ int) ([]models.Conversation, error) {
+	var out []models.Conversation
+	for _, c := range m.conversations {
+		if c.MailboxID == mailboxID && string(c.Status) == status {
+			out = append(out, *c)
+		}
+	}
+	return out, nil
+}
+
+func (m *mockConversationStore) MarkConversationRead(_ context.Context, _ int64) error {
+	return nil
+}
+
+func (m *mockConversationStore) UpdateConversationSpamLabel(_ context.Context, id int64, label string) error {
+	c, ok := m.conversations[id]
+	if !ok {
+		return errors.New("not found")
+	}
+	c.SpamLabel = label
+	return nil
+}
+
+func (m *mockConversationStore) SetConversationTags(_ context.Context, id int64, tags []string) error {
+	c, ok := m.conversations[id]
+	if !ok {
+		return errors.New("not found")
+	}
+	c.Tags = tags
+	return nil
+}
+
+func (m *mockConversationStore) MarkMessageBounced(_ context.Context, mailboxID int64, messageID, reason string) error {
+	for convID, msgs := range m.messages {
+		c := m.conversations[convID]
+		if c == nil || c.MailboxID != mailboxID {
+			continue
+		}
+		for i := range msgs {
+			if msgs[i].Direction == models.MessageOutbound && msgs[i].MessageID == messageID {
+				now := time.Now()
+				msgs[i].BouncedAt = &now
+				msgs[i].BounceReason = reason
+				return nil
+			}
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockConversationStore) PurgeSpamConversations(_ context.Context, _ time.Time) (int, []string, error) {
+	return 0, nil, nil
+}
+
 func (m *mockConversationStore) UpdateConversationStatus(_ context.Context, id int64, status string) error {
 	c, ok := m.conversations[id]
 	if !ok {
@@ -97,26 +155,55 @@ func (m *mockConversationStore) CountOpenByMailboxID(_ context.Context, mailboxI
 	return count, nil
 }
 
-func (m *mockConversationStore) CreateMessage(_ context.Context, conversationID int64, direction, senderAddress, senderName, body string) (*models.ConversationMessage, error) {
-	msg := &models.ConversationMessage{
-		ID:             m.nextMsgID,
-		PublicID:       uuid.New(),
-		ConversationID: conversationID,
-		Direction:      models.MessageDirection(direction),
-		SenderAddress:  senderAddress,
-		SenderName:     senderName,
-		Body:           body,
-		CreatedAt:      time.Now(),
+func (m *mockConversationStore) GetConversationByMessageID(_ context.Context, mailboxID int64, messageIDs []string) (*models.Conversation, error) {
+	for convID, msgs := range m.messages {
+		c := m.conversations[convID]
+		if c == nil || c.MailboxID != mailboxID {
+			continue
+		}
+		for _, msg := range msgs {
+			for _, id := range messageIDs {
+				if msg.MessageID != "" && msg.MessageID == id {
+					return c, nil
+				}
+			}
+		}
 	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockConversationStore) CreateMessage(_ context.Context, msg *models.ConversationMessage) error {
+	msg.ID = m.nextMsgID
+	msg.PublicID = uuid.New()
+	msg.CreatedAt = time.Now()
 	m.nextMsgID++
-	m.messages[conversationID] = append(m.messages[conversationID], *msg)
-	return msg, nil
+	m.messages[msg.ConversationID] = append(m.messages[msg.ConversationID], *msg)
+	return nil
+}
+
+func (m *mockConversationStore) GetMessageByInboundJobID(_ context.Context, jobID int64) (*models.ConversationMessage, error) {
+	for _, msgs := range m.messages {
+		for i := range msgs {
+			if msgs[i].InboundJobID == jobID {
+				return &msgs[i], nil
+			}
+		}
+	}
+	return nil, sql.ErrNoRows
 }
 
 func (m *mockConversationStore) GetMessagesByConversationID(_ context.Context, conversationID int64) ([]models.ConversationMessage, error) {
 	return m.messages[conversationID], nil
 }
 
+func (m *mockConversationStore) GetMessagesWithRaw(_ context.Context, _ int64, _ int) ([]models.ConversationMessage, error) {
+	return nil, nil
+}
+
+func (m *mockConversationStore) UpdateMessageContent(_ context.Context, _ int64, _, _, _, _ string) error {
+	return nil
+}
+
 type mockMailboxStoreForConv struct {
 	mailboxes map[int64]*models.Mailbox
 }
@@ -147,8 +234,13 @@ func (m *mockMailboxStoreForConv) GetMailboxByID(_ context.Context, id int64) (*
 	return mb, nil
 }
 
-func (m *mockMailboxStoreForConv) GetMailboxByPublicID(_ context.Context, _ uuid.UUID) (*models.Mailbox, error) {
-	return nil, errors.New("not implemented")
+func (m *mockMailboxStoreForConv) GetMailboxByPublicID(_ context.Context, publicID uuid.UUID) (*models.Mailbox, error) {
+	for _, mb := range m.mailboxes {
+		if mb.PublicID == publicID {
+			return mb, nil
+		}
+	}
+	return nil, errors.New("not found")
 }
 
 func (m *mockMailboxStoreForConv) DeleteMailbox(_ context.Context, _ int64) error {
@@ -160,12 +252,15 @@ type recordingSender struct {
 }
 
 type sendCall struct {
-	to, fromAddress, fromName, subject, body string
+	to, fromAddress, fromName, replyTo, subject, body string
+	messageID, autoSubmitted                          string
+	inReplyTo, references                             string
+	attachments                                       []models.Attachment
 }
 
-func (s *recordingSender) SendReply(_ context.Context, to, fromAddress, fromName, subject, body string) error {
-	s.calls = append(s.calls, sendCall{to, fromAddress, fromName, subject, body})
-	return nil
+func (s *recordingSender) SendReply(_ context.Context, email OutboundEmail) (string, error) {
+	s.calls = append(s.calls, sendCall{email.To, email.FromAddress, email.FromName, email.ReplyTo, email.Subject, email.Body, email.MessageID, email.AutoSubmitted, email.InReplyTo, email.References, email.Attachments})
+	return email.MessageID, nil
 }
 
 // --- Tests ---
@@ -174,7 +269,7 @@ func TestStartConversation_Success(t *testing.T) {
 	cs := newMockConversationStore()
 	ms := newMockMailboxStoreForConv()
 	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
-	svc := NewService(cs, ms, &NoopNotifier{}, &NoopSender{})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
 
 	stream := &models.Stream{
 		ID:        1,
@@ -183,7 +278,7 @@ func TestStartConversation_Success(t *testing.T) {
 		Enabled:   true,
 	}
 
-	conv, err := svc.StartConversation(context.Background(), stream, "Hello", "sender@test.com", "Alice", "Hi there")
+	conv, err := svc.StartConversation(context.Background(), stream, "Hello", "sender@test.com", "Alice", "Hi there", nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -213,7 +308,7 @@ func TestStartConversation_Success(t *testing.T) {
 func TestStartConversation_StreamDisabled(t *testing.T) {
 	cs := newMockConversationStore()
 	ms := newMockMailboxStoreForConv()
-	svc := NewService(cs, ms, &NoopNotifier{}, &NoopSender{})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
 
 	stream := &models.Stream{
 		ID:        1,
@@ -221,7 +316,7 @@ func TestStartConversation_StreamDisabled(t *testing.T) {
 		Enabled:   false,
 	}
 
-	_, err := svc.StartConversation(context.Background(), stream, "Hello", "sender@test.com", "Alice", "Hi")
+	_, err := svc.StartConversation(context.Background(), stream, "Hello", "sender@test.com", "Alice", "Hi", nil)
 	if !errors.Is(err, ErrStreamDisabled) {
 		t.Fatalf("expected ErrStreamDisabled, got %v", err)
 	}
@@ -232,12 +327,12 @@ func TestReply_Success(t *testing.T) {
 	ms := newMockMailboxStoreForConv()
 	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
 	sender := &recordingSender{}
-	svc := NewService(cs, ms, &NoopNotifier{}, sender)
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, &NoopFilter{})
 
 	stream := &models.Stream{ID: 1, MailboxID: 1, Enabled: true}
-	conv, _ := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Need help")
+	conv, _ := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Need help", nil)
 
-	msg, err := svc.Reply(context.Background(), conv.ID, "Sure, how can I help?")
+	msg, err := svc.Reply(context.Background(), conv.ID, "Sure, how can I help?", nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -249,6 +344,7 @@ func TestReply_Success(t *testing.T) {
 	}
 
 	// Verify the sender was called
+	deliverQueued(svc)
 	if len(sender.calls) != 1 {
 		t.Fatalf("expected 1 send call, got %d", len(sender.calls))
 	}
@@ -259,8 +355,8 @@ func TestReply_Success(t *testing.T) {
 	if call.fromAddress != "support@example.com" {
 		t.Errorf("expected from support@example.com, got %s", call.fromAddress)
 	}
-	if call.subject != "Re: Question" {
-		t.Errorf("expected subject Re: Question, got %s", call.subject)
+	if want := "Re: Question " + SubjectTag(conv.PublicID); call.subject != want {
+		t.Errorf("expected subject %s, got %s", want, call.subject)
 	}
 }
 
@@ -268,14 +364,14 @@ func TestReply_ConversationClosed(t *testing.T) {
 	cs := newMockConversationStore()
 	ms := newMockMailboxStoreForConv()
 	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
-	svc := NewService(cs, ms, &NoopNotifier{}, &NoopSender{})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
 
 	stream := &models.Stream{ID: 1, MailboxID: 1, Enabled: true}
-	conv, _ := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Hi")
+	conv, _ := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Hi", nil)
 
 	_ = svc.Close(context.Background(), conv.ID)
 
-	_, err := svc.Reply(context.Background(), conv.ID, "Too late")
+	_, err := svc.Reply(context.Background(), conv.ID, "Too late", nil)
 	if !errors.Is(err, ErrConversationClosed) {
 		t.Fatalf("expected ErrConversationClosed, got %v", err)
 	}
@@ -284,10 +380,10 @@ func TestReply_ConversationClosed(t *testing.T) {
 func TestClose_Success(t *testing.T) {
 	cs := newMockConversationStore()
 	ms := newMockMailboxStoreForConv()
-	svc := NewService(cs, ms, &NoopNotifier{}, &NoopSender{})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
 
 	stream := &models.Stream{ID: 1, MailboxID: 1, Enabled: true}
-	conv, _ := svc.StartConversation(context.Background(), stream, "Subject", "a@b.com", "A", "body")
+	conv, _ := svc.StartConversation(context.Background(), stream, "Subject", "a@b.com", "A", "body", nil)
 
 	err := svc.Close(context.Background(), conv.ID)
 	if err != nil {
@@ -305,11 +401,11 @@ func TestListConversations(t *testing.T) {
 	cs := newMockConversationStore()
 	ms := newMockMailboxStoreForConv()
 	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
-	svc := NewService(cs, ms, &NoopNotifier{}, &NoopSender{})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
 
 	stream := &models.Stream{ID: 1, MailboxID: 1, Enabled: true}
-	_, _ = svc.StartConversation(context.Background(), stream, "First", "a@b.com", "A", "body1")
-	_, _ = svc.StartConversation(context.Background(), stream, "Second", "c@d.com", "C", "body2")
+	_, _ = svc.StartConversation(context.Background(), stream, "First", "a@b.com", "A", "body1", nil)
+	_, _ = svc.StartConversation(context.Background(), stream, "Second", "c@d.com", "C", "body2", nil)
 
 	convos, err := svc.List(context.Background(), 1, 50, 0)
 	if err != nil {
@@ -319,3 +415,782 @@ func TestListConversations(t *testing.T) {
 		t.Errorf("expected 2 conversations, got %d", len(convos))
 	}
 }
+
+func TestReply_RecordsMessageIDAndReplyAddress(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	sender := &recordingSender{}
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Enabled: true}
+	conv, _ := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Need help", nil)
+
+	msg, err := svc.Reply(context.Background(), conv.ID, "On it", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	deliverQueued(svc)
+	if !strings.HasSuffix(msg.MessageID, "@example.com>") || sender.calls[0].messageID != msg.MessageID {
+		t.Errorf("expected Message-ID %q to be recorded and sent, got %q", sender.calls[0].messageID, msg.MessageID)
+	}
+
+	want := "support+" + ReplyToken(conv.PublicID) + "@example.com"
+	if sender.calls[0].replyTo != want {
+		t.Errorf("expected Reply-To %s, got %s", want, sender.calls[0].replyTo)
+	}
+}
+
+func TestReceiveEmail_ThreadsByInReplyTo(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &recordingSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, _ := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Question",
+		SenderAddress: "alice@test.com",
+		Body:          "Need help",
+		MessageID:     "<q1@test.com>",
+	})
+	reply, _ := svc.Reply(context.Background(), conv.ID, "What do you need?", nil)
+
+	got, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Re: Question",
+		SenderAddress: "alice@test.com",
+		Body:          "Details",
+		MessageID:     "<q2@test.com>",
+		InReplyTo:     []string{reply.MessageID},
+		References:    []string{"<q1@test.com>", reply.MessageID},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got.ID != conv.ID {
+		t.Fatalf("expected reply to thread into conversation %d, got %d", conv.ID, got.ID)
+	}
+	if len(cs.conversations) != 1 {
+		t.Errorf("expected 1 conversation, got %d", len(cs.conversations))
+	}
+	msgs := cs.messages[conv.ID]
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages in thread, got %d", len(msgs))
+	}
+	if msgs[2].MessageID != "<q2@test.com>" {
+		t.Errorf("expected inbound Message-ID to be stored, got %q", msgs[2].MessageID)
+	}
+}
+
+func TestReply_ThreadsUnderConversation(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	sender := &recordingSender{}
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, &NoopFilter{})
+	ctx := context.Background()
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, _ := svc.ReceiveEmail(ctx, stream, InboundEmail{
+		Subject:       "Question",
+		SenderAddress: "alice@test.com",
+		Body:          "Need help",
+		MessageID:     "<q1@test.com>",
+	})
+	first, _ := svc.Reply(ctx, conv.ID, "What do you need?", nil)
+	svc.ReceiveEmail(ctx, stream, InboundEmail{
+		Subject:       "Re: Question",
+		SenderAddress: "alice@test.com",
+		Body:          "Details",
+		MessageID:     "<q2@test.com>",
+		InReplyTo:     []string{first.MessageID},
+	})
+	if _, err := svc.Reply(ctx, conv.ID, "Thanks", nil); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+	deliverQueued(svc)
+
+	if len(sender.calls) != 2 {
+		t.Fatalf("expected 2 replies sent, got %d", len(sender.calls))
+	}
+	if got := sender.calls[0]; got.inReplyTo != "<q1@test.com>" || got.references != "<q1@test.com>" {
+		t.Errorf("expected the first reply to answer the question, got In-Reply-To %q References %q", got.inReplyTo, got.references)
+	}
+	want := "<q1@test.com> " + first.MessageID + " <q2@test.com>"
+	if got := sender.calls[1]; got.inReplyTo != "<q2@test.com>" || got.references != want {
+		t.Errorf("expected the second reply to reference the thread %q, got In-Reply-To %q References %q", want, got.inReplyTo, got.references)
+	}
+}
+
+func TestReply_SendsAttachments(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	sender := &recordingSender{}
+	outbox := newMemOutbox(cs)
+	svc := NewService(cs, outbox, ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, &NoopFilter{})
+	ctx := context.Background()
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, _ := svc.ReceiveEmail(ctx, stream, InboundEmail{Subject: "Invoice", SenderAddress: "alice@test.com", Body: "Please send it"})
+	files := []models.Attachment{{Filename: "invoice.pdf", ContentType: "application/pdf", SizeBytes: 4, StorageKey: "attachments/a"}}
+	msg, err := svc.Reply(ctx, conv.ID, "Attached.", files)
+	if err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+	if got := outbox.jobs[0].Attachments; len(got) != 1 || got[0].StorageKey != "attachments/a" || outbox.jobs[0].ConversationMessageID != msg.ID {
+		t.Fatalf("expected the attachments to be queued with the message, got %+v", outbox.jobs[0])
+	}
+	deliverQueued(svc)
+
+	if len(sender.calls) != 1 || len(sender.calls[0].attachments) != 1 || sender.calls[0].attachments[0].Filename != "invoice.pdf" {
+		t.Fatalf("expected the reply to be sent with its attachment, got %+v", sender.calls)
+	}
+}
+
+func TestThreadHeaders_TrimsLongThreads(t *testing.T) {
+	var msgs []models.ConversationMessage
+	for i := range 30 {
+		msgs = append(msgs, models.ConversationMessage{MessageID: fmt.Sprintf("<m%d@test.com>", i)})
+	}
+	msgs = append(msgs, models.ConversationMessage{MessageID: "<failed@test.com>", DeliveryStatus: models.DeliveryFailed})
+
+	inReplyTo, references := threadHeaders(msgs)
+	if inReplyTo != "<m29@test.com>" {
+		t.Errorf("expected In-Reply-To the newest delivered message, got %q", inReplyTo)
+	}
+	ids := strings.Fields(references)
+	if len(ids) != maxReferences || ids[0] != "<m0@test.com>" || ids[1] != "<m11@test.com>" || ids[len(ids)-1] != "<m29@test.com>" {
+		t.Errorf("expected the first and the latest %d IDs, got %v", maxReferences-1, ids)
+	}
+}
+
+func TestReceiveEmail_StoresRawKey(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	_, msg, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Question",
+		SenderAddress: "alice@test.com",
+		Body:          "Need help",
+		RawKey:        "raw/2026/01/abc.eml.gz",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if msg.RawKey != "raw/2026/01/abc.eml.gz" {
+		t.Errorf("expected raw key to be stored, got %q", msg.RawKey)
+	}
+}
+
+func TestReceiveEmail_RecordsRecipient(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Address: "*@test.com", Enabled: true}
+	conv, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Question",
+		SenderAddress: "alice@test.com",
+		Body:          "Need help",
+		Recipient:     "billing@test.com",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if conv.Recipient != "billing@test.com" {
+		t.Errorf("expected recipient billing@test.com, got %q", conv.Recipient)
+	}
+}
+
+func TestReceiveEmail_ReopensClosedConversation(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, _ := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:   "Question",
+		Body:      "Need help",
+		MessageID: "<q1@test.com>",
+	})
+	_ = svc.Close(context.Background(), conv.ID)
+
+	got, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Body:       "Still broken",
+		References: []string{"<q1@test.com>"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got.ID != conv.ID {
+		t.Fatalf("expected follow-up to thread into conversation %d, got %d", conv.ID, got.ID)
+	}
+	if cs.conversations[conv.ID].Status != models.ConversationOpen {
+		t.Errorf("expected conversation to be reopened, got %s", cs.conversations[conv.ID].Status)
+	}
+}
+
+// notification is a call to a channelNotifier.
+type notification struct {
+	conversationID int64
+	body           string
+	reply          bool
+}
+
+// channelNotifier reports notifications, which are sent in the background,
+// on a channel.
+type channelNotifier struct {
+	sent chan notification
+}
+
+func (n *channelNotifier) NotifyNewConversation(_ context.Context, _ *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	n.sent <- notification{conv.ID, msg.Body, false}
+	return nil
+}
+
+func (n *channelNotifier) NotifyReply(_ context.Context, _ *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	n.sent <- notification{conv.ID, msg.Body, true}
+	return nil
+}
+
+func (n *channelNotifier) next(t *testing.T) notification {
+	t.Helper()
+	select {
+	case got := <-n.sent:
+		return got
+	case <-time.After(time.Second):
+		t.Fatal("expected a notification")
+		return notification{}
+	}
+}
+
+func TestReceiveEmail_NotifiesReplies(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.mailboxes[1] = &models.Mailbox{ID: 1, UserID: 1, Name: "Support"}
+	notifier := &channelNotifier{sent: make(chan notification, 4)}
+	svc := NewService(cs, newMemOutbox(cs), ms, notifier, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, _ := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:   "Question",
+		Body:      "Need help",
+		MessageID: "<q1@test.com>",
+	})
+	if got := notifier.next(t); got.reply || got.conversationID != conv.ID {
+		t.Fatalf("expected a new conversation notification, got %+v", got)
+	}
+
+	// Out-of-office replies are not worth a notification.
+	_, _, _ = svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Body:       "I am away",
+		References: []string{"<q1@test.com>"},
+		Automated:  "auto-replied",
+	})
+	_, _, _ = svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Body:       "Still broken",
+		References: []string{"<q1@test.com>"},
+	})
+	if got := notifier.next(t); !got.reply || got.conversationID != conv.ID || got.body != "Still broken" {
+		t.Fatalf("expected a reply notification, got %+v", got)
+	}
+	select {
+	case got := <-notifier.sent:
+		t.Errorf("unexpected notification %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// failingNotifier fails every notification.
+type failingNotifier struct{ err error }
+
+func (n failingNotifier) NotifyNewConversation(context.Context, *models.Mailbox, *models.Conversation, *models.ConversationMessage) error {
+	return n.err
+}
+
+func (n failingNotifier) NotifyReply(context.Context, *models.Mailbox, *models.Conversation, *models.ConversationMessage) error {
+	return n.err
+}
+
+func TestNotifiers_NotifiesEachDespiteErrors(t *testing.T) {
+	boom := errors.New("webhook down")
+	first := &channelNotifier{sent: make(chan notification, 2)}
+	second := &channelNotifier{sent: make(chan notification, 2)}
+	n := Notifiers{first, failingNotifier{boom}, second}
+
+	conv := &models.Conversation{ID: 3}
+	msg := &models.ConversationMessage{Body: "hello"}
+	if err := n.NotifyNewConversation(context.Background(), &models.Mailbox{}, conv, msg); !errors.Is(err, boom) {
+		t.Errorf("expected the failure to be reported, got %v", err)
+	}
+	if err := n.NotifyReply(context.Background(), &models.Mailbox{}, conv, msg); !errors.Is(err, boom) {
+		t.Errorf("expected the failure to be reported, got %v", err)
+	}
+	for _, c := range []*channelNotifier{first, second} {
+		if got := c.next(t); got.reply || got.conversationID != 3 {
+			t.Errorf("expected a new conversation notification, got %+v", got)
+		}
+		if got := c.next(t); !got.reply {
+			t.Errorf("expected a reply notification, got %+v", got)
+		}
+	}
+}
+
+func TestReceiveEmail_ThreadsByReplyToken(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _ := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Need help", nil)
+
+	got, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Body:       "Reply without headers",
+		ReplyToken: ReplyToken(conv.PublicID),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got.ID != conv.ID {
+		t.Fatalf("expected reply token to match conversation %d, got %d", conv.ID, got.ID)
+	}
+}
+
+func TestReceiveEmail_ThreadsBySubjectTag(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _ := svc.StartConversation(context.Background(), stream, "Question", "alice@test.com", "Alice", "Need help", nil)
+
+	// The client dropped the threading headers and replied to the plain
+	// address, but kept the subject.
+	got, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject: "RE: Re: Question " + SubjectTag(conv.PublicID),
+		Body:    "Reply with only the subject",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got.ID != conv.ID {
+		t.Fatalf("expected subject tag to match conversation %d, got %d", conv.ID, got.ID)
+	}
+}
+
+func TestReceiveEmail_IgnoresThreadsInOtherMailboxes(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	other := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, _ := svc.ReceiveEmail(context.Background(), other, InboundEmail{
+		Subject:   "Question",
+		Body:      "Need help",
+		MessageID: "<q1@test.com>",
+	})
+
+	stream := &models.Stream{ID: 2, MailboxID: 2, Type: models.StreamTypeEmail, Enabled: true}
+	got, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:    "Re: Question",
+		Body:       "Hijack attempt",
+		InReplyTo:  []string{"<q1@test.com>"},
+		ReplyToken: ReplyToken(conv.PublicID),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got.ID == conv.ID {
+		t.Fatal("expected a new conversation for a reference outside the mailbox")
+	}
+	if got.MailboxID != 2 {
+		t.Errorf("expected mailbox 2, got %d", got.MailboxID)
+	}
+}
+
+func TestSplitReplyAddress(t *testing.T) {
+	id := uuid.New()
+	base, token, ok := SplitReplyAddress(ReplyAddress("support@example.com", id))
+	if !ok {
+		t.Fatal("expected reply address to be recognised")
+	}
+	if base != "support@example.com" {
+		t.Errorf("expected base support@example.com, got %s", base)
+	}
+	if got, _ := ParseReplyToken(token); got != id {
+		t.Errorf("expected token to round-trip to %s, got %s", id, got)
+	}
+
+	if _, _, ok := SplitReplyAddress("support+sales@example.com"); ok {
+		t.Error("expected ordinary sub-address not to be treated as a reply address")
+	}
+}
+
+func TestReceiveEmail_QuarantineStartsHeldConversation(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &recordingSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	original, _ := svc.StartConversation(context.Background(), stream, "Invoice", "billing@example.com", "Billing", "Hi", nil)
+	msgs := cs.messages[original.ID]
+	msgs[0].MessageID = "<invoice@example.com>"
+	cs.messages[original.ID] = msgs
+
+	conv, msg, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Re: Invoice",
+		SenderAddress: "billing@example.com",
+		Body:          "Please pay to this new account",
+		InReplyTo:     []string{"<invoice@example.com>"},
+		AuthResults:   "mx.example.com; spf=fail smtp.mailfrom=example.com",
+		AuthVerdict:   "fail",
+		Quarantine:    true,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if conv.ID == original.ID {
+		t.Fatal("expected quarantined email not to thread into the existing conversation")
+	}
+	if cs.conversations[conv.ID].Status != models.ConversationQuarantined {
+		t.Errorf("expected status quarantined, got %s", cs.conversations[conv.ID].Status)
+	}
+	if msg.AuthVerdict != "fail" || msg.AuthResults == "" {
+		t.Errorf("expected authentication results to be stored, got %q / %q", msg.AuthVerdict, msg.AuthResults)
+	}
+
+	if _, err := svc.Reply(context.Background(), conv.ID, "Sure", nil); !errors.Is(err, ErrConversationQuarantined) {
+		t.Errorf("expected ErrConversationQuarantined, got %v", err)
+	}
+
+	if err := svc.Release(context.Background(), conv.ID); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if cs.conversations[conv.ID].Status != models.ConversationOpen {
+		t.Errorf("expected released conversation to be open, got %s", cs.conversations[conv.ID].Status)
+	}
+}
+
+// stubSpamFilter flags messages whose subject contains "spam" and records
+// training calls.
+type stubSpamFilter struct {
+	trained  []bool
+	previous []string
+}
+
+func (f *stubSpamFilter) Check(_ context.Context, _ int64, msg spam.Message) spam.Verdict {
+	if strings.Contains(strings.ToLower(msg.Subject), "spam") {
+		return spam.Verdict{Score: 9, Hits: []spam.Hit{{Rule: "TEST", Score: 9}}, Spam: true}
+	}
+	return spam.Verdict{}
+}
+
+func (f *stubSpamFilter) Train(_ context.Context, _ int64, _ spam.Message, isSpam bool, previous string) error {
+	f.trained = append(f.trained, isSpam)
+	f.previous = append(f.previous, previous)
+	return nil
+}
+
+func TestStartConversation_SpamGoesToSpamFolder(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, UserID: 7, Name: "Support"})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &stubSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeForm, Enabled: true}
+	conv, err := svc.StartConversation(context.Background(), stream, "Buy spam now", "bot@example.com", "Bot", "Cheap", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cs.conversations[conv.ID].Status != models.ConversationSpam {
+		t.Errorf("expected status spam, got %s", cs.conversations[conv.ID].Status)
+	}
+	msg := cs.messages[conv.ID][0]
+	if msg.SpamScore != 9 || msg.SpamRules != "TEST=9.0" {
+		t.Errorf("expected spam score to be recorded, got %.1f %q", msg.SpamScore, msg.SpamRules)
+	}
+
+	spamConvs, _ := svc.ListSpam(context.Background(), 1, 50, 0)
+	if len(spamConvs) != 1 {
+		t.Errorf("expected 1 conversation in the spam folder, got %d", len(spamConvs))
+	}
+	if _, err := svc.Reply(context.Background(), conv.ID, "Hi", nil); !errors.Is(err, ErrConversationSpam) {
+		t.Errorf("expected ErrConversationSpam, got %v", err)
+	}
+}
+
+func TestReceiveEmail_SpamCheckSkipsReplies(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, UserID: 7, Name: "Support"})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &stubSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	original, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "About the spam filter",
+		SenderAddress: "alice@example.com",
+		Body:          "It flags my mail",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if original.Status != models.ConversationSpam {
+		t.Fatalf("expected new conversation in spam, got %s", original.Status)
+	}
+	if err := svc.MarkSpam(context.Background(), 7, original.ID, false); err != nil {
+		t.Fatalf("MarkSpam: %v", err)
+	}
+
+	token := ReplyToken(cs.conversations[original.ID].PublicID)
+	conv, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Re: About the spam filter",
+		SenderAddress: "alice@example.com",
+		Body:          "Thanks",
+		ReplyToken:    token,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if conv.ID != original.ID {
+		t.Error("expected the reply to thread without a spam check")
+	}
+}
+
+func TestMarkSpam_TrainsAndMoves(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, UserID: 7, Name: "Support"})
+	filter := &stubSpamFilter{}
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, filter, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeForm, Enabled: true}
+	conv, _ := svc.StartConversation(context.Background(), stream, "Hello", "bot@example.com", "Bot", "Cheap pills", nil)
+
+	if err := svc.MarkSpam(context.Background(), 7, conv.ID, true); err != nil {
+		t.Fatalf("MarkSpam: %v", err)
+	}
+	got := cs.conversations[conv.ID]
+	if got.Status != models.ConversationSpam || got.SpamLabel != spam.LabelSpam {
+		t.Errorf("expected spam/spam, got %s/%s", got.Status, got.SpamLabel)
+	}
+
+	if err := svc.MarkSpam(context.Background(), 7, conv.ID, false); err != nil {
+		t.Fatalf("MarkSpam: %v", err)
+	}
+	got = cs.conversations[conv.ID]
+	if got.Status != models.ConversationOpen || got.SpamLabel != spam.LabelHam {
+		t.Errorf("expected open/ham, got %s/%s", got.Status, got.SpamLabel)
+	}
+
+	if len(filter.trained) != 2 || !filter.trained[0] || filter.trained[1] {
+		t.Fatalf("expected training spam then ham, got %v", filter.trained)
+	}
+	if filter.previous[0] != "" || filter.previous[1] != spam.LabelSpam {
+		t.Errorf("expected previous labels \"\" then spam, got %q", filter.previous)
+	}
+}
+
+// stubFilter returns the same result for every message and records what it
+// was asked about.
+type stubFilter struct {
+	result filter.Result
+	seen   []filter.Message
+}
+
+func (f *stubFilter) Apply(_ context.Context, _ int64, msg filter.Message) (filter.Result, error) {
+	f.seen = append(f.seen, msg)
+	return f.result, nil
+}
+
+func TestStartConversation_FilterDiscardStillForwards(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	sender := &recordingSender{}
+	rules := &stubFilter{result: filter.Result{Discard: true, Forward: []string{"boss@example.com"}}}
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, rules)
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeForm, Enabled: true}
+	_, err := svc.StartConversation(context.Background(), stream, "Hello", "alice@example.com", "Alice", "Hi there", nil)
+	if !errors.Is(err, ErrDiscarded) {
+		t.Fatalf("expected ErrDiscarded, got %v", err)
+	}
+	if len(cs.conversations) != 0 {
+		t.Errorf("expected no conversation, got %d", len(cs.conversations))
+	}
+	deliverQueued(svc)
+	if len(sender.calls) != 1 || sender.calls[0].to != "boss@example.com" || sender.calls[0].replyTo != "alice@example.com" {
+		t.Fatalf("expected a forward to boss@example.com replying to the sender, got %+v", sender.calls)
+	}
+	if sender.calls[0].subject != "Fwd: Hello" || !strings.Contains(sender.calls[0].body, "Hi there") {
+		t.Errorf("unexpected forward %+v", sender.calls[0])
+	}
+	if rules.seen[0].StreamType != models.StreamTypeForm || rules.seen[0].Sender != "alice@example.com" {
+		t.Errorf("unexpected filter input %+v", rules.seen[0])
+	}
+}
+
+func TestReceiveEmail_FilterTagsClosesAndAutoReplies(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	sender := &recordingSender{}
+	rules := &stubFilter{result: filter.Result{
+		Status:    models.ConversationClosed,
+		Tags:      []string{"newsletter"},
+		AutoReply: "Thanks, we got it.",
+	}}
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, rules)
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Weekly news",
+		SenderAddress: "news@example.org",
+		Body:          "This week...",
+		Recipient:     "support@example.com",
+		Header:        mail.Header{"List-Id": {"<news.example.org>"}},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	got := cs.conversations[conv.ID]
+	if got.Status != models.ConversationClosed {
+		t.Errorf("expected status closed, got %s", got.Status)
+	}
+	if len(got.Tags) != 1 || got.Tags[0] != "newsletter" {
+		t.Errorf("expected tag newsletter, got %v", got.Tags)
+	}
+	deliverQueued(svc)
+	if len(sender.calls) != 1 || sender.calls[0].to != "news@example.org" || sender.calls[0].body != "Thanks, we got it." {
+		t.Fatalf("expected auto-reply to the sender, got %+v", sender.calls)
+	}
+	if sender.calls[0].autoSubmitted != "auto-replied" {
+		t.Errorf("expected auto-reply to be marked auto-replied, got %q", sender.calls[0].autoSubmitted)
+	}
+	if msgs := cs.messages[conv.ID]; len(msgs) != 2 || msgs[1].Direction != models.MessageOutbound {
+		t.Errorf("expected the auto-reply to be recorded, got %d messages", len(msgs))
+	}
+	if rules.seen[0].Header.Get("List-Id") == "" || rules.seen[0].Recipient != "support@example.com" {
+		t.Errorf("expected header and recipient to reach the rules, got %+v", rules.seen[0])
+	}
+}
+
+func TestReceiveEmail_FilterMovesToOwnMailboxOnly(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, PublicID: uuid.New(), UserID: 7, Name: "Support"})
+	billing := &models.Mailbox{ID: 2, PublicID: uuid.New(), UserID: 7, Name: "Billing"}
+	foreign := &models.Mailbox{ID: 3, PublicID: uuid.New(), UserID: 8, Name: "Theirs"}
+	ms.addMailbox(billing)
+	ms.addMailbox(foreign)
+	rules := &stubFilter{}
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &NoopSender{}, &NoopSpamFilter{}, rules)
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	email := InboundEmail{Subject: "Invoice", SenderAddress: "vendor@example.org", Body: "Attached"}
+
+	rules.result = filter.Result{MoveTo: billing.PublicID}
+	conv, _, err := svc.ReceiveEmail(context.Background(), stream, email)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if conv.MailboxID != billing.ID || conv.StreamID != stream.ID {
+		t.Errorf("expected conversation in mailbox %d on stream %d, got %d/%d", billing.ID, stream.ID, conv.MailboxID, conv.StreamID)
+	}
+
+	// A reply to the moved conversation still threads through the stream.
+	reply := email
+	reply.ReplyToken = ReplyToken(cs.conversations[conv.ID].PublicID)
+	rules.result = filter.Result{}
+	threaded, _, err := svc.ReceiveEmail(context.Background(), stream, reply)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if threaded.ID != conv.ID {
+		t.Error("expected the reply to thread into the moved conversation")
+	}
+
+	rules.result = filter.Result{MoveTo: foreign.PublicID}
+	conv, _, err = svc.ReceiveEmail(context.Background(), stream, email)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if conv.MailboxID != 1 {
+		t.Errorf("expected move to another user's mailbox to be ignored, got mailbox %d", conv.MailboxID)
+	}
+}
+
+func TestReceiveEmail_AutomatedMailIsNeverAnswered(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	sender := &recordingSender{}
+	rules := &stubFilter{result: filter.Result{AutoReply: "Thanks, we got it."}}
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, sender, &NoopSpamFilter{}, rules)
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, msg, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Out of office",
+		SenderAddress: "alice@example.org",
+		Body:          "I am away until Monday.",
+		MessageID:     "<ooo@example.org>",
+		Automated:     models.AutomatedAutoReply,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	deliverQueued(svc)
+	if len(sender.calls) != 0 {
+		t.Errorf("expected no auto-reply to automated mail, got %+v", sender.calls)
+	}
+	if msg.Automated != models.AutomatedAutoReply {
+		t.Errorf("expected message to be marked automated, got %q", msg.Automated)
+	}
+
+	_ = svc.Close(context.Background(), conv.ID)
+	if _, _, err := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Body:       "Still away.",
+		References: []string{"<ooo@example.org>"},
+		Automated:  models.AutomatedAutoReply,
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cs.conversations[conv.ID].Status != models.ConversationClosed {
+		t.Errorf("expected automated follow-up not to reopen the conversation, got %s", cs.conversations[conv.ID].Status)
+	}
+}
+
+func TestRecordBounce(t *testing.T) {
+	cs := newMockConversationStore()
+	ms := newMockMailboxStoreForConv()
+	ms.addMailbox(&models.Mailbox{ID: 1, Name: "Support", FromAddress: "support@example.com"})
+	svc := NewService(cs, newMemOutbox(cs), ms, &NoopNotifier{}, &recordingSender{}, &NoopSpamFilter{}, &NoopFilter{})
+
+	stream := &models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	conv, _, _ := svc.ReceiveEmail(context.Background(), stream, InboundEmail{
+		Subject:       "Question",
+		SenderAddress: "bob@example.org",
+		Body:          "Hello",
+	})
+	reply, err := svc.Reply(context.Background(), conv.ID, "Hi Bob", nil)
+	if err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+
+	found, err := svc.RecordBounce(context.Background(), 2, reply.MessageID, "5.1.1")
+	if err != nil || found {
+		t.Errorf("expected bounce in another mailbox not to match, got %v, %v", found, err)
+	}
+	found, err = svc.RecordBounce(context.Background(), 1, reply.MessageID, "5.1.1")
+	if err != nil || !found {
+		t.Fatalf("expected bounce to match the reply, got %v, %v", found, err)
+	}
+	if got := cs.messages[conv.ID][1]; got.BouncedAt == nil || got.BounceReason != "5.1.1" {
+		t.Errorf("expected reply to be marked bounced, got %+v", got)
+	}
+}
@@ -0,0 +1,87 @@
+package conversation
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ReplyToken returns the token that identifies a conversation in reply
+// addresses. It is the conversation's public ID without dashes.
+func ReplyToken(conversationID uuid.UUID) string {
+	return strings.ReplaceAll(conversationID.String(), "-", "")
+}
+
+// ParseReplyToken converts a reply token back into a conversation public ID.
+func ParseReplyToken(token string) (uuid.UUID, bool) {
+	token = strings.ToLower(strings.TrimSpace(token))
+	if len(token) != 32 {
+		return uuid.Nil, false
+	}
+	id, err := uuid.Parse(token)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// ReplyAddress returns a sub-address of fromAddress that carries the reply
+// token, e.g. support+<token>@example.com. Replies sent to it can be matched
+// to the conversation even when the client drops the threading headers.
+func ReplyAddress(fromAddress string, conversationID uuid.UUID) string {
+	at := strings.LastIndex(fromAddress, "@")
+	if at < 1 {
+		return ""
+	}
+	return fromAddress[:at] + "+" + ReplyToken(conversationID) + fromAddress[at:]
+}
+
+// SplitReplyAddress reverses ReplyAddress. It returns the base address and
+// the reply token, or ok=false if addr does not carry a valid token.
+func SplitReplyAddress(addr string) (base, token string, ok bool) {
+	at := strings.LastIndex(addr, "@")
+	if at < 1 {
+		return "", "", false
+	}
+	local, domain := addr[:at], addr[at:]
+	plus := strings.LastIndex(local, "+")
+	if plus < 1 {
+		return "", "", false
+	}
+	token = local[plus+1:]
+	if _, valid := ParseReplyToken(token); !valid {
+		return "", "", false
+	}
+	return local[:plus] + domain, token, true
+}
+
+// subjectTagRe matches the tag SubjectTag puts in a subject.
+var subjectTagRe = regexp.MustCompile(`\[#([0-9A-Fa-f]{32})\]`)
+
+// SubjectTag returns the tag that carries the reply token in the subject of
+// outbound mail, e.g. "[#<token>]". Replies keep the subject, so the tag
+// still matches them to the conversation when the client drops both the
+// threading headers and the reply address.
+func SubjectTag(conversationID uuid.UUID) string {
+	return "[#" + ReplyToken(conversationID) + "]"
+}
+
+// SubjectToken returns the reply token in a subject's tag, or "" if it has
+// none.
+func SubjectToken(subject string) string {
+	if m := subjectTagRe.FindStringSubmatch(subject); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// tagSubject appends the conversation's tag to subject unless it is
+// already there.
+func tagSubject(subject string, conversationID uuid.UUID) string {
+	tag := SubjectTag(conversationID)
+	if strings.Contains(strings.ToLower(subject), tag) {
+		return subject
+	}
+	return strings.TrimSpace(subject + " " + tag)
+}
@@ -0,0 +1,213 @@
+package domain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// Every verified domain has a DKIM key pair, one RSA and one Ed25519 key,
+// that outbound mail from it is signed with. A new pair starts out pending
+// and is activated once its TXT records are found in DNS. Rotating adds a
+// new pending pair while the current one keeps signing, so mail is never
+// signed with a key receivers cannot look up. Activating the new pair
+// retires the old one, whose records should stay published until mail
+// signed with it has been delivered.
+
+// ErrDKIMRotationPending is returned when rotating the DKIM keys of a domain
+// that already has a new pair waiting for its DNS records.
+var ErrDKIMRotationPending = errors.New("the new DKIM keys are still waiting for their DNS records")
+
+// ErrDKIMKeyNotRetired is returned when removing a DKIM key that is not
+// retired.
+var ErrDKIMKeyNotRetired = errors.New("only retired DKIM keys can be removed")
+
+const rsaKeyBits = 2048
+
+// DKIMHost returns the name the key's TXT record is published under.
+func DKIMHost(d *models.Domain, k models.DKIMKey) string {
+	return k.Selector + "._domainkey." + d.Name
+}
+
+// DKIMRecord returns the TXT record that publishes the key.
+func DKIMRecord(k models.DKIMKey) string {
+	return "v=DKIM1; k=" + dkimKeyType(k.Algorithm) + "; p=" + k.PublicKey
+}
+
+func dkimKeyType(algorithm string) string {
+	if algorithm == "ed25519-sha256" {
+		return "ed25519"
+	}
+	return "rsa"
+}
+
+// generateDKIMKeys returns a new pending key pair for the domain. The
+// selectors carry the date they were created on and a random suffix, so
+// that rotated pairs never reuse a selector.
+func generateDKIMKeys(domainID int64, now time.Time) ([]models.DKIMKey, error) {
+	var suffix [3]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return nil, err
+	}
+	selector := fmt.Sprintf("dd%s%x", now.UTC().Format("20060102"), suffix)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []models.DKIMKey{
+		{Selector: selector + "-rsa", Algorithm: "rsa-sha256", PublicKey: base64.StdEncoding.EncodeToString(rsaPublic)},
+		// Ed25519 records publish the raw key (RFC 8463).
+		{Selector: selector + "-ed25519", Algorithm: "ed25519-sha256", PublicKey: base64.StdEncoding.EncodeToString(edPublic)},
+	}
+	for i, private := range []any{rsaKey, edKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		keys[i].DomainID = domainID
+		keys[i].PrivateKey = der
+		keys[i].Status = models.DKIMPending
+	}
+	return keys, nil
+}
+
+func (s *Service) createDKIMKeys(ctx context.Context, domainID int64) ([]models.DKIMKey, error) {
+	keys, err := generateDKIMKeys(domainID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("generate dkim keys: %w", err)
+	}
+	for i := range keys {
+		if err := s.keys.CreateDKIMKey(ctx, &keys[i]); err != nil {
+			return nil, fmt.Errorf("create dkim key: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+// DKIMKeys returns the DKIM keys of the domain, newest first. A verified
+// domain without keys gets its first pair.
+func (s *Service) DKIMKeys(ctx context.Context, d *models.Domain) ([]models.DKIMKey, error) {
+	keys, err := s.keys.GetDKIMKeysByDomainID(ctx, d.ID)
+	if err != nil {
+		return nil, fmt.Errorf("list dkim keys: %w", err)
+	}
+	if len(keys) == 0 && d.Verified {
+		return s.createDKIMKeys(ctx, d.ID)
+	}
+	return keys, nil
+}
+
+// RotateDKIM adds a new pending key pair to the domain. The active pair
+// keeps signing until the new records are found by CheckDKIM.
+func (s *Service) RotateDKIM(ctx context.Context, d *models.Domain) error {
+	keys, err := s.keys.GetDKIMKeysByDomainID(ctx, d.ID)
+	if err != nil {
+		return fmt.Errorf("list dkim keys: %w", err)
+	}
+	for _, k := range keys {
+		if k.Status == models.DKIMPending {
+			return ErrDKIMRotationPending
+		}
+	}
+	_, err = s.createDKIMKeys(ctx, d.ID)
+	return err
+}
+
+// CheckDKIM looks up the TXT records of the domain's pending and active
+// keys. Pending keys whose record is published become active, retiring the
+// key of the same algorithm they replace. It returns an error naming the
+// records that were not found.
+func (s *Service) CheckDKIM(ctx context.Context, d *models.Domain) error {
+	keys, err := s.keys.GetDKIMKeysByDomainID(ctx, d.ID)
+	if err != nil {
+		return fmt.Errorf("list dkim keys: %w", err)
+	}
+
+	// Keys are newest first, so a key replaced by a pending key that is
+	// activated here comes after it.
+	var missing []string
+	replaced := make(map[string]bool)
+	for _, k := range keys {
+		if k.Status == models.DKIMRetired || replaced[k.Algorithm] {
+			continue
+		}
+		host := DKIMHost(d, k)
+		if !s.dkimPublished(host, k) {
+			missing = append(missing, host)
+			continue
+		}
+		if err := s.keys.MarkDKIMKeyVerified(ctx, k.ID); err != nil {
+			return fmt.Errorf("mark dkim key verified: %w", err)
+		}
+		if k.Status == models.DKIMPending {
+			if err := s.keys.ActivateDKIMKey(ctx, d.ID, k.ID); err != nil {
+				return fmt.Errorf("activate dkim key: %w", err)
+			}
+			replaced[k.Algorithm] = true
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("DKIM TXT record not found for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// dkimPublished reports whether host has a DKIM record with the key's
+// public key.
+func (s *Service) dkimPublished(host string, k models.DKIMKey) bool {
+	records, err := s.resolver.LookupTXT(host)
+	if err != nil {
+		return false
+	}
+	for _, record := range records {
+		var version, public string
+		for _, tag := range strings.Split(record, ";") {
+			name, value, _ := strings.Cut(tag, "=")
+			switch strings.TrimSpace(name) {
+			case "v":
+				version = strings.TrimSpace(value)
+			case "p":
+				// Long records are split into strings that some providers
+				// join with whitespace.
+				public = strings.Join(strings.Fields(value), "")
+			}
+		}
+		if (version == "" || version == "DKIM1") && public == k.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteDKIMKey removes a retired key of the domain. Its TXT record can be
+// removed from DNS afterwards.
+func (s *Service) DeleteDKIMKey(ctx context.Context, d *models.Domain, keyID int64) error {
+	err := s.keys.DeleteRetiredDKIMKey(ctx, d.ID, keyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDKIMKeyNotRetired
+	}
+	if err != nil {
+		return fmt.Errorf("delete dkim key: %w", err)
+	}
+	return nil
+}
@@ -10,8 +10,12 @@ import (
 )
 
 // DNSResolver abstracts DNS lookups so they can be replaced in tests.
+// Besides TXT records for domain verification it provides the address and
+// MX lookups needed to evaluate SPF for inbound mail.
 type DNSResolver interface {
 	LookupTXT(host string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(host string) ([]*net.MX, error)
 }
 
 // NetResolver implements DNSResolver using the standard library.
@@ -34,10 +38,15 @@ func (r *NetResolver) LookupTXT(host string) ([]string, error) {
 	seen := make(map[string]struct{})
 	results := make([]string, 0, 4)
 	var errs []string
+	notFound := 0
 
 	for _, source := range sources {
 		records, err := source(host)
 		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				notFound++
+			}
 			errs = append(errs, err.Error())
 			continue
 		}
@@ -57,6 +66,11 @@ func (r *NetResolver) LookupTXT(host string) ([]string, error) {
 	if len(results) > 0 {
 		return results, nil
 	}
+	if notFound > 0 && notFound == len(errs) {
+		// Keep NXDOMAIN distinguishable from lookup failures for callers
+		// that treat a missing record differently, like SPF and DMARC.
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
 	if len(errs) > 0 {
 		return nil, fmt.Errorf("txt lookup failed: %s", strings.Join(errs, "; "))
 	}
@@ -64,6 +78,14 @@ func (r *NetResolver) LookupTXT(host string) ([]string, error) {
 	return nil, nil
 }
 
+func (r *NetResolver) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+func (r *NetResolver) LookupMX(host string) ([]*net.MX, error) {
+	return net.LookupMX(host)
+}
+
 func lookupTXTWithResolver(host, resolverAddr string) ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
 	defer cancel()
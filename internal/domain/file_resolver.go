@@ -2,13 +2,22 @@ package domain
 
 import (
 	"bufio"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
-// FileResolver reads DNS TXT overrides from a file. Each line is
-// "domain=value". The file is re-read on every LookupTXT call so
-// records can be added at runtime (e.g., by e2e test scripts).
+// FileResolver reads DNS overrides from a file. Each line is "domain=value"
+// for a TXT record, or "TYPE:domain=value" for another record type:
+//
+//	example.com=v=spf1 mx -all
+//	A:mail.example.com=192.0.2.10
+//	AAAA:mail.example.com=2001:db8::10
+//	MX:example.com=10 mail.example.com
+//
+// The file is re-read on every lookup so records can be added at runtime
+// (e.g., by e2e test scripts).
 type FileResolver struct {
 	path string
 }
@@ -23,6 +32,53 @@ func NewFileResolver(path string) (*FileResolver, error) {
 
 // LookupTXT returns all TXT record values for the given host.
 func (r *FileResolver) LookupTXT(host string) ([]string, error) {
+	return r.lookup("TXT", host)
+}
+
+// LookupIP returns the A and AAAA records for the given host.
+func (r *FileResolver) LookupIP(host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, typ := range []string{"A", "AAAA"} {
+		values, err := r.lookup(typ, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if ip := net.ParseIP(v); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// LookupMX returns the MX records for the given host. Values are
+// "preference host"; a missing preference defaults to 0.
+func (r *FileResolver) LookupMX(host string) ([]*net.MX, error) {
+	values, err := r.lookup("MX", host)
+	if err != nil {
+		return nil, err
+	}
+	mxs := make([]*net.MX, 0, len(values))
+	for _, v := range values {
+		fields := strings.Fields(v)
+		mx := &net.MX{}
+		switch len(fields) {
+		case 1:
+			mx.Host = fields[0]
+		case 2:
+			pref, _ := strconv.Atoi(fields[0])
+			mx.Pref = uint16(pref)
+			mx.Host = fields[1]
+		default:
+			continue
+		}
+		mxs = append(mxs, mx)
+	}
+	return mxs, nil
+}
+
+func (r *FileResolver) lookup(typ, host string) ([]string, error) {
 	f, err := os.Open(r.path)
 	if err != nil {
 		return nil, err
@@ -37,7 +93,14 @@ func (r *FileResolver) LookupTXT(host string) ([]string, error) {
 			continue
 		}
 		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 && parts[0] == host {
+		if len(parts) != 2 {
+			continue
+		}
+		lineType, name := "TXT", parts[0]
+		if t, n, ok := strings.Cut(parts[0], ":"); ok {
+			lineType, name = strings.ToUpper(t), n
+		}
+		if lineType == typ && strings.EqualFold(name, host) {
 			records = append(records, parts[1])
 		}
 	}
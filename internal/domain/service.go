@@ -14,13 +14,15 @@ import (
 // Service contains the business logic for domain management.
 type Service struct {
 	domains  store.DomainStore
+	keys     store.DKIMKeyStore
 	resolver DNSResolver
 }
 
 // NewService creates a new domain Service.
-func NewService(domains store.DomainStore, resolver DNSResolver) *Service {
+func NewService(domains store.DomainStore, keys store.DKIMKeyStore, resolver DNSResolver) *Service {
 	return &Service{
 		domains:  domains,
+		keys:     keys,
 		resolver: resolver,
 	}
 }
@@ -63,7 +65,7 @@ func (s *Service) GetByPublicID(ctx context.Context, publicID uuid.UUID) (*model
 
 // Verify performs a DNS TXT lookup on the domain name and checks for a record
 // matching "deaddrop-verify=<token>". If found the domain is marked as verified
-// in the store.
+// in the store and gets its first DKIM key pair.
 func (s *Service) Verify(ctx context.Context, d *models.Domain) error {
 	records, err := s.resolver.LookupTXT(d.Name)
 	if err != nil {
@@ -77,13 +79,31 @@ func (s *Service) Verify(ctx context.Context, d *models.Domain) error {
 			if err := s.domains.MarkDomainVerified(ctx, d.ID); err != nil {
 				return fmt.Errorf("mark domain verified: %w", err)
 			}
-			return nil
+			d.Verified = true
+			_, err := s.DKIMKeys(ctx, d)
+			return err
 		}
 	}
 
 	return fmt.Errorf("verification TXT record not found for %s", d.Name)
 }
 
+// SetOutboundTransport sets how mail from the domain is delivered: through
+// the relay, directly to the recipient's MX hosts, or as the server is
+// configured.
+func (s *Service) SetOutboundTransport(ctx context.Context, d *models.Domain, transport models.OutboundTransport) error {
+	switch transport {
+	case models.TransportDefault, models.TransportRelay, models.TransportDirect:
+	default:
+		return fmt.Errorf("unknown outbound transport %q", transport)
+	}
+	if err := s.domains.SetOutboundTransport(ctx, d.ID, transport); err != nil {
+		return fmt.Errorf("set outbound transport: %w", err)
+	}
+	d.OutboundTransport = transport
+	return nil
+}
+
 // Delete removes a domain by its internal ID.
 func (s *Service) Delete(ctx context.Context, domainID int64) error {
 	if err := s.domains.DeleteDomain(ctx, domainID); err != nil {
@@ -2,8 +2,11 @@ package domain
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -91,6 +94,23 @@ func (m *mockDomainStore) MarkDomainVerified(_ context.Context, id int64) error
 	return nil
 }
 
+func (m *mockDomainStore) SetOutboundTransport(_ context.Context, id int64, transport models.OutboundTransport) error {
+	d, ok := m.domains[id]
+	if !ok {
+		return errors.New("domain not found")
+	}
+	d.OutboundTransport = transport
+	return nil
+}
+
+func (m *mockDomainStore) GetOutboundTransportByName(_ context.Context, name string) (models.OutboundTransport, error) {
+	d, ok := m.byName[name]
+	if !ok || !d.Verified {
+		return "", sql.ErrNoRows
+	}
+	return d.OutboundTransport, nil
+}
+
 func (m *mockDomainStore) DeleteDomain(_ context.Context, id int64) error {
 	d, ok := m.domains[id]
 	if !ok {
@@ -102,6 +122,85 @@ func (m *mockDomainStore) DeleteDomain(_ context.Context, id int64) error {
 	return nil
 }
 
+type mockDKIMKeyStore struct {
+	keys   []models.DKIMKey
+	nextID int64
+}
+
+func newMockDKIMKeyStore() *mockDKIMKeyStore {
+	return &mockDKIMKeyStore{nextID: 1}
+}
+
+func (m *mockDKIMKeyStore) CreateDKIMKey(_ context.Context, k *models.DKIMKey) error {
+	k.ID = m.nextID
+	k.CreatedAt = time.Now()
+	m.nextID++
+	m.keys = append(m.keys, *k)
+	return nil
+}
+
+func (m *mockDKIMKeyStore) GetDKIMKeysByDomainID(_ context.Context, domainID int64) ([]models.DKIMKey, error) {
+	var keys []models.DKIMKey
+	for i := len(m.keys) - 1; i >= 0; i-- {
+		if m.keys[i].DomainID == domainID {
+			keys = append(keys, m.keys[i])
+		}
+	}
+	return keys, nil
+}
+
+func (m *mockDKIMKeyStore) GetActiveDKIMKeysByDomainName(_ context.Context, _ string) ([]models.DKIMKey, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockDKIMKeyStore) MarkDKIMKeyVerified(_ context.Context, id int64) error {
+	for i := range m.keys {
+		if m.keys[i].ID == id {
+			now := time.Now()
+			m.keys[i].VerifiedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *mockDKIMKeyStore) ActivateDKIMKey(_ context.Context, domainID, id int64) error {
+	var algorithm string
+	for _, k := range m.keys {
+		if k.ID == id && k.DomainID == domainID {
+			algorithm = k.Algorithm
+		}
+	}
+	for i, k := range m.keys {
+		switch {
+		case k.ID == id && k.DomainID == domainID:
+			m.keys[i].Status = models.DKIMActive
+		case k.DomainID == domainID && k.Algorithm == algorithm && k.Status == models.DKIMActive:
+			m.keys[i].Status = models.DKIMRetired
+		}
+	}
+	return nil
+}
+
+func (m *mockDKIMKeyStore) DeleteRetiredDKIMKey(_ context.Context, domainID, id int64) error {
+	for i, k := range m.keys {
+		if k.ID == id && k.DomainID == domainID && k.Status == models.DKIMRetired {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// statuses returns the status of each key of the domain, newest first.
+func (m *mockDKIMKeyStore) statuses(domainID int64) []models.DKIMKeyStatus {
+	keys, _ := m.GetDKIMKeysByDomainID(context.Background(), domainID)
+	var statuses []models.DKIMKeyStatus
+	for _, k := range keys {
+		statuses = append(statuses, k.Status)
+	}
+	return statuses
+}
+
 // --- Mock DNS resolver ---
 
 type mockDNSResolver struct {
@@ -116,12 +215,20 @@ func (m *mockDNSResolver) LookupTXT(host string) ([]string, error) {
 	return m.records[host], nil
 }
 
+func (m *mockDNSResolver) LookupIP(_ string) ([]net.IP, error) {
+	return nil, nil
+}
+
+func (m *mockDNSResolver) LookupMX(_ string) ([]*net.MX, error) {
+	return nil, nil
+}
+
 // --- Tests ---
 
 func TestCreate_Success(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	d, err := svc.Create(context.Background(), 1, "example.com")
 	if err != nil {
@@ -144,7 +251,7 @@ func TestCreate_Success(t *testing.T) {
 func TestCreate_EmptyName(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	_, err := svc.Create(context.Background(), 1, "")
 	if err == nil {
@@ -155,7 +262,7 @@ func TestCreate_EmptyName(t *testing.T) {
 func TestCreate_WhitespaceName(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	_, err := svc.Create(context.Background(), 1, "   ")
 	if err == nil {
@@ -166,7 +273,7 @@ func TestCreate_WhitespaceName(t *testing.T) {
 func TestCreate_TrimsWhitespace(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	d, err := svc.Create(context.Background(), 1, "  example.com  ")
 	if err != nil {
@@ -180,7 +287,7 @@ func TestCreate_TrimsWhitespace(t *testing.T) {
 func TestList_ReturnsDomains(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	_, _ = svc.Create(context.Background(), 1, "a.com")
 	_, _ = svc.Create(context.Background(), 1, "b.com")
@@ -198,7 +305,7 @@ func TestList_ReturnsDomains(t *testing.T) {
 func TestGetByPublicID_Found(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	created, _ := svc.Create(context.Background(), 1, "example.com")
 
@@ -214,7 +321,7 @@ func TestGetByPublicID_Found(t *testing.T) {
 func TestGetByPublicID_NotFound(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	_, err := svc.GetByPublicID(context.Background(), uuid.New())
 	if err == nil {
@@ -227,7 +334,7 @@ func TestVerify_Success(t *testing.T) {
 	resolver := &mockDNSResolver{
 		records: map[string][]string{},
 	}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	d, _ := svc.Create(context.Background(), 1, "example.com")
 
@@ -255,7 +362,7 @@ func TestVerify_NoMatchingRecord(t *testing.T) {
 			"example.com": {"v=spf1 include:_spf.google.com ~all"},
 		},
 	}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	d, _ := svc.Create(context.Background(), 1, "example.com")
 
@@ -270,7 +377,7 @@ func TestVerify_DNSLookupError(t *testing.T) {
 	resolver := &mockDNSResolver{
 		err: errors.New("dns lookup failed"),
 	}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	d, _ := svc.Create(context.Background(), 1, "example.com")
 
@@ -283,7 +390,7 @@ func TestVerify_DNSLookupError(t *testing.T) {
 func TestDelete_Success(t *testing.T) {
 	store := newMockDomainStore()
 	resolver := &mockDNSResolver{}
-	svc := NewService(store, resolver)
+	svc := NewService(store, newMockDKIMKeyStore(), resolver)
 
 	d, _ := svc.Create(context.Background(), 1, "example.com")
 
@@ -332,6 +439,43 @@ func TestFileResolver_LookupTXT(t *testing.T) {
 	}
 }
 
+func TestFileResolver_TypedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns-overrides.txt")
+	content := "example.com=v=spf1 mx -all\n" +
+		"MX:example.com=10 mail.example.com\n" +
+		"A:mail.example.com=192.0.2.10\n" +
+		"AAAA:mail.example.com=2001:db8::10\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver, err := NewFileResolver(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txt, _ := resolver.LookupTXT("example.com")
+	if len(txt) != 1 || txt[0] != "v=spf1 mx -all" {
+		t.Errorf("expected only the TXT record, got %v", txt)
+	}
+
+	mxs, err := resolver.LookupMX("example.com")
+	if err != nil {
+		t.Fatalf("LookupMX: %v", err)
+	}
+	if len(mxs) != 1 || mxs[0].Host != "mail.example.com" || mxs[0].Pref != 10 {
+		t.Errorf("unexpected MX records %+v", mxs)
+	}
+
+	ips, err := resolver.LookupIP("mail.example.com")
+	if err != nil {
+		t.Fatalf("LookupIP: %v", err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.10")) || !ips[1].Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+}
+
 func TestFileResolver_ReloadsFile(t *testing.T) {
 	f, err := os.CreateTemp("", "dns-overrides-*.txt")
 	if err != nil {
@@ -357,3 +501,73 @@ func TestFileResolver_ReloadsFile(t *testing.T) {
 		t.Errorf("expected [deaddrop-verify=new-token], got %v", records)
 	}
 }
+
+func TestDKIM_RotationOverlapsKeys(t *testing.T) {
+	store := newMockDomainStore()
+	keys := newMockDKIMKeyStore()
+	resolver := &mockDNSResolver{records: map[string][]string{}}
+	svc := NewService(store, keys, resolver)
+	ctx := context.Background()
+
+	d, _ := svc.Create(ctx, 1, "example.com")
+	resolver.records["example.com"] = []string{"deaddrop-verify=" + d.VerificationToken}
+	if err := svc.Verify(ctx, d); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	first, _ := svc.DKIMKeys(ctx, d)
+	if len(first) != 2 || first[0].Status != models.DKIMPending || first[1].Status != models.DKIMPending {
+		t.Fatalf("expected verification to create a pending key pair, got %+v", first)
+	}
+
+	publish := func(keys []models.DKIMKey) {
+		for _, k := range keys {
+			// Split like a long record served as several strings.
+			record := DKIMRecord(k)
+			resolver.records[DKIMHost(d, k)] = []string{record[:40] + " " + record[40:]}
+		}
+	}
+
+	if err := svc.CheckDKIM(ctx, d); err == nil {
+		t.Fatal("expected CheckDKIM to fail before the records are published")
+	}
+	publish(first)
+	if err := svc.CheckDKIM(ctx, d); err != nil {
+		t.Fatalf("CheckDKIM: %v", err)
+	}
+	if got := keys.statuses(d.ID); len(got) != 2 || got[0] != models.DKIMActive || got[1] != models.DKIMActive {
+		t.Fatalf("expected the published pair to be active, got %v", got)
+	}
+
+	if err := svc.RotateDKIM(ctx, d); err != nil {
+		t.Fatalf("RotateDKIM: %v", err)
+	}
+	if err := svc.RotateDKIM(ctx, d); !errors.Is(err, ErrDKIMRotationPending) {
+		t.Fatalf("expected a second rotation to wait for the first, got %v", err)
+	}
+	all, _ := svc.DKIMKeys(ctx, d)
+	if err := svc.CheckDKIM(ctx, d); err == nil {
+		t.Fatal("expected CheckDKIM to report the unpublished new keys")
+	}
+	if got := keys.statuses(d.ID); got[0] != models.DKIMPending || got[2] != models.DKIMActive {
+		t.Fatalf("expected the old pair to keep signing until the new one is published, got %v", got)
+	}
+
+	publish(all[:2])
+	if err := svc.CheckDKIM(ctx, d); err != nil {
+		t.Fatalf("CheckDKIM: %v", err)
+	}
+	want := []models.DKIMKeyStatus{models.DKIMActive, models.DKIMActive, models.DKIMRetired, models.DKIMRetired}
+	if got := keys.statuses(d.ID); len(got) != 4 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+		t.Fatalf("expected the new pair to replace the old one, got %v", got)
+	}
+
+	if err := svc.DeleteDKIMKey(ctx, d, all[0].ID); !errors.Is(err, ErrDKIMKeyNotRetired) {
+		t.Fatalf("expected an active key not to be removable, got %v", err)
+	}
+	if err := svc.DeleteDKIMKey(ctx, d, all[3].ID); err != nil {
+		t.Fatalf("DeleteDKIMKey: %v", err)
+	}
+	if got := keys.statuses(d.ID); len(got) != 3 {
+		t.Errorf("expected the retired key to be removed, got %v", got)
+	}
+}
@@ -0,0 +1,187 @@
+// Package filter runs the user-defined rules of a mailbox against messages
+// that start a new conversation, in the spirit of Sieve: rules run in order,
+// each tests its conditions against the message and, if they match, adds its
+// actions to the result, and a rule can stop the ones after it.
+package filter
+
+import (
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// Message is what the rules test.
+type Message struct {
+	Sender     string // email address
+	Recipient  string // address an email was sent to; empty for forms
+	Subject    string
+	Body       string
+	Header     mail.Header // nil for form submissions
+	StreamType models.StreamType
+}
+
+// Result is the combined decision of the matching rules.
+type Result struct {
+	// Matched names the rules that matched, in order.
+	Matched []string
+
+	// Status is the status to file the conversation under; empty leaves
+	// it open.
+	Status models.ConversationStatus
+	Tags   []string
+	// Forward lists addresses to send a copy of the message to.
+	Forward []string
+	// AutoReply is the body of a reply to send to the sender.
+	AutoReply string
+	// MoveTo is the public ID of the mailbox to file the conversation in,
+	// or uuid.Nil to keep it in its own.
+	MoveTo uuid.UUID
+	// Discard drops the message. Forwards are still sent.
+	Discard bool
+}
+
+// Moved reports whether the rules move the conversation to another mailbox.
+func (r Result) Moved() bool {
+	return r.MoveTo != uuid.Nil
+}
+
+// Evaluate runs the enabled rules against msg in order.
+func Evaluate(rules []models.FilterRule, msg Message) Result {
+	var res Result
+	for _, rule := range rules {
+		if !rule.Enabled || !Matches(rule, msg) {
+			continue
+		}
+		res.Matched = append(res.Matched, rule.Name)
+		for _, a := range rule.Actions {
+			res.apply(a)
+		}
+		if rule.Stop {
+			break
+		}
+	}
+	return res
+}
+
+// apply adds an action to the result. Later rules override the status,
+// auto-reply and target mailbox set by earlier ones.
+func (r *Result) apply(a models.FilterAction) {
+	switch a.Type {
+	case models.FilterSetStatus:
+		r.Status = models.ConversationStatus(a.Value)
+	case models.FilterTag:
+		r.Tags = appendUnique(r.Tags, a.Value)
+	case models.FilterForward:
+		r.Forward = appendUnique(r.Forward, a.Value)
+	case models.FilterAutoReply:
+		r.AutoReply = a.Value
+	case models.FilterMove:
+		if id, err := uuid.Parse(a.Value); err == nil {
+			r.MoveTo = id
+		}
+	case models.FilterDiscard:
+		r.Discard = true
+	}
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// Matches reports whether msg meets the rule's conditions. A rule without
+// conditions matches every message.
+func Matches(rule models.FilterRule, msg Message) bool {
+	if len(rule.Conditions) == 0 {
+		return true
+	}
+	for _, c := range rule.Conditions {
+		ok := matchCondition(c, msg)
+		if ok && !rule.MatchAll {
+			return true
+		}
+		if !ok && rule.MatchAll {
+			return false
+		}
+	}
+	return rule.MatchAll
+}
+
+func matchCondition(c models.FilterCondition, msg Message) bool {
+	matched := false
+	for _, v := range fieldValues(c, msg) {
+		if compare(c.Op, v, c.Value) {
+			matched = true
+			break
+		}
+	}
+	return matched != c.Not
+}
+
+// fieldValues returns the values of the tested field. A header may appear
+// more than once; the condition holds if any occurrence matches. A missing
+// header is tested as the empty string.
+func fieldValues(c models.FilterCondition, msg Message) []string {
+	switch c.Field {
+	case models.FilterSender:
+		return []string{msg.Sender}
+	case models.FilterRecipient:
+		return []string{msg.Recipient}
+	case models.FilterSubject:
+		return []string{msg.Subject}
+	case models.FilterBody:
+		return []string{msg.Body}
+	case models.FilterStreamType:
+		return []string{string(msg.StreamType)}
+	case models.FilterHeader:
+		if values := msg.Header[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(c.Header))]; len(values) > 0 {
+			return values
+		}
+		return []string{""}
+	}
+	return nil
+}
+
+// compare tests value against pattern. Like Sieve's default comparator, all
+// operators ignore case.
+func compare(op models.FilterOp, value, pattern string) bool {
+	switch op {
+	case models.FilterIs:
+		return strings.EqualFold(strings.TrimSpace(value), strings.TrimSpace(pattern))
+	case models.FilterContains:
+		return strings.Contains(strings.ToLower(value), strings.ToLower(pattern))
+	case models.FilterMatches:
+		return wildcard(pattern).MatchString(value)
+	case models.FilterRegex:
+		re, err := regexp.Compile("(?i)" + pattern)
+		return err == nil && re.MatchString(value)
+	}
+	return false
+}
+
+// wildcard compiles a Sieve :matches pattern, where * matches any run of
+// characters and ? any single one, into an anchored regular expression.
+func wildcard(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,295 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// --- Mock stores ---
+
+type mockRuleStore struct {
+	rules  []models.FilterRule
+	nextID int64
+}
+
+func (m *mockRuleStore) CreateFilterRule(_ context.Context, rule *models.FilterRule) error {
+	m.nextID++
+	rule.ID = m.nextID
+	rule.Position = len(m.rules) + 1
+	m.rules = append(m.rules, *rule)
+	return nil
+}
+
+func (m *mockRuleStore) GetFilterRulesByMailboxID(_ context.Context, mailboxID int64) ([]models.FilterRule, error) {
+	var out []models.FilterRule
+	for _, r := range m.rules {
+		if r.MailboxID == mailboxID {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (m *mockRuleStore) UpdateFilterRuleEnabled(_ context.Context, id int64, enabled bool) error {
+	for i := range m.rules {
+		if m.rules[i].ID == id {
+			m.rules[i].Enabled = enabled
+		}
+	}
+	return nil
+}
+
+func (m *mockRuleStore) ReorderFilterRules(_ context.Context, _ int64, ids []int64) error {
+	byID := make(map[int64]models.FilterRule)
+	for _, r := range m.rules {
+		byID[r.ID] = r
+	}
+	m.rules = m.rules[:0]
+	for i, id := range ids {
+		r := byID[id]
+		r.Position = i + 1
+		m.rules = append(m.rules, r)
+	}
+	return nil
+}
+
+func (m *mockRuleStore) DeleteFilterRule(_ context.Context, id int64) error {
+	for i := range m.rules {
+		if m.rules[i].ID == id {
+			m.rules = append(m.rules[:i], m.rules[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+type mockMailboxStore struct {
+	mailboxes []*models.Mailbox
+}
+
+func (m *mockMailboxStore) CreateMailbox(_ context.Context, _, _ int64, _, _ string) (*models.Mailbox, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockMailboxStore) GetMailboxesByUserID(_ context.Context, _ int64) ([]models.Mailbox, error) {
+	return nil, nil
+}
+
+func (m *mockMailboxStore) GetMailboxByID(_ context.Context, id int64) (*models.Mailbox, error) {
+	for _, mb := range m.mailboxes {
+		if mb.ID == id {
+			return mb, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (m *mockMailboxStore) GetMailboxByPublicID(_ context.Context, publicID uuid.UUID) (*models.Mailbox, error) {
+	for _, mb := range m.mailboxes {
+		if mb.PublicID == publicID {
+			return mb, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (m *mockMailboxStore) DeleteMailbox(_ context.Context, _ int64) error {
+	return nil
+}
+
+// --- Evaluate ---
+
+func TestMatches_Conditions(t *testing.T) {
+	msg := Message{
+		Sender:     "Billing@Vendor.example",
+		Recipient:  "invoices@example.com",
+		Subject:    "Invoice #42 for March",
+		Body:       "Please find attached.",
+		Header:     mail.Header{"X-Priority": {"1"}, "Received": {"from a", "from b"}},
+		StreamType: models.StreamTypeEmail,
+	}
+
+	tests := []struct {
+		name string
+		cond models.FilterCondition
+		want bool
+	}{
+		{"sender is ignores case", models.FilterCondition{Field: models.FilterSender, Op: models.FilterIs, Value: "billing@vendor.example"}, true},
+		{"recipient contains", models.FilterCondition{Field: models.FilterRecipient, Op: models.FilterContains, Value: "invoices@"}, true},
+		{"subject matches wildcard", models.FilterCondition{Field: models.FilterSubject, Op: models.FilterMatches, Value: "invoice #?? for *"}, true},
+		{"subject matches is anchored", models.FilterCondition{Field: models.FilterSubject, Op: models.FilterMatches, Value: "invoice"}, false},
+		{"body regex", models.FilterCondition{Field: models.FilterBody, Op: models.FilterRegex, Value: `^please\b`}, true},
+		{"invalid regex never matches", models.FilterCondition{Field: models.FilterBody, Op: models.FilterRegex, Value: `(`}, false},
+		{"header by any case", models.FilterCondition{Field: models.FilterHeader, Header: "x-priority", Op: models.FilterIs, Value: "1"}, true},
+		{"repeated header", models.FilterCondition{Field: models.FilterHeader, Header: "Received", Op: models.FilterIs, Value: "from b"}, true},
+		{"missing header is empty", models.FilterCondition{Field: models.FilterHeader, Header: "List-Id", Op: models.FilterIs, Value: ""}, true},
+		{"stream type", models.FilterCondition{Field: models.FilterStreamType, Op: models.FilterIs, Value: "form"}, false},
+		{"negated", models.FilterCondition{Field: models.FilterStreamType, Op: models.FilterIs, Value: "form", Not: true}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := models.FilterRule{MatchAll: true, Conditions: []models.FilterCondition{tc.cond}}
+			if got := Matches(rule, msg); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMatches_AllAndAny(t *testing.T) {
+	msg := Message{Subject: "hello", Body: "world"}
+	conds := []models.FilterCondition{
+		{Field: models.FilterSubject, Op: models.FilterIs, Value: "hello"},
+		{Field: models.FilterBody, Op: models.FilterIs, Value: "nope"},
+	}
+
+	if Matches(models.FilterRule{MatchAll: true, Conditions: conds}, msg) {
+		t.Error("expected all-of rule not to match")
+	}
+	if !Matches(models.FilterRule{MatchAll: false, Conditions: conds}, msg) {
+		t.Error("expected any-of rule to match")
+	}
+	if !Matches(models.FilterRule{}, msg) {
+		t.Error("expected rule without conditions to match everything")
+	}
+}
+
+func TestEvaluate_OrderAndStop(t *testing.T) {
+	target := uuid.New()
+	rules := []models.FilterRule{
+		{Name: "disabled", Enabled: false, Actions: []models.FilterAction{{Type: models.FilterDiscard}}},
+		{Name: "tag", Enabled: true, Actions: []models.FilterAction{
+			{Type: models.FilterTag, Value: "vip"},
+			{Type: models.FilterSetStatus, Value: "closed"},
+		}},
+		{Name: "move", Enabled: true, Stop: true, Actions: []models.FilterAction{
+			{Type: models.FilterTag, Value: "VIP"},
+			{Type: models.FilterMove, Value: target.String()},
+			{Type: models.FilterForward, Value: "boss@example.com"},
+		}},
+		{Name: "after stop", Enabled: true, Actions: []models.FilterAction{{Type: models.FilterAutoReply, Value: "hi"}}},
+	}
+
+	res := Evaluate(rules, Message{})
+	if len(res.Matched) != 2 || res.Matched[0] != "tag" || res.Matched[1] != "move" {
+		t.Fatalf("expected rules tag and move to match, got %v", res.Matched)
+	}
+	if res.Discard || res.AutoReply != "" {
+		t.Error("expected disabled rule and rules after stop to be skipped")
+	}
+	if len(res.Tags) != 1 || res.Tags[0] != "vip" {
+		t.Errorf("expected tags to be deduplicated, got %v", res.Tags)
+	}
+	if res.Status != models.ConversationClosed {
+		t.Errorf("expected status closed, got %q", res.Status)
+	}
+	if !res.Moved() || res.MoveTo != target {
+		t.Errorf("expected move to %s, got %s", target, res.MoveTo)
+	}
+	if len(res.Forward) != 1 {
+		t.Errorf("expected one forward, got %v", res.Forward)
+	}
+}
+
+// --- Service ---
+
+// newTestService returns a service over two mailboxes of user 7 and one of
+// user 8.
+func newTestService() (*Service, *mockRuleStore, []*models.Mailbox) {
+	mailboxes := []*models.Mailbox{
+		{ID: 1, PublicID: uuid.New(), UserID: 7, Name: "Support"},
+		{ID: 2, PublicID: uuid.New(), UserID: 7, Name: "Billing"},
+		{ID: 3, PublicID: uuid.New(), UserID: 8, Name: "Theirs"},
+	}
+	rules := &mockRuleStore{}
+	svc := NewService(rules, &mockMailboxStore{mailboxes: mailboxes}, nil, nil, nil)
+	return svc, rules, mailboxes
+}
+
+func TestCreate_Validates(t *testing.T) {
+	svc, _, mailboxes := newTestService()
+	mb, other, foreign := mailboxes[0], mailboxes[1], mailboxes[2]
+	ctx := context.Background()
+
+	valid := func() *models.FilterRule {
+		return &models.FilterRule{
+			Name:       "Invoices",
+			Conditions: []models.FilterCondition{{Field: models.FilterSubject, Op: models.FilterContains, Value: "invoice"}},
+			Actions:    []models.FilterAction{{Type: models.FilterMove, Value: other.PublicID.String()}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(*models.FilterRule)
+	}{
+		{"empty name", func(r *models.FilterRule) { r.Name = " " }},
+		{"no actions", func(r *models.FilterRule) { r.Actions = nil }},
+		{"unknown field", func(r *models.FilterRule) { r.Conditions[0].Field = "cc" }},
+		{"header without name", func(r *models.FilterRule) { r.Conditions[0].Field = models.FilterHeader }},
+		{"bad regex", func(r *models.FilterRule) {
+			r.Conditions[0].Op = models.FilterRegex
+			r.Conditions[0].Value = "("
+		}},
+		{"bad status", func(r *models.FilterRule) {
+			r.Actions[0] = models.FilterAction{Type: models.FilterSetStatus, Value: "open"}
+		}},
+		{"bad forward", func(r *models.FilterRule) {
+			r.Actions[0] = models.FilterAction{Type: models.FilterForward, Value: "nobody"}
+		}},
+		{"move to same mailbox", func(r *models.FilterRule) { r.Actions[0].Value = mb.PublicID.String() }},
+		{"move to foreign mailbox", func(r *models.FilterRule) { r.Actions[0].Value = foreign.PublicID.String() }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := valid()
+			tc.mutate(rule)
+			if err := svc.Create(ctx, mb, rule); err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+
+	rule := valid()
+	if err := svc.Create(ctx, mb, rule); err != nil {
+		t.Fatalf("expected valid rule to be created, got %v", err)
+	}
+	if rule.MailboxID != mb.ID || !rule.Enabled {
+		t.Errorf("expected rule to be enabled in mailbox %d, got %+v", mb.ID, rule)
+	}
+}
+
+func TestMove_Reorders(t *testing.T) {
+	svc, store, mailboxes := newTestService()
+	mb := mailboxes[0]
+	ctx := context.Background()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := svc.Create(ctx, mb, &models.FilterRule{Name: name, Actions: []models.FilterAction{{Type: models.FilterDiscard}}}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	if err := svc.Move(ctx, mb.ID, store.rules[2].ID, true); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if err := svc.Move(ctx, mb.ID, store.rules[0].ID, true); err != nil {
+		t.Fatalf("Move of first rule up: %v", err)
+	}
+
+	var order string
+	for _, r := range store.rules {
+		order += r.Name
+	}
+	if order != "acb" {
+		t.Errorf("expected order acb, got %s", order)
+	}
+
+	if err := svc.Delete(ctx, 99, store.rules[0].ID); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("expected ErrRuleNotFound for another mailbox, got %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/rawmail"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// ErrRuleNotFound is returned for a rule that does not belong to the mailbox.
+var ErrRuleNotFound = errors.New("rule not found")
+
+// Service manages the filter rules of mailboxes and applies them.
+type Service struct {
+	rules         store.FilterRuleStore
+	mailboxes     store.MailboxStore
+	conversations store.ConversationStore
+	streams       store.StreamStore
+	archive       *rawmail.Archive
+}
+
+// NewService creates a filter service. The archive is used by DryRun to read
+// the headers of stored email and may be nil.
+func NewService(
+	rules store.FilterRuleStore,
+	mailboxes store.MailboxStore,
+	conversations store.ConversationStore,
+	streams store.StreamStore,
+	archive *rawmail.Archive,
+) *Service {
+	return &Service{
+		rules:         rules,
+		mailboxes:     mailboxes,
+		conversations: conversations,
+		streams:       streams,
+		archive:       archive,
+	}
+}
+
+// List returns a mailbox's rules in the order they run.
+func (s *Service) List(ctx context.Context, mailboxID int64) ([]models.FilterRule, error) {
+	return s.rules.GetFilterRulesByMailboxID(ctx, mailboxID)
+}
+
+// Create validates rule and adds it after the mailbox's existing rules.
+func (s *Service) Create(ctx context.Context, mb *models.Mailbox, rule *models.FilterRule) error {
+	if err := s.validate(ctx, mb, rule); err != nil {
+		return err
+	}
+	rule.MailboxID = mb.ID
+	rule.Enabled = true
+	if err := s.rules.CreateFilterRule(ctx, rule); err != nil {
+		return fmt.Errorf("create rule: %w", err)
+	}
+	return nil
+}
+
+// SetEnabled turns a rule on or off.
+func (s *Service) SetEnabled(ctx context.Context, mailboxID, ruleID int64, enabled bool) error {
+	if _, _, err := s.find(ctx, mailboxID, ruleID); err != nil {
+		return err
+	}
+	return s.rules.UpdateFilterRuleEnabled(ctx, ruleID, enabled)
+}
+
+// Move moves a rule one place earlier (up) or later in the run order.
+func (s *Service) Move(ctx context.Context, mailboxID, ruleID int64, up bool) error {
+	rules, i, err := s.find(ctx, mailboxID, ruleID)
+	if err != nil {
+		return err
+	}
+	j := i + 1
+	if up {
+		j = i - 1
+	}
+	if j < 0 || j >= len(rules) {
+		return nil
+	}
+	rules[i], rules[j] = rules[j], rules[i]
+
+	ids := make([]int64, len(rules))
+	for k, r := range rules {
+		ids[k] = r.ID
+	}
+	return s.rules.ReorderFilterRules(ctx, mailboxID, ids)
+}
+
+// Delete removes a rule.
+func (s *Service) Delete(ctx context.Context, mailboxID, ruleID int64) error {
+	if _, _, err := s.find(ctx, mailboxID, ruleID); err != nil {
+		return err
+	}
+	return s.rules.DeleteFilterRule(ctx, ruleID)
+}
+
+// find returns the mailbox's rules and the index of ruleID among them.
+func (s *Service) find(ctx context.Context, mailboxID, ruleID int64) ([]models.FilterRule, int, error) {
+	rules, err := s.rules.GetFilterRulesByMailboxID(ctx, mailboxID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("get rules: %w", err)
+	}
+	for i, r := range rules {
+		if r.ID == ruleID {
+			return rules, i, nil
+		}
+	}
+	return nil, 0, ErrRuleNotFound
+}
+
+// Apply runs the mailbox's rules against a message that starts a new
+// conversation.
+func (s *Service) Apply(ctx context.Context, mailboxID int64, msg Message) (Result, error) {
+	rules, err := s.rules.GetFilterRulesByMailboxID(ctx, mailboxID)
+	if err != nil {
+		return Result{}, fmt.Errorf("get rules: %w", err)
+	}
+	return Evaluate(rules, msg), nil
+}
+
+// DryRunResult is what the rules would have done with a stored message.
+type DryRunResult struct {
+	Conversation models.Conversation
+	Message      Message
+	Result       Result
+}
+
+// DryRun runs the mailbox's enabled rules against the first message of its
+// most recent conversations, up to limit, without acting on the results.
+func (s *Service) DryRun(ctx context.Context, mailboxID int64, limit int) ([]DryRunResult, error) {
+	rules, err := s.rules.GetFilterRulesByMailboxID(ctx, mailboxID)
+	if err != nil {
+		return nil, fmt.Errorf("get rules: %w", err)
+	}
+	convos, err := s.conversations.GetConversationsByMailboxID(ctx, mailboxID, limit, 0)
+	if err != nil {
+		return nil, fmt.Errorf("get conversations: %w", err)
+	}
+	streams, err := s.streams.GetStreamsByMailboxID(ctx, mailboxID)
+	if err != nil {
+		return nil, fmt.Errorf("get streams: %w", err)
+	}
+	streamTypes := make(map[int64]models.StreamType, len(streams))
+	for _, st := range streams {
+		streamTypes[st.ID] = st.Type
+	}
+
+	results := make([]DryRunResult, 0, len(convos))
+	for _, conv := range convos {
+		msgs, err := s.conversations.GetMessagesByConversationID(ctx, conv.ID)
+		if err != nil {
+			return nil, fmt.Errorf("get messages: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Direction != models.MessageInbound {
+				continue
+			}
+			msg := Message{
+				Sender:     m.SenderAddress,
+				Recipient:  conv.Recipient,
+				Subject:    conv.Subject,
+				Body:       m.Body,
+				Header:     s.header(ctx, m.RawKey),
+				StreamType: streamTypes[conv.StreamID],
+			}
+			results = append(results, DryRunResult{
+				Conversation: conv,
+				Message:      msg,
+				Result:       Evaluate(rules, msg),
+			})
+			break
+		}
+	}
+	return results, nil
+}
+
+// header reads the header of a stored original message. Messages without
+// an original, such as form submissions, have none.
+func (s *Service) header(ctx context.Context, rawKey string) mail.Header {
+	if s.archive == nil || rawKey == "" {
+		return nil
+	}
+	raw, err := s.archive.Open(ctx, rawKey)
+	if err != nil {
+		slog.Warn("failed to read original message for dry run", "key", rawKey, "error", err)
+		return nil
+	}
+	defer raw.Close()
+	// Only the header is read; the body is left in the archive.
+	parsed, err := mail.ReadMessage(raw)
+	if err != nil {
+		return nil
+	}
+	return parsed.Header
+}
+
+const (
+	maxNameLength = 100
+	maxTagLength  = 50
+)
+
+// validate checks a rule before it is stored and normalises its values.
+func (s *Service) validate(ctx context.Context, mb *models.Mailbox, rule *models.FilterRule) error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		return errors.New("rule name must not be empty")
+	}
+	if len(rule.Name) > maxNameLength {
+		return fmt.Errorf("rule name must be at most %d characters", maxNameLength)
+	}
+
+	for i := range rule.Conditions {
+		if err := validateCondition(&rule.Conditions[i]); err != nil {
+			return err
+		}
+	}
+
+	if len(rule.Actions) == 0 {
+		return errors.New("rule must have at least one action")
+	}
+	for i := range rule.Actions {
+		if err := s.validateAction(ctx, mb, &rule.Actions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCondition(c *models.FilterCondition) error {
+	switch c.Field {
+	case models.FilterSender, models.FilterRecipient, models.FilterSubject, models.FilterBody, models.FilterStreamType:
+		c.Header = ""
+	case models.FilterHeader:
+		c.Header = strings.TrimSpace(c.Header)
+		if c.Header == "" || strings.ContainsAny(c.Header, ": \t") {
+			return errors.New("header conditions need a header name")
+		}
+	default:
+		return fmt.Errorf("unknown condition field %q", c.Field)
+	}
+
+	switch c.Op {
+	case models.FilterIs:
+	case models.FilterContains, models.FilterMatches:
+		if c.Value == "" {
+			return fmt.Errorf("%s condition needs a value", c.Op)
+		}
+	case models.FilterRegex:
+		if _, err := regexp.Compile(c.Value); err != nil {
+			return fmt.Errorf("invalid regular expression: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown condition operator %q", c.Op)
+	}
+	return nil
+}
+
+func (s *Service) validateAction(ctx context.Context, mb *models.Mailbox, a *models.FilterAction) error {
+	a.Value = strings.TrimSpace(a.Value)
+	switch a.Type {
+	case models.FilterSetStatus:
+		switch models.ConversationStatus(a.Value) {
+		case models.ConversationClosed, models.ConversationSpam:
+		default:
+			return errors.New("status must be closed or spam")
+		}
+	case models.FilterTag:
+		if a.Value == "" || len(a.Value) > maxTagLength {
+			return fmt.Errorf("tags must be 1 to %d characters", maxTagLength)
+		}
+	case models.FilterForward:
+		addr, err := mail.ParseAddress(a.Value)
+		if err != nil {
+			return fmt.Errorf("invalid forward address %q", a.Value)
+		}
+		a.Value = addr.Address
+	case models.FilterAutoReply:
+		if a.Value == "" {
+			return errors.New("auto-reply needs a message")
+		}
+	case models.FilterMove:
+		id, err := uuid.Parse(a.Value)
+		if err != nil {
+			return errors.New("invalid target mailbox")
+		}
+		target, err := s.mailboxes.GetMailboxByPublicID(ctx, id)
+		if err != nil || target.UserID != mb.UserID {
+			return errors.New("invalid target mailbox")
+		}
+		if target.ID == mb.ID {
+			return errors.New("cannot move to the same mailbox")
+		}
+	case models.FilterDiscard:
+		a.Value = ""
+	default:
+		return fmt.Errorf("unknown action %q", a.Type)
+	}
+	return nil
+}
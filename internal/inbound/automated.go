@@ -0,0 +1,158 @@
+package inbound
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// automatedKind classifies machine-generated mail by its envelope sender and
+// headers. It returns one of the models.Automated* values, or the empty
+// string for mail a person sent.
+//
+// Bounces are recognised by the null reverse-path (RFC 5321 4.5.5) or a
+// delivery status report (RFC 3464); auto-replies by Auto-Submitted
+// (RFC 3834) or the older X-Autoreply headers; and list or bulk mail by
+// Precedence or List-Id.
+func automatedKind(envelopeFrom string, header mail.Header) string {
+	if strings.Trim(strings.TrimSpace(envelopeFrom), "<>") == "" || isDeliveryReport(header) {
+		return models.AutomatedBounce
+	}
+	if header == nil {
+		return ""
+	}
+
+	if v := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return models.AutomatedAutoReply
+	}
+	if header.Get("X-Autoreply") != "" || header.Get("X-Autorespond") != "" {
+		return models.AutomatedAutoReply
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return models.AutomatedBulk
+	}
+	if header.Get("List-Id") != "" {
+		return models.AutomatedBulk
+	}
+	return ""
+}
+
+// isDeliveryReport reports whether the message is a multipart/report of
+// report-type delivery-status.
+func isDeliveryReport(header mail.Header) bool {
+	if header == nil {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/report" &&
+		strings.EqualFold(params["report-type"], "delivery-status")
+}
+
+// dsn is the part of a delivery status notification needed to match it to
+// the outbound message it reports on.
+type dsn struct {
+	// MessageID is the Message-ID of the returned original, including
+	// angle brackets.
+	MessageID string
+
+	// Failed reports whether delivery to any recipient failed, as opposed
+	// to being delayed or relayed.
+	Failed bool
+
+	// Reason describes the first failed recipient, e.g.
+	// "user@example.com: 5.1.1 (550 5.1.1 No such user)".
+	Reason string
+}
+
+// parseDSN reads a delivery status notification. It returns false if the
+// message is not a delivery-status report.
+func parseDSN(r io.Reader) (dsn, bool) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil || !isDeliveryReport(msg.Header) {
+		return dsn{}, false
+	}
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if params["boundary"] == "" {
+		return dsn{}, false
+	}
+
+	var report dsn
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body := decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding"))
+
+		switch mediaType {
+		case "message/delivery-status", "message/global-delivery-status":
+			report.Failed, report.Reason = readDeliveryStatus(body)
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			// Only the header of the returned message is needed; the
+			// body may be missing or truncated.
+			h, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+			if err != nil && len(h) == 0 {
+				continue
+			}
+			if ids := parseMessageIDs(h.Get("Message-ID")); len(ids) > 0 {
+				report.MessageID = ids[0]
+			}
+		}
+	}
+	return report, true
+}
+
+// readDeliveryStatus reads the per-message and per-recipient fields of a
+// message/delivery-status body, which are header blocks separated by blank
+// lines. It reports whether any recipient failed and describes the first
+// one that did.
+func readDeliveryStatus(body io.Reader) (failed bool, reason string) {
+	tp := textproto.NewReader(bufio.NewReader(body))
+	for {
+		fields, err := tp.ReadMIMEHeader()
+		if strings.EqualFold(strings.TrimSpace(fields.Get("Action")), "failed") && !failed {
+			failed = true
+			reason = describeFailure(fields)
+		}
+		if err != nil {
+			return failed, reason
+		}
+	}
+}
+
+// describeFailure summarises a failed recipient's DSN fields.
+func describeFailure(fields textproto.MIMEHeader) string {
+	recipient := dsnValue(fields.Get("Final-Recipient"))
+	if recipient == "" {
+		recipient = dsnValue(fields.Get("Original-Recipient"))
+	}
+
+	var b strings.Builder
+	if recipient != "" {
+		b.WriteString(recipient + ": ")
+	}
+	b.WriteString(strings.TrimSpace(fields.Get("Status")))
+	if diag := dsnValue(fields.Get("Diagnostic-Code")); diag != "" {
+		b.WriteString(" (" + diag + ")")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// dsnValue strips the type prefix from a typed DSN field such as
+// "rfc822; user@example.com" or "smtp; 550 No such user".
+func dsnValue(v string) string {
+	if i := strings.Index(v, ";"); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
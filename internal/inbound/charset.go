@@ -0,0 +1,141 @@
+package inbound
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// Everything stored from an inbound message must be valid UTF-8: Postgres
+// rejects invalid sequences and NUL bytes in text columns. Text parts and
+// headers are converted from their declared charset, looked up by the
+// WHATWG names mail clients also use, so that e.g. ISO-8859-1 is read as its
+// Windows-1252 superset and GB2312 as GBK. When the charset is missing,
+// unknown or plainly wrong, it is guessed instead.
+
+var (
+	// wordDecoder decodes RFC 2047 encoded words in any supported charset.
+	wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+	// addressParser parses From headers with wordDecoder; net/mail on its
+	// own only knows UTF-8, US-ASCII and ISO-8859-1.
+	addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+	// metaCharsetRe finds the charset an HTML document declares for itself.
+	metaCharsetRe = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_:.\-]+)`)
+)
+
+// charsetReader returns a reader converting input in the named charset to
+// UTF-8, for mime.WordDecoder.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc := lookupCharset(charset)
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// lookupCharset returns the encoding for a MIME charset name, or nil if it
+// is unknown. UTF-8 and US-ASCII return encoding.Nop.
+func lookupCharset(charset string) encoding.Encoding {
+	charset = strings.ToLower(strings.Trim(strings.TrimSpace(charset), `"'`))
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return encoding.Nop
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return encoding.Nop
+	}
+	return enc
+}
+
+// decodeCharset converts b from the declared charset to valid UTF-8.
+func decodeCharset(b []byte, charset string) string {
+	enc := lookupCharset(charset)
+	switch {
+	case enc == nil:
+		// Unknown charset: guess.
+		enc = detectCharset(b)
+	case enc == encoding.Nop:
+		// Declared UTF-8 or ASCII, or not declared at all. Legacy
+		// clients often send 8-bit or ISO-2022-JP text without saying so.
+		enc = detectCharset(b)
+	case isSingleByte(enc) && !isASCII(b) && utf8.Valid(b):
+		// UTF-8 mislabelled as Latin-1 and the like. Multi-byte
+		// sequences that happen to be valid UTF-8 are vanishingly rare in
+		// real single-byte text.
+		enc = encoding.Nop
+	}
+
+	if enc != encoding.Nop {
+		if decoded, err := enc.NewDecoder().Bytes(b); err == nil {
+			b = decoded
+		}
+	}
+	return sanitizeText(string(b))
+}
+
+// detectCharset guesses the charset of text that is not valid UTF-8 or that
+// came without a usable charset.
+func detectCharset(b []byte) encoding.Encoding {
+	switch {
+	case bytes.Contains(b, []byte("\x1b$B")) || bytes.Contains(b, []byte("\x1b$@")):
+		// ISO-2022-JP is 7-bit, so also valid UTF-8; it switches to
+		// JIS X 0208 with these escapes.
+		return japanese.ISO2022JP
+	case utf8.Valid(b):
+		return encoding.Nop
+	default:
+		// The most common undeclared legacy charset. Every byte
+		// sequence is valid in it, so nothing is lost.
+		return charmap.Windows1252
+	}
+}
+
+// isSingleByte reports whether enc is one of the single-byte charsets whose
+// bytes cannot be validated, so any input decodes.
+func isSingleByte(enc encoding.Encoding) bool {
+	_, ok := enc.(*charmap.Charmap)
+	return ok
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeText replaces invalid UTF-8 and drops NUL bytes.
+func sanitizeText(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+// htmlCharset returns the charset declared in an HTML document's meta tags,
+// for HTML parts whose Content-Type names none.
+func htmlCharset(b []byte) string {
+	if len(b) > 1024 {
+		b = b[:1024]
+	}
+	if m := metaCharsetRe.FindSubmatch(b); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
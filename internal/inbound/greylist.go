@@ -0,0 +1,107 @@
+package inbound
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// Greylisting temporarily refuses the first delivery attempt of each
+// (client network, sender, recipient) triplet. Real mail servers retry after
+// a few minutes and are let through; most spam software never retries. The
+// client is keyed by its /24 (IPv4) or /64 (IPv6) network because large
+// providers retry from a different address of the same pool.
+
+const (
+	// DefaultGreylistDelay is how long a new triplet is refused.
+	DefaultGreylistDelay = 5 * time.Minute
+
+	// greylistExpiry is how long a triplet is remembered after it was last
+	// seen. A sender that passed once is not delayed again while it keeps
+	// sending at least this often.
+	greylistExpiry = 36 * 24 * time.Hour
+)
+
+// Greylist decides which delivery attempts are greylisted.
+type Greylist struct {
+	triplets store.GreylistStore
+	delay    time.Duration
+
+	// Clients in whitelistNets and senders in whitelistDomains are never
+	// greylisted.
+	whitelistNets    []netip.Prefix
+	whitelistDomains []string
+
+	now func() time.Time
+}
+
+// NewGreylist returns a greylist that refuses new triplets for delay,
+// except from the whitelisted networks and sender domains.
+func NewGreylist(triplets store.GreylistStore, delay time.Duration, whitelistNets []netip.Prefix, whitelistDomains []string) *Greylist {
+	if delay <= 0 {
+		delay = DefaultGreylistDelay
+	}
+	domains := make([]string, len(whitelistDomains))
+	for i, d := range whitelistDomains {
+		domains[i] = strings.ToLower(strings.TrimPrefix(d, "@"))
+	}
+	return &Greylist{
+		triplets:         triplets,
+		delay:            delay,
+		whitelistNets:    whitelistNets,
+		whitelistDomains: domains,
+		now:              time.Now,
+	}
+}
+
+// Pass records a delivery attempt from ip and reports whether it may
+// proceed: the triplet was first seen at least the delay ago, or the client
+// or sender is whitelisted.
+func (g *Greylist) Pass(ctx context.Context, ip netip.Addr, sender, recipient string) (bool, error) {
+	if !ip.IsValid() || containsAddr(g.whitelistNets, ip) || g.whitelistedSender(sender) {
+		return true, nil
+	}
+
+	sender = strings.ToLower(strings.Trim(strings.TrimSpace(sender), "<>"))
+	if sender == "" {
+		sender = "<>"
+	}
+	firstSeen, err := g.triplets.TouchGreylistTriplet(ctx, clientNetwork(ip).String(), sender, strings.ToLower(recipient), greylistExpiry)
+	if err != nil {
+		return false, err
+	}
+	return g.now().Sub(firstSeen) >= g.delay, nil
+}
+
+// Prune forgets triplets that have not been seen for the expiry period.
+func (g *Greylist) Prune(ctx context.Context) (int, error) {
+	return g.triplets.DeleteStaleGreylistTriplets(ctx, g.now().Add(-greylistExpiry))
+}
+
+func (g *Greylist) whitelistedSender(sender string) bool {
+	at := strings.LastIndexByte(sender, '@')
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(strings.Trim(sender[at+1:], "> "))
+	for _, d := range g.whitelistDomains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientNetwork returns the network a client address is greylisted as.
+func clientNetwork(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	bits := 64
+	if ip.Is4() {
+		bits = 24
+	}
+	p, _ := ip.Prefix(bits)
+	return p
+}
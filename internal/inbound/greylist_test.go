@@ -0,0 +1,89 @@
+package inbound
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// memGreylist is an in-memory store.GreylistStore.
+type memGreylist struct {
+	now     func() time.Time
+	first   map[string]time.Time
+	touched int
+}
+
+func (m *memGreylist) TouchGreylistTriplet(_ context.Context, network, sender, recipient string, _ time.Duration) (time.Time, error) {
+	m.touched++
+	key := network + " " + sender + " " + recipient
+	if _, ok := m.first[key]; !ok {
+		m.first[key] = m.now()
+	}
+	return m.first[key], nil
+}
+
+func (m *memGreylist) DeleteStaleGreylistTriplets(_ context.Context, _ time.Time) (int, error) {
+	return 0, nil
+}
+
+func TestGreylist_Pass(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	triplets := &memGreylist{now: clock, first: make(map[string]time.Time)}
+	g := NewGreylist(triplets, 5*time.Minute,
+		[]netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}, []string{"partner.example"})
+	g.now = clock
+	ctx := context.Background()
+	sender := netip.MustParseAddr("198.51.100.7")
+
+	pass := func(ip netip.Addr, from, to string) bool {
+		t.Helper()
+		ok, err := g.Pass(ctx, ip, from, to)
+		if err != nil {
+			t.Fatalf("Pass: %v", err)
+		}
+		return ok
+	}
+
+	if pass(sender, "alice@example.org", "support@example.com") {
+		t.Error("expected first attempt to be greylisted")
+	}
+	now = now.Add(2 * time.Minute)
+	if pass(sender, "alice@example.org", "support@example.com") {
+		t.Error("expected retry within the delay to be greylisted")
+	}
+	now = now.Add(4 * time.Minute)
+	// A retry from another address of the same /24 counts as the same
+	// client.
+	if !pass(netip.MustParseAddr("198.51.100.99"), "Alice@Example.org", "support@example.com") {
+		t.Error("expected retry after the delay to pass")
+	}
+	if pass(sender, "alice@example.org", "sales@example.com") {
+		t.Error("expected a new recipient to be greylisted")
+	}
+
+	touched := triplets.touched
+	if !pass(netip.MustParseAddr("203.0.113.5"), "bob@example.net", "support@example.com") {
+		t.Error("expected whitelisted network to pass")
+	}
+	if !pass(sender, "noreply@mail.partner.example", "support@example.com") {
+		t.Error("expected whitelisted sender domain to pass")
+	}
+	if triplets.touched != touched {
+		t.Error("expected whitelisted attempts not to be recorded")
+	}
+}
+
+func TestClientNetwork(t *testing.T) {
+	tests := map[string]string{
+		"198.51.100.7":        "198.51.100.0/24",
+		"2001:db8:1:2:3::4":   "2001:db8:1:2::/64",
+		"::ffff:198.51.100.7": "198.51.100.0/24",
+	}
+	for ip, want := range tests {
+		if got := clientNetwork(netip.MustParseAddr(ip)).String(); got != want {
+			t.Errorf("clientNetwork(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package inbound
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/ratelimit"
+)
+
+// Limits keeps a single sender from flooding the listener. Connections are
+// counted when they are accepted, before any SMTP is spoken, so that a
+// sender over its limit costs no more than a one-line reply.
+type Limits struct {
+	// MaxConnections caps concurrent connections from all senders, and
+	// MaxConnectionsPerIP those from one address. 0 means no limit.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// MessagesPerMinute and MessageBurst limit the transactions one address
+	// may start. 0 means no limit.
+	MessagesPerMinute float64
+	MessageBurst      int
+
+	// Allow lists networks exempt from the per-IP limits and greylisting,
+	// such as a backup MX. Deny lists networks whose connections are
+	// refused outright.
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// rejectTimeout bounds how long writing the reply to a refused connection
+// may take.
+const rejectTimeout = 5 * time.Second
+
+// connLimiter counts open connections in total and per address.
+type connLimiter struct {
+	limits Limits
+
+	mu    sync.Mutex
+	total int
+	byIP  map[netip.Addr]int
+
+	// messages limits transactions per address; nil if unlimited.
+	messages *ratelimit.Limiter
+}
+
+func newConnLimiter(limits Limits) *connLimiter {
+	l := &connLimiter{limits: limits, byIP: make(map[netip.Addr]int)}
+	if limits.MessagesPerMinute > 0 {
+		burst := limits.MessageBurst
+		if burst < 1 {
+			burst = 1
+		}
+		l.messages = ratelimit.NewLimiter(limits.MessagesPerMinute/60, burst)
+	}
+	return l
+}
+
+// allowed reports whether ip is on the allow list.
+func (l *connLimiter) allowed(ip netip.Addr) bool {
+	return containsAddr(l.limits.Allow, ip)
+}
+
+// admit counts a new connection from ip. It returns the reply to refuse the
+// connection with, or "" if it may proceed, in which case release must be
+// called once it is closed.
+func (l *connLimiter) admit(ip netip.Addr) string {
+	if containsAddr(l.limits.Deny, ip) {
+		return "554 5.7.1 Access denied\r\n"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MaxConnections > 0 && l.total >= l.limits.MaxConnections {
+		return "421 4.7.0 Too many connections, try again later\r\n"
+	}
+	if ip.IsValid() && !l.allowed(ip) && l.limits.MaxConnectionsPerIP > 0 && l.byIP[ip] >= l.limits.MaxConnectionsPerIP {
+		return "421 4.7.0 Too many connections from your address, try again later\r\n"
+	}
+	l.total++
+	if ip.IsValid() {
+		l.byIP[ip]++
+	}
+	return ""
+}
+
+// release uncounts a connection admitted from ip.
+func (l *connLimiter) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if ip.IsValid() {
+		if l.byIP[ip]--; l.byIP[ip] <= 0 {
+			delete(l.byIP, ip)
+		}
+	}
+}
+
+// allowMessage reports whether ip may start another transaction.
+func (l *connLimiter) allowMessage(ip netip.Addr) bool {
+	if l.messages == nil || !ip.IsValid() || l.allowed(ip) {
+		return true
+	}
+	return l.messages.Allow(ip.String())
+}
+
+// limitListener refuses connections the connLimiter does not admit. greet
+// selects whether the refusal is sent as an SMTP reply; on an implicit-TLS
+// listener the connection is just closed.
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+	greet   bool
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := addrOf(c.RemoteAddr())
+		if reply := l.limiter.admit(ip); reply != "" {
+			slog.Warn("inbound SMTP connection refused", "remote_ip", ip, "reply", reply[:3])
+			if l.greet {
+				_ = c.SetWriteDeadline(time.Now().Add(rejectTimeout))
+				_, _ = c.Write([]byte(reply))
+			}
+			c.Close()
+			continue
+		}
+		return &limitConn{Conn: c, release: func() { l.limiter.release(ip) }}, nil
+	}
+}
+
+// limitConn releases its connection slot when closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// addrOf returns the IP address of a TCP peer, or the zero Addr for other
+// kinds of connection.
+func addrOf(addr net.Addr) netip.Addr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package inbound
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestConnLimiter_Admit(t *testing.T) {
+	l := newConnLimiter(Limits{
+		MaxConnections:      3,
+		MaxConnectionsPerIP: 2,
+		Allow:               []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Deny:                []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	})
+	sender := netip.MustParseAddr("198.51.100.7")
+	relay := netip.MustParseAddr("10.1.2.3")
+
+	if reply := l.admit(netip.MustParseAddr("192.0.2.9")); !strings.HasPrefix(reply, "554") {
+		t.Errorf("expected denied network to get 554, got %q", reply)
+	}
+
+	for range 2 {
+		if reply := l.admit(sender); reply != "" {
+			t.Fatalf("expected connection to be admitted, got %q", reply)
+		}
+	}
+	if reply := l.admit(sender); !strings.HasPrefix(reply, "421") {
+		t.Errorf("expected third connection from one address to get 421, got %q", reply)
+	}
+
+	// The allow list is exempt from the per-IP limit but not the global one.
+	if reply := l.admit(relay); reply != "" {
+		t.Fatalf("expected allowed address to be admitted, got %q", reply)
+	}
+	if reply := l.admit(relay); !strings.HasPrefix(reply, "421") {
+		t.Errorf("expected global limit to apply, got %q", reply)
+	}
+
+	l.release(sender)
+	if reply := l.admit(sender); reply != "" {
+		t.Errorf("expected released slot to be reused, got %q", reply)
+	}
+}
+
+func TestConnLimiter_AllowMessage(t *testing.T) {
+	l := newConnLimiter(Limits{
+		MessagesPerMinute: 1,
+		MessageBurst:      2,
+		Allow:             []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	sender := netip.MustParseAddr("198.51.100.7")
+
+	if !l.allowMessage(sender) || !l.allowMessage(sender) {
+		t.Fatal("expected the burst to be allowed")
+	}
+	if l.allowMessage(sender) {
+		t.Error("expected messages over the burst to be limited")
+	}
+	if !l.allowMessage(netip.MustParseAddr("198.51.100.8")) {
+		t.Error("expected another address to have its own limit")
+	}
+	for range 5 {
+		if !l.allowMessage(netip.MustParseAddr("10.9.9.9")) {
+			t.Fatal("expected allowed address to be exempt")
+		}
+	}
+}
+
+func TestLimitListener_RefusesWithReply(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := &limitListener{Listener: inner, limiter: newConnLimiter(Limits{MaxConnectionsPerIP: 1}), greet: true}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	held := <-accepted
+
+	second, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer second.Close()
+	reply, _ := bufio.NewReader(second).ReadString('\n')
+	if !strings.HasPrefix(reply, "421 ") {
+		t.Errorf("expected 421 for second connection, got %q", reply)
+	}
+
+	// Closing the first connection frees its slot.
+	held.Close()
+	third, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer third.Close()
+	(<-accepted).Close()
+}
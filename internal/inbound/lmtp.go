@@ -0,0 +1,144 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// With LMTP (RFC 2033) DeadDrop is the final delivery agent behind an MTA
+// such as Postfix. Sessions work as over SMTP, except that the peer is the
+// trusted MTA: sender authentication, greylisting and the per-IP limits are
+// left to it, and after DATA each recipient gets its own reply.
+
+// listenLMTP listens on a Unix socket, given as "/path" or "unix:/path", or
+// on a TCP address.
+func listenLMTP(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok && !strings.HasPrefix(addr, "/") {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by an unclean exit would make Listen fail.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The MTA usually runs as another user, in DeadDrop's group.
+	if err := os.Chmod(path, 0o660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// LMTPData implements smtp.LMTPSession. It queues the message like Data and
+// reports the result for every recipient.
+//
+// If a recipient header is trusted and the transaction has a single
+// recipient, the address in that header is used to find the stream, so
+// that routing sees the address the sender used rather than the one the
+// MTA rewrote it to. With several recipients the header cannot tell which
+// one it belongs to and is ignored.
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if len(s.recipients) == 0 {
+		return errors.New("no valid recipient")
+	}
+
+	spool, size, err := s.spool(r)
+	if err != nil {
+		return err
+	}
+	defer closeSpool(spool)
+
+	ctx := context.Background()
+	if s.server.lmtpHeader != "" && len(s.recipients) == 1 {
+		s.applyRecipientHeader(ctx, spool)
+	}
+
+	// Recipients whose stream is still unknown fail; the others are
+	// queued.
+	results := make([]error, len(s.recipients))
+	var resolved []recipient
+	var resolvedIdx []int
+	for i, rcpt := range s.recipients {
+		if rcpt.stream == nil {
+			slog.Warn("inbound email to unknown address", "to", rcpt.addr)
+			results[i] = errNoSuchRecipient
+			continue
+		}
+		resolved = append(resolved, rcpt)
+		resolvedIdx = append(resolvedIdx, i)
+	}
+	if len(resolved) > 0 {
+		for j, err := range s.enqueue(ctx, resolved, spool, size) {
+			results[resolvedIdx[j]] = err
+		}
+	}
+
+	for i, rcpt := range s.recipients {
+		for _, to := range rcpt.rcptTo {
+			status.SetStatus(to, results[i])
+		}
+	}
+	return nil
+}
+
+// applyRecipientHeader routes the only recipient by the trusted recipient
+// header, if the message has one naming a stream.
+func (s *session) applyRecipientHeader(ctx context.Context, msg io.ReadSeeker) {
+	addr, err := headerRecipient(msg, s.server.lmtpHeader)
+	if err != nil || addr == "" {
+		return
+	}
+	stream, replyToken, err := s.server.resolveStream(ctx, addr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		slog.Error("failed to look up inbound recipient", "to", addr, "error", err)
+		return
+	}
+	if !stream.Enabled || tooLarge(stream, s.size) {
+		return
+	}
+
+	rcpt := &s.recipients[0]
+	if rcpt.addr != addr {
+		slog.Info("inbound LMTP recipient taken from header", "rcpt_to", rcpt.addr, "to", addr, "header", s.server.lmtpHeader)
+	}
+	rcpt.addr, rcpt.stream, rcpt.replyToken = addr, stream, replyToken
+}
+
+// headerRecipient returns the address in the first instance of the named
+// header, which the MTA adds above any the sender supplied.
+func headerRecipient(msg io.ReadSeeker, name string) (string, error) {
+	if _, err := msg.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	header, err := textproto.NewReader(bufio.NewReader(msg)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", err
+	}
+	value := strings.TrimSpace(header.Get(name))
+	if value == "" {
+		return "", nil
+	}
+	if addr, err := mail.ParseAddress(value); err == nil {
+		value = addr.Address
+	}
+	return strings.ToLower(strings.Trim(value, "<>")), nil
+}
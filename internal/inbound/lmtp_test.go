@@ -0,0 +1,111 @@
+package inbound
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// startLMTP serves srv over LMTP on a Unix socket and returns a connected
+// client.
+func startLMTP(t *testing.T, srv *Server, header string) *smtp.Client {
+	t.Helper()
+	addr := filepath.Join(t.TempDir(), "lmtp.sock")
+	srv.lmtpServer = srv.newSMTPServer(Config{Domain: "mx.example.com"}, addr, true)
+	srv.lmtpHeader = header
+
+	l, err := listenLMTP(addr)
+	if err != nil {
+		t.Fatalf("listenLMTP: %v", err)
+	}
+	go srv.lmtpServer.Serve(l)
+	t.Cleanup(func() { srv.lmtpServer.Close() })
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c := smtp.NewClientLMTP(conn)
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("mta.example.com"); err != nil {
+		t.Fatalf("LHLO: %v", err)
+	}
+	return c
+}
+
+// sendLMTP sends msg and returns the per-recipient replies.
+func sendLMTP(t *testing.T, c *smtp.Client, rcpts []string, msg string) (map[string]*smtp.DataResponse, error) {
+	t.Helper()
+	if err := c.Mail("alice@example.org", nil); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	for _, to := range rcpts {
+		if err := c.Rcpt(to, nil); err != nil {
+			t.Fatalf("RCPT %s: %v", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return w.CloseWithLMTPResponse()
+}
+
+func TestLMTP_PerRecipientStatus(t *testing.T) {
+	open := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, Address: "support@example.com"}
+	small := models.Stream{ID: 2, MailboxID: 2, Type: models.StreamTypeEmail, Enabled: true, Address: "small@example.com", MaxMessageBytes: 16}
+	srv, jobs := newQueueServer(t, &deliveryStore{}, open, small)
+	c := startLMTP(t, srv, "")
+
+	_, err := sendLMTP(t, c, []string{"support@example.com", "small@example.com"},
+		"From: alice@example.org\r\nSubject: Hi\r\n\r\nHello there\r\n")
+	var statuses smtp.LMTPDataError
+	if !errors.As(err, &statuses) {
+		t.Fatalf("expected per-recipient errors, got %v", err)
+	}
+	if _, failed := statuses["support@example.com"]; failed {
+		t.Errorf("expected support@example.com to be accepted, got %v", statuses["support@example.com"])
+	}
+	if e := statuses["small@example.com"]; e == nil || e.Code != 552 {
+		t.Errorf("expected 552 for small@example.com, got %v", e)
+	}
+	if len(jobs.jobs) != 1 || jobs.jobs[0].StreamID != open.ID {
+		t.Fatalf("expected one job for the open stream, got %+v", jobs.jobs)
+	}
+	if jobs.jobs[0].RemoteIP != "" || jobs.jobs[0].AuthResults != "" {
+		t.Errorf("expected no client IP or authentication results from the MTA hop, got %+v", jobs.jobs[0])
+	}
+}
+
+func TestLMTP_TrustedRecipientHeader(t *testing.T) {
+	support := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, Address: "support@example.com"}
+	srv, jobs := newQueueServer(t, &deliveryStore{}, support)
+	c := startLMTP(t, srv, "X-Original-To")
+
+	// The MTA delivers to its local name for DeadDrop; the header carries
+	// the address the sender used.
+	msg := "X-Original-To: support@example.com\r\nFrom: alice@example.org\r\nSubject: Hi\r\n\r\nHello\r\n"
+	if _, err := sendLMTP(t, c, []string{"deaddrop@localhost"}, msg); err != nil {
+		t.Fatalf("expected delivery via header, got %v", err)
+	}
+	if len(jobs.jobs) != 1 || jobs.jobs[0].StreamID != support.ID || jobs.jobs[0].Recipient != "support@example.com" {
+		t.Fatalf("expected job for support@example.com, got %+v", jobs.jobs)
+	}
+
+	// Without the header the rewritten address routes nowhere.
+	if err := c.Reset(); err != nil {
+		t.Fatalf("RSET: %v", err)
+	}
+	_, err := sendLMTP(t, c, []string{"deaddrop@localhost"}, "From: alice@example.org\r\n\r\nHello\r\n")
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("expected 550 without the header, got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package inbound
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/conversation"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
+	"github.com/znz-systems/deaddrop/internal/worker"
+)
+
+// Accepted messages are spooled: the SMTP session only authenticates the
+// message, archives it and queues one job per mailbox before answering 250.
+// Workers then parse it, run the spam filter and rules and store the
+// attachments, retrying with exponential backoff when that fails. A job that
+// keeps failing becomes a dead letter, shown on the mailbox's queue page
+// until it is retried or deleted.
+
+const (
+	// maxAttempts is how often a job is tried before it becomes a dead
+	// letter, which leaves a sender's MTA time to give up on us first.
+	maxAttempts = 10
+
+	// claimLease bounds how long filing one message may take: spam checks,
+	// rules and attachment uploads. After it the job is handed to another
+	// worker, and deliver notices what the first one already filed.
+	claimLease = 10 * time.Minute
+)
+
+// backoff spaces the attempts of a job out over about six hours, so a
+// database or storage outage of that length loses no mail.
+var backoff = worker.Backoff{Base: time.Minute, Max: 2 * time.Hour}
+
+// ErrJobNotFound is returned when a queued message does not exist, belongs
+// to another mailbox or is being processed.
+var ErrJobNotFound = errors.New("queued message not found")
+
+// Queue is the durable spool between accepting an inbound message and
+// filing it.
+type Queue struct {
+	jobs store.InboundQueueStore
+	wake chan struct{}
+}
+
+func NewQueue(jobs store.InboundQueueStore) *Queue {
+	return &Queue{jobs: jobs, wake: make(chan struct{}, 1)}
+}
+
+// enqueue adds a job and wakes a worker.
+func (q *Queue) enqueue(ctx context.Context, job *models.InboundJob) error {
+	if err := q.jobs.EnqueueInbound(ctx, job); err != nil {
+		return err
+	}
+	worker.Signal(q.wake)
+	return nil
+}
+
+// Failed returns the mailbox's messages that failed to be filed at least
+// once: those waiting for a retry and the dead letters.
+func (q *Queue) Failed(ctx context.Context, mailboxID int64) ([]models.InboundJob, error) {
+	return q.jobs.GetFailedInboundByMailboxID(ctx, mailboxID)
+}
+
+// Retry makes a failed message of the mailbox due immediately, with a fresh
+// set of attempts.
+func (q *Queue) Retry(ctx context.Context, mailboxID, jobID int64) error {
+	err := q.jobs.RequeueInbound(ctx, mailboxID, jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrJobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	worker.Signal(q.wake)
+	return nil
+}
+
+// Delete drops a failed message of the mailbox. Its raw source stays in the
+// archive.
+func (q *Queue) Delete(ctx context.Context, mailboxID, jobID int64) error {
+	err := q.jobs.DeleteInbound(ctx, mailboxID, jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrJobNotFound
+	}
+	return err
+}
+
+// work processes queued jobs until ctx is cancelled.
+func (s *Server) work(ctx context.Context) {
+	worker.Run(ctx, s.queue.wake, s.processNext)
+}
+
+// processNext claims and processes one due job. It reports whether there
+// was one.
+func (s *Server) processNext(ctx context.Context) bool {
+	job, err := s.queue.jobs.ClaimInbound(ctx, claimLease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to claim queued inbound email", "error", err)
+		}
+		return false
+	}
+
+	err = s.deliver(ctx, job)
+	switch {
+	case err == nil:
+		err = s.queue.jobs.CompleteInbound(ctx, job.ID)
+	case job.Attempts >= maxAttempts:
+		slog.Error("giving up on inbound email",
+			"job_id", job.ID, "to", job.Recipient, "attempts", job.Attempts, "error", err)
+		err = s.queue.jobs.FailInbound(ctx, job.ID, err.Error())
+	default:
+		delay := backoff.Delay(job.Attempts)
+		slog.Warn("failed to deliver inbound email, will retry",
+			"job_id", job.ID, "to", job.Recipient, "attempts", job.Attempts, "retry_in", delay, "error", err)
+		err = s.queue.jobs.RetryInbound(ctx, job.ID, time.Now().Add(delay), err.Error())
+	}
+	if err != nil {
+		// The claim expires and the job is tried again.
+		slog.Error("failed to update queued inbound email", "job_id", job.ID, "error", err)
+	}
+	return true
+}
+
+// deliver files a queued message into its mailbox. A bounce of mail the
+// mailbox sent is recorded on the outbound message instead.
+func (s *Server) deliver(ctx context.Context, job *models.InboundJob) error {
+	stream, err := s.streams.GetStreamByID(ctx, job.StreamID)
+	if err != nil {
+		return fmt.Errorf("look up stream: %w", err)
+	}
+	// The message is parsed as it is read from the archive, so it never has
+	// to fit in memory.
+	raw, err := s.archive.Open(ctx, job.RawKey)
+	if err != nil {
+		return fmt.Errorf("open raw message: %w", err)
+	}
+	src := &errReader{r: raw}
+	email := readEmail(src, job.EnvelopeFrom)
+	raw.Close()
+	defer removeSpooled(email.Attachments)
+	if src.err != nil {
+		return fmt.Errorf("read raw message: %w", src.err)
+	}
+
+	// A job is claimed again if its worker died, or its lease ran out,
+	// after the message was filed; only its attachments may be missing.
+	filed, err := s.conversations.FiledMessage(ctx, job.ID)
+	if err != nil {
+		return fmt.Errorf("look up filed message: %w", err)
+	}
+	if filed != nil {
+		if len(email.Attachments) > 0 {
+			saved, err := s.attachments.ListByConversation(ctx, filed.ConversationID)
+			if err != nil {
+				return fmt.Errorf("list attachments: %w", err)
+			}
+			if len(saved[filed.ID]) == 0 {
+				s.saveAttachments(ctx, job.Recipient, stream, filed, email.Attachments)
+			}
+		}
+		slog.Info("inbound email already filed", "job_id", job.ID, "to", job.Recipient, "message_id", filed.ID)
+		return nil
+	}
+
+	automated := automatedKind(job.EnvelopeFrom, email.Header)
+	if automated == models.AutomatedBounce {
+		raw, err := s.archive.Open(ctx, job.RawKey)
+		if err != nil {
+			return fmt.Errorf("open raw message: %w", err)
+		}
+		report, _ := parseDSN(raw)
+		raw.Close()
+		if report.Failed && report.MessageID != "" {
+			found, err := s.conversations.RecordBounce(ctx, job.MailboxID, report.MessageID, report.Reason)
+			if err != nil {
+				return fmt.Errorf("record bounce: %w", err)
+			}
+			if found {
+				slog.Info("bounce recorded on outbound message",
+					"to", job.Recipient, "message_id", report.MessageID, "reason", report.Reason)
+				return nil
+			}
+		}
+	}
+
+	_, msg, err := s.conversations.ReceiveEmail(ctx, stream, conversation.InboundEmail{
+		Subject:       email.Subject,
+		SenderAddress: email.SenderAddress,
+		SenderName:    email.SenderName,
+		Body:          email.Body,
+		BodyHTML:      email.BodyHTML,
+		MessageID:     email.MessageID,
+		InReplyTo:     email.InReplyTo,
+		References:    email.References,
+		Recipient:     job.Recipient,
+		ReplyToken:    job.ReplyToken,
+		RawKey:        job.RawKey,
+		InboundJobID:  job.ID,
+		Helo:          job.Helo,
+		TLS:           job.TLS,
+		AuthResults:   job.AuthResults,
+		AuthVerdict:   job.AuthVerdict,
+		Quarantine:    job.Quarantine,
+		Automated:     automated,
+		Header:        email.Header,
+		RemoteIP:      net.ParseIP(job.RemoteIP),
+	})
+	if errors.Is(err, conversation.ErrDiscarded) {
+		slog.Info("inbound email discarded by filter rule",
+			"from", email.SenderAddress, "to", job.Recipient)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("create conversation: %w", err)
+	}
+
+	s.saveAttachments(ctx, job.Recipient, stream, msg, email.Attachments)
+
+	slog.Info("inbound email processed",
+		"from", email.SenderAddress,
+		"to", job.Recipient,
+		"subject", email.Subject,
+	)
+	return nil
+}
+
+// errReader remembers the first read error other than io.EOF, which the
+// MIME parser would otherwise treat as the end of a part.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,171 @@
+package inbound
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// memQueue is an in-memory InboundQueueStore. Pending jobs are claimed in
+// order, whether they are due or not.
+type memQueue struct {
+	jobs   []*models.InboundJob
+	nextID int64
+}
+
+func (q *memQueue) EnqueueInbound(_ context.Context, job *models.InboundJob) error {
+	q.nextID++
+	job.ID = q.nextID
+	job.Status = models.InboundPending
+	job.CreatedAt = time.Now()
+	job.NextAttemptAt = job.CreatedAt
+	j := *job
+	q.jobs = append(q.jobs, &j)
+	return nil
+}
+
+func (q *memQueue) ClaimInbound(_ context.Context, _ time.Duration) (*models.InboundJob, error) {
+	for _, j := range q.jobs {
+		if j.Status == models.InboundPending {
+			j.Status = models.InboundProcessing
+			j.Attempts++
+			claimed := *j
+			return &claimed, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (q *memQueue) find(id int64) (int, *models.InboundJob) {
+	for i, j := range q.jobs {
+		if j.ID == id {
+			return i, j
+		}
+	}
+	return -1, nil
+}
+
+func (q *memQueue) CompleteInbound(_ context.Context, id int64) error {
+	if i, _ := q.find(id); i >= 0 {
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+	}
+	return nil
+}
+
+func (q *memQueue) RetryInbound(_ context.Context, id int64, next time.Time, lastError string) error {
+	if _, j := q.find(id); j != nil {
+		j.Status, j.NextAttemptAt, j.LastError = models.InboundPending, next, lastError
+	}
+	return nil
+}
+
+func (q *memQueue) FailInbound(_ context.Context, id int64, lastError string) error {
+	if _, j := q.find(id); j != nil {
+		j.Status, j.LastError = models.InboundDead, lastError
+	}
+	return nil
+}
+
+func (q *memQueue) GetFailedInboundByMailboxID(_ context.Context, mailboxID int64) ([]models.InboundJob, error) {
+	var out []models.InboundJob
+	for _, j := range q.jobs {
+		if j.MailboxID == mailboxID && j.LastError != "" {
+			out = append(out, *j)
+		}
+	}
+	return out, nil
+}
+
+func (q *memQueue) RequeueInbound(_ context.Context, mailboxID, id int64) error {
+	_, j := q.find(id)
+	if j == nil || j.MailboxID != mailboxID || j.Status == models.InboundProcessing {
+		return sql.ErrNoRows
+	}
+	j.Status, j.Attempts, j.NextAttemptAt = models.InboundPending, 0, time.Now()
+	return nil
+}
+
+func (q *memQueue) DeleteInbound(_ context.Context, mailboxID, id int64) error {
+	i, j := q.find(id)
+	if j == nil || j.MailboxID != mailboxID || j.Status == models.InboundProcessing {
+		return sql.ErrNoRows
+	}
+	q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+	return nil
+}
+
+func TestProcess_RetriesThenDeadLetters(t *testing.T) {
+	convs := &deliveryStore{}
+	// The stream is missing from the store, so filing the message fails.
+	srv, jobs := newQueueServer(t, convs)
+	stream := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	sess := &session{server: srv, from: "alice@example.org", recipients: []recipient{{addr: "support@example.com", stream: &stream}}}
+
+	if err := dataResult(enqueueRaw(sess, []byte("From: alice@example.org\r\nSubject: Hi\r\n\r\nHello"))); err != nil {
+		t.Fatalf("expected message to be accepted into the queue, got %v", err)
+	}
+
+	before := time.Now()
+	srv.processNext(context.Background())
+	job := jobs.jobs[0]
+	if job.Status != models.InboundPending || job.Attempts != 1 || job.LastError == "" {
+		t.Fatalf("expected failed job to wait for a retry, got %+v", job)
+	}
+	if job.NextAttemptAt.Before(before.Add(backoff.Base)) {
+		t.Errorf("expected retry to be delayed by %v, got %v", backoff.Base, job.NextAttemptAt.Sub(before))
+	}
+
+	drain(srv)
+	if job.Status != models.InboundDead || job.Attempts != maxAttempts {
+		t.Fatalf("expected job to be dead after %d attempts, got %+v", maxAttempts, job)
+	}
+	if failed, _ := srv.queue.Failed(context.Background(), 1); len(failed) != 1 {
+		t.Errorf("expected dead letter to be listed, got %d", len(failed))
+	}
+
+	if err := srv.queue.Retry(context.Background(), 2, job.ID); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound for another mailbox, got %v", err)
+	}
+	if err := srv.queue.Retry(context.Background(), 1, job.ID); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	srv.streams.(*routeStore).streams = []models.Stream{stream}
+	drain(srv)
+	if len(jobs.jobs) != 0 || len(convs.conversations) != 1 {
+		t.Errorf("expected retried job to be delivered, got %d jobs and %d conversations", len(jobs.jobs), len(convs.conversations))
+	}
+}
+
+func TestProcess_ExpiredLeaseDoesNotFileTwice(t *testing.T) {
+	convs := &deliveryStore{}
+	stream := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	srv, jobs := newQueueServer(t, convs, stream)
+	sess := &session{server: srv, from: "alice@example.org", recipients: []recipient{{addr: "support@example.com", stream: &stream}}}
+
+	if err := dataResult(enqueueRaw(sess, []byte("From: alice@example.org\r\nSubject: Hi\r\n\r\nHello"))); err != nil {
+		t.Fatalf("expected message to be accepted into the queue, got %v", err)
+	}
+
+	// The worker files the message but dies before completing the job, so
+	// its lease runs out and the job is claimed again.
+	job, err := jobs.ClaimInbound(context.Background(), claimLease)
+	if err != nil {
+		t.Fatalf("ClaimInbound: %v", err)
+	}
+	if err := srv.deliver(context.Background(), job); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	jobs.jobs[0].Status = models.InboundPending
+
+	drain(srv)
+	if len(jobs.jobs) != 0 {
+		t.Errorf("expected job to be completed, got %+v", jobs.jobs)
+	}
+	if len(convs.conversations) != 1 || len(convs.messages) != 1 {
+		t.Errorf("expected message to be filed once, got %d conversations and %d messages", len(convs.conversations), len(convs.messages))
+	}
+}
@@ -0,0 +1,84 @@
+package inbound
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/znz-systems/deaddrop/internal/rawmail"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// ReparseResult summarises a Reparse run.
+type ReparseResult struct {
+	Scanned int
+	Changed int
+	Failed  int
+}
+
+const reparseBatchSize = 100
+
+// Reparse runs the current parser over the stored raw source of every inbound
+// message and updates the sender and bodies of messages whose parsed content
+// has changed. With dryRun set, changes are only reported.
+func Reparse(ctx context.Context, messages store.ConversationStore, archive *rawmail.Archive, dryRun bool) (ReparseResult, error) {
+	var res ReparseResult
+	var afterID int64
+
+	for {
+		batch, err := messages.GetMessagesWithRaw(ctx, afterID, reparseBatchSize)
+		if err != nil {
+			return res, fmt.Errorf("list messages: %w", err)
+		}
+		if len(batch) == 0 {
+			return res, nil
+		}
+
+		for _, m := range batch {
+			afterID = m.ID
+			res.Scanned++
+
+			// The envelope sender is not archived; the stored address stands
+			// in for it when the message has no usable From header.
+			email, err := readArchived(ctx, archive, m.RawKey, m.SenderAddress)
+			if err != nil {
+				slog.Error("failed to read raw message", "message_id", m.ID, "key", m.RawKey, "error", err)
+				res.Failed++
+				continue
+			}
+			if email.SenderAddress == m.SenderAddress && email.SenderName == m.SenderName &&
+				email.Body == m.Body && email.BodyHTML == m.BodyHTML {
+				continue
+			}
+
+			res.Changed++
+			slog.Info("reparsed message differs", "message_id", m.ID, "dry_run", dryRun)
+			if dryRun {
+				continue
+			}
+			if err := messages.UpdateMessageContent(ctx, m.ID, email.SenderAddress, email.SenderName, email.Body, email.BodyHTML); err != nil {
+				return res, fmt.Errorf("update message %d: %w", m.ID, err)
+			}
+		}
+	}
+}
+
+// readArchived parses the archived message at key as it is read, like
+// deliver does. Only the text is compared, so the attachments are dropped
+// and their spool files removed.
+func readArchived(ctx context.Context, archive *rawmail.Archive, key, envelopeFrom string) (parsedEmail, error) {
+	raw, err := archive.Open(ctx, key)
+	if err != nil {
+		return parsedEmail{}, err
+	}
+	defer raw.Close()
+
+	src := &errReader{r: raw}
+	email := readEmail(src, envelopeFrom)
+	removeSpooled(email.Attachments)
+	email.Attachments = nil
+	if src.err != nil {
+		return parsedEmail{}, src.err
+	}
+	return email, nil
+}
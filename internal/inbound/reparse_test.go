@@ -0,0 +1,131 @@
+package inbound
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/znz-systems/deaddrop/internal/blob"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/rawmail"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// reparseStore implements the message methods Reparse uses; the embedded
+// interface panics if anything else is called.
+type reparseStore struct {
+	store.ConversationStore
+	messages    []models.ConversationMessage
+	updated     map[int64]string
+	updatedHTML map[int64]string
+}
+
+func (s *reparseStore) GetMessagesWithRaw(_ context.Context, afterID int64, limit int) ([]models.ConversationMessage, error) {
+	var out []models.ConversationMessage
+	for _, m := range s.messages {
+		if m.ID > afterID && len(out) < limit {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+func (s *reparseStore) UpdateMessageContent(_ context.Context, id int64, _, _, body, bodyHTML string) error {
+	s.updated[id] = body
+	s.updatedHTML[id] = bodyHTML
+	return nil
+}
+
+func newReparseFixture(t *testing.T) (*reparseStore, *rawmail.Archive) {
+	t.Helper()
+	blobs, err := blob.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFSStore: %v", err)
+	}
+	archive := rawmail.NewArchive(blobs)
+
+	raw := []byte("From: Alice <alice@example.com>\r\nSubject: Hi\r\nContent-Type: text/html\r\n\r\n<p>Hello <b>there</b></p>")
+	key, err := archive.Put(context.Background(), raw)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	st := &reparseStore{
+		messages: []models.ConversationMessage{
+			// Stored by an older parser that kept the HTML tags.
+			{ID: 1, SenderAddress: "alice@example.com", SenderName: "Alice", Body: "<p>Hello <b>there</b></p>", RawKey: key},
+			{ID: 2, SenderAddress: "alice@example.com", SenderName: "Alice", Body: "Hello there", BodyHTML: "<p>Hello <b>there</b></p>", RawKey: key},
+		},
+		updated:     make(map[int64]string),
+		updatedHTML: make(map[int64]string),
+	}
+	return st, archive
+}
+
+func TestReparse_UpdatesChangedMessages(t *testing.T) {
+	st, archive := newReparseFixture(t)
+
+	res, err := Reparse(context.Background(), st, archive, false)
+	if err != nil {
+		t.Fatalf("Reparse: %v", err)
+	}
+	if res.Scanned != 2 || res.Changed != 1 || res.Failed != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got := st.updated[1]; got != "Hello there" {
+		t.Errorf("expected message 1 body to be reparsed, got %q", got)
+	}
+	if got := st.updatedHTML[1]; got != "<p>Hello <b>there</b></p>" {
+		t.Errorf("expected message 1 to gain its HTML body, got %q", got)
+	}
+	if _, ok := st.updated[2]; ok {
+		t.Error("expected unchanged message 2 not to be updated")
+	}
+}
+
+func TestReparse_DryRunDoesNotUpdate(t *testing.T) {
+	st, archive := newReparseFixture(t)
+
+	res, err := Reparse(context.Background(), st, archive, true)
+	if err != nil {
+		t.Fatalf("Reparse: %v", err)
+	}
+	if res.Changed != 1 {
+		t.Fatalf("expected 1 changed message, got %d", res.Changed)
+	}
+	if len(st.updated) != 0 {
+		t.Fatalf("expected no updates in dry run, got %v", st.updated)
+	}
+}
+
+func TestReparse_RemovesSpooledAttachments(t *testing.T) {
+	st, archive := newReparseFixture(t)
+	raw := "From: Alice <alice@example.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"mix\"\r\n" +
+		"\r\n" +
+		"--mix\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--mix\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"backup.bin\"\r\n" +
+		"\r\n" +
+		strings.Repeat("0123456789abcdef", spoolThreshold/8) + "\r\n" +
+		"--mix--\r\n"
+	key, err := archive.Put(context.Background(), []byte(raw))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	st.messages = []models.ConversationMessage{{ID: 1, SenderAddress: "alice@example.com", Body: "See attached.", RawKey: key}}
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	if _, err := Reparse(context.Background(), st, archive, true); err != nil {
+		t.Fatalf("Reparse: %v", err)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("expected spooled attachments to be removed, found %d files", len(left))
+	}
+}
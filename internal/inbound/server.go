@@ -3,6 +3,8 @@ package inbound
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"html"
@@ -11,79 +13,337 @@ import (
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net"
 	"net/mail"
+	"net/netip"
 	"net/textproto"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/emersion/go-smtp"
+	"github.com/znz-systems/deaddrop/internal/attachment"
 	"github.com/znz-systems/deaddrop/internal/conversation"
+	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/mailauth"
 	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/proxyproto"
+	"github.com/znz-systems/deaddrop/internal/rawmail"
+	"github.com/znz-systems/deaddrop/internal/routing"
 	"github.com/znz-systems/deaddrop/internal/store"
 )
 
+// Config configures the inbound SMTP listeners.
+type Config struct {
+	Addr   string
+	Domain string
+
+	// TLSConfig enables STARTTLS on Addr. ImplicitTLSAddr, if set, also
+	// accepts connections that start with a TLS handshake (SMTPS).
+	TLSConfig       *tls.Config
+	ImplicitTLSAddr string
+
+	// Resolver is used to evaluate SPF, DKIM and DMARC. Nil disables the
+	// checks.
+	Resolver domain.DNSResolver
+
+	// Workers is the number of goroutines filing queued messages. It
+	// defaults to 4.
+	Workers int
+
+	// MaxMessageBytes is the largest message accepted, advertised with the
+	// SIZE extension. Streams can set a lower limit. It defaults to 25 MB.
+	MaxMessageBytes int64
+
+	// Limits caps connections and message rates and lists allowed and
+	// denied networks.
+	Limits Limits
+
+	// Greylist, if set, greylists recipients of clients that are not on
+	// the allow list.
+	Greylist *Greylist
+
+	// TrustedProxies lists load balancers allowed to send a PROXY protocol
+	// header naming the real client on the SMTP listeners. Connections
+	// from them must start with one.
+	TrustedProxies []netip.Prefix
+
+	// LMTPAddr, if set, also accepts mail from an MTA over LMTP, on a Unix
+	// socket ("/path" or "unix:/path") or a TCP address. Addr may then be
+	// empty to run without an SMTP listener.
+	LMTPAddr string
+
+	// LMTPRecipientHeader names a header, such as X-Original-To or
+	// Delivered-To, that the MTA sets to the original recipient. It is
+	// trusted to route LMTP deliveries, see LMTPData.
+	LMTPRecipientHeader string
+}
+
+const (
+	// maxRecipients is the number of RCPT TO commands accepted per
+	// transaction, the minimum RFC 5321 requires servers to buffer.
+	maxRecipients = 100
+
+	defaultMaxMessageBytes = 25 << 20
+
+	// spoolThreshold is the size above which an attachment is written to a
+	// temporary file while a message is parsed, rather than kept in memory.
+	spoolThreshold = 1 << 20
+
+	// fallbackLimit is how much of the start of a message is kept for a
+	// plain text body when it cannot be parsed as MIME.
+	fallbackLimit = 1 << 20
+
+	// textLimit is how much of a text part is read into memory. The rest
+	// is skipped.
+	textLimit = 1 << 20
+)
+
 type Server struct {
-	smtpServer    *smtp.Server
-	streams       store.StreamStore
-	conversations *conversation.Service
+	smtpServer      *smtp.Server
+	implicitTLSAddr string
+	lmtpServer      *smtp.Server
+	lmtpHeader      string
+	resolver        domain.DNSResolver
+	limiter         *connLimiter
+	trustedProxies  []netip.Prefix
+	greylist        *Greylist
+	streams         store.StreamStore
+	queue           *Queue
+	workers         int
+	stopWorkers     context.CancelFunc
+	workersDone     sync.WaitGroup
+	conversations   *conversation.Service
+	attachments     *attachment.Service
+	archive         *rawmail.Archive
 }
 
-func NewServer(addr, domain string, streams store.StreamStore, conversations *conversation.Service) *Server {
+func NewServer(cfg Config, streams store.StreamStore, queue *Queue, conversations *conversation.Service, attachments *attachment.Service, archive *rawmail.Archive) *Server {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 4
+	}
 	s := &Server{
-		streams:       streams,
-		conversations: conversations,
+		implicitTLSAddr: cfg.ImplicitTLSAddr,
+		resolver:        cfg.Resolver,
+		limiter:         newConnLimiter(cfg.Limits),
+		trustedProxies:  cfg.TrustedProxies,
+		greylist:        cfg.Greylist,
+		streams:         streams,
+		queue:           queue,
+		workers:         workers,
+		stopWorkers:     func() {},
+		conversations:   conversations,
+		attachments:     attachments,
+		archive:         archive,
+	}
+
+	s.smtpServer = s.newSMTPServer(cfg, cfg.Addr, false)
+	if cfg.LMTPAddr != "" {
+		s.lmtpServer = s.newSMTPServer(cfg, cfg.LMTPAddr, true)
+		s.lmtpHeader = cfg.LMTPRecipientHeader
 	}
+	return s
+}
 
+// newSMTPServer returns the protocol server for a listener, speaking LMTP
+// instead of SMTP if lmtp is set.
+func (s *Server) newSMTPServer(cfg Config, addr string, lmtp bool) *smtp.Server {
 	smtpSrv := smtp.NewServer(s)
 	smtpSrv.Addr = addr
-	smtpSrv.Domain = domain
+	smtpSrv.LMTP = lmtp
+	smtpSrv.Domain = cfg.Domain
 	smtpSrv.ReadTimeout = 30 * time.Second
 	smtpSrv.WriteTimeout = 30 * time.Second
-	smtpSrv.MaxMessageBytes = 10 * 1024 * 1024 // 10MB
-	smtpSrv.MaxRecipients = 1
-	smtpSrv.AllowInsecureAuth = true
-
-	s.smtpServer = smtpSrv
-	return s
+	smtpSrv.MaxMessageBytes = cfg.MaxMessageBytes
+	if smtpSrv.MaxMessageBytes <= 0 {
+		smtpSrv.MaxMessageBytes = defaultMaxMessageBytes
+	}
+	smtpSrv.MaxRecipients = maxRecipients
+	// STARTTLS is advertised whenever a TLS config is set.
+	smtpSrv.TLSConfig = cfg.TLSConfig
+	smtpSrv.AllowInsecureAuth = cfg.TLSConfig == nil
+	return smtpSrv
 }
 
+// ErrNoListener is returned by Start when neither an SMTP nor an LMTP
+// address is configured.
+var ErrNoListener = errors.New("inbound: no SMTP or LMTP address configured")
+
+// Start starts the queue workers and serves the plaintext/STARTTLS
+// listener and, if configured, the implicit-TLS and LMTP listeners. It
+// returns when any listener fails, or nil once Shutdown is called.
 func (s *Server) Start() error {
-	slog.Info("inbound SMTP server starting", "addr", s.smtpServer.Addr)
-	return s.smtpServer.ListenAndServe()
+	if s.smtpServer.Addr == "" && s.implicitTLSAddr == "" && s.lmtpServer == nil {
+		return ErrNoListener
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWorkers = cancel
+	for range s.workers {
+		s.workersDone.Add(1)
+		go func() {
+			defer s.workersDone.Done()
+			s.work(ctx)
+		}()
+	}
+
+	errc := make(chan error, 3)
+
+	if s.smtpServer.Addr != "" {
+		slog.Info("inbound SMTP server starting", "addr", s.smtpServer.Addr, "starttls", s.smtpServer.TLSConfig != nil)
+		go func() {
+			l, err := s.listen(s.smtpServer.Addr)
+			if err != nil {
+				errc <- err
+				return
+			}
+			errc <- s.smtpServer.Serve(&limitListener{Listener: l, limiter: s.limiter, greet: true})
+		}()
+	}
+
+	if s.implicitTLSAddr != "" {
+		slog.Info("inbound SMTPS server starting", "addr", s.implicitTLSAddr)
+		go func() {
+			l, err := s.listen(s.implicitTLSAddr)
+			if err != nil {
+				errc <- err
+				return
+			}
+			// Connections are counted before the handshake, so refused ones
+			// cost no TLS work.
+			limited := &limitListener{Listener: l, limiter: s.limiter}
+			errc <- s.smtpServer.Serve(tls.NewListener(limited, s.smtpServer.TLSConfig))
+		}()
+	}
+
+	if s.lmtpServer != nil {
+		slog.Info("inbound LMTP server starting", "addr", s.lmtpServer.Addr)
+		go func() {
+			l, err := listenLMTP(s.lmtpServer.Addr)
+			if err != nil {
+				errc <- err
+				return
+			}
+			// The MTA in front controls its own concurrency, so the
+			// connection limits do not apply.
+			errc <- s.lmtpServer.Serve(l)
+		}()
+	}
+
+	return <-errc
 }
 
-func (s *Server) Shutdown() error {
-	return s.smtpServer.Close()
+// listen listens for SMTP on a TCP address. Behind trusted proxies the
+// PROXY protocol header is read first, so that limits, SPF and logs see the
+// real client.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || len(s.trustedProxies) == 0 {
+		return l, err
+	}
+	return &proxyproto.Listener{Listener: l, Trusted: s.trustedProxies}, nil
+}
+
+// Shutdown closes the listeners, waits for open sessions to end and stops
+// the workers. Jobs being processed are claimed again once their lease
+// expires. If ctx ends first, Shutdown returns its error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.smtpServer.Shutdown(ctx)
+	if s.lmtpServer != nil {
+		if lerr := s.lmtpServer.Shutdown(ctx); err == nil {
+			err = lerr
+		}
+	}
+	s.stopWorkers()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.workersDone.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
 }
 
 // NewSession implements smtp.Backend.
-func (s *Server) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &session{server: s}, nil
+func (s *Server) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{server: s, conn: c, lmtp: c.Server().LMTP}, nil
 }
 
 type session struct {
-	server *Server
-	from   string
-	to     string
-	stream *models.Stream
+	server     *Server
+	conn       *smtp.Conn
+	lmtp       bool // delivered by an MTA over LMTP
+	from       string
+	size       int64 // SIZE declared with MAIL FROM, if any
+	recipients []recipient
+}
+
+// recipient is an accepted RCPT TO address and the stream it resolved to.
+// The stream of an LMTP recipient is nil until LMTPData resolves it from the
+// trusted header.
+type recipient struct {
+	addr       string
+	stream     *models.Stream
+	replyToken string
+
+	// rcptTo holds the address as given in each RCPT TO naming it, which
+	// LMTP statuses are reported for.
+	rcptTo []string
+}
+
+var errRateLimited = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "too many messages from your address, try again later",
 }
 
-func (s *session) Mail(from string, _ *smtp.MailOptions) error {
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if ip := s.remoteAddr(); !s.server.limiter.allowMessage(ip) {
+		slog.Warn("inbound email rate limited", "remote_ip", ip, "from", from)
+		return errRateLimited
+	}
 	s.from = from
+	if opts != nil {
+		s.size = opts.Size
+	}
 	return nil
 }
 
 func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
-	// Look up the stream by recipient address.
 	addr := strings.ToLower(strings.TrimSpace(to))
-	stream, err := s.server.streams.GetStreamByAddress(context.Background(), addr)
-	if err != nil {
+	for i, rcpt := range s.recipients {
+		if rcpt.addr == addr {
+			s.recipients[i].rcptTo = append(rcpt.rcptTo, to)
+			return nil
+		}
+	}
+
+	stream, replyToken, err := s.server.resolveStream(context.Background(), addr)
+	if errors.Is(err, sql.ErrNoRows) && s.lmtp && s.server.lmtpHeader != "" {
+		// The MTA may have rewritten the address; the trusted header can
+		// still name a stream.
+		s.recipients = append(s.recipients, recipient{addr: addr, rcptTo: []string{to}})
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
 		slog.Warn("inbound email to unknown address", "to", addr)
+		return errNoSuchRecipient
+	}
+	if err != nil {
+		slog.Error("failed to look up inbound recipient", "to", addr, "error", err)
 		return &smtp.SMTPError{
-			Code:         550,
-			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
-			Message:      "no such recipient",
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "temporary failure looking up recipient",
 		}
 	}
 
@@ -95,50 +355,384 @@ func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
 		}
 	}
 
-	s.to = addr
-	s.stream = stream
+	if tooLarge(stream, s.size) {
+		return errTooLargeForRecipient
+	}
+
+	if !s.judgedAlike(stream) {
+		return errSplitTransaction
+	}
+
+	if err := s.checkGreylist(addr); err != nil {
+		return err
+	}
+
+	s.recipients = append(s.recipients, recipient{addr: addr, stream: stream, replyToken: replyToken, rcptTo: []string{to}})
+	return nil
+}
+
+// errSplitTransaction asks the client to send the message to a recipient
+// again in a later transaction, as it does when a server limits the number
+// of recipients.
+var errSplitTransaction = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+	Message:      "too many recipients with different limits, send again for this one",
+}
+
+// judgedAlike reports whether a message to stream is certain to be accepted
+// or refused after DATA exactly as for the recipients accepted so far.
+// SMTP has one reply for all of them, so a recipient refused while another
+// is accepted would be lost without a bounce. Such a recipient is deferred
+// with errSplitTransaction instead. Without a declared SIZE that means the
+// streams must have the same size limit, and when the sender is
+// authenticated the same choice of whether failing mail is rejected. LMTP
+// replies for each recipient, so anything goes there.
+func (s *session) judgedAlike(stream *models.Stream) bool {
+	if s.lmtp || len(s.recipients) == 0 {
+		return true
+	}
+	// Every accepted recipient was judged alike with the first.
+	first := s.recipients[0].stream
+	if s.size == 0 && first.MaxMessageBytes != stream.MaxMessageBytes {
+		return false
+	}
+	rejects := func(st *models.Stream) bool { return st.AuthPolicy == models.AuthPolicyReject }
+	return s.server.resolver == nil || rejects(first) == rejects(stream)
+}
+
+var errGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "greylisted, please try again later",
+}
+
+// checkGreylist returns errGreylisted if delivery to addr is greylisted.
+// Clients on the allow list are not greylisted, and neither is anyone if
+// the greylist cannot be consulted.
+func (s *session) checkGreylist(addr string) error {
+	ip := s.remoteAddr()
+	if s.server.greylist == nil || s.server.limiter.allowed(ip) {
+		return nil
+	}
+	pass, err := s.server.greylist.Pass(context.Background(), ip, s.from, addr)
+	if err != nil {
+		slog.Error("failed to check greylist", "remote_ip", ip, "to", addr, "error", err)
+		return nil
+	}
+	if !pass {
+		slog.Info("inbound email greylisted", "remote_ip", ip, "from", s.from, "to", addr)
+		return errGreylisted
+	}
 	return nil
 }
 
+// resolveStream finds the email stream for a recipient address and returns
+// the reply token carried in its sub-address, if any. An exact address wins.
+// Replies to our outbound mail go to a sub-address carrying the
+// conversation's reply token and are routed to the base address. Anything
+// else is matched against the plus-tag, pattern and catch-all streams on the
+// recipient's domain. It returns sql.ErrNoRows if no stream matches.
+func (s *Server) resolveStream(ctx context.Context, addr string) (*models.Stream, string, error) {
+	stream, err := s.streams.GetStreamByAddress(ctx, addr)
+	if err == nil {
+		return stream, "", nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, "", err
+	}
+
+	if base, token, ok := conversation.SplitReplyAddress(addr); ok {
+		stream, err = s.streams.GetStreamByAddress(ctx, base)
+		if err == nil {
+			return stream, token, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, "", err
+		}
+	}
+
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return nil, "", sql.ErrNoRows
+	}
+	streams, err := s.streams.GetEmailStreamsByDomain(ctx, addr[at+1:])
+	if err != nil {
+		return nil, "", err
+	}
+	if stream := routing.Resolve(streams, addr); stream != nil {
+		return stream, "", nil
+	}
+	return nil, "", sql.ErrNoRows
+}
+
+var (
+	errNoSuchRecipient = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "no such recipient",
+	}
+	errAuthRejected = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "message failed sender authentication",
+	}
+	errTooLargeForRecipient = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "message too large for recipient",
+	}
+	errLargerThanDeclared = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "message larger than the SIZE declared",
+	}
+)
+
+// tooLarge reports whether a message of size bytes exceeds the stream's own
+// limit. The server-wide limit is enforced while the message is read.
+func tooLarge(stream *models.Stream, size int64) bool {
+	return stream.MaxMessageBytes > 0 && size > stream.MaxMessageBytes
+}
+
+// Data spools the message to a temporary file instead of memory, then
+// queues it. Reading fails with 552 once the message exceeds the server's
+// size limit, so nothing is ever truncated.
 func (s *session) Data(r io.Reader) error {
-	if s.stream == nil {
+	if len(s.recipients) == 0 {
 		return errors.New("no valid recipient")
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r, 10*1024*1024))
+	spool, size, err := s.spool(r)
 	if err != nil {
 		return err
 	}
+	defer closeSpool(spool)
 
-	// Parse the email to extract subject and plain text body.
-	email := parseEmail(body, s.from)
+	// Recipients were checked against the declared size only, so a larger
+	// message might suit some of them and not others.
+	if s.size > 0 && size > s.size {
+		slog.Warn("inbound email larger than declared", "from", s.from, "size", size, "declared", s.size)
+		return errLargerThanDeclared
+	}
 
-	_, err = s.server.conversations.StartConversation(
-		context.Background(),
-		s.stream,
-		email.Subject,
-		email.SenderAddress,
-		email.SenderName,
-		email.Body,
-	)
+	return dataResult(s.enqueue(context.Background(), s.recipients, spool, size))
+}
+
+// spool copies the message to a temporary file, to be removed with
+// closeSpool.
+func (s *session) spool(r io.Reader) (*os.File, int64, error) {
+	spool, err := os.CreateTemp("", "deaddrop-inbound-*.eml")
 	if err != nil {
-		slog.Error("failed to create conversation from inbound email",
-			"from", s.from, "to", s.to, "error", err)
-		return err
+		slog.Error("failed to create inbound spool file", "error", err)
+		return nil, 0, errSpoolFailed
 	}
 
-	slog.Info("inbound email processed",
-		"from", email.SenderAddress,
-		"to", s.to,
-		"subject", email.Subject,
-	)
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		closeSpool(spool)
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return nil, 0, smtpErr
+		}
+		slog.Error("failed to spool inbound email", "from", s.from, "error", err)
+		return nil, 0, errSpoolFailed
+	}
+	return spool, size, nil
+}
+
+func closeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+var errSpoolFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "temporary failure queueing message",
+}
+
+// enqueue queues the spooled message of the given size for every recipient
+// and returns one result per recipient. Only what decides the reply happens
+// during the session: size and authentication checks, which can reject the
+// message, archiving the source and queueing one job per mailbox.
+// Recipients that share a mailbox share its job and result. The workers do
+// the rest, see deliver.
+func (s *session) enqueue(ctx context.Context, recipients []recipient, msg io.ReadSeeker, size int64) []error {
+	auth, verdict := s.authenticate(msg)
+	var authHeader string
+	if auth != "" {
+		authHeader = "Authentication-Results: " + auth + "\r\n"
+	}
+
+	var remoteIP string
+	if ip := s.remoteIP(); ip != nil {
+		remoteIP = ip.String()
+	}
+
+	results := make([]error, len(recipients))
+	queued := make(map[int64]int) // mailbox ID -> recipient index
+	rawKey := ""
+	for i, rcpt := range recipients {
+		if j, ok := queued[rcpt.stream.MailboxID]; ok {
+			results[i] = results[j]
+			continue
+		}
+
+		if tooLarge(rcpt.stream, size) {
+			slog.Warn("inbound email too large for stream",
+				"from", s.from, "to", rcpt.addr, "size", size, "limit", rcpt.stream.MaxMessageBytes)
+			results[i] = errTooLargeForRecipient
+			continue
+		}
+
+		if verdict == mailauth.VerdictFail && rcpt.stream.AuthPolicy == models.AuthPolicyReject {
+			slog.Warn("inbound email rejected by authentication policy",
+				"from", s.from, "to", rcpt.addr, "results", auth)
+			results[i] = errAuthRejected
+			continue
+		}
+		queued[rcpt.stream.MailboxID] = i
+
+		// The archived source is what the workers read, so the message
+		// cannot be accepted without it.
+		if rawKey == "" {
+			var key string
+			_, err := msg.Seek(0, io.SeekStart)
+			if err == nil {
+				key, err = s.server.archive.PutReader(ctx, io.MultiReader(strings.NewReader(authHeader), msg))
+			}
+			if err != nil {
+				slog.Error("failed to archive raw inbound email", "to", rcpt.addr, "error", err)
+				results[i] = errSpoolFailed
+				continue
+			}
+			rawKey = key
+		}
+
+		err := s.server.queue.enqueue(ctx, &models.InboundJob{
+			MailboxID:    rcpt.stream.MailboxID,
+			StreamID:     rcpt.stream.ID,
+			Recipient:    rcpt.addr,
+			ReplyToken:   rcpt.replyToken,
+			EnvelopeFrom: s.from,
+			RawKey:       rawKey,
+			RemoteIP:     remoteIP,
+			Helo:         s.helo(),
+			TLS:          s.tlsVersion(),
+			AuthResults:  auth,
+			AuthVerdict:  string(verdict),
+			Quarantine:   verdict == mailauth.VerdictFail && rcpt.stream.AuthPolicy == models.AuthPolicyQuarantine,
+		})
+		if err != nil {
+			slog.Error("failed to queue inbound email", "from", s.from, "to", rcpt.addr, "error", err)
+			results[i] = errSpoolFailed
+		}
+	}
+	return results
+}
+
+// dataResult reduces per-recipient results to the single reply SMTP allows
+// after DATA. The message is accepted if it was delivered to any recipient:
+// failing the transaction would make the client resend it to the recipients
+// that already have it. Otherwise the first failure is returned. Rcpt only
+// accepts recipients the size and authentication checks judge alike, so
+// they never reject some recipients of an accepted message.
+func dataResult(results []error) error {
+	var failed error
+	for _, err := range results {
+		if err == nil {
+			return nil
+		}
+		if failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// authenticate evaluates SPF, DKIM and DMARC for the message and returns the
+// Authentication-Results value and verdict. Both are empty when checks are
+// disabled or the message cannot be read, and for LMTP, where the peer is
+// the MTA that already checked the sender.
+func (s *session) authenticate(msg io.ReadSeeker) (string, mailauth.Verdict) {
+	if s.server.resolver == nil || s.conn == nil || s.lmtp {
+		return "", ""
+	}
+	if _, err := msg.Seek(0, io.SeekStart); err != nil {
+		return "", ""
+	}
+	res := mailauth.Evaluate(s.server.resolver, mailauth.Input{
+		IP:       s.remoteIP(),
+		Helo:     s.conn.Hostname(),
+		MailFrom: s.from,
+		Message:  msg,
+	})
+	return res.Header(s.server.smtpServer.Domain), res.Verdict()
+}
+
+// remoteIP returns the address of the connecting client, if known.
+func (s *session) remoteIP() net.IP {
+	// An LMTP peer is the MTA, not the sender.
+	if s.conn == nil || s.lmtp {
+		return nil
+	}
+	if addr, ok := s.conn.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
 	return nil
 }
 
+// remoteAddr is remoteIP as a netip.Addr, or the zero Addr if unknown.
+func (s *session) remoteAddr() netip.Addr {
+	addr, _ := netip.AddrFromSlice(s.remoteIP())
+	return addr.Unmap()
+}
+
+// helo returns the name the client gave in HELO or EHLO, or "" for LMTP,
+// where the client is the MTA.
+func (s *session) helo() string {
+	if s.conn == nil || s.lmtp {
+		return ""
+	}
+	return s.conn.Hostname()
+}
+
+// tlsVersion describes the transport security of the session's connection:
+// the TLS version name, or "none" for plaintext. It is empty for LMTP, where
+// the sender's connection was to the MTA.
+func (s *session) tlsVersion() string {
+	if s.conn == nil || s.lmtp {
+		return ""
+	}
+	state, ok := s.conn.TLSConnectionState()
+	if !ok {
+		return "none"
+	}
+	return tls.VersionName(state.Version)
+}
+
+// saveAttachments stores the attachments that pass the stream's limits.
+// Rejected or failed attachments are logged; the message itself is kept.
+func (s *Server) saveAttachments(ctx context.Context, to string, stream *models.Stream, msg *models.ConversationMessage, files []attachment.File) {
+	for _, f := range files {
+		if err := attachment.CheckLimits(stream, f); err != nil {
+			slog.Warn("inbound attachment rejected",
+				"to", to, "filename", f.Filename, "content_type", f.ContentType,
+				"size", f.Len(), "reason", err)
+			continue
+		}
+		if _, err := s.attachments.Save(ctx, msg.ID, f); err != nil {
+			slog.Error("failed to store inbound attachment",
+				"to", to, "filename", f.Filename, "error", err)
+		}
+	}
+}
+
 func (s *session) Reset() {
 	s.from = ""
-	s.to = ""
-	s.stream = nil
+	s.size = 0
+	s.recipients = nil
 }
 
 func (s *session) Logout() error {
@@ -150,25 +744,53 @@ type parsedEmail struct {
 	SenderAddress string
 	SenderName    string
 	Body          string
+	BodyHTML      string
+	MessageID     string
+	InReplyTo     []string
+	References    []string
+	Attachments   []attachment.File
+	Header        mail.Header
+}
+
+// bodyParts collects what extractBodyFromHeader finds besides the text: the
+// first HTML rendition and the attachments.
+type bodyParts struct {
+	HTML        string
+	Attachments []attachment.File
 }
 
 var (
 	scriptStyleTagRe = regexp.MustCompile(`(?is)<(script|style)\b[^>]*>.*?</(script|style)>`)
 	htmlTagRe        = regexp.MustCompile(`(?s)<[^>]+>`)
+	messageIDRe      = regexp.MustCompile(`<[^<>\s]+>`)
 )
 
 // parseEmail extracts sender, subject, and a readable text body from raw MIME email bytes.
 func parseEmail(raw []byte, envelopeFrom string) parsedEmail {
+	return readEmail(bytes.NewReader(raw), envelopeFrom)
+}
+
+// readEmail is parseEmail for a message read from r, which is parsed as it
+// is read. Large attachments are spooled to temporary files that the caller
+// must remove with removeSpooled.
+func readEmail(r io.Reader, envelopeFrom string) parsedEmail {
 	email := parsedEmail{
 		SenderAddress: strings.TrimSpace(envelopeFrom),
 	}
 
-	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	// The start of the message is kept to fall back on if it cannot be
+	// parsed.
+	head := &headBuffer{max: fallbackLimit}
+	tr := io.TeeReader(r, head)
+
+	msg, err := mail.ReadMessage(tr)
 	if err != nil {
-		email.Body = fallbackBody(raw)
+		_, _ = io.Copy(io.Discard, io.LimitReader(tr, fallbackLimit))
+		email.Body = fallbackBody(head.Bytes())
 		return email
 	}
 
+	email.Header = msg.Header
 	email.Subject = decodeHeaderValue(msg.Header.Get("Subject"))
 	addr, name := parseFrom(msg.Header.Get("From"))
 	if addr != "" {
@@ -176,46 +798,83 @@ func parseEmail(raw []byte, envelopeFrom string) parsedEmail {
 	}
 	email.SenderName = name
 
-	body, err := extractBodyFromHeader(textproto.MIMEHeader(msg.Header), msg.Body)
+	if ids := parseMessageIDs(msg.Header.Get("Message-ID")); len(ids) > 0 {
+		email.MessageID = ids[0]
+	}
+	email.InReplyTo = parseMessageIDs(msg.Header.Get("In-Reply-To"))
+	email.References = parseMessageIDs(msg.Header.Get("References"))
+
+	var parts bodyParts
+	body, err := extractBodyFromHeader(textproto.MIMEHeader(msg.Header), msg.Body, &parts)
+	email.BodyHTML = parts.HTML
+	email.Attachments = parts.Attachments
 	if err != nil {
-		email.Body = fallbackBody(raw)
+		email.Body = fallbackBody(head.Bytes())
 	} else {
 		email.Body = strings.TrimSpace(body)
 	}
 
 	if email.Body == "" {
-		email.Body = fallbackBody(raw)
+		email.Body = fallbackBody(head.Bytes())
 	}
 
 	return email
 }
 
+// headBuffer keeps the first max bytes written to it and discards the rest.
+type headBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
 func parseFrom(rawFrom string) (address, name string) {
 	if strings.TrimSpace(rawFrom) == "" {
 		return "", ""
 	}
-	addr, err := mail.ParseAddress(rawFrom)
+	addr, err := addressParser.Parse(rawFrom)
 	if err != nil {
 		return "", ""
 	}
 	return strings.TrimSpace(addr.Address), decodeHeaderValue(addr.Name)
 }
 
+// parseMessageIDs extracts the angle-bracketed message identifiers from a
+// Message-ID, In-Reply-To or References header value.
+func parseMessageIDs(v string) []string {
+	return messageIDRe.FindAllString(v, -1)
+}
+
+// decodeHeaderValue decodes the RFC 2047 encoded words in a header value
+// and converts it to valid UTF-8. Raw 8-bit headers, which some clients
+// send without declaring a charset, have their charset guessed.
 func decodeHeaderValue(v string) string {
 	v = strings.TrimSpace(v)
 	if v == "" {
 		return ""
 	}
+	if !utf8.ValidString(v) {
+		v = decodeCharset([]byte(v), "")
+	}
 
-	decoded, err := new(mime.WordDecoder).DecodeHeader(v)
+	decoded, err := wordDecoder.DecodeHeader(v)
 	if err != nil {
-		return v
+		return sanitizeText(v)
 	}
 
-	return strings.TrimSpace(decoded)
+	return strings.TrimSpace(sanitizeText(decoded))
 }
 
-func extractBodyFromHeader(header textproto.MIMEHeader, body io.Reader) (string, error) {
+// extractBodyFromHeader returns the readable text of a MIME entity. The first
+// HTML part is also kept as is in parts, and parts that are attachments are
+// decoded and added to parts instead.
+func extractBodyFromHeader(header textproto.MIMEHeader, body io.Reader, parts *bodyParts) (string, error) {
 	contentType := header.Get("Content-Type")
 	if strings.TrimSpace(contentType) == "" {
 		contentType = "text/plain; charset=utf-8"
@@ -230,16 +889,9 @@ func extractBodyFromHeader(header textproto.MIMEHeader, body io.Reader) (string,
 	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
 	decodedReader := decodeTransferEncoding(body, encoding)
 
-	if strings.HasPrefix(mediaType, "multipart/") {
-		boundary := params["boundary"]
-		if boundary == "" {
-			b, readErr := io.ReadAll(decodedReader)
-			if readErr != nil {
-				return "", readErr
-			}
-			return strings.TrimSpace(string(b)), nil
-		}
-
+	// Without a boundary a multipart body cannot be split and is read as
+	// text below.
+	if boundary := params["boundary"]; strings.HasPrefix(mediaType, "multipart/") && boundary != "" {
 		mr := multipart.NewReader(decodedReader, boundary)
 		var plainBody string
 		var htmlBody string
@@ -253,7 +905,17 @@ func extractBodyFromHeader(header textproto.MIMEHeader, body io.Reader) (string,
 				return "", partErr
 			}
 
-			partBody, extractErr := extractBodyFromHeader(part.Header, part)
+			if isAttachmentPart(part.Header) {
+				if f, readErr := readAttachment(part.Header, part); readErr != nil {
+					slog.Warn("failed to read inbound attachment", "error", readErr)
+				} else {
+					parts.Attachments = append(parts.Attachments, f)
+				}
+				_ = part.Close()
+				continue
+			}
+
+			partBody, extractErr := extractBodyFromHeader(part.Header, part, parts)
 			_ = part.Close()
 			if extractErr != nil {
 				continue
@@ -288,23 +950,123 @@ func extractBodyFromHeader(header textproto.MIMEHeader, body io.Reader) (string,
 		return "", nil
 	}
 
-	b, err := io.ReadAll(decodedReader)
+	switch {
+	case mediaType == "message/rfc822":
+		nested, err := mail.ReadMessage(decodedReader)
+		if err != nil {
+			return "", err
+		}
+		return extractBodyFromHeader(textproto.MIMEHeader(nested.Header), nested.Body, parts)
+	case !strings.HasPrefix(mediaType, "text/") && !strings.HasPrefix(mediaType, "message/") &&
+		!strings.HasPrefix(mediaType, "multipart/"):
+		// A body that is not text, such as a PDF sent on its own, is kept
+		// as an attachment.
+		f, err := readAttachment(header, body)
+		if err != nil {
+			return "", err
+		}
+		parts.Attachments = append(parts.Attachments, f)
+		return "", nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(decodedReader, textLimit))
 	if err != nil {
 		return "", err
 	}
-	text := string(b)
 
-	switch mediaType {
-	case "text/html":
-		return strings.TrimSpace(htmlToText(text)), nil
-	case "message/rfc822":
-		nested, nestedErr := mail.ReadMessage(bytes.NewReader(b))
-		if nestedErr != nil {
-			return strings.TrimSpace(text), nil
+	charset := params["charset"]
+	if charset == "" && mediaType == "text/html" {
+		charset = htmlCharset(b)
+	}
+	text := decodeCharset(b, charset)
+
+	if mediaType == "text/html" {
+		if parts.HTML == "" {
+			parts.HTML = strings.TrimSpace(text)
 		}
-		return extractBodyFromHeader(textproto.MIMEHeader(nested.Header), nested.Body)
+		return strings.TrimSpace(htmlToText(text)), nil
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// isAttachmentPart reports whether a multipart part should be kept as an
+// attachment rather than read as message text.
+func isAttachmentPart(header textproto.MIMEHeader) bool {
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	disposition = strings.ToLower(disposition)
+	if disposition == "attachment" {
+		return true
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	mediaType = strings.ToLower(mediaType)
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"), mediaType == "message/rfc822":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		named := dispParams["filename"] != "" || params["name"] != ""
+		return named && disposition != "inline"
 	default:
-		return strings.TrimSpace(text), nil
+		return true
+	}
+}
+
+func readAttachment(header textproto.MIMEHeader, body io.Reader) (attachment.File, error) {
+	_, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	f := attachment.File{
+		Filename:    decodeHeaderValue(filename),
+		ContentType: strings.ToLower(mediaType),
+		ContentID:   strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>"),
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	decoded := decodeTransferEncoding(body, encoding)
+	data, err := io.ReadAll(io.LimitReader(decoded, spoolThreshold+1))
+	if err != nil {
+		return attachment.File{}, err
+	}
+	if len(data) <= spoolThreshold {
+		f.Data = data
+		return f, nil
+	}
+
+	// Too large to keep in memory: continue into a temporary file.
+	tmp, err := os.CreateTemp("", "deaddrop-attachment-*")
+	if err != nil {
+		return attachment.File{}, err
+	}
+	n, err := io.Copy(tmp, io.MultiReader(bytes.NewReader(data), decoded))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return attachment.File{}, err
+	}
+	f.Path, f.Size = tmp.Name(), n
+	return f, nil
+}
+
+// removeSpooled deletes the temporary files of spooled attachments.
+func removeSpooled(files []attachment.File) {
+	for _, f := range files {
+		if f.Path != "" {
+			os.Remove(f.Path)
+		}
 	}
 }
 
@@ -362,7 +1124,7 @@ func htmlToText(s string) string {
 func fallbackBody(raw []byte) string {
 	parts := strings.SplitN(string(raw), "\r\n\r\n", 2)
 	if len(parts) == 2 {
-		return strings.TrimSpace(parts[1])
+		return strings.TrimSpace(decodeCharset([]byte(parts[1]), ""))
 	}
-	return strings.TrimSpace(string(raw))
+	return strings.TrimSpace(decodeCharset(raw, ""))
 }
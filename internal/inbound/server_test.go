@@ -1,8 +1,36 @@
 package inbound
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/textproto"
+	"os"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/blob"
+	"github.com/znz-systems/deaddrop/internal/conversation"
+	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/rawmail"
+	"github.com/znz-systems/deaddrop/internal/store"
 )
 
 func TestParseEmail(t *testing.T) {
@@ -66,6 +94,9 @@ func TestParseEmail_MultipartAlternativePrefersText(t *testing.T) {
 	if email.Body != "Plain body" {
 		t.Errorf("expected plain body, got '%s'", email.Body)
 	}
+	if email.BodyHTML != "<div>HTML body</div>" {
+		t.Errorf("expected HTML rendition to be kept, got '%s'", email.BodyHTML)
+	}
 }
 
 func TestParseEmail_HTMLOnlyBody(t *testing.T) {
@@ -82,4 +113,1066 @@ func TestParseEmail_HTMLOnlyBody(t *testing.T) {
 	if email.Body != "test" {
 		t.Errorf("expected html body converted to text 'test', got '%s'", email.Body)
 	}
+	if !strings.Contains(email.BodyHTML, `<span style="font-size:14px">test</span>`) {
+		t.Errorf("expected decoded HTML body, got '%s'", email.BodyHTML)
+	}
+}
+
+func TestParseEmail_RelatedInlineImages(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: news@example.com",
+		"Subject: Newsletter",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/related; boundary=\"rel\"",
+		"",
+		"--rel",
+		"Content-Type: text/html; charset=\"iso-8859-1\"",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"<table><tr><td><img src=3D\"cid:logo@example.com\"></td><td>Caf=E9</td></tr></table>",
+		"--rel",
+		"Content-Type: image/png",
+		"Content-Transfer-Encoding: base64",
+		"Content-ID: <logo@example.com>",
+		"Content-Disposition: inline",
+		"",
+		"iVBORw0KGgo=",
+		"--rel--",
+		"",
+	}, "\r\n")
+
+	email := parseEmail([]byte(raw), "envelope@example.com")
+	if !strings.Contains(email.BodyHTML, "<td>Café</td>") {
+		t.Errorf("expected HTML body in UTF-8, got %q", email.BodyHTML)
+	}
+	if email.Body != "Café" {
+		t.Errorf("expected text rendition 'Café', got %q", email.Body)
+	}
+	if len(email.Attachments) != 1 || email.Attachments[0].ContentID != "logo@example.com" {
+		t.Fatalf("expected inline image with its content ID, got %+v", email.Attachments)
+	}
+}
+
+func TestParseEmail_ThreadingHeaders(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: alice@example.com",
+		"Subject: Re: Question",
+		"Message-ID: <reply-2@example.com>",
+		"In-Reply-To: <sent-1@deaddrop.test>",
+		"References: <orig-1@example.com>",
+		" <sent-1@deaddrop.test>",
+		"",
+		"Thanks!",
+		"",
+	}, "\r\n")
+
+	email := parseEmail([]byte(raw), "envelope@example.com")
+	if email.MessageID != "<reply-2@example.com>" {
+		t.Errorf("expected Message-ID <reply-2@example.com>, got '%s'", email.MessageID)
+	}
+	if len(email.InReplyTo) != 1 || email.InReplyTo[0] != "<sent-1@deaddrop.test>" {
+		t.Errorf("unexpected In-Reply-To: %v", email.InReplyTo)
+	}
+	if len(email.References) != 2 || email.References[0] != "<orig-1@example.com>" || email.References[1] != "<sent-1@deaddrop.test>" {
+		t.Errorf("unexpected References: %v", email.References)
+	}
+}
+
+func TestParseEmail_CollectsAttachments(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: Alice <alice@example.com>",
+		"Subject: Invoice",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=\"mix\"",
+		"",
+		"--mix",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Invoice attached.",
+		"--mix",
+		"Content-Type: application/pdf; name=\"invoice.pdf\"",
+		"Content-Disposition: attachment; filename=\"invoice.pdf\"",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"JVBERi0xLjQ=",
+		"--mix",
+		"Content-Type: image/png",
+		"Content-Disposition: inline; filename=\"=?UTF-8?Q?sch=C3=B6n.png?=\"",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"iVBORw0KGgo=",
+		"--mix--",
+		"",
+	}, "\r\n")
+
+	email := parseEmail([]byte(raw), "envelope@example.com")
+	if email.Body != "Invoice attached." {
+		t.Errorf("expected text body, got '%s'", email.Body)
+	}
+	if len(email.Attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(email.Attachments))
+	}
+
+	pdf := email.Attachments[0]
+	if pdf.Filename != "invoice.pdf" || pdf.ContentType != "application/pdf" || string(pdf.Data) != "%PDF-1.4" {
+		t.Errorf("unexpected pdf attachment: %+v", pdf)
+	}
+	png := email.Attachments[1]
+	if png.Filename != "schön.png" || png.ContentType != "image/png" {
+		t.Errorf("unexpected inline image attachment: name=%q type=%q", png.Filename, png.ContentType)
+	}
+}
+
+// charsetFixtures are real-world shapes of non-UTF-8 mail: legacy clients,
+// Japanese, Russian and Chinese mailers, and senders that get the charset
+// wrong or leave it out.
+var charsetFixtures = []struct {
+	name        string
+	raw         string
+	wantSubject string
+	wantName    string
+	wantBody    string
+}{
+	{
+		name: "iso-8859-1 quoted-printable",
+		raw: "From: =?ISO-8859-1?Q?Fran=E7ois_Dupr=E9?= <francois@example.fr>\r\n" +
+			"Subject: =?ISO-8859-1?Q?R=E9servation_confirm=E9e?=\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Caf=E9 cr=E8me =E0 10=A0h.\r\n",
+		wantSubject: "Réservation confirmée",
+		wantName:    "François Dupré",
+		wantBody:    "Café crème à 10 h.",
+	},
+	{
+		name: "windows-1252 8bit smart quotes",
+		raw: "From: Outlook User <user@example.com>\r\n" +
+			"Subject: Quote\r\n" +
+			"Content-Type: text/plain; charset=\"windows-1252\"\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"\x93Hello\x94 \x80 5\r\n",
+		wantSubject: "Quote",
+		wantName:    "Outlook User",
+		wantBody:    "“Hello” € 5",
+	},
+	{
+		name: "shift_jis",
+		raw: "From: =?Shift_JIS?B?gqiW4oKijYeC7YK5?= <info@example.jp>\r\n" +
+			"Subject: =?Shift_JIS?B?gqiW4oKijYeC7YK5?=\r\n" +
+			"Content-Type: text/plain; charset=Shift_JIS\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd\r\n",
+		wantSubject: "お問い合わせ",
+		wantName:    "お問い合わせ",
+		wantBody:    "こんにちは",
+	},
+	{
+		name: "iso-2022-jp without charset",
+		raw: "From: sender@example.jp\r\n" +
+			"Subject: =?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?=\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"\x1b$B$3$s$K$A$O\x1b(B\r\n",
+		wantSubject: "こんにちは",
+		wantBody:    "こんにちは",
+	},
+	{
+		name: "koi8-r",
+		raw: "From: =?KOI8-R?B?+sHLwdo=?= <zakaz@example.ru>\r\n" +
+			"Subject: =?koi8-r?B?+sHLwdo=?=\r\n" +
+			"Content-Type: text/plain; charset=koi8-r\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"\xf0\xd2\xc9\xd7\xc5\xd4, \xcd\xc9\xd2\r\n",
+		wantSubject: "Заказ",
+		wantName:    "Заказ",
+		wantBody:    "Привет, мир",
+	},
+	{
+		name: "gb2312 base64",
+		raw: "From: sales@example.cn\r\n" +
+			"Subject: =?GB2312?B?0a+82w==?=\r\n" +
+			"Content-Type: text/plain; charset=\"gb2312\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"xOO6w6OsysC95w==\r\n",
+		wantSubject: "询价",
+		wantBody:    "你好，世界",
+	},
+	{
+		name: "iso-8859-2 sender name",
+		raw: "From: =?ISO-8859-2?Q?Pawe=B3?= <pawel@example.pl>\r\n" +
+			"Subject: Hi\r\n" +
+			"\r\n" +
+			"Hello\r\n",
+		wantSubject: "Hi",
+		wantName:    "Paweł",
+		wantBody:    "Hello",
+	},
+	{
+		name: "8bit without charset",
+		raw: "From: old@example.de\r\n" +
+			"Subject: Gr\xfc\xdfe\r\n" +
+			"\r\n" +
+			"Sch\xf6ne Gr\xfc\xdfe\r\n",
+		wantSubject: "Grüße",
+		wantBody:    "Schöne Grüße",
+	},
+	{
+		name: "utf-8 mislabelled as latin-1",
+		raw: "From: web@example.com\r\n" +
+			"Subject: Order\r\n" +
+			"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"\r\n" +
+			"Na\xc3\xafve caf\xc3\xa9\r\n",
+		wantSubject: "Order",
+		wantBody:    "Naïve café",
+	},
+	{
+		name: "unknown charset",
+		raw: "From: app@example.com\r\n" +
+			"Subject: =?x-unknown?Q?Hi?=\r\n" +
+			"Content-Type: text/plain; charset=x-unknown\r\n" +
+			"\r\n" +
+			"caf\xc3\xa9\r\n",
+		wantSubject: "=?x-unknown?Q?Hi?=",
+		wantBody:    "café",
+	},
+	{
+		name: "html meta charset",
+		raw: "From: news@example.com\r\n" +
+			"Subject: News\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<html><head><meta http-equiv=\"Content-Type\" content=\"text/html; charset=windows-1251\"></head>" +
+			"<body><p>\xcf\xf0\xe8\xe2\xe5\xf2</p></body></html>\r\n",
+		wantSubject: "News",
+		wantBody:    "Привет",
+	},
+	{
+		name: "nul bytes",
+		raw: "From: bot@example.com\r\n" +
+			"Subject: Report\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"\r\n" +
+			"ok\x00 done\r\n",
+		wantSubject: "Report",
+		wantBody:    "ok done",
+	},
+}
+
+func TestParseEmail_Charsets(t *testing.T) {
+	for _, tt := range charsetFixtures {
+		t.Run(tt.name, func(t *testing.T) {
+			email := parseEmail([]byte(tt.raw), "envelope@example.com")
+			if email.Subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", email.Subject, tt.wantSubject)
+			}
+			if email.SenderName != tt.wantName {
+				t.Errorf("sender name = %q, want %q", email.SenderName, tt.wantName)
+			}
+			if email.Body != tt.wantBody {
+				t.Errorf("body = %q, want %q", email.Body, tt.wantBody)
+			}
+			for _, v := range []string{email.Subject, email.SenderName, email.Body} {
+				if !utf8.ValidString(v) || strings.ContainsRune(v, 0) {
+					t.Errorf("expected valid UTF-8 without NUL, got %q", v)
+				}
+			}
+		})
+	}
+}
+
+// routeStore implements the stream lookups resolveStream uses; the embedded
+// interface panics if anything else is called.
+type routeStore struct {
+	store.StreamStore
+	streams []models.Stream
+}
+
+func (s *routeStore) GetStreamByAddress(_ context.Context, address string) (*models.Stream, error) {
+	for i := range s.streams {
+		if s.streams[i].Address == address {
+			return &s.streams[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *routeStore) GetStreamByID(_ context.Context, id int64) (*models.Stream, error) {
+	for i := range s.streams {
+		if s.streams[i].ID == id {
+			return &s.streams[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *routeStore) GetEmailStreamsByDomain(_ context.Context, domainName string) ([]models.Stream, error) {
+	var out []models.Stream
+	for _, st := range s.streams {
+		if strings.HasSuffix(st.Address, "@"+domainName) {
+			out = append(out, st)
+		}
+	}
+	return out, nil
+}
+
+func TestResolveStream(t *testing.T) {
+	srv := &Server{streams: &routeStore{streams: []models.Stream{
+		{ID: 1, Type: models.StreamTypeEmail, Address: "*@example.com"},
+		{ID: 2, Type: models.StreamTypeEmail, Address: "support+*@example.com"},
+		{ID: 3, Type: models.StreamTypeEmail, Address: "support@example.com"},
+	}}}
+	token := conversation.ReplyToken(uuid.New())
+
+	tests := []struct {
+		addr      string
+		wantID    int64
+		wantToken string
+	}{
+		{"support@example.com", 3, ""},
+		{"support+" + token + "@example.com", 3, token},
+		{"support+billing@example.com", 2, ""},
+		{"sales@example.com", 1, ""},
+	}
+	for _, tt := range tests {
+		st, gotToken, err := srv.resolveStream(context.Background(), tt.addr)
+		if err != nil {
+			t.Errorf("resolveStream(%q): %v", tt.addr, err)
+			continue
+		}
+		if st.ID != tt.wantID || gotToken != tt.wantToken {
+			t.Errorf("resolveStream(%q) = stream %d, token %q; want %d, %q", tt.addr, st.ID, gotToken, tt.wantID, tt.wantToken)
+		}
+	}
+
+	if _, _, err := srv.resolveStream(context.Background(), "support@example.org"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for unknown domain, got %v", err)
+	}
+}
+
+// deliveryStore records the conversations and messages created for inbound
+// email; the embedded interface panics if anything else is called.
+type deliveryStore struct {
+	store.ConversationStore
+	conversations []models.Conversation
+	messages      []models.ConversationMessage
+
+	// sent holds the Message-IDs of outbound messages that can bounce;
+	// bounced records the reason for those that did.
+	sent    []string
+	bounced map[string]string
+}
+
+func (s *deliveryStore) CreateConversation(ctx context.Context, c *models.Conversation, first *models.ConversationMessage) error {
+	c.ID = int64(len(s.conversations) + 1)
+	s.conversations = append(s.conversations, *c)
+	first.ConversationID = c.ID
+	return s.CreateMessage(ctx, first)
+}
+
+func (s *deliveryStore) CreateMessage(_ context.Context, m *models.ConversationMessage) error {
+	m.ID = int64(len(s.messages) + 1)
+	s.messages = append(s.messages, *m)
+	return nil
+}
+
+func (s *deliveryStore) GetMessageByInboundJobID(_ context.Context, jobID int64) (*models.ConversationMessage, error) {
+	for i := range s.messages {
+		if s.messages[i].InboundJobID == jobID {
+			return &s.messages[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *deliveryStore) MarkMessageBounced(_ context.Context, _ int64, messageID, reason string) error {
+	for _, id := range s.sent {
+		if id == messageID {
+			if s.bounced == nil {
+				s.bounced = make(map[string]string)
+			}
+			s.bounced[messageID] = reason
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+type noMailboxes struct {
+	store.MailboxStore
+}
+
+func (noMailboxes) GetMailboxByID(_ context.Context, _ int64) (*models.Mailbox, error) {
+	return nil, sql.ErrNoRows
+}
+
+// newQueueServer returns a server over the given streams whose queue and
+// archive live in memory and a temporary directory.
+func newQueueServer(t *testing.T, convs *deliveryStore, streams ...models.Stream) (*Server, *memQueue) {
+	t.Helper()
+	blobs, err := blob.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFSStore: %v", err)
+	}
+	jobs := &memQueue{}
+	return &Server{
+		limiter:       newConnLimiter(Limits{}),
+		streams:       &routeStore{streams: streams},
+		queue:         NewQueue(jobs),
+		conversations: conversation.NewService(convs, nil, noMailboxes{}, &conversation.NoopNotifier{}, &conversation.NoopSender{}, &conversation.NoopSpamFilter{}, &conversation.NoopFilter{}),
+		archive:       rawmail.NewArchive(blobs),
+	}, jobs
+}
+
+// enqueueRaw queues raw as the session's message.
+func enqueueRaw(sess *session, raw []byte) []error {
+	return sess.enqueue(context.Background(), sess.recipients, bytes.NewReader(raw), int64(len(raw)))
+}
+
+// drain processes queued jobs until none is left to claim.
+func drain(srv *Server) {
+	for srv.processNext(context.Background()) {
+	}
+}
+
+func TestEnqueue_OneConversationPerMailbox(t *testing.T) {
+	convs := &deliveryStore{}
+	sales := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	support := models.Stream{ID: 2, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	billing := models.Stream{ID: 3, MailboxID: 2, Type: models.StreamTypeEmail, Enabled: true}
+	srv, jobs := newQueueServer(t, convs, sales, support, billing)
+	sess := &session{server: srv, from: "alice@example.org", recipients: []recipient{
+		{addr: "sales@example.com", stream: &sales},
+		{addr: "support@example.com", stream: &support},
+		{addr: "billing@example.com", stream: &billing},
+	}}
+
+	raw := []byte("From: Alice <alice@example.org>\r\nTo: sales@example.com, billing@example.com\r\nCc: support@example.com\r\nSubject: Quote\r\n\r\nHello")
+	results := enqueueRaw(sess, raw)
+	for i, err := range results {
+		if err != nil {
+			t.Errorf("recipient %d: %v", i, err)
+		}
+	}
+	if len(jobs.jobs) != 2 {
+		t.Fatalf("expected 2 queued jobs, got %d", len(jobs.jobs))
+	}
+	if len(convs.conversations) != 0 {
+		t.Fatal("expected nothing to be filed before the queue is processed")
+	}
+
+	drain(srv)
+	if len(jobs.jobs) != 0 {
+		t.Errorf("expected delivered jobs to leave the queue, %d left", len(jobs.jobs))
+	}
+	if len(convs.conversations) != 2 {
+		t.Fatalf("expected 2 conversations, got %d", len(convs.conversations))
+	}
+	if c := convs.conversations[0]; c.MailboxID != 1 || c.Recipient != "sales@example.com" {
+		t.Errorf("unexpected first conversation %+v", c)
+	}
+	if c := convs.conversations[1]; c.MailboxID != 2 || c.Recipient != "billing@example.com" {
+		t.Errorf("unexpected second conversation %+v", c)
+	}
+}
+
+func TestAutomatedKind(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   string
+		header mail.Header
+		want   string
+	}{
+		{"person", "alice@example.org", mail.Header{"Subject": {"Hi"}}, ""},
+		{"null sender", "", mail.Header{"Subject": {"Hi"}}, models.AutomatedBounce},
+		{"delivery report", "mailer@example.org", mail.Header{"Content-Type": {`multipart/report; report-type="delivery-status"; boundary=x`}}, models.AutomatedBounce},
+		{"auto-submitted", "alice@example.org", mail.Header{"Auto-Submitted": {"auto-replied"}}, models.AutomatedAutoReply},
+		{"auto-submitted no", "alice@example.org", mail.Header{"Auto-Submitted": {"No"}}, ""},
+		{"x-autoreply", "alice@example.org", mail.Header{"X-Autoreply": {"yes"}}, models.AutomatedAutoReply},
+		{"precedence bulk", "news@example.org", mail.Header{"Precedence": {"Bulk"}}, models.AutomatedBulk},
+		{"list-id", "list@example.org", mail.Header{"List-Id": {"<dev.example.org>"}}, models.AutomatedBulk},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := automatedKind(tt.from, tt.header); got != tt.want {
+				t.Errorf("automatedKind = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// bounceFixture is a delivery status notification for a reply sent from a
+// mailbox, as a typical MTA generates it.
+const bounceFixture = "From: Mail Delivery System <MAILER-DAEMON@mx.example.org>\r\n" +
+	"To: support@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Auto-Submitted: auto-replied\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"B\"\r\n" +
+	"\r\n" +
+	"--B\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--B\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; bob@example.org\r\n" +
+	"Original-Recipient: rfc822; bob@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n" +
+	"--B\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: Support <support@example.com>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: Re: Quote\r\n" +
+	"Message-ID: <1.abc@example.com>\r\n" +
+	"--B--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	report, ok := parseDSN(strings.NewReader(bounceFixture))
+	if !ok {
+		t.Fatal("expected fixture to parse as a DSN")
+	}
+	if !report.Failed {
+		t.Error("expected failed delivery")
+	}
+	if report.MessageID != "<1.abc@example.com>" {
+		t.Errorf("unexpected message id %q", report.MessageID)
+	}
+	if want := "bob@example.org: 5.1.1 (550 5.1.1 No such user)"; report.Reason != want {
+		t.Errorf("reason = %q, want %q", report.Reason, want)
+	}
+
+	delayed := strings.Replace(bounceFixture, "Action: failed", "Action: delayed", 1)
+	if report, _ := parseDSN(strings.NewReader(delayed)); report.Failed {
+		t.Error("expected delayed delivery not to count as failed")
+	}
+
+	if _, ok := parseDSN(strings.NewReader("From: alice@example.org\r\nSubject: Hi\r\n\r\nHello")); ok {
+		t.Error("expected plain message not to parse as a DSN")
+	}
+}
+
+func TestDeliver_BounceRecordedOnOutboundMessage(t *testing.T) {
+	convs := &deliveryStore{}
+	// The returned headers arrive as an attachment; the size limit keeps
+	// them from reaching the attachment service, which the test lacks.
+	stream := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, MaxAttachmentBytes: 1}
+	srv, _ := newQueueServer(t, convs, stream)
+	sess := &session{server: srv, from: "", recipients: []recipient{{addr: "support@example.com", stream: &stream}}}
+
+	// Without a matching outbound message the bounce is filed like any
+	// other email.
+	if err := dataResult(enqueueRaw(sess, []byte(bounceFixture))); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	drain(srv)
+	if len(convs.conversations) != 1 {
+		t.Fatalf("expected unmatched bounce to start a conversation, got %d", len(convs.conversations))
+	}
+
+	convs.sent = []string{"<1.abc@example.com>"}
+	if err := dataResult(enqueueRaw(sess, []byte(bounceFixture))); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	drain(srv)
+	if len(convs.conversations) != 1 {
+		t.Errorf("expected matched bounce not to start a conversation, got %d", len(convs.conversations))
+	}
+	if reason := convs.bounced["<1.abc@example.com>"]; !strings.Contains(reason, "No such user") {
+		t.Errorf("expected bounce reason to be recorded, got %q", reason)
+	}
+}
+
+func TestDataResult(t *testing.T) {
+	failure := &smtp.SMTPError{Code: 451, Message: "try later"}
+
+	if err := dataResult([]error{nil, nil}); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if err := dataResult([]error{failure, nil}); err != nil {
+		t.Errorf("expected partial delivery to be accepted, got %v", err)
+	}
+	if err := dataResult([]error{failure, errAuthRejected}); err != failure {
+		t.Errorf("expected first failure, got %v", err)
+	}
+}
+
+// tooLargeReader fails like the go-smtp data reader once a message exceeds
+// the server's limit.
+type tooLargeReader struct{}
+
+func (tooLargeReader) Read([]byte) (int, error) { return 0, smtp.ErrDataTooLarge }
+
+func TestData_OversizeMessageRejected(t *testing.T) {
+	stream := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true}
+	srv, jobs := newQueueServer(t, &deliveryStore{}, stream)
+	sess := &session{server: srv, from: "alice@example.org", recipients: []recipient{{addr: "support@example.com", stream: &stream}}}
+
+	err := sess.Data(io.MultiReader(strings.NewReader("Subject: Big\r\n\r\n"), tooLargeReader{}))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Fatalf("expected 552, got %v", err)
+	}
+	if len(jobs.jobs) != 0 {
+		t.Errorf("expected nothing to be queued, got %d jobs", len(jobs.jobs))
+	}
+}
+
+func TestStreamMessageLimit(t *testing.T) {
+	small := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, Address: "small@example.com", MaxMessageBytes: 16}
+	large := models.Stream{ID: 2, MailboxID: 2, Type: models.StreamTypeEmail, Enabled: true, Address: "large@example.com"}
+	srv, jobs := newQueueServer(t, &deliveryStore{}, small, large)
+
+	// A declared size over the limit is refused at RCPT TO.
+	sess := &session{server: srv}
+	if err := sess.Mail("alice@example.org", &smtp.MailOptions{Size: 1024}); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := sess.Rcpt("small@example.com", nil); err != errTooLargeForRecipient {
+		t.Errorf("expected small stream to refuse declared size, got %v", err)
+	}
+	if err := sess.Rcpt("large@example.com", nil); err != nil {
+		t.Errorf("expected large stream to accept, got %v", err)
+	}
+
+	// Without a declared size it is enforced once the message is read, so
+	// a recipient with another limit is deferred to its own transaction.
+	// Otherwise the one reply to DATA would accept the message for large
+	// and silently drop it for small.
+	msg := "From: alice@example.org\r\nSubject: Hi\r\n\r\nHello there"
+	sess.Reset()
+	sess.Mail("alice@example.org", nil)
+	if err := sess.Rcpt("small@example.com", nil); err != nil {
+		t.Fatalf("Rcpt small: %v", err)
+	}
+	if err := sess.Rcpt("large@example.com", nil); err != errSplitTransaction {
+		t.Fatalf("expected large stream to be deferred, got %v", err)
+	}
+	err := sess.Data(strings.NewReader(msg))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Errorf("expected small stream to reject message with 552, got %v", err)
+	}
+
+	sess.Reset()
+	sess.Mail("alice@example.org", nil)
+	if err := sess.Rcpt("large@example.com", nil); err != nil {
+		t.Fatalf("Rcpt large: %v", err)
+	}
+	if err := sess.Data(strings.NewReader(msg)); err != nil {
+		t.Errorf("expected large stream to accept message, got %v", err)
+	}
+	if len(jobs.jobs) != 1 || jobs.jobs[0].StreamID != large.ID {
+		t.Errorf("expected one job for the large stream, got %+v", jobs.jobs)
+	}
+
+	// A message larger than declared may exceed a limit it was accepted
+	// under, so it is refused for everyone.
+	sess.Reset()
+	sess.Mail("alice@example.org", &smtp.MailOptions{Size: 8})
+	if err := sess.Rcpt("small@example.com", nil); err != nil {
+		t.Fatalf("Rcpt small: %v", err)
+	}
+	if err := sess.Rcpt("large@example.com", nil); err != nil {
+		t.Fatalf("Rcpt large: %v", err)
+	}
+	if err := sess.Data(strings.NewReader(msg)); err != errLargerThanDeclared {
+		t.Errorf("expected message larger than declared to be refused, got %v", err)
+	}
+	if len(jobs.jobs) != 1 {
+		t.Errorf("expected nothing more to be queued, got %+v", jobs.jobs)
+	}
+}
+
+func TestRcpt_DefersRecipientWithOtherAuthPolicy(t *testing.T) {
+	strict := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, Address: "strict@example.com", AuthPolicy: models.AuthPolicyReject}
+	lax := models.Stream{ID: 2, MailboxID: 2, Type: models.StreamTypeEmail, Enabled: true, Address: "lax@example.com", AuthPolicy: models.AuthPolicyQuarantine}
+	srv, _ := newQueueServer(t, &deliveryStore{}, strict, lax)
+
+	// Without authentication checks the policy decides nothing at DATA.
+	sess := &session{server: srv}
+	sess.Mail("alice@example.org", nil)
+	if err := sess.Rcpt("strict@example.com", nil); err != nil {
+		t.Fatalf("Rcpt strict: %v", err)
+	}
+	if err := sess.Rcpt("lax@example.com", nil); err != nil {
+		t.Errorf("expected lax stream to be accepted without checks, got %v", err)
+	}
+
+	// The resolver is only consulted at DATA.
+	srv.resolver = &domain.NetResolver{}
+	sess.Reset()
+	sess.Mail("alice@example.org", nil)
+	if err := sess.Rcpt("strict@example.com", nil); err != nil {
+		t.Fatalf("Rcpt strict: %v", err)
+	}
+	if err := sess.Rcpt("lax@example.com", nil); err != errSplitTransaction {
+		t.Errorf("expected lax stream to be deferred, got %v", err)
+	}
+}
+
+func TestReadEmail_SpoolsLargeAttachment(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), spoolThreshold/8)
+	raw := "From: alice@example.org\r\n" +
+		"Subject: Backup\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"mix\"\r\n" +
+		"\r\n" +
+		"--mix\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--mix\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"backup.bin\"\r\n" +
+		"\r\n" +
+		string(data) + "\r\n" +
+		"--mix--\r\n"
+
+	email := readEmail(strings.NewReader(raw), "alice@example.org")
+	defer removeSpooled(email.Attachments)
+	if email.Body != "See attached." {
+		t.Errorf("expected text body, got %q", email.Body)
+	}
+	if len(email.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(email.Attachments))
+	}
+	f := email.Attachments[0]
+	if f.Path == "" || f.Data != nil {
+		t.Fatalf("expected attachment to be spooled to disk, got path %q and %d bytes in memory", f.Path, len(f.Data))
+	}
+	if f.Len() != int64(len(data)) {
+		t.Errorf("expected %d bytes, got %d", len(data), f.Len())
+	}
+	got, err := os.ReadFile(f.Path)
+	if err != nil {
+		t.Fatalf("read spool: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("spooled attachment differs from the original")
+	}
+
+	removeSpooled(email.Attachments)
+	if _, err := os.Stat(f.Path); !os.IsNotExist(err) {
+		t.Errorf("expected spool file to be removed, got %v", err)
+	}
+}
+
+func TestReadEmail_ForwardedMessageIsStreamed(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), spoolThreshold/8)
+	raw := "From: alice@example.org\r\n" +
+		"Subject: Fwd: Backup\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"From: bob@example.org\r\n" +
+		"Subject: Backup\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"mix\"\r\n" +
+		"\r\n" +
+		"--mix\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--mix\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"backup.bin\"\r\n" +
+		"\r\n" +
+		string(data) + "\r\n" +
+		"--mix--\r\n"
+
+	email := readEmail(strings.NewReader(raw), "alice@example.org")
+	defer removeSpooled(email.Attachments)
+	if email.Body != "See attached." {
+		t.Errorf("expected forwarded text body, got %q", email.Body)
+	}
+	if len(email.Attachments) != 1 || email.Attachments[0].Path == "" {
+		t.Fatalf("expected forwarded attachment to be spooled, got %+v", email.Attachments)
+	}
+}
+
+func TestReadEmail_LimitsTextAndKeepsOtherBodies(t *testing.T) {
+	text := strings.Repeat("a", textLimit+100)
+	for _, ct := range []string{"text/plain", "multipart/mixed"} {
+		raw := "From: alice@example.org\r\nContent-Type: " + ct + "\r\n\r\n" + text
+		if email := readEmail(strings.NewReader(raw), ""); len(email.Body) != textLimit {
+			t.Errorf("%s: expected body to be cut at %d bytes, got %d", ct, textLimit, len(email.Body))
+		}
+	}
+
+	data := bytes.Repeat([]byte{0, 1, 2, 3}, spoolThreshold/2)
+	raw := "From: alice@example.org\r\n" +
+		"Content-Type: application/pdf; name=\"scan.pdf\"\r\n" +
+		"\r\n" +
+		string(data)
+	email := readEmail(strings.NewReader(raw), "")
+	defer removeSpooled(email.Attachments)
+	if len(email.Attachments) != 1 {
+		t.Fatalf("expected body to be kept as an attachment, got %d", len(email.Attachments))
+	}
+	if f := email.Attachments[0]; f.Filename != "scan.pdf" || f.Path == "" || f.Len() != int64(len(data)) {
+		t.Errorf("expected spooled scan.pdf of %d bytes, got %q at %q with %d", len(data), f.Filename, f.Path, f.Len())
+	}
+}
+
+// selfSignedTLS returns a server TLS config with a fresh self-signed
+// certificate for mx.example.com.
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"mx.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startServer runs srv with the given config's listeners until the test
+// ends, and waits until its SMTP listener accepts connections.
+func startServer(t *testing.T, srv *Server, cfg Config) {
+	t.Helper()
+	srv.smtpServer = srv.newSMTPServer(cfg, cfg.Addr, false)
+	srv.implicitTLSAddr = cfg.ImplicitTLSAddr
+	srv.trustedProxies = cfg.TrustedProxies
+	go srv.Start()
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	waitListening(t, cfg.Addr)
+}
+
+// waitListening waits until addr accepts connections.
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+	}
+}
+
+// sendSMTP sends a message to support@example.com over c, which has
+// greeted the server if it needs another name than localhost.
+func sendSMTP(t *testing.T, c *smtp.Client, subject string) {
+	t.Helper()
+	defer c.Close()
+	if err := c.Mail("alice@example.org", nil); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := c.Rcpt("support@example.com", nil); err != nil {
+		t.Fatalf("RCPT: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	if _, err := io.WriteString(w, "From: alice@example.org\r\nSubject: "+subject+"\r\n\r\nHello\r\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("end of DATA: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT: %v", err)
+	}
+}
+
+func TestServer_StartWithoutListener(t *testing.T) {
+	srv, _ := newQueueServer(t, &deliveryStore{})
+	srv.smtpServer = srv.newSMTPServer(Config{Domain: "mx.example.com"}, "", false)
+	if err := srv.Start(); !errors.Is(err, ErrNoListener) {
+		t.Fatalf("expected ErrNoListener, got %v", err)
+	}
+}
+
+func TestServer_ShutdownEndsStart(t *testing.T) {
+	srv, _ := newQueueServer(t, &deliveryStore{})
+	addr := freeAddr(t)
+	srv.smtpServer = srv.newSMTPServer(Config{Domain: "mx.example.com"}, addr, false)
+	started := make(chan error, 1)
+	go func() { started <- srv.Start() }()
+	// The session ends before Shutdown, which waits for open ones.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c, err := smtp.Dial(addr)
+		if err == nil {
+			if err := c.Quit(); err != nil {
+				t.Fatalf("QUIT: %v", err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("expected Start to return nil after Shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Start to return after Shutdown")
+	}
+}
+
+func TestServer_RecordsTransportSecurity(t *testing.T) {
+	support := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, Address: "support@example.com"}
+	convs := &deliveryStore{}
+	srv, _ := newQueueServer(t, convs, support)
+	cfg := Config{Domain: "mx.example.com", Addr: freeAddr(t), ImplicitTLSAddr: freeAddr(t), TLSConfig: selfSignedTLS(t)}
+	startServer(t, srv, cfg)
+	client := &tls.Config{ServerName: "mx.example.com", InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}
+
+	plain, err := smtp.Dial(cfg.Addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := plain.Hello("client.example.org"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	if ok, _ := plain.Extension("STARTTLS"); !ok {
+		t.Error("expected STARTTLS to be advertised")
+	}
+	sendSMTP(t, plain, "plain")
+
+	starttls, err := smtp.DialStartTLS(cfg.Addr, client)
+	if err != nil {
+		t.Fatalf("dial with STARTTLS: %v", err)
+	}
+	sendSMTP(t, starttls, "starttls")
+
+	implicit, err := smtp.DialTLS(cfg.ImplicitTLSAddr, client)
+	if err != nil {
+		t.Fatalf("dial implicit TLS: %v", err)
+	}
+	sendSMTP(t, implicit, "implicit")
+
+	drain(srv)
+	want := map[string]string{"plain": "none", "starttls": "TLS 1.3", "implicit": "TLS 1.3"}
+	if len(convs.messages) != len(want) {
+		t.Fatalf("expected %d messages, got %d", len(want), len(convs.messages))
+	}
+	for i, m := range convs.messages {
+		subject := convs.conversations[i].Subject
+		if m.TLS != want[subject] {
+			t.Errorf("%s: expected TLS %q, got %q", subject, want[subject], m.TLS)
+		}
+	}
+}
+
+func TestServer_ProxyHeaderNamesClient(t *testing.T) {
+	support := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, Address: "support@example.com"}
+	convs := &deliveryStore{}
+	srv, _ := newQueueServer(t, convs, support)
+	cfg := Config{Domain: "mx.example.com", Addr: freeAddr(t), TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	startServer(t, srv, cfg)
+
+	conn, err := net.Dial("tcp", cfg.Addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if _, err := io.WriteString(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 40000 25\r\n"); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	c := smtp.NewClient(conn)
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	sendSMTP(t, c, "proxied")
+
+	drain(srv)
+	if len(convs.messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(convs.messages))
+	}
+	if m := convs.messages[0]; m.RemoteIP != "203.0.113.7" || m.Helo != "client.example.org" {
+		t.Errorf("expected client 203.0.113.7 greeting as client.example.org, got %q and %q", m.RemoteIP, m.Helo)
+	}
+}
+
+func TestServer_RejectsProxyHeaderFromUntrustedPeer(t *testing.T) {
+	support := models.Stream{ID: 1, MailboxID: 1, Type: models.StreamTypeEmail, Enabled: true, Address: "support@example.com"}
+	convs := &deliveryStore{}
+	srv, _ := newQueueServer(t, convs, support)
+	cfg := Config{Domain: "mx.example.com", Addr: freeAddr(t), TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	startServer(t, srv, cfg)
+
+	conn, err := net.Dial("tcp", cfg.Addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	tc := textproto.NewConn(conn)
+	defer tc.Close()
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	// The header is an unknown command from anyone but a trusted proxy.
+	if err := tc.PrintfLine("PROXY TCP4 203.0.113.7 127.0.0.1 40000 25"); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if code, msg, err := tc.ReadResponse(250); err == nil || code < 500 {
+		t.Fatalf("expected PROXY to be refused, got %d %s", code, msg)
+	}
+
+	// The session goes on as the peer's own.
+	for _, step := range []struct {
+		cmd  string
+		code int
+	}{
+		{"EHLO client.example.org", 250},
+		{"MAIL FROM:<alice@example.org>", 250},
+		{"RCPT TO:<support@example.com>", 250},
+		{"DATA", 354},
+		{"From: alice@example.org\r\nSubject: spoofed\r\n\r\nHello\r\n.", 250},
+	} {
+		if err := tc.PrintfLine("%s", step.cmd); err != nil {
+			t.Fatalf("write %q: %v", step.cmd, err)
+		}
+		if _, msg, err := tc.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q: %v %s", step.cmd, err, msg)
+		}
+	}
+	drain(srv)
+	if len(convs.messages) != 1 || convs.messages[0].RemoteIP != "127.0.0.1" {
+		t.Errorf("expected the peer's own address to be recorded, got %+v", convs.messages)
+	}
 }
@@ -0,0 +1,292 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// header is a header field to compose, in order.
+type header struct {
+	name, value string
+}
+
+// compose builds the complete message for m, with CRLF line endings. The
+// body is multipart/alternative with a plain text part and an HTML part;
+// whichever of m.Body and m.HTML is missing is derived from the other.
+// With attachments, that is the first part of a multipart/mixed body and
+// each attachment follows.
+func compose(m Message, from, messageID string, date time.Time) ([]byte, error) {
+	contentType, body, err := alternativeBody(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Attachments) > 0 {
+		if contentType, body, err = mixedBody(contentType, body, m.Attachments); err != nil {
+			return nil, err
+		}
+	}
+
+	headers := []header{
+		{"From", formatAddress(from, m.FromName)},
+		{"To", formatAddress(m.To, "")},
+	}
+	if m.ReplyTo != "" {
+		headers = append(headers, header{"Reply-To", formatAddress(m.ReplyTo, "")})
+	}
+	headers = append(headers,
+		header{"Subject", encodeHeader(m.Subject)},
+		header{"Date", date.Format(time.RFC1123Z)},
+		header{"Message-ID", messageID},
+	)
+	if m.InReplyTo != "" {
+		headers = append(headers, header{"In-Reply-To", stripNewlines(m.InReplyTo)})
+	}
+	if m.References != "" {
+		headers = append(headers, header{"References", foldIDs(m.References)})
+	}
+	if m.AutoSubmitted != "" {
+		headers = append(headers, header{"Auto-Submitted", m.AutoSubmitted})
+	}
+	headers = append(headers,
+		header{"MIME-Version", "1.0"},
+		header{"Content-Type", contentType},
+	)
+
+	var msg bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.name, h.value)
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body)
+	return msg.Bytes(), nil
+}
+
+// alternativeBody returns the Content-Type and content of the
+// multipart/alternative text and HTML body of m.
+func alternativeBody(m Message) (string, []byte, error) {
+	text, htmlBody := m.Body, m.HTML
+	switch {
+	case htmlBody == "":
+		htmlBody = htmlDocument(renderMarkdown(text))
+	case text == "":
+		text = textFromHTML(htmlBody)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.SetBoundary(newBoundary()); err != nil {
+		return "", nil, err
+	}
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", htmlBody},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(normalizeNewlines(part.content))); err != nil {
+			return "", nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", nil, err
+	}
+	return multipartType("multipart/alternative", mw.Boundary()), body.Bytes(), nil
+}
+
+// mixedBody returns the Content-Type and content of a multipart/mixed body
+// with the given first part followed by the attachments, base64 encoded.
+func mixedBody(firstType string, first []byte, attachments []Attachment) (string, []byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.SetBoundary(newBoundary()); err != nil {
+		return "", nil, err
+	}
+	w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {firstType}})
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := w.Write(first); err != nil {
+		return "", nil, err
+	}
+
+	for _, a := range attachments {
+		contentType := a.ContentType
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			contentType = "application/octet-stream"
+		}
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := w.Write(base64Lines(a.Data)); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", nil, err
+	}
+	return multipartType("multipart/mixed", mw.Boundary()), body.Bytes(), nil
+}
+
+// multipartType returns the Content-Type of a multipart body, folded
+// before the boundary to keep the header line short.
+func multipartType(mediaType, boundary string) string {
+	return strings.Replace(mime.FormatMediaType(mediaType, map[string]string{"boundary": boundary}), "; ", ";\r\n ", 1)
+}
+
+// base64Lines encodes data as base64 in lines of 76 characters, as MIME
+// requires.
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b bytes.Buffer
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	return b.Bytes()
+}
+
+// formatAddress returns raw, an address with or without a display name, as
+// a header value, with a non-ASCII name encoded as RFC 2047 requires. name
+// replaces the display name in raw if set. Values that do not parse are
+// used as they are, minus line breaks.
+func formatAddress(raw, name string) string {
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return stripNewlines(raw)
+	}
+	if name != "" {
+		addr.Name = name
+	}
+	switch {
+	case addr.Name == "":
+		return addr.Address
+	case isPhrase(addr.Name):
+		return addr.Name + " <" + addr.Address + ">"
+	default:
+		// Quoted, or encoded if the name is not ASCII.
+		return addr.String()
+	}
+}
+
+// isPhrase reports whether name can be used as a display name as it is,
+// because it consists of atoms (RFC 5322, section 3.2.3) and spaces.
+func isPhrase(name string) bool {
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == ' ':
+		case strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// encodeHeader returns s as an unstructured header value, RFC 2047
+// encoded if it is not plain ASCII.
+func encodeHeader(s string) string {
+	return mime.QEncoding.Encode("utf-8", stripNewlines(s))
+}
+
+func stripNewlines(s string) string {
+	return strings.Join(strings.Fields(strings.NewReplacer("\r", " ", "\n", " ").Replace(s)), " ")
+}
+
+// foldIDs folds a list of message IDs onto one line each, so that a long
+// References header stays within the line length limit.
+func foldIDs(ids string) string {
+	return strings.Join(strings.Fields(ids), "\r\n ")
+}
+
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+}
+
+func newBoundary() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("deaddrop-%x", b)
+}
+
+// htmlDocument wraps an HTML fragment into a document.
+func htmlDocument(fragment string) string {
+	return `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"></head>
+<body style="font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; font-size: 14px; line-height: 1.5; color: #222222;">
+` + fragment + `
+</body>
+</html>
+`
+}
+
+// textFromHTML returns the text of an HTML document, with a line break
+// after each block element.
+func textFromHTML(src string) string {
+	var b strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(src))
+	skip := 0
+	for z.Next() != nethtml.ErrorToken {
+		tok := z.Token()
+		switch tok.Type {
+		case nethtml.TextToken:
+			if skip == 0 {
+				b.WriteString(strings.Join(strings.Fields(tok.Data), " "))
+			}
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken, nethtml.EndTagToken:
+			switch tok.Data {
+			case "style", "script", "title":
+				if tok.Type == nethtml.StartTagToken {
+					skip++
+				} else if tok.Type == nethtml.EndTagToken && skip > 0 {
+					skip--
+				}
+			case "br", "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre":
+				b.WriteString("\n")
+			default:
+				b.WriteString(" ")
+			}
+		}
+	}
+	return collapseBlankLines(b.String())
+}
+
+// collapseBlankLines trims every line and keeps at most one blank line
+// between paragraphs.
+func collapseBlankLines(s string) string {
+	var out []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && (len(out) == 0 || out[len(out)-1] == "") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
@@ -0,0 +1,232 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parts returns the bodies of a multipart/alternative message by content
+// type, decoded.
+func parts(t *testing.T, msg *mail.Message) map[string]string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %q", msg.Header.Get("Content-Type"))
+	}
+	bodies := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		bodies[contentType] = string(b)
+	}
+	return bodies
+}
+
+func TestSMTPClientDeliver_ComposesTextAndHTMLParts(t *testing.T) {
+	client := NewSMTPClient("smtp.example.com", 25, "", "", "no-reply@example.com")
+
+	var sent string
+	withStubSendMail(t, func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+		sent = string(msg)
+		return nil
+	})
+
+	body := "Hi Alice,\nuse <b>x</b> if 1 < 2.\n\n- **one**\n- two"
+	if _, err := client.Deliver(Message{
+		EnvelopeFrom: "support@example.com",
+		FromName:     "Zoë Support",
+		To:           "alice@test.com",
+		Subject:      "Re: Über uns",
+		Body:         body,
+		InReplyTo:    "<q2@test.com>",
+		References:   "<q1@test.com> <a1@example.com> <q2@test.com>",
+	}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(sent))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	for _, line := range strings.Split(sent[:strings.Index(sent, "\r\n\r\n")], "\r\n") {
+		for _, r := range line {
+			if r > 127 {
+				t.Fatalf("expected headers in ASCII, got %q", line)
+			}
+		}
+	}
+	var dec mime.WordDecoder
+	if subject, _ := dec.DecodeHeader(msg.Header.Get("Subject")); subject != "Re: Über uns" {
+		t.Errorf("expected the subject to decode, got %q", subject)
+	}
+	if from, err := msg.Header.AddressList("From"); err != nil || from[0].Name != "Zoë Support" || from[0].Address != "support@example.com" {
+		t.Errorf("expected the display name to decode, got %v (%v)", from, err)
+	}
+	if got := msg.Header.Get("In-Reply-To"); got != "<q2@test.com>" {
+		t.Errorf("unexpected In-Reply-To %q", got)
+	}
+	if got := strings.Fields(msg.Header.Get("References")); strings.Join(got, " ") != "<q1@test.com> <a1@example.com> <q2@test.com>" {
+		t.Errorf("unexpected References %q", got)
+	}
+
+	bodies := parts(t, msg)
+	if text := bodies["text/plain"]; strings.ReplaceAll(text, "\r\n", "\n") != body {
+		t.Errorf("expected the text part to be the reply as typed, got %q", text)
+	}
+	html := bodies["text/html"]
+	for _, want := range []string{"Hi Alice,<br>", "use &lt;b&gt;x&lt;/b&gt; if 1 &lt; 2.", "<li><strong>one</strong></li>"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected the HTML part to contain %q, got %q", want, html)
+		}
+	}
+}
+
+func TestSMTPClientDeliver_DerivesTextFromHTML(t *testing.T) {
+	client := NewSMTPClient("smtp.example.com", 25, "", "", "no-reply@example.com")
+
+	var sent string
+	withStubSendMail(t, func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+		sent = string(msg)
+		return nil
+	})
+
+	html := "<html><head><style>p {}</style></head><body><p>Hello</p><p>You have <b>1</b> message.</p></body></html>"
+	if _, err := client.Deliver(Message{To: "owner@test.com", Subject: "New message", HTML: html}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(sent))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	bodies := parts(t, msg)
+	if text := strings.ReplaceAll(bodies["text/plain"], "\r\n", "\n"); text != "Hello\n\nYou have 1 message." {
+		t.Errorf("unexpected text part %q", text)
+	}
+	if !strings.Contains(bodies["text/html"], "<b>1</b>") {
+		t.Errorf("expected the HTML part as given, got %q", bodies["text/html"])
+	}
+}
+
+func TestCompose_AttachesFiles(t *testing.T) {
+	data := bytes.Repeat([]byte{0, 1, 2, 0xff}, 100)
+	raw, err := compose(Message{
+		To:      "alice@test.com",
+		Subject: "Invoice",
+		Body:    "Attached.",
+		Attachments: []Attachment{
+			{Filename: "Rechnung März.pdf", ContentType: "application/pdf", Data: data},
+			{Filename: "notes.txt", ContentType: "not a type", Data: []byte("hi")},
+		},
+	}, "support@example.com", "<m@example.com>", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %q", mediaType)
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	first, err := r.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodies := parts(t, &mail.Message{Header: mail.Header(first.Header), Body: first}); bodies["text/plain"] != "Attached." {
+		t.Errorf("expected the text and HTML body first, got %q", bodies)
+	}
+
+	var got []*multipart.Part
+	var contents [][]byte
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+		got = append(got, p)
+		contents = append(contents, b)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(got))
+	}
+	if got[0].FileName() != "Rechnung März.pdf" || got[0].Header.Get("Content-Type") != "application/pdf" || !bytes.Equal(contents[0], data) {
+		t.Errorf("unexpected first attachment %q %q", got[0].FileName(), got[0].Header.Get("Content-Type"))
+	}
+	if got[1].FileName() != "notes.txt" || got[1].Header.Get("Content-Type") != "application/octet-stream" || string(contents[1]) != "hi" {
+		t.Errorf("unexpected second attachment %q %q", got[1].FileName(), got[1].Header.Get("Content-Type"))
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 78 {
+			t.Fatalf("expected lines within 78 characters, got %q", line)
+		}
+	}
+}
+
+func TestCompose_FoldsLongReferences(t *testing.T) {
+	var ids []string
+	for range 20 {
+		ids = append(ids, "<0123456789abcdef0123456789abcdef@mail.example.com>")
+	}
+	msg, err := compose(Message{To: "alice@test.com", Subject: "Hi", Body: "Hello", References: strings.Join(ids, " ")}, "support@example.com", "<m@example.com>", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(msg), "\r\n") {
+		if len(line) > 78 {
+			t.Fatalf("expected header lines within 78 characters, got %q", line)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one<br>\ntwo</p>\n<p>three</p>\n"},
+		{"escaping", "a <script> & b", "<p>a &lt;script&gt; &amp; b</p>\n"},
+		{"emphasis", "**bold** and *it*", "<p><strong>bold</strong> and <em>it</em></p>\n"},
+		{"code", "run `a*b*c` now", "<p>run <code>a*b*c</code> now</p>\n"},
+		{"fence", "```\n<x>\n  y\n```", "<pre><code>&lt;x&gt;\n  y</code></pre>\n"},
+		{"ordered list", "1. a\n2) b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"link", "see [docs](https://example.com/a_b) or https://example.com/x.", `<p>see <a href="https://example.com/a_b">docs</a> or <a href="https://example.com/x">https://example.com/x</a>.</p>` + "\n"},
+		{"no javascript links", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.in); got != tt.want {
+				t.Errorf("renderMarkdown(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	quoted := renderMarkdown("> quoted\n> - item\n\nreply")
+	if !strings.Contains(quoted, "<blockquote") || !strings.Contains(quoted, "<p>quoted</p>\n<ul>\n<li>item</li>\n</ul>\n</blockquote>\n<p>reply</p>") {
+		t.Errorf("unexpected quote rendering %q", quoted)
+	}
+}
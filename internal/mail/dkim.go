@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/mailauth"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// DKIMSigner signs outbound mail with the active DKIM keys of the verified
+// domain its From header is in.
+type DKIMSigner struct {
+	keys store.DKIMKeyStore
+	now  func() time.Time
+}
+
+// NewDKIMSigner creates a DKIMSigner that reads keys from the store.
+func NewDKIMSigner(keys store.DKIMKeyStore) *DKIMSigner {
+	return &DKIMSigner{keys: keys, now: time.Now}
+}
+
+// Sign returns msg with a DKIM-Signature header for each active key of the
+// From domain, or of the closest parent domain that has keys, which still
+// aligns for DMARC. Mail from a domain without keys is returned unsigned.
+func (s *DKIMSigner) Sign(ctx context.Context, from string, msg []byte) ([]byte, error) {
+	for _, name := range parentDomains(extractDomain(from)) {
+		keys, err := s.keys.GetActiveDKIMKeysByDomainName(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("dkim: load keys for %s: %w", name, err)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		var headers strings.Builder
+		for _, k := range keys {
+			private, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("dkim: parse key %s: %w", k.Selector, err)
+			}
+			signer, ok := private.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("dkim: key %s cannot sign", k.Selector)
+			}
+			field, err := mailauth.SignDKIM(msg, mailauth.DKIMKey{Domain: name, Selector: k.Selector, Signer: signer}, s.now())
+			if err != nil {
+				return nil, err
+			}
+			headers.WriteString(field)
+		}
+		return append([]byte(headers.String()), msg...), nil
+	}
+	return msg, nil
+}
@@ -0,0 +1,143 @@
+package mail
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// renderMarkdown renders the plain text of a reply as HTML. It understands
+// the little Markdown people type into email: paragraphs, line breaks,
+// "-", "*" and "1." lists, "> " quotes, fenced code blocks, `code`,
+// **bold**, *italic*, [links](https://...) and bare URLs. Everything else
+// is escaped and shown as typed.
+func renderMarkdown(text string) string {
+	lines := strings.Split(normalizeNewlines(text), "\n")
+
+	var b strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			i++
+
+		case strings.HasPrefix(trimmed, "```"):
+			i++
+			var code []string
+			for i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```") {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // closing fence
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(q, " "))
+			}
+			b.WriteString(`<blockquote style="margin: 0 0 0 .8ex; border-left: 1px solid #cccccc; padding-left: 1ex;">` + "\n")
+			b.WriteString(renderMarkdown(strings.Join(quoted, "\n")))
+			b.WriteString("</blockquote>\n")
+
+		case listItem(trimmed, false) != "" || listItem(trimmed, true) != "":
+			ordered := listItem(trimmed, true) != ""
+			tag := "ul"
+			if ordered {
+				tag = "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for ; i < len(lines); i++ {
+				item := listItem(strings.TrimSpace(lines[i]), ordered)
+				if item == "" {
+					break
+				}
+				b.WriteString("<li>" + renderInline(item) + "</li>\n")
+			}
+			b.WriteString("</" + tag + ">\n")
+
+		default:
+			var para []string
+			for ; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if t == "" || strings.HasPrefix(t, "```") || strings.HasPrefix(t, ">") ||
+					listItem(t, false) != "" || listItem(t, true) != "" {
+					break
+				}
+				para = append(para, renderInline(t))
+			}
+			b.WriteString("<p>" + strings.Join(para, "<br>\n") + "</p>\n")
+		}
+	}
+	return b.String()
+}
+
+var orderedItemRe = regexp.MustCompile(`^\d{1,3}[.)]\s+(.*)$`)
+
+// listItem returns the text of a list item line, or "" if the line is not
+// an item of an ordered or unordered list.
+func listItem(line string, ordered bool) string {
+	if ordered {
+		if m := orderedItemRe.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+		return ""
+	}
+	for _, bullet := range []string{"- ", "* ", "+ "} {
+		if strings.HasPrefix(line, bullet) {
+			return strings.TrimSpace(line[len(bullet):])
+		}
+	}
+	return ""
+}
+
+var (
+	// linkRe matches [text](url) links and bare URLs in escaped text.
+	linkRe   = regexp.MustCompile(`\[([^\]]+)\]\(((?:https?://|mailto:)[^\s)]+)\)|https?://[^\s<]*[^\s<.,;:!?)]`)
+	strongRe = regexp.MustCompile(`\*\*([^*\s](?:[^*]*[^*\s])?)\*\*`)
+	emRe     = regexp.MustCompile(`\*([^*\s](?:[^*]*[^*\s])?)\*`)
+)
+
+// renderInline renders the inline markup of one line.
+func renderInline(s string) string {
+	var b strings.Builder
+	parts := strings.Split(s, "`")
+	for i, part := range parts {
+		switch {
+		case i%2 == 1 && i < len(parts)-1:
+			b.WriteString("<code>" + html.EscapeString(part) + "</code>")
+		case i%2 == 1:
+			// An unmatched backtick.
+			b.WriteString("`" + renderLinks(html.EscapeString(part)))
+		default:
+			b.WriteString(renderLinks(html.EscapeString(part)))
+		}
+	}
+	return b.String()
+}
+
+// renderLinks turns links in escaped text into anchors and applies
+// emphasis to the text between them, so that URLs are left alone.
+func renderLinks(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range linkRe.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(renderEmphasis(s[last:m[0]]))
+		if m[2] >= 0 {
+			b.WriteString(`<a href="` + s[m[4]:m[5]] + `">` + renderEmphasis(s[m[2]:m[3]]) + "</a>")
+		} else {
+			url := s[m[0]:m[1]]
+			b.WriteString(`<a href="` + url + `">` + url + "</a>")
+		}
+		last = m[1]
+	}
+	b.WriteString(renderEmphasis(s[last:]))
+	return b.String()
+}
+
+func renderEmphasis(s string) string {
+	s = strongRe.ReplaceAllString(s, "<strong>$1</strong>")
+	return emRe.ReplaceAllString(s, "<em>$1</em>")
+}
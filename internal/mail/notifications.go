@@ -0,0 +1,162 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Notification names, each rendered from <name>.html with base.html and
+// from <name>.txt, which also defines the "subject" template.
+const (
+	notifyNewMessage      = "new_message"
+	notifyNewConversation = "new_conversation"
+	notifyNewReply        = "new_reply"
+	notifyDigest          = "digest"
+)
+
+// Notification is a rendered notification email.
+type Notification struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// NewMessageData is what the new_message templates are executed with.
+type NewMessageData struct {
+	Domain      string
+	SenderName  string
+	SenderEmail string
+	Body        string
+	URL         string // the domain's page in the dashboard
+}
+
+// NewConversationData is what the new_conversation and new_reply templates
+// are executed with.
+type NewConversationData struct {
+	Mailbox       string
+	Subject       string
+	SenderName    string
+	SenderAddress string
+	Body          string
+	URL           string // the conversation in the dashboard
+}
+
+// DigestData is what the digest templates are executed with.
+type DigestData struct {
+	Items       []DigestItem
+	URL         string // the dashboard
+	SettingsURL string // the notification settings
+}
+
+// DigestItem is a conversation in a digest.
+type DigestItem struct {
+	Mailbox       string
+	Subject       string
+	SenderName    string
+	SenderAddress string
+	Excerpt       string // the start of the latest message
+	Reply         bool   // the latest message is a reply
+	Messages      int    // how many new messages the conversation has
+	URL           string // the conversation in the dashboard
+}
+
+// Notifications renders notification emails from templates: HTML with
+// html/template, so everything a sender wrote is escaped, and plain text
+// with text/template.
+type Notifications struct {
+	html    map[string]*htmltemplate.Template
+	text    map[string]*texttemplate.Template
+	baseURL string
+}
+
+// LoadNotifications parses the notification templates in fsys. Files in
+// dir, if set, take the place of the templates of the same name, so that
+// operators can change some of them and keep the others. Links point into
+// the dashboard at baseURL.
+func LoadNotifications(fsys fs.FS, dir, baseURL string) (*Notifications, error) {
+	if dir != "" {
+		fsys = overlayFS{top: os.DirFS(dir), bottom: fsys}
+	}
+	n := &Notifications{
+		html:    make(map[string]*htmltemplate.Template),
+		text:    make(map[string]*texttemplate.Template),
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+	for _, name := range []string{notifyNewMessage, notifyNewConversation, notifyNewReply, notifyDigest} {
+		html, err := htmltemplate.ParseFS(fsys, "base.html", name+".html")
+		if err != nil {
+			return nil, fmt.Errorf("mail: parse %s.html: %w", name, err)
+		}
+		text, err := texttemplate.ParseFS(fsys, name+".txt")
+		if err != nil {
+			return nil, fmt.Errorf("mail: parse %s.txt: %w", name, err)
+		}
+		if text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("mail: %s.txt does not define a subject", name)
+		}
+		n.html[name], n.text[name] = html, text
+	}
+	return n, nil
+}
+
+// NewMessage renders the notification of a message sent to a domain.
+func (n *Notifications) NewMessage(data NewMessageData) (*Notification, error) {
+	return n.render(notifyNewMessage, data)
+}
+
+// NewConversation renders the notification of a new conversation.
+func (n *Notifications) NewConversation(data NewConversationData) (*Notification, error) {
+	return n.render(notifyNewConversation, data)
+}
+
+// NewReply renders the notification of a reply on an open conversation.
+func (n *Notifications) NewReply(data NewConversationData) (*Notification, error) {
+	return n.render(notifyNewReply, data)
+}
+
+// Digest renders a summary of unread conversations.
+func (n *Notifications) Digest(data DigestData) (*Notification, error) {
+	return n.render(notifyDigest, data)
+}
+
+// link returns the dashboard URL of path.
+func (n *Notifications) link(path string) string {
+	return n.baseURL + path
+}
+
+func (n *Notifications) render(name string, data any) (*Notification, error) {
+	var subject, text, html bytes.Buffer
+	if err := n.text[name].ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("mail: render %s subject: %w", name, err)
+	}
+	if err := n.text[name].ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return nil, fmt.Errorf("mail: render %s.txt: %w", name, err)
+	}
+	if err := n.html[name].ExecuteTemplate(&html, "base", data); err != nil {
+		return nil, fmt.Errorf("mail: render %s.html: %w", name, err)
+	}
+	return &Notification{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+// overlayFS serves files from top, and from bottom those top lacks.
+type overlayFS struct {
+	top, bottom fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.bottom.Open(name)
+	}
+	return f, err
+}
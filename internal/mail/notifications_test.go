@@ -0,0 +1,155 @@
+package mail
+
+import (
+	"io/fs"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/znz-systems/deaddrop/templates"
+)
+
+func loadTestNotifications(t *testing.T, dir string) *Notifications {
+	t.Helper()
+	emailTemplates, err := fs.Sub(templates.FS, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := LoadNotifications(emailTemplates, dir, "https://deaddrop.example.com/")
+	if err != nil {
+		t.Fatalf("LoadNotifications: %v", err)
+	}
+	return n
+}
+
+func TestNotifications_EscapeSenderContent(t *testing.T) {
+	n := loadTestNotifications(t, "")
+
+	got, err := n.NewConversation(NewConversationData{
+		Mailbox:       "Support",
+		Subject:       `<img src=x onerror=alert(1)>`,
+		SenderName:    `<script>alert("name")</script>`,
+		SenderAddress: "mallory@test.com",
+		Body:          "Hi <b>there</b>\n& welcome",
+		URL:           n.link("/mailboxes/m1/conversations/c1"),
+	})
+	if err != nil {
+		t.Fatalf("NewConversation: %v", err)
+	}
+	if got.Subject != "New conversation in Support" {
+		t.Errorf("unexpected subject %q", got.Subject)
+	}
+	for _, bad := range []string{"<script>", "<img", "<b>there"} {
+		if strings.Contains(got.HTML, bad) {
+			t.Errorf("expected %q to be escaped in the HTML, got %q", bad, got.HTML)
+		}
+	}
+	for _, want := range []string{"&lt;script&gt;", "Hi &lt;b&gt;there&lt;/b&gt;\n&amp; welcome", `href="https://deaddrop.example.com/mailboxes/m1/conversations/c1"`} {
+		if !strings.Contains(got.HTML, want) {
+			t.Errorf("expected the HTML to contain %q, got %q", want, got.HTML)
+		}
+	}
+	for _, want := range []string{`From:    <script>alert("name")</script>`, "Hi <b>there</b>\n& welcome", "Open conversation: https://deaddrop.example.com/mailboxes/m1/conversations/c1"} {
+		if !strings.Contains(got.Text, want) {
+			t.Errorf("expected the text to contain %q, got %q", want, got.Text)
+		}
+	}
+}
+
+func TestNotifications_OverridesFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	custom := `{{define "subject"}}[{{.Domain}}] {{.SenderName}}{{end}}{{.Body}}`
+	if err := os.WriteFile(filepath.Join(dir, "new_message.txt"), []byte(custom), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n := loadTestNotifications(t, dir)
+
+	got, err := n.NewMessage(NewMessageData{Domain: "example.com", SenderName: "Alice", Body: "Hello"})
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	if got.Subject != "[example.com] Alice" || got.Text != "Hello\n" {
+		t.Errorf("expected the custom text template, got %q / %q", got.Subject, got.Text)
+	}
+	if !strings.Contains(got.HTML, "New message on example.com") {
+		t.Errorf("expected the built-in HTML template, got %q", got.HTML)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "new_conversation.txt"), []byte("{{.Body}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	emailTemplates, _ := fs.Sub(templates.FS, "email")
+	if _, err := LoadNotifications(emailTemplates, dir, ""); err == nil {
+		t.Error("expected a text template without a subject to be refused")
+	}
+}
+
+func TestSMTPClientSendNotification(t *testing.T) {
+	n := loadTestNotifications(t, "")
+	client := NewSMTPClient("smtp.example.com", 25, "", "", "no-reply@example.com")
+
+	var sent string
+	withStubSendMail(t, func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+		sent = string(msg)
+		return nil
+	})
+
+	notification, err := n.NewMessage(NewMessageData{Domain: "example.com", SenderName: "Alice", SenderEmail: "alice@test.com", Body: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendNotification("owner@example.com", notification); err != nil {
+		t.Fatalf("SendNotification: %v", err)
+	}
+	for _, want := range []string{"Subject: New message on example.com\r\n", "Auto-Submitted: auto-generated\r\n", "multipart/alternative", "text/plain", "text/html"} {
+		if !strings.Contains(sent, want) {
+			t.Errorf("expected %q in the message, got %q", want, sent)
+		}
+	}
+}
+
+func TestNotifications_Digest(t *testing.T) {
+	n := loadTestNotifications(t, "")
+
+	got, err := n.Digest(DigestData{
+		Items: []DigestItem{
+			{Mailbox: "Support", Subject: "Refund", SenderName: "Alice", SenderAddress: "alice@test.com", Excerpt: "Where is <my> money?", Messages: 2, URL: n.link("/mailboxes/m1/conversations/c1")},
+			{Mailbox: "Sales", SenderName: "Bob", SenderAddress: "bob@test.com", Excerpt: "Thanks", Reply: true, Messages: 1, URL: n.link("/mailboxes/m2/conversations/c2")},
+		},
+		URL:         n.link("/mailboxes"),
+		SettingsURL: n.link("/settings/notifications"),
+	})
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if got.Subject != "2 unread conversations in DeadDrop" {
+		t.Errorf("unexpected subject %q", got.Subject)
+	}
+	for _, want := range []string{"[Support] Refund (2 new messages)", "[Sales] (no subject) (reply)", "Open conversation: https://deaddrop.example.com/mailboxes/m2/conversations/c2", "https://deaddrop.example.com/settings/notifications"} {
+		if !strings.Contains(got.Text, want) {
+			t.Errorf("expected the text to contain %q, got %q", want, got.Text)
+		}
+	}
+	if !strings.Contains(got.HTML, "Where is &lt;my&gt; money?") || !strings.Contains(got.HTML, `href="https://deaddrop.example.com/mailboxes/m1/conversations/c1"`) {
+		t.Errorf("unexpected HTML %q", got.HTML)
+	}
+
+	reply, err := n.NewReply(NewConversationData{Mailbox: "Support", Subject: "Refund", SenderName: "Alice", Body: "Any news?"})
+	if err != nil {
+		t.Fatalf("NewReply: %v", err)
+	}
+	if reply.Subject != "Re: Refund [Support]" || !strings.Contains(reply.Text, "Any news?") {
+		t.Errorf("unexpected reply notification %q / %q", reply.Subject, reply.Text)
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	if got := excerpt("  short  ", 10); got != "short" {
+		t.Errorf("expected short bodies as they are, got %q", got)
+	}
+	if got := excerpt("Grüße aus Köln und viele weitere Wörter", 20); got != "Grüße aus Köln und…" {
+		t.Errorf("expected a cut at a word boundary, got %q", got)
+	}
+}
@@ -3,24 +3,39 @@ package mail
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"strings"
 
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/conversation"
 	"github.com/znz-systems/deaddrop/internal/models"
 	"github.com/znz-systems/deaddrop/internal/store"
 )
 
+// AttachmentOpener reads the content of stored attachments.
+type AttachmentOpener interface {
+	Open(ctx context.Context, a *models.Attachment) (io.ReadCloser, error)
+}
+
 // Service implements the message.Notifier interface by sending email
 // notifications to domain owners when new messages are received.
 type Service struct {
-	client *SMTPClient
-	users  store.UserStore
+	client        *SMTPClient
+	users         store.UserStore
+	attachments   AttachmentOpener
+	notifications *Notifications
 }
 
-// NewService creates a new mail Service that sends notifications via SMTP.
-func NewService(client *SMTPClient, users store.UserStore) *Service {
+// NewService creates a new mail Service that sends notifications via SMTP,
+// rendered from notifications. Reply attachments are read from
+// attachments.
+func NewService(client *SMTPClient, users store.UserStore, attachments AttachmentOpener, notifications *Notifications) *Service {
 	return &Service{
-		client: client,
-		users:  users,
+		client:        client,
+		users:         users,
+		attachments:   attachments,
+		notifications: notifications,
 	}
 }
 
@@ -32,10 +47,18 @@ func (s *Service) NotifyNewMessage(ctx context.Context, domain *models.Domain, m
 		return fmt.Errorf("mail: failed to look up domain owner (userID=%d): %w", domain.UserID, err)
 	}
 
-	subject := fmt.Sprintf("New message on %s", domain.Name)
-	body := NewMessageNotificationBody(domain.Name, msg.SenderName, msg.SenderEmail, msg.Body)
+	n, err := s.notifications.NewMessage(NewMessageData{
+		Domain:      domain.Name,
+		SenderName:  msg.SenderName,
+		SenderEmail: msg.SenderEmail,
+		Body:        msg.Body,
+		URL:         s.notifications.link("/domains/" + domain.PublicID.String()),
+	})
+	if err != nil {
+		return err
+	}
 
-	if err := s.client.Send(user.Email, subject, body); err != nil {
+	if err := s.client.SendNotification(user.Email, n); err != nil {
 		return fmt.Errorf("mail: failed to send notification to %s: %w", user.Email, err)
 	}
 
@@ -48,25 +71,133 @@ func (s *Service) NotifyNewMessage(ctx context.Context, domain *models.Domain, m
 	return nil
 }
 
-// SendReply sends a reply email from a mailbox. Implements conversation.Sender.
-func (s *Service) SendReply(ctx context.Context, to, fromAddress, fromName, subject, body string) error {
-	headerFrom := fromAddress
-	if fromName != "" {
-		headerFrom = fmt.Sprintf("%s <%s>", fromName, fromAddress)
+// SendReply sends a reply email from a mailbox and returns its Message-ID.
+// Implements conversation.Sender.
+func (s *Service) SendReply(ctx context.Context, email conversation.OutboundEmail) (string, error) {
+	attachments, err := s.readAttachments(ctx, email.Attachments)
+	if err != nil {
+		return "", err
+	}
+	return s.client.Deliver(Message{
+		EnvelopeFrom: email.FromAddress,
+		HeaderFrom:   email.FromAddress,
+		FromName:     email.FromName,
+		To:           email.To,
+		ReplyTo:      email.ReplyTo,
+		Subject:      email.Subject,
+		Body:         email.Body,
+		MessageID:    email.MessageID,
+		InReplyTo:    email.InReplyTo,
+		References:   email.References,
+		Attachments:  attachments,
+
+		AutoSubmitted: email.AutoSubmitted,
+	})
+}
+
+func (s *Service) readAttachments(ctx context.Context, stored []models.Attachment) ([]Attachment, error) {
+	attachments := make([]Attachment, 0, len(stored))
+	for i := range stored {
+		a := &stored[i]
+		content, err := s.attachments.Open(ctx, a)
+		if err != nil {
+			return nil, fmt.Errorf("mail: open attachment %s: %w", a.Filename, err)
+		}
+		data, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("mail: read attachment %s: %w", a.Filename, err)
+		}
+		attachments = append(attachments, Attachment{Filename: a.Filename, ContentType: a.ContentType, Data: data})
 	}
-	return s.client.SendFrom(fromAddress, headerFrom, to, subject, body)
+	return attachments, nil
 }
 
 // NotifyNewConversation sends an email notification when a new conversation is started.
 // Implements conversation.Notifier.
 func (s *Service) NotifyNewConversation(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	return s.notifyConversation(ctx, mailbox, conv, msg, s.notifications.NewConversation)
+}
+
+// NotifyReply sends an email notification when a reply arrives on an open
+// conversation. Implements conversation.Notifier.
+func (s *Service) NotifyReply(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	return s.notifyConversation(ctx, mailbox, conv, msg, s.notifications.NewReply)
+}
+
+func (s *Service) notifyConversation(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage, render func(NewConversationData) (*Notification, error)) error {
 	user, err := s.users.GetUserByID(ctx, mailbox.UserID)
 	if err != nil {
 		return fmt.Errorf("mail: failed to look up mailbox owner: %w", err)
 	}
 
-	subject := fmt.Sprintf("New conversation in %s", mailbox.Name)
-	body := NewConversationNotificationBody(mailbox.Name, msg.SenderName, msg.SenderAddress, msg.Body, conv.Subject)
+	n, err := render(NewConversationData{
+		Mailbox:       mailbox.Name,
+		Subject:       conv.Subject,
+		SenderName:    msg.SenderName,
+		SenderAddress: msg.SenderAddress,
+		Body:          msg.Body,
+		URL:           s.notifications.link(conversationPath(mailbox.PublicID, conv.PublicID)),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.client.SendNotification(user.Email, n)
+}
+
+// SendDigest sends a user one email summarising the given conversations.
+func (s *Service) SendDigest(ctx context.Context, user *models.User, entries []models.DigestEntry) error {
+	data := DigestData{
+		URL:         s.notifications.link("/mailboxes"),
+		SettingsURL: s.notifications.link("/settings/notifications"),
+	}
+	for _, e := range entries {
+		data.Items = append(data.Items, DigestItem{
+			Mailbox:       e.MailboxName,
+			Subject:       e.Subject,
+			SenderName:    e.SenderName,
+			SenderAddress: e.SenderAddress,
+			Excerpt:       excerpt(e.Body, digestExcerptLength),
+			Reply:         e.Reply,
+			Messages:      e.Messages,
+			URL:           s.notifications.link(conversationPath(e.MailboxPublicID, e.ConversationPublicID)),
+		})
+	}
+
+	n, err := s.notifications.Digest(data)
+	if err != nil {
+		return err
+	}
+	if err := s.client.SendNotification(user.Email, n); err != nil {
+		return fmt.Errorf("mail: failed to send digest to %s: %w", user.Email, err)
+	}
 
-	return s.client.Send(user.Email, subject, body)
+	slog.InfoContext(ctx, "sent notification digest",
+		"recipient", user.Email,
+		"conversations", len(entries),
+	)
+	return nil
+}
+
+// digestExcerptLength is how many characters of a message a digest shows.
+const digestExcerptLength = 300
+
+func conversationPath(mailboxID, conversationID uuid.UUID) string {
+	return fmt.Sprintf("/mailboxes/%s/conversations/%s", mailboxID, conversationID)
+}
+
+// excerpt returns the start of body, up to n characters, cut at a word
+// boundary where possible.
+func excerpt(body string, n int) string {
+	body = strings.TrimSpace(body)
+	r := []rune(body)
+	if len(r) <= n {
+		return body
+	}
+	cut := string(r[:n])
+	if i := strings.LastIndexAny(cut, " \n\t"); i > n/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimSpace(cut) + "…"
 }
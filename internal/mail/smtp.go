@@ -1,6 +1,7 @@
 package mail
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -12,43 +13,77 @@ import (
 
 var smtpSendMail = smtp.SendMail
 
-// SMTPClient wraps net/smtp to provide a simple interface for sending emails.
+// SMTPClient builds outbound emails and hands them to a Transport, by
+// default an SMTP relay.
 type SMTPClient struct {
-	host string
-	port int
-	user string
-	pass string
-	from string
+	from      string
+	transport Transport
+
+	signer *DKIMSigner
 }
 
-// NewSMTPClient creates a new SMTPClient with the given SMTP server configuration.
+// NewSMTPClient creates a new SMTPClient that sends through the SMTP relay
+// at host:port.
 func NewSMTPClient(host string, port int, user, pass, from string) *SMTPClient {
 	return &SMTPClient{
-		host: host,
-		port: port,
-		user: user,
-		pass: pass,
-		from: from,
+		from:      from,
+		transport: NewRelayTransport(host, port, user, pass),
 	}
 }
 
-func (c *SMTPClient) auth() (smtp.Auth, error) {
-	if c.user == "" && c.pass == "" {
-		return nil, nil
-	}
-	if c.user == "" || c.pass == "" {
-		return nil, errors.New("smtp credentials are incomplete")
-	}
-	return smtp.PlainAuth("", c.user, c.pass, c.host), nil
+// SetTransport replaces the relay the client sends through.
+func (c *SMTPClient) SetTransport(t Transport) {
+	c.transport = t
 }
 
-func (c *SMTPClient) send(envelopeFrom, headerFrom, to, subject, body string) error {
-	addr := fmt.Sprintf("%s:%d", c.host, c.port)
-	auth, err := c.auth()
-	if err != nil {
-		return err
-	}
+// SetDKIMSigner makes the client DKIM-sign the mail it delivers.
+func (c *SMTPClient) SetDKIMSigner(s *DKIMSigner) {
+	c.signer = s
+}
+
+// Message is an outbound email handed to SMTPClient.Deliver.
+type Message struct {
+	EnvelopeFrom string
+	HeaderFrom   string
+	FromName     string // display name for HeaderFrom, if set
+	To           string
+	ReplyTo      string
+	Subject      string
+
+	// Body is the plain text of the message, which may use Markdown. HTML
+	// is the HTML version. If one of them is empty it is made from the
+	// other.
+	Body string
+	HTML string
+
+	// MessageID, if set, is the Message-ID header to send; otherwise one
+	// is made up.
+	MessageID string
+
+	// InReplyTo and References thread the message (RFC 5322, section
+	// 3.6.4). References is a space-separated list of message IDs.
+	InReplyTo  string
+	References string
+
+	// AutoSubmitted, if set, is sent as the RFC 3834 Auto-Submitted header
+	// so that receiving systems do not auto-reply to the message.
+	AutoSubmitted string
+
+	// Attachments are sent after the body.
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to a Message.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
 
+// Deliver sends m and returns the Message-ID header it was sent with.
+func (c *SMTPClient) Deliver(m Message) (string, error) {
+	envelopeFrom := m.EnvelopeFrom
+	headerFrom := m.HeaderFrom
 	if envelopeFrom == "" {
 		envelopeFrom = c.from
 	}
@@ -57,26 +92,26 @@ func (c *SMTPClient) send(envelopeFrom, headerFrom, to, subject, body string) er
 	}
 
 	if envelopeFrom == "" {
-		return errors.New("from address is required")
+		return "", errors.New("from address is required")
 	}
 
-	messageID := buildMessageID(envelopeFrom, headerFrom, c.from)
-	dateHeader := time.Now().UTC().Format(time.RFC1123Z)
-
-	headers := fmt.Sprintf(
-		"From: %s\r\n"+
-			"To: %s\r\n"+
-			"Subject: %s\r\n"+
-			"Date: %s\r\n"+
-			"Message-ID: %s\r\n"+
-			"MIME-Version: 1.0\r\n"+
-			"Content-Type: text/html; charset=\"UTF-8\"\r\n"+
-			"\r\n",
-		headerFrom, to, subject, dateHeader, messageID,
-	)
-
-	msg := []byte(headers + body)
-	return smtpSendMail(addr, auth, envelopeFrom, []string{to}, msg)
+	messageID := m.MessageID
+	if messageID == "" {
+		messageID = buildMessageID(envelopeFrom, headerFrom, c.from)
+	}
+	msg, err := compose(m, headerFrom, messageID, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	if c.signer != nil {
+		if msg, err = c.signer.Sign(context.Background(), headerFrom, msg); err != nil {
+			return "", err
+		}
+	}
+	if err := c.transport.Send(envelopeFrom, []string{m.To}, msg); err != nil {
+		return "", err
+	}
+	return messageID, nil
 }
 
 func buildMessageID(addresses ...string) string {
@@ -119,13 +154,9 @@ func extractDomain(raw string) string {
 	return strings.ToLower(domain)
 }
 
-// Send delivers an HTML email to the specified recipient using SMTP.
-func (c *SMTPClient) Send(to, subject, body string) error {
-	return c.send(c.from, c.from, to, subject, body)
-}
-
-// SendFrom delivers an email using a custom envelope sender and header sender.
-// Used for mailbox replies where the From header should include the mailbox name.
-func (c *SMTPClient) SendFrom(envelopeFrom, headerFrom, to, subject, body string) error {
-	return c.send(envelopeFrom, headerFrom, to, subject, body)
+// SendNotification sends a rendered notification from the configured
+// address.
+func (c *SMTPClient) SendNotification(to string, n *Notification) error {
+	_, err := c.Deliver(Message{EnvelopeFrom: c.from, HeaderFrom: c.from, To: to, Subject: n.Subject, Body: n.Text, HTML: n.HTML, AutoSubmitted: "auto-generated"})
+	return err
 }
@@ -1,9 +1,20 @@
 package mail
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
 	"net/smtp"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/mailauth"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
 )
 
 func withStubSendMail(t *testing.T, stub func(addr string, a smtp.Auth, from string, to []string, msg []byte) error) {
@@ -15,7 +26,7 @@ func withStubSendMail(t *testing.T, stub func(addr string, a smtp.Auth, from str
 	})
 }
 
-func TestSMTPClientSend_NoAuthWhenCredentialsBlank(t *testing.T) {
+func TestSMTPClientDeliver_NoAuthWhenCredentialsBlank(t *testing.T) {
 	client := NewSMTPClient("smtp.example.com", 25, "", "", "no-reply@example.com")
 
 	withStubSendMail(t, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
@@ -43,12 +54,12 @@ func TestSMTPClientSend_NoAuthWhenCredentialsBlank(t *testing.T) {
 		return nil
 	})
 
-	if err := client.Send("user@example.com", "Subject", "<p>Body</p>"); err != nil {
-		t.Fatalf("Send returned error: %v", err)
+	if _, err := client.Deliver(Message{To: "user@example.com", Subject: "Subject", HTML: "<p>Body</p>"}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
 	}
 }
 
-func TestSMTPClientSendFrom_UsesEnvelopeAndHeaderSeparately(t *testing.T) {
+func TestSMTPClientDeliver_UsesEnvelopeAndHeaderSeparately(t *testing.T) {
 	client := NewSMTPClient("smtp.example.com", 25, "", "", "fallback@example.com")
 
 	withStubSendMail(t, func(_ string, _ smtp.Auth, from string, _ []string, msg []byte) error {
@@ -64,14 +75,20 @@ func TestSMTPClientSendFrom_UsesEnvelopeAndHeaderSeparately(t *testing.T) {
 		return nil
 	})
 
-	if err := client.SendFrom("support@example.com", "Support Team <support@example.com>", "user@example.com", "Re: Help", "<p>Reply</p>"); err != nil {
-		t.Fatalf("SendFrom returned error: %v", err)
+	if _, err := client.Deliver(Message{
+		EnvelopeFrom: "support@example.com",
+		HeaderFrom:   "Support Team <support@example.com>",
+		To:           "user@example.com",
+		Subject:      "Re: Help",
+		Body:         "Reply",
+	}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
 	}
 }
 
-func TestSMTPClientSend_IncompleteCredentialsFail(t *testing.T) {
+func TestSMTPClientDeliver_IncompleteCredentialsFail(t *testing.T) {
 	client := NewSMTPClient("smtp.example.com", 587, "user-only", "", "no-reply@example.com")
-	err := client.Send("user@example.com", "Subject", "<p>Body</p>")
+	_, err := client.Deliver(Message{To: "user@example.com", Subject: "Subject", HTML: "<p>Body</p>"})
 	if err == nil {
 		t.Fatal("expected error for incomplete SMTP credentials")
 	}
@@ -79,3 +96,145 @@ func TestSMTPClientSend_IncompleteCredentialsFail(t *testing.T) {
 		t.Fatalf("expected incomplete credentials error, got %v", err)
 	}
 }
+
+func TestSMTPClientDeliver_ReturnsMessageIDAndSetsReplyTo(t *testing.T) {
+	client := NewSMTPClient("smtp.example.com", 25, "", "", "fallback@example.com")
+
+	var sent string
+	withStubSendMail(t, func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+		sent = string(msg)
+		return nil
+	})
+
+	messageID, err := client.Deliver(Message{
+		EnvelopeFrom: "support@example.com",
+		To:           "user@example.com",
+		ReplyTo:      "support+token@example.com",
+		Subject:      "Re: Help",
+		Body:         "<p>Reply</p>",
+	})
+	if err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+	if !strings.HasPrefix(messageID, "<") || !strings.HasSuffix(messageID, "@example.com>") {
+		t.Fatalf("unexpected Message-ID %q", messageID)
+	}
+	if !strings.Contains(sent, "Message-ID: "+messageID+"\r\n") {
+		t.Fatalf("expected returned Message-ID in message, got %q", sent)
+	}
+	if !strings.Contains(sent, "Reply-To: support+token@example.com\r\n") {
+		t.Fatalf("expected Reply-To header in message, got %q", sent)
+	}
+}
+
+func TestSMTPClientDeliver_AutoSubmittedHeader(t *testing.T) {
+	client := NewSMTPClient("smtp.example.com", 25, "", "", "no-reply@example.com")
+
+	var sent string
+	withStubSendMail(t, func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+		sent = string(msg)
+		return nil
+	})
+
+	if _, err := client.Deliver(Message{To: "user@example.com", Subject: "Re: Help", Body: "Thanks"}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+	if strings.Contains(sent, "Auto-Submitted:") {
+		t.Fatalf("expected no Auto-Submitted header on a personal reply, got %q", sent)
+	}
+
+	if _, err := client.Deliver(Message{To: "user@example.com", Subject: "Re: Help", Body: "Away", AutoSubmitted: "auto-replied"}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+	if !strings.Contains(sent, "Auto-Submitted: auto-replied\r\n") {
+		t.Fatalf("expected Auto-Submitted header, got %q", sent)
+	}
+}
+
+func TestSMTPClientDeliver_UsesGivenMessageID(t *testing.T) {
+	client := NewSMTPClient("smtp.example.com", 25, "", "", "no-reply@example.com")
+
+	var sent string
+	withStubSendMail(t, func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+		sent = string(msg)
+		return nil
+	})
+
+	messageID, err := client.Deliver(Message{To: "user@example.com", Subject: "Re: Help", Body: "Thanks", MessageID: "<queued-1@example.com>"})
+	if err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+	if messageID != "<queued-1@example.com>" || !strings.Contains(sent, "Message-ID: <queued-1@example.com>\r\n") {
+		t.Fatalf("expected the given Message-ID to be sent and returned, got %q in %q", messageID, sent)
+	}
+}
+
+// activeKeys is a DKIMKeyStore that only answers the signer's lookup.
+type activeKeys struct {
+	store.DKIMKeyStore
+	byDomain map[string][]models.DKIMKey
+}
+
+func (s *activeKeys) GetActiveDKIMKeysByDomainName(_ context.Context, name string) ([]models.DKIMKey, error) {
+	return s.byDomain[name], nil
+}
+
+// txtResolver answers TXT lookups from a map.
+type txtResolver map[string]string
+
+func (r txtResolver) LookupTXT(host string) ([]string, error) {
+	if record, ok := r[host]; ok {
+		return []string{record}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r txtResolver) LookupIP(string) ([]net.IP, error)  { return nil, nil }
+func (r txtResolver) LookupMX(string) ([]*net.MX, error) { return nil, nil }
+
+func TestSMTPClientDeliver_SignsWithDomainKeys(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &activeKeys{byDomain: map[string][]models.DKIMKey{
+		"example.com": {{Selector: "dd1-ed25519", Algorithm: "ed25519-sha256", PrivateKey: der, Status: models.DKIMActive}},
+	}}
+	resolver := txtResolver{
+		"dd1-ed25519._domainkey.example.com": "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public),
+	}
+
+	client := NewSMTPClient("smtp.example.com", 25, "", "", "no-reply@other.test")
+	client.SetDKIMSigner(NewDKIMSigner(keys))
+
+	var sent string
+	withStubSendMail(t, func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+		sent = string(msg)
+		return nil
+	})
+
+	if _, err := client.Deliver(Message{
+		EnvelopeFrom: "support@mail.example.com",
+		HeaderFrom:   "Support <support@mail.example.com>",
+		To:           "user@test.com",
+		Subject:      "Re: Help",
+		Body:         "Reply",
+	}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+	res := mailauth.VerifyDKIM(resolver, strings.NewReader(sent), time.Now())
+	if len(res) != 1 || res[0].Result != "pass" || res[0].Domain != "example.com" {
+		t.Fatalf("expected reply to carry a passing signature for example.com, got %+v in %q", res, sent)
+	}
+
+	if _, err := client.Deliver(Message{To: "owner@test.com", Subject: "New message", HTML: "<p>Hi</p>"}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+	if strings.Contains(sent, "DKIM-Signature:") {
+		t.Fatalf("expected mail from a domain without keys to be unsigned, got %q", sent)
+	}
+}
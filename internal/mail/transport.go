@@ -0,0 +1,319 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// Transport hands a complete message to the next hop for its recipients.
+type Transport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// RelayTransport sends all mail through one SMTP relay, authenticating
+// with PLAIN if credentials are set.
+type RelayTransport struct {
+	host string
+	port int
+	user string
+	pass string
+}
+
+// NewRelayTransport creates a RelayTransport for the relay at host:port.
+func NewRelayTransport(host string, port int, user, pass string) *RelayTransport {
+	return &RelayTransport{host: host, port: port, user: user, pass: pass}
+}
+
+func (t *RelayTransport) auth() (smtp.Auth, error) {
+	if t.user == "" && t.pass == "" {
+		return nil, nil
+	}
+	if t.user == "" || t.pass == "" {
+		return nil, errors.New("smtp credentials are incomplete")
+	}
+	return smtp.PlainAuth("", t.user, t.pass, t.host), nil
+}
+
+func (t *RelayTransport) Send(from string, to []string, msg []byte) error {
+	if t.host == "" {
+		return errors.New("no SMTP relay is configured")
+	}
+	auth, err := t.auth()
+	if err != nil {
+		return err
+	}
+	return smtpSendMail(fmt.Sprintf("%s:%d", t.host, t.port), auth, from, to, msg)
+}
+
+const (
+	directDialTimeout = 30 * time.Second
+	// directSessionTimeout bounds a whole SMTP session with one MX host.
+	directSessionTimeout = 5 * time.Minute
+)
+
+// DirectTransport delivers mail straight to the MX hosts of each
+// recipient's domain, in order of preference, using STARTTLS whenever the
+// host offers it. The certificate is not checked, as is usual between
+// MTAs: opportunistic TLS protects against eavesdropping, not against
+// someone who can change the DNS answers.
+type DirectTransport struct {
+	resolver domain.DNSResolver
+	helo     string
+	port     int
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewDirectTransport creates a DirectTransport that looks up MX records with
+// resolver and introduces itself as helo.
+func NewDirectTransport(resolver domain.DNSResolver, helo string) *DirectTransport {
+	d := &net.Dialer{Timeout: directDialTimeout}
+	return &DirectTransport{resolver: resolver, helo: helo, port: 25, dial: d.DialContext}
+}
+
+// DeliveryAttempt is the outcome of trying to hand a message to one MX host.
+type DeliveryAttempt struct {
+	Host string
+	TLS  bool  // whether the session was encrypted with STARTTLS
+	Err  error // nil if the host accepted the message
+}
+
+// DeliveryError is returned when no MX host of a domain accepted a
+// message. It unwraps to the error of the last attempt, so that a
+// permanent rejection that ended delivery can be recognised.
+type DeliveryError struct {
+	Domain   string
+	Attempts []DeliveryAttempt
+}
+
+func (e *DeliveryError) Error() string {
+	parts := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		parts = append(parts, a.Host+": "+a.Err.Error())
+	}
+	return fmt.Sprintf("delivery to %s failed: %s", e.Domain, strings.Join(parts, "; "))
+}
+
+func (e *DeliveryError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+func (t *DirectTransport) Send(from string, to []string, msg []byte) error {
+	byDomain := make(map[string][]string)
+	var domains []string
+	for _, rcpt := range to {
+		d := extractDomain(rcpt)
+		if d == "" {
+			return fmt.Errorf("invalid recipient %q", rcpt)
+		}
+		if byDomain[d] == nil {
+			domains = append(domains, d)
+		}
+		byDomain[d] = append(byDomain[d], rcpt)
+	}
+
+	for _, d := range domains {
+		attempts, err := t.Deliver(d, from, byDomain[d], msg)
+		for _, a := range attempts {
+			if a.Err != nil {
+				slog.Warn("direct delivery attempt failed", "domain", d, "mx", a.Host, "tls", a.TLS, "error", a.Err)
+			} else {
+				slog.Info("delivered directly", "domain", d, "mx", a.Host, "tls", a.TLS)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliver hands msg to the MX hosts of domainName for the given recipients
+// in that domain. It tries the hosts in order of preference until one
+// accepts the message, stopping early on a permanent rejection, and
+// returns the result of each attempt.
+func (t *DirectTransport) Deliver(domainName, from string, to []string, msg []byte) ([]DeliveryAttempt, error) {
+	hosts, err := t.mxHosts(domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	var attempts []DeliveryAttempt
+	for _, host := range hosts {
+		a := t.attempt(host, from, to, msg)
+		attempts = append(attempts, a)
+		if a.Err == nil {
+			return attempts, nil
+		}
+		if permanent(a.Err) {
+			break
+		}
+	}
+	return attempts, &DeliveryError{Domain: domainName, Attempts: attempts}
+}
+
+// mxHosts returns the MX hosts of the domain in order of preference. A
+// domain without MX records is its own mail host (RFC 5321, section 5.1).
+func (t *DirectTransport) mxHosts(domainName string) ([]string, error) {
+	records, err := t.resolver.LookupMX(domainName)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, fmt.Errorf("mx lookup for %s: %w", domainName, err)
+	}
+	if len(records) == 0 {
+		return []string{domainName}, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// A null MX (RFC 7505): the domain accepts no mail.
+			return nil, &textproto.Error{Code: 556, Msg: "5.1.10 " + domainName + " does not accept mail"}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// attempt runs one SMTP session with host.
+func (t *DirectTransport) attempt(host, from string, to []string, msg []byte) DeliveryAttempt {
+	a := DeliveryAttempt{Host: host}
+
+	ctx, cancel := context.WithTimeout(context.Background(), directSessionTimeout)
+	defer cancel()
+	conn, err := t.dial(ctx, "tcp", net.JoinHostPort(host, fmt.Sprint(t.port)))
+	if err != nil {
+		a.Err = err
+		return a
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		a.Err = err
+		return a
+	}
+	defer c.Close()
+
+	a.Err = func() error {
+		if err := c.Hello(t.helo); err != nil {
+			return err
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+				return fmt.Errorf("starttls: %w", err)
+			}
+			a.TLS = true
+		}
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		for _, rcpt := range to {
+			if err := c.Rcpt(rcpt); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return c.Quit()
+	}()
+	return a
+}
+
+// permanent reports whether err is a 5xx SMTP reply, which another MX host
+// of the same domain would give too.
+func permanent(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
+
+// DomainTransports sends mail with the transport the sender's domain is
+// configured to use, or with the default one.
+type DomainTransports struct {
+	domains    store.DomainStore
+	transports map[models.OutboundTransport]Transport
+	fallback   models.OutboundTransport
+}
+
+// NewDomainTransports creates a DomainTransports choosing between relay
+// and direct, where fallback is the transport of domains that have not
+// chosen one.
+func NewDomainTransports(domains store.DomainStore, fallback models.OutboundTransport, relay, direct Transport) *DomainTransports {
+	return &DomainTransports{
+		domains: domains,
+		transports: map[models.OutboundTransport]Transport{
+			models.TransportRelay:  relay,
+			models.TransportDirect: direct,
+		},
+		fallback: fallback,
+	}
+}
+
+func (t *DomainTransports) Send(from string, to []string, msg []byte) error {
+	choice, err := t.transportFor(from)
+	if err != nil {
+		return err
+	}
+	transport := t.transports[choice]
+	if transport == nil {
+		return fmt.Errorf("unknown outbound transport %q", choice)
+	}
+	return transport.Send(from, to, msg)
+}
+
+// transportFor returns the transport of the verified domain that from, or
+// the closest parent domain, belongs to.
+func (t *DomainTransports) transportFor(from string) (models.OutboundTransport, error) {
+	for _, name := range parentDomains(extractDomain(from)) {
+		choice, err := t.domains.GetOutboundTransportByName(context.Background(), name)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("look up outbound transport of %s: %w", name, err)
+		}
+		if choice != models.TransportDefault {
+			return choice, nil
+		}
+		break
+	}
+	return t.fallback, nil
+}
+
+// parentDomains returns name followed by its parent domains, down to the
+// one below the top-level domain.
+func parentDomains(name string) []string {
+	var names []string
+	for ; strings.Contains(name, "."); _, name, _ = strings.Cut(name, ".") {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,276 @@
+package mail
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// fakeMX is a local SMTP server standing in for a recipient's mail host.
+type fakeMX struct {
+	addr    string
+	rcptErr error // returned for every RCPT if set
+
+	mu       sync.Mutex
+	messages []string
+	tls      bool // whether the last session used STARTTLS
+}
+
+type fakeMXSession struct {
+	mx   *fakeMX
+	conn *smtp.Conn
+}
+
+func (mx *fakeMX) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &fakeMXSession{mx: mx, conn: c}, nil
+}
+
+func (s *fakeMXSession) Mail(string, *smtp.MailOptions) error { return nil }
+func (s *fakeMXSession) Rcpt(string, *smtp.RcptOptions) error { return s.mx.rcptErr }
+func (s *fakeMXSession) Reset()                               {}
+func (s *fakeMXSession) Logout() error                        { return nil }
+
+func (s *fakeMXSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, isTLS := s.conn.TLSConnectionState()
+	s.mx.mu.Lock()
+	defer s.mx.mu.Unlock()
+	s.mx.messages = append(s.mx.messages, string(b))
+	s.mx.tls = isTLS
+	return nil
+}
+
+func (mx *fakeMX) received() []string {
+	mx.mu.Lock()
+	defer mx.mu.Unlock()
+	return append([]string(nil), mx.messages...)
+}
+
+// startFakeMX starts a fake MX on a loopback port, offering STARTTLS with a
+// self-signed certificate if withTLS is set.
+func startFakeMX(t *testing.T, withTLS bool, rcptErr error) *fakeMX {
+	t.Helper()
+	mx := &fakeMX{rcptErr: rcptErr}
+	srv := smtp.NewServer(mx)
+	srv.Domain = "mx.test"
+	if withTLS {
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	mx.addr = ln.Addr().String()
+	return mx
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// closedAddr returns a loopback address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// mxResolver answers MX lookups from a map.
+type mxResolver map[string][]*net.MX
+
+func (r mxResolver) LookupTXT(string) ([]string, error) { return nil, nil }
+func (r mxResolver) LookupIP(string) ([]net.IP, error)  { return nil, nil }
+
+func (r mxResolver) LookupMX(host string) ([]*net.MX, error) {
+	if records, ok := r[host]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// newTestDirectTransport returns a DirectTransport that connects to the
+// given addresses instead of port 25 of each MX host.
+func newTestDirectTransport(resolver mxResolver, hosts map[string]string) *DirectTransport {
+	tr := NewDirectTransport(resolver, "deaddrop.test")
+	tr.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, hosts[host])
+	}
+	return tr
+}
+
+const testMessage = "From: support@example.com\r\nTo: alice@dest.test\r\nSubject: Hi\r\n\r\nHello\r\n"
+
+func TestDirectTransport_FallsBackAcrossMXPriorities(t *testing.T) {
+	busy := startFakeMX(t, false, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again later"})
+	good := startFakeMX(t, true, nil)
+	resolver := mxResolver{"dest.test": {
+		{Host: "mx3.dest.test.", Pref: 30},
+		{Host: "mx1.dest.test.", Pref: 10},
+		{Host: "mx2.dest.test.", Pref: 20},
+	}}
+	tr := newTestDirectTransport(resolver, map[string]string{
+		"mx1.dest.test": closedAddr(t),
+		"mx2.dest.test": busy.addr,
+		"mx3.dest.test": good.addr,
+	})
+
+	attempts, err := tr.Deliver("dest.test", "support@example.com", []string{"alice@dest.test"}, []byte(testMessage))
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("expected an attempt per MX host, got %+v", attempts)
+	}
+	for i, host := range []string{"mx1.dest.test", "mx2.dest.test", "mx3.dest.test"} {
+		if attempts[i].Host != host {
+			t.Errorf("expected attempt %d to go to %s, got %s", i, host, attempts[i].Host)
+		}
+	}
+	if attempts[0].Err == nil || attempts[1].Err == nil || !strings.Contains(attempts[1].Err.Error(), "Try again later") {
+		t.Errorf("expected the first two attempts to fail, got %+v", attempts)
+	}
+	if attempts[2].Err != nil || !attempts[2].TLS {
+		t.Errorf("expected the last host to accept the message over STARTTLS, got %+v", attempts[2])
+	}
+	got := good.received()
+	if len(got) != 1 || !strings.HasSuffix(got[0], "\r\n\r\nHello\r\n") || !good.tls {
+		t.Fatalf("expected the message to arrive over TLS, got %q", got)
+	}
+	if len(busy.received()) != 0 {
+		t.Error("expected the busy host not to take the message")
+	}
+}
+
+func TestDirectTransport_PermanentRejectionStopsDelivery(t *testing.T) {
+	rejecting := startFakeMX(t, false, &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"})
+	backup := startFakeMX(t, false, nil)
+	tr := newTestDirectTransport(mxResolver{"dest.test": {
+		{Host: "mx1.dest.test.", Pref: 10},
+		{Host: "mx2.dest.test.", Pref: 20},
+	}}, map[string]string{"mx1.dest.test": rejecting.addr, "mx2.dest.test": backup.addr})
+
+	err := tr.Send("support@example.com", []string{"nobody@dest.test"}, []byte(testMessage))
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) || len(delivery.Attempts) != 1 {
+		t.Fatalf("expected delivery to stop after the rejection, got %v", err)
+	}
+	var reply *textproto.Error
+	if !errors.As(err, &reply) || reply.Code != 550 {
+		t.Fatalf("expected the error to carry the 550 reply, got %v", err)
+	}
+	if len(backup.received()) != 0 {
+		t.Error("expected the backup MX not to be tried")
+	}
+}
+
+func TestDirectTransport_ImplicitAndNullMX(t *testing.T) {
+	mx := startFakeMX(t, false, nil)
+	tr := newTestDirectTransport(mxResolver{
+		"nomail.test": {{Host: ".", Pref: 0}},
+	}, map[string]string{"dest.test": mx.addr})
+
+	if err := tr.Send("support@example.com", []string{"alice@dest.test"}, []byte(testMessage)); err != nil {
+		t.Fatalf("expected a domain without MX records to be its own mail host, got %v", err)
+	}
+	if len(mx.received()) != 1 {
+		t.Fatal("expected the message to be delivered to the domain itself")
+	}
+
+	err := tr.Send("support@example.com", []string{"alice@nomail.test"}, []byte(testMessage))
+	var reply *textproto.Error
+	if !errors.As(err, &reply) || reply.Code != 556 {
+		t.Fatalf("expected a null MX to reject the message permanently, got %v", err)
+	}
+}
+
+// recordingTransport records the senders it is asked to send for.
+type recordingTransport struct {
+	sent []string
+}
+
+func (t *recordingTransport) Send(from string, _ []string, _ []byte) error {
+	t.sent = append(t.sent, from)
+	return nil
+}
+
+// transportChoices is a DomainStore that only answers the transport lookup.
+type transportChoices struct {
+	store.DomainStore
+	byName map[string]models.OutboundTransport
+}
+
+func (s *transportChoices) GetOutboundTransportByName(_ context.Context, name string) (models.OutboundTransport, error) {
+	choice, ok := s.byName[name]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return choice, nil
+}
+
+func TestDomainTransports_ChoosesBySenderDomain(t *testing.T) {
+	relay, direct := &recordingTransport{}, &recordingTransport{}
+	domains := &transportChoices{byName: map[string]models.OutboundTransport{
+		"direct.test": models.TransportDirect,
+		"relay.test":  models.TransportRelay,
+		"plain.test":  models.TransportDefault,
+	}}
+	client := NewSMTPClient("", 0, "", "", "no-reply@other.test")
+	client.SetTransport(NewDomainTransports(domains, models.TransportRelay, relay, direct))
+
+	for _, from := range []string{"a@direct.test", "b@mail.direct.test", "c@relay.test", "d@plain.test", "e@unknown.test"} {
+		if _, err := client.Deliver(Message{EnvelopeFrom: from, To: "alice@dest.test", Subject: "Hi", Body: "Hello"}); err != nil {
+			t.Fatalf("Deliver from %s: %v", from, err)
+		}
+	}
+	if strings.Join(direct.sent, ",") != "a@direct.test,b@mail.direct.test" {
+		t.Errorf("expected mail from direct.test and its subdomains to go direct, got %v", direct.sent)
+	}
+	if strings.Join(relay.sent, ",") != "c@relay.test,d@plain.test,e@unknown.test" {
+		t.Errorf("expected other mail to use the relay, got %v", relay.sent)
+	}
+}
@@ -0,0 +1,470 @@
+package mailauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/domain"
+)
+
+// DKIMResult is the outcome of verifying one DKIM-Signature header.
+type DKIMResult struct {
+	Result   string // pass, fail, neutral, temperror or permerror
+	Domain   string // d= tag
+	Selector string // s= tag
+	Reason   string
+}
+
+// maxDKIMSignatures bounds the work done for messages carrying many
+// signatures.
+const maxDKIMSignatures = 5
+
+// minRSAKeyBits is the smallest RSA key accepted; shorter keys can be
+// factored (RFC 8301).
+const minRSAKeyBits = 1024
+
+// VerifyDKIM verifies every DKIM-Signature header of the message read from
+// msg (RFC 6376, with the rsa-sha256 and ed25519-sha256 algorithms). The
+// body is hashed as it is read, so the message is never held in memory.
+func VerifyDKIM(r domain.DNSResolver, msg io.Reader, now time.Time) []DKIMResult {
+	_, results := verifyDKIM(r, bufio.NewReader(msg), now)
+	return results
+}
+
+// verifyDKIM is VerifyDKIM, also returning the message's header fields. The
+// body is only read if the message is signed.
+func verifyDKIM(r domain.DNSResolver, br *bufio.Reader, now time.Time) ([]headerField, []DKIMResult) {
+	headers := readHeaders(br)
+
+	var sigs []*dkimSignature
+	for i, h := range headers {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+		if len(sigs) == maxDKIMSignatures {
+			break
+		}
+		sigs = append(sigs, parseSignature(headers, i, now))
+	}
+	if len(sigs) == 0 {
+		return headers, nil
+	}
+
+	// Every signature hashes the body with its own canonicalization and
+	// length; the body is read once for all of them.
+	var bodies []*bodyCanonicalizer
+	for _, sig := range sigs {
+		if sig.body != nil {
+			bodies = append(bodies, sig.body)
+		}
+	}
+	for {
+		line, ok := readLine(br)
+		if !ok {
+			break
+		}
+		for _, b := range bodies {
+			b.line(line)
+		}
+	}
+	for _, b := range bodies {
+		b.close()
+	}
+
+	results := make([]DKIMResult, len(sigs))
+	for i, sig := range sigs {
+		results[i] = sig.verify(r, headers)
+	}
+	return headers, results
+}
+
+type headerField struct {
+	name string
+	raw  string // the full field including folding and the trailing CRLF
+}
+
+// readLine reads one line without its line ending; a bare LF ends a line
+// like CRLF does. It reports false at the end of the input.
+func readLine(br *bufio.Reader) ([]byte, bool) {
+	line, err := br.ReadBytes('\n')
+	if len(line) == 0 && err != nil {
+		return nil, false
+	}
+	if bytes.HasSuffix(line, []byte("\n")) {
+		line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	}
+	return line, true
+}
+
+// readHeaders reads the header fields of a message up to the blank line
+// that ends them, with CRLF line endings.
+func readHeaders(br *bufio.Reader) []headerField {
+	var headers []headerField
+	for {
+		line, ok := readLine(br)
+		if !ok || len(line) == 0 {
+			return headers
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].raw += string(line) + "\r\n"
+			continue
+		}
+		name, _, _ := strings.Cut(string(line), ":")
+		headers = append(headers, headerField{name: strings.TrimSpace(name), raw: string(line) + "\r\n"})
+	}
+}
+
+// splitMessage separates the header fields from the body of a message held
+// in memory.
+func splitMessage(raw []byte) ([]headerField, []byte) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	headers := readHeaders(br)
+	body, _ := io.ReadAll(br)
+	return headers, body
+}
+
+// dkimSignature is a DKIM-Signature header being verified.
+type dkimSignature struct {
+	// res is the result so far; Result is set as soon as the signature is
+	// known not to verify.
+	res           DKIMResult
+	field         headerField
+	tags          map[string]string
+	algorithm     string
+	signedHeaders []string
+	headerCanon   string
+
+	// body computes the body hash while the body is read. It is nil if the
+	// signature failed before that.
+	body     *bodyCanonicalizer
+	bodyHash hash.Hash
+}
+
+// parseSignature checks the tags of the DKIM-Signature at sigIndex and
+// prepares hashing the body for it.
+func parseSignature(headers []headerField, sigIndex int, now time.Time) *dkimSignature {
+	sig := &dkimSignature{field: headers[sigIndex]}
+	_, sigValue, _ := strings.Cut(sig.field.raw, ":")
+	tags := parseTagList(sigValue)
+	sig.tags = tags
+	sig.res = DKIMResult{Domain: strings.ToLower(tags["d"]), Selector: tags["s"]}
+	permerror := func(reason string) *dkimSignature {
+		sig.res.Result, sig.res.Reason = "permerror", reason
+		return sig
+	}
+
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return permerror("missing " + required + "= tag")
+		}
+	}
+	if tags["v"] != "1" {
+		return permerror("unsupported version")
+	}
+
+	sig.algorithm = strings.ToLower(tags["a"])
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return permerror("unsupported algorithm " + sig.algorithm)
+	}
+
+	sig.signedHeaders = strings.Split(tags["h"], ":")
+	signsFrom := false
+	for i, name := range sig.signedHeaders {
+		sig.signedHeaders[i] = strings.TrimSpace(name)
+		if strings.EqualFold(sig.signedHeaders[i], "From") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return permerror("From header not signed")
+	}
+
+	// The signing identity must be the signing domain or below it.
+	if i, ok := tags["i"]; ok {
+		at := strings.LastIndexByte(i, '@')
+		identity := strings.ToLower(strings.TrimSuffix(i[at+1:], "."))
+		if at < 0 || (identity != sig.res.Domain && !strings.HasSuffix(identity, "."+sig.res.Domain)) {
+			return permerror("i= not within d=")
+		}
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err == nil && now.Unix() > expires {
+			sig.res.Result, sig.res.Reason = "fail", "signature expired"
+			return sig
+		}
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		hc, bc, hasBody := strings.Cut(strings.ToLower(c), "/")
+		headerCanon = hc
+		if hasBody {
+			bodyCanon = bc
+		}
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return permerror("unsupported canonicalization")
+	}
+	sig.headerCanon = headerCanon
+
+	// A body length limit would let anyone append to a signed message, so
+	// l= is not honoured: the whole body is hashed, and a signature that
+	// covers only part of it does not verify.
+	if l, ok := tags["l"]; ok {
+		if n, err := strconv.ParseInt(l, 10, 64); err != nil || n < 0 {
+			return permerror("invalid l= tag")
+		}
+	}
+	sig.bodyHash = sha256.New()
+	sig.body = &bodyCanonicalizer{w: sig.bodyHash, canon: bodyCanon}
+	return sig
+}
+
+// verify checks the body hash and the signature once the body has been
+// read.
+func (sig *dkimSignature) verify(r domain.DNSResolver, headers []headerField) DKIMResult {
+	res := sig.res
+	if res.Result != "" {
+		return res
+	}
+	permerror := func(reason string) DKIMResult {
+		res.Result, res.Reason = "permerror", reason
+		return res
+	}
+	fail := func(reason string) DKIMResult {
+		res.Result, res.Reason = "fail", reason
+		return res
+	}
+
+	// Body hash.
+	wantBodyHash, err := base64.StdEncoding.DecodeString(stripWhitespace(sig.tags["bh"]))
+	if err != nil {
+		return permerror("invalid bh= tag")
+	}
+	if !bytes.Equal(sig.bodyHash.Sum(nil), wantBodyHash) {
+		return fail("body hash did not verify")
+	}
+
+	// Public key.
+	key, errResult := lookupDKIMKey(r, res.Selector, res.Domain, sig.algorithm)
+	if errResult != nil {
+		errResult.Domain, errResult.Selector = res.Domain, res.Selector
+		return *errResult
+	}
+
+	// Header hash: signed headers are taken bottom-up, then the signature
+	// field itself with an empty b= value and no trailing CRLF.
+	h := sha256.New()
+	used := make(map[string]int)
+	for _, name := range sig.signedHeaders {
+		lower := strings.ToLower(name)
+		seen := 0
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !strings.EqualFold(headers[i].name, name) {
+				continue
+			}
+			if seen == used[lower] {
+				h.Write([]byte(canonicalHeader(headers[i].raw, sig.headerCanon)))
+				break
+			}
+			seen++
+		}
+		used[lower]++
+	}
+	_, sigValue, _ := strings.Cut(sig.field.raw, ":")
+	emptied := sig.field.raw[:strings.IndexByte(sig.field.raw, ':')+1] + emptyBTag(sigValue)
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(emptied, sig.headerCanon), "\r\n")))
+	digest := h.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(stripWhitespace(sig.tags["b"]))
+	if err != nil {
+		return permerror("invalid b= tag")
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature); err != nil {
+			return fail("signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, signature) {
+			return fail("signature did not verify")
+		}
+	}
+
+	res.Result = "pass"
+	return res
+}
+
+func lookupDKIMKey(r domain.DNSResolver, selector, domainName, algorithm string) (crypto.PublicKey, *DKIMResult) {
+	txts, err := r.LookupTXT(selector + "._domainkey." + domainName)
+	if err != nil && !isNotFound(err) {
+		return nil, &DKIMResult{Result: "temperror", Reason: "key lookup failed"}
+	}
+	if len(txts) == 0 {
+		return nil, &DKIMResult{Result: "permerror", Reason: "no key for signature"}
+	}
+
+	tags := parseTagList(strings.Join(txts, ""))
+	p := stripWhitespace(tags["p"])
+	if p == "" {
+		return nil, &DKIMResult{Result: "permerror", Reason: "key revoked"}
+	}
+	keyType := strings.ToLower(tags["k"])
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	if !strings.HasPrefix(algorithm, keyType+"-") {
+		return nil, &DKIMResult{Result: "permerror", Reason: "key type does not match algorithm"}
+	}
+
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, &DKIMResult{Result: "permerror", Reason: "invalid key encoding"}
+	}
+
+	switch keyType {
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, &DKIMResult{Result: "permerror", Reason: "invalid ed25519 key"}
+		}
+		return ed25519.PublicKey(der), nil
+	default:
+		var rsaKey *rsa.PublicKey
+		if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+			rsaKey, _ = pub.(*rsa.PublicKey)
+		} else if key, err := x509.ParsePKCS1PublicKey(der); err == nil {
+			rsaKey = key
+		}
+		if rsaKey == nil {
+			return nil, &DKIMResult{Result: "permerror", Reason: "invalid rsa key"}
+		}
+		if rsaKey.N.BitLen() < minRSAKeyBits {
+			return nil, &DKIMResult{Result: "permerror", Reason: "rsa key too short"}
+		}
+		return rsaKey, nil
+	}
+}
+
+// parseTagList parses a DKIM tag=value list.
+func parseTagList(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if _, dup := tags[name]; name == "" || dup {
+			continue
+		}
+		tags[name] = strings.TrimSpace(unfold(value))
+	}
+	return tags
+}
+
+var bTagRe = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// emptyBTag removes the value of the b= tag, leaving bh= untouched.
+func emptyBTag(value string) string {
+	return bTagRe.ReplaceAllString(value, "${1}${2}")
+}
+
+func canonicalHeader(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	value = collapseWhitespace(unfold(value))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value) + "\r\n"
+}
+
+// canonicalBody canonicalizes a body held in memory.
+func canonicalBody(body []byte, canon string) []byte {
+	var buf bytes.Buffer
+	c := &bodyCanonicalizer{w: &buf, canon: canon}
+	br := bufio.NewReader(bytes.NewReader(body))
+	for {
+		line, ok := readLine(br)
+		if !ok {
+			break
+		}
+		c.line(line)
+	}
+	c.close()
+	return buf.Bytes()
+}
+
+// bodyCanonicalizer canonicalizes a body line by line (RFC 6376 3.4.3 and
+// 3.4.4) and writes the result to w.
+type bodyCanonicalizer struct {
+	w     io.Writer
+	canon string
+
+	// blank counts empty lines held back: they are written only if a
+	// non-empty line follows, which drops them at the end of the body.
+	blank   int
+	written bool
+}
+
+// line adds a body line without its line ending.
+func (c *bodyCanonicalizer) line(l []byte) {
+	if c.canon == "relaxed" {
+		l = bytes.TrimRight([]byte(collapseWhitespace(string(l))), " ")
+	}
+	if len(l) == 0 {
+		c.blank++
+		return
+	}
+	for ; c.blank > 0; c.blank-- {
+		c.write([]byte("\r\n"))
+	}
+	c.write(l)
+	c.write([]byte("\r\n"))
+}
+
+// close ends the body. An empty body is a single CRLF in simple
+// canonicalization and nothing in relaxed.
+func (c *bodyCanonicalizer) close() {
+	if !c.written && c.canon == "simple" {
+		c.write([]byte("\r\n"))
+	}
+}
+
+func (c *bodyCanonicalizer) write(b []byte) {
+	c.written = true
+	c.w.Write(b)
+}
+
+func unfold(s string) string {
+	return strings.NewReplacer("\r\n", "", "\n", "").Replace(s)
+}
+
+var whitespaceRunRe = regexp.MustCompile(`[ \t]+`)
+
+func collapseWhitespace(s string) string {
+	return whitespaceRunRe.ReplaceAllString(s, " ")
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
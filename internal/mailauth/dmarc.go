@@ -0,0 +1,114 @@
+package mailauth
+
+import (
+	"strings"
+
+	"github.com/znz-systems/deaddrop/internal/domain"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARCResult is the outcome of evaluating the From domain's DMARC policy.
+type DMARCResult struct {
+	Result string // pass, fail, none, temperror or permerror
+	Policy string // the requested disposition on failure: none, quarantine or reject
+	Domain string // the RFC 5322 From domain
+}
+
+// CheckDMARC applies the DMARC policy published for fromDomain (RFC 7489)
+// to the SPF and DKIM results of a message.
+func CheckDMARC(r domain.DNSResolver, fromDomain string, spf SPFResult, spfDomain string, dkim []DKIMResult) DMARCResult {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	res := DMARCResult{Domain: fromDomain}
+	if fromDomain == "" {
+		res.Result = "none"
+		return res
+	}
+
+	tags, result := lookupDMARC(r, fromDomain)
+	policy := tags["p"]
+	if tags == nil && result == "none" {
+		org := organizationalDomain(fromDomain)
+		if org != fromDomain {
+			tags, result = lookupDMARC(r, org)
+			policy = tags["p"]
+			if sp, ok := tags["sp"]; ok {
+				policy = sp
+			}
+		}
+	}
+	if tags == nil {
+		res.Result = result
+		return res
+	}
+
+	switch strings.ToLower(policy) {
+	case "none", "quarantine", "reject":
+		res.Policy = strings.ToLower(policy)
+	default:
+		res.Result = "permerror"
+		return res
+	}
+
+	strictSPF := strings.EqualFold(tags["aspf"], "s")
+	strictDKIM := strings.EqualFold(tags["adkim"], "s")
+
+	if spf == SPFPass && aligned(spfDomain, fromDomain, strictSPF) {
+		res.Result = "pass"
+		return res
+	}
+	for _, d := range dkim {
+		if d.Result == "pass" && aligned(d.Domain, fromDomain, strictDKIM) {
+			res.Result = "pass"
+			return res
+		}
+	}
+	res.Result = "fail"
+	return res
+}
+
+// lookupDMARC returns the tags of the DMARC record for name, or nil with a
+// result of none, temperror or permerror.
+func lookupDMARC(r domain.DNSResolver, name string) (map[string]string, string) {
+	txts, err := r.LookupTXT("_dmarc." + name)
+	if err != nil && !isNotFound(err) {
+		return nil, "temperror"
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(txt)), "V=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return nil, "none"
+	case 1:
+		return parseTagList(records[0]), ""
+	default:
+		return nil, "permerror"
+	}
+}
+
+func aligned(authDomain, fromDomain string, strict bool) bool {
+	authDomain = strings.ToLower(strings.TrimSuffix(authDomain, "."))
+	if authDomain == "" {
+		return false
+	}
+	if strict {
+		return authDomain == fromDomain
+	}
+	return organizationalDomain(authDomain) == organizationalDomain(fromDomain)
+}
+
+// organizationalDomain returns the registrable domain of name by the
+// public suffix list. A name that is itself a public suffix is returned
+// as is.
+func organizationalDomain(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	org, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return org
+}
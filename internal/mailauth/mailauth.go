@@ -0,0 +1,144 @@
+// Package mailauth evaluates SPF, DKIM and DMARC for inbound mail and
+// DKIM-signs outbound mail.
+package mailauth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/domain"
+)
+
+// Verdict summarises the authentication results of a message.
+type Verdict string
+
+const (
+	// VerdictPass means the From domain was authenticated.
+	VerdictPass Verdict = "pass"
+	// VerdictFail means the message failed the From domain's DMARC policy
+	// or, without DMARC, a hard SPF failure with no valid signature.
+	// Without DMARC, only an SPF or DKIM pass for a domain aligned with the
+	// From domain gives VerdictPass; anyone can pass for their own domain.
+	VerdictFail Verdict = "fail"
+	// VerdictNone means there was nothing conclusive to evaluate.
+	VerdictNone Verdict = "none"
+)
+
+// Input describes an inbound message as seen by the SMTP server.
+type Input struct {
+	IP       net.IP
+	Helo     string
+	MailFrom string
+
+	// Message is the message as received. It is read once, without being
+	// held in memory.
+	Message io.Reader
+}
+
+// Result holds the outcome of every check for one message.
+type Result struct {
+	SPF       SPFResult
+	SPFDomain string
+	DKIM      []DKIMResult
+	DMARC     DMARCResult
+}
+
+// Evaluate runs SPF, DKIM and DMARC for a message.
+func Evaluate(r domain.DNSResolver, in Input) Result {
+	// With a null reverse path SPF checks the HELO identity instead.
+	sender := strings.TrimSpace(in.MailFrom)
+	if sender == "" {
+		sender = "postmaster@" + in.Helo
+	}
+	spfDomain := sender[strings.LastIndexByte(sender, '@')+1:]
+
+	res := Result{SPFDomain: strings.ToLower(spfDomain)}
+	if in.IP != nil {
+		res.SPF = CheckSPF(r, in.IP, in.Helo, spfDomain, sender)
+	} else {
+		res.SPF = SPFNone
+	}
+	headers, dkim := verifyDKIM(r, bufio.NewReader(in.Message), time.Now())
+	res.DKIM = dkim
+	res.DMARC = CheckDMARC(r, fromDomain(headers), res.SPF, res.SPFDomain, res.DKIM)
+	return res
+}
+
+// Verdict reduces the results to pass, fail or none.
+func (res Result) Verdict() Verdict {
+	switch res.DMARC.Result {
+	case "pass":
+		return VerdictPass
+	case "fail":
+		return VerdictFail
+	}
+
+	from := res.DMARC.Domain
+	if res.SPF == SPFPass && aligned(res.SPFDomain, from, false) {
+		return VerdictPass
+	}
+	dkimPass := false
+	for _, d := range res.DKIM {
+		if d.Result != "pass" {
+			continue
+		}
+		if aligned(d.Domain, from, false) {
+			return VerdictPass
+		}
+		dkimPass = true
+	}
+	if res.SPF == SPFFail && !dkimPass {
+		return VerdictFail
+	}
+	return VerdictNone
+}
+
+// Header formats the results as an Authentication-Results header value
+// (RFC 8601) for the given authserv-id.
+func (res Result) Header(authservID string) string {
+	parts := []string{authservID}
+	parts = append(parts, fmt.Sprintf("spf=%s smtp.mailfrom=%s", res.SPF, res.SPFDomain))
+	if len(res.DKIM) == 0 {
+		parts = append(parts, "dkim=none")
+	}
+	for _, d := range res.DKIM {
+		entry := fmt.Sprintf("dkim=%s header.d=%s header.s=%s", d.Result, d.Domain, d.Selector)
+		if d.Reason != "" {
+			entry += fmt.Sprintf(" reason=%q", d.Reason)
+		}
+		parts = append(parts, entry)
+	}
+	dmarc := "dmarc=" + res.DMARC.Result
+	if res.DMARC.Policy != "" {
+		dmarc += " policy.dmarc=" + res.DMARC.Policy
+	}
+	if res.DMARC.Domain != "" {
+		dmarc += " header.from=" + res.DMARC.Domain
+	}
+	parts = append(parts, dmarc)
+	return strings.Join(parts, "; ")
+}
+
+// fromDomain returns the domain of the first RFC 5322 From address.
+func fromDomain(headers []headerField) string {
+	var b strings.Builder
+	for _, h := range headers {
+		b.WriteString(h.raw)
+	}
+	b.WriteString("\r\n")
+	msg, err := mail.ReadMessage(strings.NewReader(b.String()))
+	if err != nil {
+		return ""
+	}
+	addrs, err := msg.Header.AddressList("From")
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	addr := addrs[0].Address
+	return strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+}
@@ -0,0 +1,394 @@
+package mailauth
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/znz-systems/deaddrop/internal/domain"
+)
+
+// SPFResult is an RFC 7208 check_host() result.
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// spfLookupLimit caps the DNS-querying terms evaluated per check (RFC 7208
+// section 4.6.4).
+const spfLookupLimit = 10
+
+// CheckSPF evaluates the SPF policy of domainName for a message from ip with
+// the given HELO name and MAIL FROM address.
+func CheckSPF(r domain.DNSResolver, ip net.IP, helo, domainName, sender string) SPFResult {
+	c := &spfChecker{resolver: r, ip: ip, helo: helo, sender: sender}
+	return c.checkHost(strings.ToLower(strings.TrimSuffix(domainName, ".")))
+}
+
+type spfChecker struct {
+	resolver domain.DNSResolver
+	ip       net.IP
+	helo     string
+	sender   string
+	lookups  int
+}
+
+var errSPFPerm = errors.New("spf permanent error")
+
+func (c *spfChecker) checkHost(domainName string) SPFResult {
+	if domainName == "" || !strings.Contains(domainName, ".") {
+		return SPFNone
+	}
+
+	txts, err := c.resolver.LookupTXT(domainName)
+	if err != nil {
+		if isNotFound(err) {
+			return SPFNone
+		}
+		return SPFTempError
+	}
+
+	var record string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			if record != "" {
+				return SPFPermError
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return SPFNone
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		name, value, isModifier := splitModifier(term)
+		if isModifier {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+
+		matched, result := c.matchMechanism(domainName, term)
+		if result != "" {
+			return result
+		}
+		if matched {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		if c.lookups++; c.lookups > spfLookupLimit {
+			return SPFPermError
+		}
+		target, err := c.expand(redirect, domainName)
+		if err != nil {
+			return SPFPermError
+		}
+		result := c.checkHost(target)
+		if result == SPFNone {
+			return SPFPermError
+		}
+		return result
+	}
+
+	return SPFNeutral
+}
+
+// matchMechanism reports whether a single mechanism matches. A non-empty
+// result ends evaluation immediately (errors and the lookup limit).
+func (c *spfChecker) matchMechanism(domainName, term string) (bool, SPFResult) {
+	name, arg, _ := strings.Cut(term, ":")
+
+	// a and mx may carry a CIDR suffix without a domain argument. It is
+	// split off before lowercasing, which can change the name's length.
+	if arg == "" {
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name, arg = name[:i], name[i:]
+		}
+	}
+	lowerName := strings.ToLower(name)
+
+	switch lowerName {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		_, network, err := parseNetwork(arg, lowerName == "ip6")
+		if err != nil {
+			return false, SPFPermError
+		}
+		return network.Contains(c.ip), ""
+	}
+
+	if c.lookups++; c.lookups > spfLookupLimit {
+		return false, SPFPermError
+	}
+
+	target, cidr4, cidr6, err := c.domainSpec(arg, domainName)
+	if err != nil {
+		return false, SPFPermError
+	}
+
+	switch lowerName {
+	case "include":
+		if arg == "" {
+			return false, SPFPermError
+		}
+		switch c.checkHost(target) {
+		case SPFPass:
+			return true, ""
+		case SPFTempError:
+			return false, SPFTempError
+		case SPFPermError, SPFNone:
+			return false, SPFPermError
+		}
+		return false, ""
+	case "a":
+		ips, err := c.resolver.LookupIP(target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError
+		}
+		return c.matchIPs(ips, cidr4, cidr6), ""
+	case "mx":
+		mxs, err := c.resolver.LookupMX(target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError
+		}
+		if len(mxs) > 10 {
+			return false, SPFPermError
+		}
+		for _, mx := range mxs {
+			ips, err := c.resolver.LookupIP(strings.TrimSuffix(mx.Host, "."))
+			if err != nil && !isNotFound(err) {
+				return false, SPFTempError
+			}
+			if c.matchIPs(ips, cidr4, cidr6) {
+				return true, ""
+			}
+		}
+		return false, ""
+	case "exists":
+		ips, err := c.resolver.LookupIP(target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError
+		}
+		return len(ips) > 0, ""
+	case "ptr":
+		// ptr is deprecated and needs reverse lookups; treat it as no match.
+		return false, ""
+	}
+	return false, SPFPermError
+}
+
+// domainSpec splits "domain/cidr4//cidr6", expanding macros and defaulting
+// the domain to the one being evaluated.
+func (c *spfChecker) domainSpec(arg, current string) (target string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	spec := arg
+	if i := strings.Index(spec, "//"); i >= 0 {
+		if cidr6, err = strconv.Atoi(spec[i+2:]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+		spec = spec[:i]
+	}
+	if i := strings.IndexByte(spec, '/'); i >= 0 {
+		if cidr4, err = strconv.Atoi(spec[i+1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+		spec = spec[:i]
+	}
+	if spec == "" {
+		return current, cidr4, cidr6, nil
+	}
+	target, err = c.expand(spec, current)
+	return target, cidr4, cidr6, err
+}
+
+func (c *spfChecker) matchIPs(ips []net.IP, cidr4, cidr6 int) bool {
+	client4 := c.ip.To4()
+	mask4, mask6 := net.CIDRMask(cidr4, 32), net.CIDRMask(cidr6, 128)
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			if client4 != nil && v4.Mask(mask4).Equal(client4.Mask(mask4)) {
+				return true
+			}
+			continue
+		}
+		if client4 == nil && ip.Mask(mask6).Equal(c.ip.Mask(mask6)) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetwork(arg string, v6 bool) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(arg, "/") {
+		if v6 {
+			arg += "/128"
+		} else {
+			arg += "/32"
+		}
+	}
+	ip, network, err := net.ParseCIDR(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (ip.To4() == nil) != v6 {
+		return nil, nil, errSPFPerm
+	}
+	return ip, network, nil
+}
+
+// splitModifier reports whether term is a name=value modifier.
+func splitModifier(term string) (name, value string, ok bool) {
+	i := strings.IndexByte(term, '=')
+	if i <= 0 || strings.ContainsAny(term[:i], ":/") {
+		return "", "", false
+	}
+	return term[:i], term[i+1:], true
+}
+
+// expand performs RFC 7208 macro expansion for the letters that don't need
+// reverse DNS (s, l, o, d, i, h, v), including the digit and "r"
+// transformers and custom delimiters.
+func (c *spfChecker) expand(spec, current string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return strings.ToLower(strings.TrimSuffix(spec, ".")), nil
+	}
+
+	local, senderDomain := "postmaster", current
+	if at := strings.LastIndexByte(c.sender, '@'); at >= 0 {
+		if at > 0 {
+			local = c.sender[:at]
+		}
+		senderDomain = c.sender[at+1:]
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errSPFPerm
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = c.sender
+		case "l":
+			value = local
+		case "o":
+			value = senderDomain
+		case "d":
+			value = current
+		case "i":
+			value = spfIPMacro(c.ip)
+		case "h":
+			value = c.helo
+		case "v":
+			if c.ip.To4() != nil {
+				value = "in-addr"
+			} else {
+				value = "ip6"
+			}
+		default:
+			return "", errSPFPerm
+		}
+
+		transformer := macro[1:]
+		digits := 0
+		for len(transformer) > 0 && transformer[0] >= '0' && transformer[0] <= '9' {
+			digits = digits*10 + int(transformer[0]-'0')
+			transformer = transformer[1:]
+		}
+		reverse := false
+		if len(transformer) > 0 && (transformer[0] == 'r' || transformer[0] == 'R') {
+			reverse = true
+			transformer = transformer[1:]
+		}
+		delimiters := transformer
+		if delimiters == "" {
+			delimiters = "."
+		}
+
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		b.WriteString(strings.Join(parts, "."))
+	}
+	return strings.ToLower(strings.TrimSuffix(b.String(), ".")), nil
+}
+
+// spfIPMacro formats ip for %{i}: dotted quad for IPv4, dot-separated
+// nibbles for IPv6.
+func spfIPMacro(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0x0f]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/routing"
 	"github.com/znz-systems/deaddrop/internal/store"
 )
 
@@ -61,6 +62,25 @@ func (s *Service) Create(ctx context.Context, userID, domainID int64, name, from
 	return mb, nil
 }
 
+// StreamAddress validates the address of an email stream for mb and returns
+// it normalized. The address may be a pattern (see package routing) but must
+// be on the mailbox's domain.
+func (s *Service) StreamAddress(ctx context.Context, mb *models.Mailbox, address string) (string, error) {
+	addr, err := routing.Parse(address)
+	if err != nil {
+		return "", err
+	}
+
+	domain, err := s.domains.GetDomainByID(ctx, mb.DomainID)
+	if err != nil {
+		return "", fmt.Errorf("domain not found: %w", err)
+	}
+	if addr.Domain != strings.ToLower(domain.Name) {
+		return "", fmt.Errorf("stream address must be on domain %s", domain.Name)
+	}
+	return addr.String(), nil
+}
+
 func (s *Service) List(ctx context.Context, userID int64) ([]models.Mailbox, error) {
 	return s.mailboxes.GetMailboxesByUserID(ctx, userID)
 }
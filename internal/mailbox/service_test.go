@@ -149,6 +149,40 @@ func TestCreate_FromAddressDomainMismatch(t *testing.T) {
 	}
 }
 
+func TestStreamAddress_NormalizesPatterns(t *testing.T) {
+	ds := newMockDomainStoreForMailbox()
+	ds.addDomain(&models.Domain{ID: 1, Verified: true, Name: "example.com"})
+	svc := NewService(newMockMailboxStore(), ds)
+	mb := &models.Mailbox{ID: 1, DomainID: 1}
+
+	for in, want := range map[string]string{
+		" Support@Example.com ":      "support@example.com",
+		"Support+*@example.com":      "support+*@example.com",
+		"*@example.com":              "*@example.com",
+		"/^Sales-\\d+$/@example.com": "/^Sales-\\d+$/@example.com",
+	} {
+		got, err := svc.StreamAddress(context.Background(), mb, in)
+		if err != nil {
+			t.Errorf("StreamAddress(%q): %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("StreamAddress(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestStreamAddress_RejectsOtherDomain(t *testing.T) {
+	ds := newMockDomainStoreForMailbox()
+	ds.addDomain(&models.Domain{ID: 1, Verified: true, Name: "example.com"})
+	svc := NewService(newMockMailboxStore(), ds)
+	mb := &models.Mailbox{ID: 1, DomainID: 1}
+
+	if _, err := svc.StreamAddress(context.Background(), mb, "*@other.com"); err == nil {
+		t.Fatal("expected error for a catch-all on another domain")
+	}
+}
+
 func TestList_ReturnsMailboxes(t *testing.T) {
 	ms := newMockMailboxStore()
 	ds := newMockDomainStoreForMailbox()
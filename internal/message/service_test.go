@@ -155,6 +155,14 @@ func (m *mockDomainStore) MarkDomainVerified(_ context.Context, _ int64) error {
 	return nil
 }
 
+func (m *mockDomainStore) SetOutboundTransport(_ context.Context, _ int64, _ models.OutboundTransport) error {
+	return nil
+}
+
+func (m *mockDomainStore) GetOutboundTransportByName(_ context.Context, _ string) (models.OutboundTransport, error) {
+	return "", sql.ErrNoRows
+}
+
 func (m *mockDomainStore) DeleteDomain(_ context.Context, _ int64) error {
 	return nil
 }
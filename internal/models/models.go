@@ -30,10 +30,42 @@ type Domain struct {
 	Name              string
 	VerificationToken string
 	Verified          bool
+	OutboundTransport OutboundTransport
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
 }
 
+// OutboundTransport is how mail from a domain leaves DeadDrop.
+type OutboundTransport string
+
+const (
+	TransportDefault OutboundTransport = ""       // the server's OUTBOUND_TRANSPORT
+	TransportRelay   OutboundTransport = "relay"  // through the SMTP_HOST relay
+	TransportDirect  OutboundTransport = "direct" // straight to the recipient's MX
+)
+
+type DKIMKeyStatus string
+
+const (
+	DKIMPending DKIMKeyStatus = "pending" // waiting for its DNS record; not signing yet
+	DKIMActive  DKIMKeyStatus = "active"
+	DKIMRetired DKIMKeyStatus = "retired" // replaced; its record stays until removed
+)
+
+// DKIMKey is a key pair outbound mail from a domain is signed with,
+// published as a TXT record at Selector._domainkey.<domain>.
+type DKIMKey struct {
+	ID         int64
+	DomainID   int64
+	Selector   string
+	Algorithm  string // rsa-sha256 or ed25519-sha256
+	PrivateKey []byte // PKCS #8, DER
+	PublicKey  string // base64 p= value of the DNS record
+	Status     DKIMKeyStatus
+	VerifiedAt *time.Time // when the DNS record was last found
+	CreatedAt  time.Time
+}
+
 type Message struct {
 	ID          int64
 	PublicID    uuid.UUID
@@ -73,13 +105,36 @@ type Stream struct {
 	Enabled   bool
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	// Attachment limits for inbound email. An empty AllowedAttachmentTypes
+	// accepts every type.
+	MaxAttachmentBytes     int64
+	AllowedAttachmentTypes string
+
+	// MaxMessageBytes limits the size of inbound email to the stream
+	// below the server-wide limit; 0 applies only the server's.
+	MaxMessageBytes int64
+
+	// AuthPolicy decides what happens to inbound email that fails
+	// SPF/DKIM/DMARC evaluation.
+	AuthPolicy AuthPolicy
 }
 
+type AuthPolicy string
+
+const (
+	AuthPolicyAccept     AuthPolicy = "accept"
+	AuthPolicyQuarantine AuthPolicy = "quarantine"
+	AuthPolicyReject     AuthPolicy = "reject"
+)
+
 type ConversationStatus string
 
 const (
-	ConversationOpen   ConversationStatus = "open"
-	ConversationClosed ConversationStatus = "closed"
+	ConversationOpen        ConversationStatus = "open"
+	ConversationClosed      ConversationStatus = "closed"
+	ConversationQuarantined ConversationStatus = "quarantined"
+	ConversationSpam        ConversationStatus = "spam"
 )
 
 type Conversation struct {
@@ -91,6 +146,17 @@ type Conversation struct {
 	Status    ConversationStatus
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	// Recipient is the address an inbound email conversation was started
+	// at, which tells which alias of a pattern stream was used.
+	Recipient string
+
+	// SpamLabel is how the user last trained the spam filter with this
+	// conversation: "spam", "ham" or empty.
+	SpamLabel string
+
+	// Tags are applied by the mailbox's filter rules.
+	Tags []string
 }
 
 type MessageDirection string
@@ -108,5 +174,317 @@ type ConversationMessage struct {
 	SenderAddress  string
 	SenderName     string
 	Body           string
+	BodyHTML       string // HTML rendition of inbound email as received, unsanitised; empty if none
+	MessageID      string
+	RawKey         string // blob key of the original source, inbound email only
+	RemoteIP       string // address of the client that delivered inbound email, if known
+	Helo           string // name the client gave in HELO/EHLO, inbound email only
+	TLS            string // TLS version inbound email arrived over, "none" if plaintext
+	AuthResults    string // Authentication-Results header value for inbound email
+	AuthVerdict    string // pass, fail or none; empty when not evaluated
+	SpamScore      float64
+	SpamRules      string // the spam rules that fired, e.g. "LINK_DENSITY=2.0, BAYES_99=3.5"
+	Automated      string // one of the Automated* kinds for machine-generated inbound mail
+	InboundJobID   int64  // the inbound queue job that filed the message, 0 if none
+	BouncedAt      *time.Time
+	BounceReason   string         // status and diagnostic from the bounce, outbound only
+	DeliveryStatus DeliveryStatus // outbound only
+	DeliveryError  string         // last delivery error of an outbound message
 	CreatedAt      time.Time
 }
+
+// DeliveryStatus is how far an outbound message has got to its recipient.
+type DeliveryStatus string
+
+const (
+	DeliveryQueued   DeliveryStatus = "queued"
+	DeliverySent     DeliveryStatus = "sent"
+	DeliveryDeferred DeliveryStatus = "deferred" // failed, will be retried
+	DeliveryFailed   DeliveryStatus = "failed"   // rejected or failed too often; waits for a manual retry
+	DeliveryBounced  DeliveryStatus = "bounced"  // accepted, then returned by a bounce
+)
+
+// Kinds of machine-generated inbound mail. Such mail never receives an
+// automatic response.
+const (
+	AutomatedBounce    = "bounce"
+	AutomatedAutoReply = "auto-reply"
+	AutomatedBulk      = "bulk"
+)
+
+type Attachment struct {
+	ID                    int64
+	PublicID              uuid.UUID
+	ConversationMessageID int64
+	Filename              string
+	ContentType           string
+	SizeBytes             int64
+	StorageKey            string
+	ContentID             string // Content-ID of an inline part, without angle brackets
+	CreatedAt             time.Time
+}
+
+// SpamTokenCount is how often a token appeared in messages a user trained
+// as spam and as ham.
+type SpamTokenCount struct {
+	Spam int
+	Ham  int
+}
+
+// FilterRule is a user-defined rule run against messages that start a new
+// conversation in a mailbox. Rules run in Position order.
+type FilterRule struct {
+	ID         int64
+	MailboxID  int64
+	Position   int
+	Name       string
+	MatchAll   bool // all conditions must match, rather than any
+	Conditions []FilterCondition
+	Actions    []FilterAction
+	Stop       bool // skip the remaining rules when this one matches
+	Enabled    bool
+	CreatedAt  time.Time
+}
+
+type FilterField string
+
+const (
+	FilterSender     FilterField = "sender"
+	FilterRecipient  FilterField = "recipient"
+	FilterSubject    FilterField = "subject"
+	FilterBody       FilterField = "body"
+	FilterHeader     FilterField = "header"
+	FilterStreamType FilterField = "stream_type"
+)
+
+type FilterOp string
+
+const (
+	FilterIs       FilterOp = "is"
+	FilterContains FilterOp = "contains"
+	FilterMatches  FilterOp = "matches" // wildcard pattern with * and ?
+	FilterRegex    FilterOp = "regex"
+)
+
+type FilterCondition struct {
+	Field  FilterField `json:"field"`
+	Header string      `json:"header,omitempty"` // header name, for FilterHeader
+	Op     FilterOp    `json:"op"`
+	Value  string      `json:"value"`
+	Not    bool        `json:"not,omitempty"`
+}
+
+type FilterActionType string
+
+const (
+	FilterSetStatus FilterActionType = "set_status"
+	FilterTag       FilterActionType = "tag"
+	FilterForward   FilterActionType = "forward"
+	FilterDiscard   FilterActionType = "discard"
+	FilterAutoReply FilterActionType = "auto_reply"
+	FilterMove      FilterActionType = "move" // Value is the target mailbox's public ID
+)
+
+type FilterAction struct {
+	Type  FilterActionType `json:"type"`
+	Value string           `json:"value,omitempty"`
+}
+
+type InboundJobStatus string
+
+const (
+	InboundPending    InboundJobStatus = "pending"
+	InboundProcessing InboundJobStatus = "processing"
+	InboundDead       InboundJobStatus = "dead" // failed too often; waits for a manual retry
+)
+
+// InboundJob is an accepted inbound email waiting in the queue to be filed
+// into a mailbox. The message itself is in the raw archive under RawKey.
+type InboundJob struct {
+	ID            int64
+	MailboxID     int64
+	StreamID      int64
+	Recipient     string
+	ReplyToken    string
+	EnvelopeFrom  string
+	RawKey        string
+	RemoteIP      string
+	Helo          string
+	TLS           string
+	AuthResults   string
+	AuthVerdict   string
+	Quarantine    bool
+	Status        InboundJobStatus
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+}
+
+type OutboundJobStatus string
+
+const (
+	OutboundPending    OutboundJobStatus = "pending"
+	OutboundProcessing OutboundJobStatus = "processing"
+	OutboundFailed     OutboundJobStatus = "failed" // will not be retried unless asked to
+)
+
+// OutboundJob is an email waiting in the queue to be handed to the mail
+// transport, composed as it will be sent.
+type OutboundJob struct {
+	ID                    int64
+	ConversationMessageID int64 // the outbound message it delivers; 0 for forwards
+	To                    string
+	FromAddress           string
+	FromName              string
+	ReplyTo               string
+	Subject               string
+	Body                  string
+	MessageID             string
+	InReplyTo             string
+	References            string // space-separated message IDs
+	AutoSubmitted         string
+	Attachments           []Attachment // stored with the message it delivers
+	Status                OutboundJobStatus
+	Attempts              int
+	LastError             string
+	NextAttemptAt         time.Time
+	CreatedAt             time.Time
+}
+
+// NotifyMode is how a user is told about new conversations.
+type NotifyMode string
+
+const (
+	NotifyInstant NotifyMode = "instant" // an email for each conversation
+	NotifyHourly  NotifyMode = "hourly"  // a digest every hour
+	NotifyDaily   NotifyMode = "daily"   // a digest every morning
+	NotifyOff     NotifyMode = "off"
+)
+
+// NotificationSettings is how a user wants to be notified. MailboxID is 0
+// for the user's defaults; settings for a mailbox replace the Mode and
+// Replies of the defaults for its mail. Quiet hours and the time zone are
+// only taken from the defaults.
+type NotificationSettings struct {
+	UserID    int64
+	MailboxID int64
+	Mode      NotifyMode
+
+	// Replies asks for notifications of replies on open conversations,
+	// not only of new conversations.
+	Replies bool
+
+	// QuietStart and QuietEnd are minutes after midnight in Timezone
+	// between which nothing is sent. Equal values mean no quiet hours.
+	QuietStart int
+	QuietEnd   int
+	Timezone   string
+}
+
+// PendingNotification is a new conversation or reply waiting to be sent in
+// a digest, or after quiet hours.
+type PendingNotification struct {
+	ID             int64
+	UserID         int64
+	ConversationID int64
+	MessageID      int64
+	Reply          bool
+	DueAt          time.Time
+	CreatedAt      time.Time
+}
+
+// DigestEntry is a due pending notification, with what a digest shows of
+// its conversation and message.
+type DigestEntry struct {
+	UserID               int64
+	ConversationID       int64
+	ConversationPublicID uuid.UUID
+	MailboxPublicID      uuid.UUID
+	MailboxName          string
+	Subject              string
+	SenderName           string
+	SenderAddress        string
+	Body                 string
+	Reply                bool
+
+	// Unread is whether the conversation is still open and has not been
+	// opened since the notification was queued.
+	Unread bool
+
+	// Messages is how many new messages of the conversation the entry
+	// stands for once a digest merges them; the message shown is the
+	// latest.
+	Messages  int
+	CreatedAt time.Time
+}
+
+// ChannelType is the kind of service a notification channel posts to.
+type ChannelType string
+
+const (
+	ChannelWebhook ChannelType = "webhook" // JSON to any URL
+	ChannelSlack   ChannelType = "slack"   // Slack or Mattermost incoming webhook
+	ChannelMatrix  ChannelType = "matrix"  // a Matrix room
+	ChannelNtfy    ChannelType = "ntfy"
+	ChannelGotify  ChannelType = "gotify"
+)
+
+// NotificationChannel is a place besides email where a mailbox announces
+// new conversations.
+type NotificationChannel struct {
+	ID        int64
+	PublicID  uuid.UUID
+	MailboxID int64
+	Type      ChannelType
+	Name      string
+	URL       string
+
+	// Token is the secret the channel needs: the signing key of a
+	// webhook, a Matrix access token, an ntfy access token or a Gotify
+	// application token.
+	Token string
+
+	// Room is the Matrix room ID or alias.
+	Room string
+
+	// Template renders the JSON body of a webhook; empty sends the event
+	// as it is.
+	Template string
+
+	// MaxAttempts and RetryInterval are the channel's retry policy: the
+	// number of attempts, and the wait before the second one, doubling
+	// after each failure.
+	MaxAttempts   int
+	RetryInterval time.Duration
+
+	Enabled   bool
+	CreatedAt time.Time
+}
+
+type ChannelDeliveryStatus string
+
+const (
+	ChannelDeliveryPending    ChannelDeliveryStatus = "pending"
+	ChannelDeliveryProcessing ChannelDeliveryStatus = "processing"
+	ChannelDeliveryDelivered  ChannelDeliveryStatus = "delivered"
+	ChannelDeliveryFailed     ChannelDeliveryStatus = "failed"
+)
+
+// ChannelDelivery is an event queued for, or sent to, a notification
+// channel.
+type ChannelDelivery struct {
+	ID            int64
+	ChannelID     int64
+	EventType     string
+	Event         []byte // JSON
+	Status        ChannelDeliveryStatus
+	Attempts      int
+	ResponseCode  int // of the last attempt; 0 without a response
+	LastError     string
+	NextAttemptAt time.Time
+	DeliveredAt   *time.Time
+	CreatedAt     time.Time
+
+	Channel *NotificationChannel // loaded when the delivery is claimed
+}
@@ -0,0 +1,282 @@
+// Package notify decides when users hear about new conversations and
+// replies: at once, in an hourly or daily digest, or not at all, outside
+// their quiet hours.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	_ "time/tzdata" // time zones work without a system database
+
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+var (
+	ErrInvalidMode       = errors.New("unknown notification mode")
+	ErrInvalidTimezone   = errors.New("unknown time zone")
+	ErrInvalidQuietHours = errors.New("quiet hours must be times of day")
+)
+
+// dailyDigestHour is the local hour the daily digest is sent at.
+const dailyDigestHour = 8
+
+// Mailer sends notification emails.
+type Mailer interface {
+	NotifyNewConversation(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error
+	NotifyReply(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error
+	SendDigest(ctx context.Context, user *models.User, entries []models.DigestEntry) error
+}
+
+// Service implements conversation.Notifier by applying the mailbox owner's
+// notification settings: it sends instant notifications through the
+// Mailer and queues the others for SendDigests.
+type Service struct {
+	settings store.NotificationStore
+	users    store.UserStore
+	mailer   Mailer
+	now      func() time.Time
+}
+
+func NewService(settings store.NotificationStore, users store.UserStore, mailer Mailer) *Service {
+	return &Service{
+		settings: settings,
+		users:    users,
+		mailer:   mailer,
+		now:      time.Now,
+	}
+}
+
+// Settings are a user's notification settings.
+type Settings struct {
+	Defaults  models.NotificationSettings
+	Mailboxes map[int64]models.NotificationSettings // by mailbox ID
+}
+
+// For returns the settings that apply to a mailbox: its own mode and
+// replies if it has any, and the quiet hours of the defaults.
+func (s *Settings) For(mailboxID int64) models.NotificationSettings {
+	n := s.Defaults
+	if mb, ok := s.Mailboxes[mailboxID]; ok {
+		n.MailboxID = mailboxID
+		n.Mode = mb.Mode
+		n.Replies = mb.Replies
+	}
+	return n
+}
+
+// DefaultSettings are the settings of a user who saved none: an email for
+// every new conversation and none for replies.
+func DefaultSettings(userID int64) models.NotificationSettings {
+	return models.NotificationSettings{
+		UserID:   userID,
+		Mode:     models.NotifyInstant,
+		Timezone: "UTC",
+	}
+}
+
+// Settings returns a user's notification settings.
+func (s *Service) Settings(ctx context.Context, userID int64) (*Settings, error) {
+	saved, err := s.settings.GetNotificationSettings(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get notification settings: %w", err)
+	}
+	settings := &Settings{
+		Defaults:  DefaultSettings(userID),
+		Mailboxes: make(map[int64]models.NotificationSettings),
+	}
+	for _, n := range saved {
+		if n.MailboxID == 0 {
+			settings.Defaults = n
+		} else {
+			settings.Mailboxes[n.MailboxID] = n
+		}
+	}
+	return settings, nil
+}
+
+// Save validates and stores a user's defaults, or a mailbox's settings if
+// MailboxID is set.
+func (s *Service) Save(ctx context.Context, n *models.NotificationSettings) error {
+	switch n.Mode {
+	case models.NotifyInstant, models.NotifyHourly, models.NotifyDaily, models.NotifyOff:
+	default:
+		return ErrInvalidMode
+	}
+	if n.QuietStart < 0 || n.QuietStart >= 24*60 || n.QuietEnd < 0 || n.QuietEnd >= 24*60 {
+		return ErrInvalidQuietHours
+	}
+	if n.Timezone == "" {
+		n.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(n.Timezone); err != nil {
+		return ErrInvalidTimezone
+	}
+	return s.settings.SaveNotificationSettings(ctx, n)
+}
+
+// ResetMailbox deletes a mailbox's settings, so that the user's defaults
+// apply to it.
+func (s *Service) ResetMailbox(ctx context.Context, userID, mailboxID int64) error {
+	return s.settings.DeleteNotificationSettings(ctx, userID, mailboxID)
+}
+
+// NotifyNewConversation implements conversation.Notifier.
+func (s *Service) NotifyNewConversation(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	return s.dispatch(ctx, mailbox, conv, msg, false)
+}
+
+// NotifyReply implements conversation.Notifier. Replies are only notified
+// if the user asked for them.
+func (s *Service) NotifyReply(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage) error {
+	return s.dispatch(ctx, mailbox, conv, msg, true)
+}
+
+func (s *Service) dispatch(ctx context.Context, mailbox *models.Mailbox, conv *models.Conversation, msg *models.ConversationMessage, reply bool) error {
+	settings, err := s.Settings(ctx, mailbox.UserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load notification settings", "user_id", mailbox.UserID, "error", err)
+		return err
+	}
+	n := settings.For(mailbox.ID)
+	if n.Mode == models.NotifyOff || (reply && !n.Replies) {
+		return nil
+	}
+
+	now := s.now()
+	due := dueAt(n, now)
+	if n.Mode == models.NotifyInstant && due.Equal(now) {
+		send := s.mailer.NotifyNewConversation
+		if reply {
+			send = s.mailer.NotifyReply
+		}
+		if err := send(ctx, mailbox, conv, msg); err != nil {
+			slog.ErrorContext(ctx, "failed to send notification", "mailbox_id", mailbox.ID, "conversation_id", conv.ID, "error", err)
+			return err
+		}
+		return nil
+	}
+
+	err = s.settings.QueueNotification(ctx, &models.PendingNotification{
+		UserID:         mailbox.UserID,
+		ConversationID: conv.ID,
+		MessageID:      msg.ID,
+		Reply:          reply,
+		DueAt:          due,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to queue notification", "mailbox_id", mailbox.ID, "conversation_id", conv.ID, "error", err)
+		return fmt.Errorf("queue notification: %w", err)
+	}
+	return nil
+}
+
+// SendDigests sends every user with due notifications one email about the
+// conversations they have not read since, and forgets the notifications.
+// A digest that fails to send is tried again on the next call.
+func (s *Service) SendDigests(ctx context.Context) error {
+	now := s.now()
+	entries, err := s.settings.GetDueNotifications(ctx, now)
+	if err != nil {
+		return fmt.Errorf("get due notifications: %w", err)
+	}
+
+	var users []int64
+	byUser := make(map[int64][]models.DigestEntry)
+	for _, e := range entries {
+		if _, ok := byUser[e.UserID]; !ok {
+			users = append(users, e.UserID)
+		}
+		byUser[e.UserID] = append(byUser[e.UserID], e)
+	}
+
+	for _, userID := range users {
+		if unread := merge(byUser[userID]); len(unread) > 0 {
+			user, err := s.users.GetUserByID(ctx, userID)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to look up digest recipient", "user_id", userID, "error", err)
+				continue
+			}
+			if err := s.mailer.SendDigest(ctx, user, unread); err != nil {
+				slog.ErrorContext(ctx, "failed to send notification digest", "user_id", userID, "error", err)
+				continue
+			}
+		}
+		if err := s.settings.DeleteDueNotifications(ctx, userID, now); err != nil {
+			slog.ErrorContext(ctx, "failed to delete sent notifications", "user_id", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+// merge returns one entry per conversation with unread entries, in the
+// order they arrived, showing its latest message.
+func merge(entries []models.DigestEntry) []models.DigestEntry {
+	var merged []models.DigestEntry
+	index := make(map[int64]int)
+	for _, e := range entries {
+		if !e.Unread {
+			continue
+		}
+		i, ok := index[e.ConversationID]
+		if !ok {
+			index[e.ConversationID] = len(merged)
+			merged = append(merged, e)
+			continue
+		}
+		messages := merged[i].Messages + e.Messages
+		merged[i] = e
+		merged[i].Messages = messages
+	}
+	return merged
+}
+
+// dueAt returns when a notification arriving at now should be sent: now,
+// at the next full hour or at the next daily digest, moved to the end of
+// the quiet hours if it falls into them.
+func dueAt(n models.NotificationSettings, now time.Time) time.Time {
+	loc, err := time.LoadLocation(n.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t := now.In(loc)
+	switch n.Mode {
+	case models.NotifyHourly:
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+	case models.NotifyDaily:
+		next := time.Date(t.Year(), t.Month(), t.Day(), dailyDigestHour, 0, 0, 0, loc)
+		if !next.After(t) {
+			next = next.AddDate(0, 0, 1)
+		}
+		t = next
+	}
+	if end, ok := quietEnd(n, t); ok {
+		return end
+	}
+	return t
+}
+
+// quietEnd returns the end of the quiet hours t falls into, if it does.
+func quietEnd(n models.NotificationSettings, t time.Time) (time.Time, bool) {
+	start, end := n.QuietStart, n.QuietEnd
+	if start == end {
+		return t, false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	quiet := minute >= start && minute < end
+	if start > end {
+		// Over midnight.
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return t, false
+	}
+	e := time.Date(t.Year(), t.Month(), t.Day(), 0, end, 0, 0, t.Location())
+	if !e.After(t) {
+		e = e.AddDate(0, 0, 1)
+	}
+	return e, true
+}
@@ -0,0 +1,292 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+type memNotificationStore struct {
+	settings []models.NotificationSettings
+	pending  []models.PendingNotification
+	entries  []models.DigestEntry // what GetDueNotifications returns
+	deleted  []int64              // users whose due notifications were deleted
+}
+
+func (m *memNotificationStore) GetNotificationSettings(_ context.Context, userID int64) ([]models.NotificationSettings, error) {
+	var out []models.NotificationSettings
+	for _, n := range m.settings {
+		if n.UserID == userID {
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+func (m *memNotificationStore) SaveNotificationSettings(_ context.Context, n *models.NotificationSettings) error {
+	for i := range m.settings {
+		if m.settings[i].UserID == n.UserID && m.settings[i].MailboxID == n.MailboxID {
+			m.settings[i] = *n
+			return nil
+		}
+	}
+	m.settings = append(m.settings, *n)
+	return nil
+}
+
+func (m *memNotificationStore) DeleteNotificationSettings(_ context.Context, userID, mailboxID int64) error {
+	for i := range m.settings {
+		if m.settings[i].UserID == userID && m.settings[i].MailboxID == mailboxID {
+			m.settings = append(m.settings[:i], m.settings[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *memNotificationStore) QueueNotification(_ context.Context, n *models.PendingNotification) error {
+	m.pending = append(m.pending, *n)
+	return nil
+}
+
+func (m *memNotificationStore) GetDueNotifications(_ context.Context, _ time.Time) ([]models.DigestEntry, error) {
+	return m.entries, nil
+}
+
+func (m *memNotificationStore) DeleteDueNotifications(_ context.Context, userID int64, _ time.Time) error {
+	m.deleted = append(m.deleted, userID)
+	return nil
+}
+
+type memUserStore struct{}
+
+func (memUserStore) CreateUser(_ context.Context, _, _ string) (*models.User, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (memUserStore) GetUserByEmail(_ context.Context, _ string) (*models.User, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (memUserStore) GetUserByID(_ context.Context, id int64) (*models.User, error) {
+	return &models.User{ID: id, Email: "owner@example.com"}, nil
+}
+
+type recordingMailer struct {
+	sent    []string // "conversation" or "reply", per notification
+	digests map[int64][]models.DigestEntry
+	fail    bool
+}
+
+func (m *recordingMailer) NotifyNewConversation(_ context.Context, _ *models.Mailbox, _ *models.Conversation, _ *models.ConversationMessage) error {
+	m.sent = append(m.sent, "conversation")
+	return nil
+}
+
+func (m *recordingMailer) NotifyReply(_ context.Context, _ *models.Mailbox, _ *models.Conversation, _ *models.ConversationMessage) error {
+	m.sent = append(m.sent, "reply")
+	return nil
+}
+
+func (m *recordingMailer) SendDigest(_ context.Context, user *models.User, entries []models.DigestEntry) error {
+	if m.fail {
+		return errors.New("smtp down")
+	}
+	if m.digests == nil {
+		m.digests = make(map[int64][]models.DigestEntry)
+	}
+	m.digests[user.ID] = entries
+	return nil
+}
+
+func newTestService(now time.Time) (*Service, *memNotificationStore, *recordingMailer) {
+	store := &memNotificationStore{}
+	mailer := &recordingMailer{}
+	svc := NewService(store, memUserStore{}, mailer)
+	svc.now = func() time.Time { return now }
+	return svc, store, mailer
+}
+
+var (
+	testMailbox = &models.Mailbox{ID: 7, UserID: 1, Name: "Support"}
+	testConv    = &models.Conversation{ID: 3, MailboxID: 7}
+	testMsg     = &models.ConversationMessage{ID: 11, ConversationID: 3}
+)
+
+func TestNotify_DefaultsSendNewConversationsOnly(t *testing.T) {
+	svc, store, mailer := newTestService(time.Date(2026, 3, 2, 14, 30, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	if err := svc.NotifyNewConversation(ctx, testMailbox, testConv, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.NotifyReply(ctx, testMailbox, testConv, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0] != "conversation" {
+		t.Errorf("expected only the new conversation to be sent, got %v", mailer.sent)
+	}
+	if len(store.pending) != 0 {
+		t.Errorf("expected nothing queued, got %v", store.pending)
+	}
+}
+
+func TestNotify_MailboxSettingsOverrideDefaults(t *testing.T) {
+	now := time.Date(2026, 3, 2, 14, 30, 0, 0, time.UTC)
+	svc, store, mailer := newTestService(now)
+	ctx := context.Background()
+	store.settings = []models.NotificationSettings{
+		{UserID: 1, Mode: models.NotifyOff, Timezone: "UTC"},
+		{UserID: 1, MailboxID: 7, Mode: models.NotifyHourly, Replies: true},
+	}
+
+	_ = svc.NotifyNewConversation(ctx, testMailbox, testConv, testMsg)
+	_ = svc.NotifyReply(ctx, testMailbox, testConv, testMsg)
+	_ = svc.NotifyNewConversation(ctx, &models.Mailbox{ID: 8, UserID: 1}, testConv, testMsg)
+
+	if len(mailer.sent) != 0 {
+		t.Errorf("expected nothing sent at once, got %v", mailer.sent)
+	}
+	if len(store.pending) != 2 {
+		t.Fatalf("expected the conversation and reply in mailbox 7 to be queued, got %v", store.pending)
+	}
+	want := time.Date(2026, 3, 2, 15, 0, 0, 0, time.UTC)
+	for _, p := range store.pending {
+		if !p.DueAt.Equal(want) {
+			t.Errorf("expected the next hourly digest at %v, got %v", want, p.DueAt)
+		}
+	}
+	if store.pending[0].Reply || !store.pending[1].Reply {
+		t.Errorf("expected the reply to be marked, got %v", store.pending)
+	}
+}
+
+func TestDueAt(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	tests := []struct {
+		name     string
+		settings models.NotificationSettings
+		now      time.Time
+		want     time.Time
+	}{
+		{
+			name:     "instant",
+			settings: models.NotificationSettings{Mode: models.NotifyInstant, Timezone: "UTC"},
+			now:      time.Date(2026, 3, 2, 14, 30, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 2, 14, 30, 0, 0, time.UTC),
+		},
+		{
+			name:     "daily before the digest hour",
+			settings: models.NotificationSettings{Mode: models.NotifyDaily, Timezone: "Europe/Berlin"},
+			now:      time.Date(2026, 3, 2, 5, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 2, 8, 0, 0, 0, berlin),
+		},
+		{
+			name:     "daily after the digest hour",
+			settings: models.NotificationSettings{Mode: models.NotifyDaily, Timezone: "Europe/Berlin"},
+			now:      time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 3, 8, 0, 0, 0, berlin),
+		},
+		{
+			name:     "instant in quiet hours over midnight",
+			settings: models.NotificationSettings{Mode: models.NotifyInstant, QuietStart: 22 * 60, QuietEnd: 7*60 + 30, Timezone: "Europe/Berlin"},
+			now:      time.Date(2026, 3, 2, 22, 15, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 3, 7, 30, 0, 0, berlin),
+		},
+		{
+			name:     "hourly digest falling in quiet hours",
+			settings: models.NotificationSettings{Mode: models.NotifyHourly, QuietStart: 12 * 60, QuietEnd: 13 * 60, Timezone: "UTC"},
+			now:      time.Date(2026, 3, 2, 11, 40, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 2, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "outside quiet hours",
+			settings: models.NotificationSettings{Mode: models.NotifyInstant, QuietStart: 22 * 60, QuietEnd: 7 * 60, Timezone: "UTC"},
+			now:      time.Date(2026, 3, 2, 7, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 2, 7, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dueAt(tt.settings, tt.now); !got.Equal(tt.want) {
+				t.Errorf("dueAt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotify_QuietHoursHoldInstantNotifications(t *testing.T) {
+	svc, store, mailer := newTestService(time.Date(2026, 3, 2, 23, 0, 0, 0, time.UTC))
+	store.settings = []models.NotificationSettings{
+		{UserID: 1, Mode: models.NotifyInstant, QuietStart: 22 * 60, QuietEnd: 7 * 60, Timezone: "UTC"},
+	}
+
+	_ = svc.NotifyNewConversation(context.Background(), testMailbox, testConv, testMsg)
+	if len(mailer.sent) != 0 {
+		t.Errorf("expected nothing sent in quiet hours, got %v", mailer.sent)
+	}
+	if len(store.pending) != 1 || !store.pending[0].DueAt.Equal(time.Date(2026, 3, 3, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the notification held until 07:00, got %v", store.pending)
+	}
+}
+
+func TestSendDigests_MergesUnreadConversations(t *testing.T) {
+	svc, store, mailer := newTestService(time.Now())
+	store.entries = []models.DigestEntry{
+		{UserID: 1, ConversationID: 3, Body: "first", Unread: true, Messages: 1},
+		{UserID: 1, ConversationID: 4, Body: "read already", Unread: false, Messages: 1},
+		{UserID: 1, ConversationID: 3, Body: "second", Reply: true, Unread: true, Messages: 1},
+		{UserID: 2, ConversationID: 5, Body: "closed", Unread: false, Messages: 1},
+	}
+
+	if err := svc.SendDigests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := mailer.digests[1]
+	if len(got) != 1 || got[0].Body != "second" || !got[0].Reply || got[0].Messages != 2 {
+		t.Errorf("expected conversation 3 with its latest message, got %+v", got)
+	}
+	if _, ok := mailer.digests[2]; ok {
+		t.Error("expected no digest for a user without unread conversations")
+	}
+	if len(store.deleted) != 2 {
+		t.Errorf("expected the notifications of both users to be deleted, got %v", store.deleted)
+	}
+}
+
+func TestSendDigests_KeepsNotificationsWhenSendingFails(t *testing.T) {
+	svc, store, mailer := newTestService(time.Now())
+	mailer.fail = true
+	store.entries = []models.DigestEntry{{UserID: 1, ConversationID: 3, Unread: true, Messages: 1}}
+
+	if err := svc.SendDigests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.deleted) != 0 {
+		t.Errorf("expected the notifications to be kept for the next attempt, got %v", store.deleted)
+	}
+}
+
+func TestSave_Validates(t *testing.T) {
+	svc, store, _ := newTestService(time.Now())
+	ctx := context.Background()
+
+	if err := svc.Save(ctx, &models.NotificationSettings{UserID: 1, Mode: "weekly"}); !errors.Is(err, ErrInvalidMode) {
+		t.Errorf("expected ErrInvalidMode, got %v", err)
+	}
+	if err := svc.Save(ctx, &models.NotificationSettings{UserID: 1, Mode: models.NotifyDaily, Timezone: "Mars/Olympus"}); !errors.Is(err, ErrInvalidTimezone) {
+		t.Errorf("expected ErrInvalidTimezone, got %v", err)
+	}
+	if err := svc.Save(ctx, &models.NotificationSettings{UserID: 1, Mode: models.NotifyDaily, QuietEnd: 24 * 60}); !errors.Is(err, ErrInvalidQuietHours) {
+		t.Errorf("expected ErrInvalidQuietHours, got %v", err)
+	}
+	if err := svc.Save(ctx, &models.NotificationSettings{UserID: 1, Mode: models.NotifyDaily}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if len(store.settings) != 1 || store.settings[0].Timezone != "UTC" {
+		t.Errorf("expected the settings saved in UTC, got %v", store.settings)
+	}
+}
@@ -0,0 +1,278 @@
+// Package proxyproto reads the HAProxy PROXY protocol header, versions 1
+// and 2, that a load balancer sends ahead of a forwarded TCP connection to
+// tell the backend who the real client is.
+//
+// The header is only accepted from trusted proxies. Anyone else could claim
+// any address with it, so connections from other peers are passed through
+// unchanged, and a trusted proxy that sends no header is refused.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long a trusted proxy has to send the header.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrNoHeader is returned when a trusted proxy's connection does not
+	// start with a PROXY protocol header.
+	ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+)
+
+// v1MaxLen is the longest version 1 header, CRLF included.
+const v1MaxLen = 107
+
+// Listener wraps a listener whose connections may come through trusted
+// proxies. Accepted connections from them report the client's address as
+// their RemoteAddr.
+type Listener struct {
+	net.Listener
+
+	// Trusted lists the networks of the proxies whose headers are read.
+	Trusted []netip.Prefix
+
+	// Timeout bounds reading the header; DefaultTimeout if zero.
+	Timeout time.Duration
+
+	start     sync.Once
+	ready     chan accepted
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// accepted is a connection, or an error, for Accept to return.
+type accepted struct {
+	c   net.Conn
+	err error
+}
+
+// Accept returns the next connection. Headers are read off the accept
+// path, each in its own goroutine, so a trusted proxy that is slow to send
+// one holds up only its own connection. Connections from trusted proxies
+// that fail to send a valid header are closed and skipped.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(l.init)
+	select {
+	case a := <-l.ready:
+		return a.c, a.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the wrapped listener and any connections still waiting for
+// Accept.
+func (l *Listener) Close() error {
+	l.start.Do(l.init)
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+func (l *Listener) init() {
+	l.ready = make(chan accepted)
+	l.closed = make(chan struct{})
+	go l.acceptLoop()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.hand(accepted{err: err})
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !l.trusted(c.RemoteAddr()) {
+			l.hand(accepted{c: c})
+			continue
+		}
+		go func() {
+			pc, err := l.readHeader(c)
+			if err != nil {
+				slog.Warn("dropping proxied connection", "proxy", c.RemoteAddr(), "error", err)
+				c.Close()
+				return
+			}
+			l.hand(accepted{c: pc})
+		}()
+	}
+}
+
+// hand passes a to Accept, or closes its connection if the listener is
+// closed first.
+func (l *Listener) hand(a accepted) {
+	select {
+	case l.ready <- a:
+	case <-l.closed:
+		if a.c != nil {
+			a.c.Close()
+		}
+	}
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, p := range l.Trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) readHeader(c net.Conn) (net.Conn, error) {
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	src, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	pc := &conn{Conn: c, r: br, remote: c.RemoteAddr()}
+	if src.IsValid() {
+		pc.remote = net.TCPAddrFromAddrPort(src)
+	}
+	return pc, nil
+}
+
+// conn is a proxied connection. Reads continue after the header.
+type conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *conn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// RemoteAddr returns the client's address, or the proxy's if the proxy did
+// not name one, as for its own health checks.
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// ReadHeader reads a version 1 or 2 header from r and returns the source
+// address it names. The address is the zero AddrPort for connections the
+// proxy made itself (v1 UNKNOWN, v2 LOCAL) or of an unsupported family.
+func ReadHeader(r *bufio.Reader) (netip.AddrPort, error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil && len(start) == 0 {
+		return netip.AddrPort{}, err
+	}
+	switch {
+	case bytes.HasPrefix(start, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(start, v1Prefix):
+		return readV1(r)
+	}
+	return netip.AddrPort{}, ErrNoHeader
+}
+
+// readV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.2 56324 25\r\n".
+func readV1(r *bufio.Reader) (netip.AddrPort, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return netip.AddrPort{}, errors.New("proxyproto: malformed v1 header")
+	}
+
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: malformed v1 header %q", s)
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: bad v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: bad v1 source port %q", fields[4])
+	}
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// readV2 reads a binary header: the signature, version and command,
+// address family and protocol, the length of the rest, then the addresses
+// and any TLVs, which are skipped.
+func readV2(r *bufio.Reader) (netip.AddrPort, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if hdr[12]>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: unsupported version %d", hdr[12]>>4)
+	}
+	command, family := hdr[12]&0x0f, hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return netip.AddrPort{}, nil
+	case 0x1: // PROXY
+	default:
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: unsupported command %d", command)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(body) < 12 {
+			return netip.AddrPort{}, errors.New("proxyproto: short v2 IPv4 addresses")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10])), nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(body) < 36 {
+			return netip.AddrPort{}, errors.New("proxyproto: short v2 IPv6 addresses")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34])), nil
+	}
+	// Unix sockets and unspecified families carry no usable address.
+	return netip.AddrPort{}, nil
+}
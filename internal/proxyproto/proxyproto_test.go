@@ -0,0 +1,129 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(command, family byte, addrs []byte) string {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return string(append(h, addrs...))
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0, 25}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	binary.BigEndian.PutUint16(ipv6[32:], 4000)
+	// A TLV after the addresses is skipped.
+	withTLV := append(append([]byte{}, ipv4...), 0x04, 0, 1, 'x')
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.2 56324 25\r\n", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 4000 25\r\n", "[2001:db8::1]:4000", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "invalid AddrPort", false},
+		{"v1 family mismatch", "PROXY TCP6 192.0.2.1 198.51.100.2 56324 25\r\n", "", true},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 198.51.100.2 56324 25\n", "", true},
+		{"v2 tcp4", v2Header(1, 0x11, ipv4), "192.0.2.1:56324", false},
+		{"v2 tcp6", v2Header(1, 0x21, ipv6), "[2001:db8::1]:4000", false},
+		{"v2 tlv", v2Header(1, 0x11, withTLV), "192.0.2.1:56324", false},
+		{"v2 local", v2Header(0, 0x00, nil), "invalid AddrPort", false},
+		{"v2 short", v2Header(1, 0x11, ipv4[:8]), "", true},
+		{"no header", "EHLO mail.example.org\r\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in + "EHLO x\r\n"))
+			got, err := ReadHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "EHLO x\r\n" {
+				t.Errorf("expected the stream to continue after the header, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := &Listener{Listener: inner, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	dial := func(send string) net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		if _, err := io.WriteString(c, send); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return c
+	}
+
+	// A trusted proxy that is slow to send its header does not hold up
+	// the connections behind it.
+	silent := dial("")
+	defer silent.Close()
+
+	c := dial("PROXY TCP4 203.0.113.9 127.0.0.1 40000 25\r\nEHLO client\r\n")
+	defer c.Close()
+	var pc net.Conn
+	select {
+	case pc = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("expected proxied connection to be accepted while another waits for its header")
+	}
+	defer pc.Close()
+	if got := pc.RemoteAddr().String(); got != "203.0.113.9:40000" {
+		t.Errorf("expected client address, got %s", got)
+	}
+	line, err := bufio.NewReader(pc).ReadString('\n')
+	if err != nil || line != "EHLO client\r\n" {
+		t.Errorf("expected client data after the header, got %q, %v", line, err)
+	}
+
+	// A trusted proxy without a header is dropped rather than taken for
+	// the client.
+	bare := dial("EHLO proxy\r\n")
+	defer bare.Close()
+	if _, err := bare.Read(make([]byte, 1)); err == nil {
+		t.Error("expected connection without header to be closed")
+	}
+}
@@ -0,0 +1,86 @@
+package rawmail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/blob"
+)
+
+// Archive keeps the original RFC 5322 source of inbound messages,
+// gzip-compressed, in a blob store.
+type Archive struct {
+	blobs blob.Store
+}
+
+// NewArchive creates an Archive backed by the given blob store.
+func NewArchive(blobs blob.Store) *Archive {
+	return &Archive{blobs: blobs}
+}
+
+// Put compresses and stores raw, returning the key to retrieve it with.
+func (a *Archive) Put(ctx context.Context, raw []byte) (string, error) {
+	return a.PutReader(ctx, bytes.NewReader(raw))
+}
+
+// PutReader compresses and stores the message read from r as it is read,
+// returning the key to retrieve it with.
+func (a *Archive) PutReader(ctx context.Context, r io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	key := fmt.Sprintf("raw/%s/%s.eml.gz", time.Now().UTC().Format("2006/01"), uuid.New())
+	err := a.blobs.Put(ctx, key, pr)
+	// Unblock the compressor if the store gave up early.
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", fmt.Errorf("store raw message: %w", err)
+	}
+	return key, nil
+}
+
+// Open returns a reader for the decompressed message stored under key.
+func (a *Archive) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := a.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("decompress raw message: %w", err)
+	}
+	return &gzipReadCloser{Reader: zr, underlying: rc}, nil
+}
+
+// ReadAll returns the full decompressed message stored under key.
+func (a *Archive) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	rc, err := a.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	underlying io.Closer
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.underlying.Close()
+}
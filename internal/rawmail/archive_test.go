@@ -0,0 +1,40 @@
+package rawmail
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/znz-systems/deaddrop/internal/blob"
+)
+
+func TestArchive_RoundTripCompressed(t *testing.T) {
+	blobs, _ := blob.NewFSStore(t.TempDir())
+	a := NewArchive(blobs)
+	raw := []byte("From: a@example.com\r\nSubject: Hi\r\n\r\n" + strings.Repeat("hello world\r\n", 200))
+
+	key, err := a.Put(context.Background(), raw)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if !strings.HasSuffix(key, ".eml.gz") {
+		t.Errorf("unexpected key %q", key)
+	}
+
+	stored, _ := blobs.Get(context.Background(), key)
+	compressed, _ := io.ReadAll(stored)
+	stored.Close()
+	if len(compressed) >= len(raw) {
+		t.Errorf("expected stored blob to be compressed, got %d bytes for %d raw", len(compressed), len(raw))
+	}
+
+	got, err := a.ReadAll(context.Background(), key)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Error("expected original bytes back")
+	}
+}
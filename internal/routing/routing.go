@@ -0,0 +1,149 @@
+// Package routing matches inbound recipient addresses to email streams.
+//
+// A stream address is either a literal address or a pattern on the local
+// part; the domain is always literal:
+//
+//	support@example.com          exact
+//	support+*@example.com        plus-tag: support+anything@example.com
+//	sales-*@example.com          glob (*, ? and [...] as in path.Match)
+//	/^(sales|billing)$/@example.com  regular expression, case-insensitive
+//	*@example.com                catch-all
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// Kind is the type of a stream address. Lower kinds take precedence.
+type Kind int
+
+const (
+	KindExact Kind = iota
+	KindPlus
+	KindPattern
+	KindCatchAll
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindExact:
+		return "exact"
+	case KindPlus:
+		return "plus"
+	case KindPattern:
+		return "pattern"
+	case KindCatchAll:
+		return "catch-all"
+	}
+	return "unknown"
+}
+
+// Address is a parsed stream address.
+type Address struct {
+	Kind   Kind
+	Local  string // the local part or pattern, without the domain
+	Domain string
+
+	re *regexp.Regexp
+}
+
+// Parse validates a stream address and classifies it.
+func Parse(address string) (*Address, error) {
+	address = strings.TrimSpace(address)
+	at := strings.LastIndexByte(address, '@')
+	if at < 1 || at == len(address)-1 {
+		return nil, errors.New("address must have the form local@domain")
+	}
+	local, domainName := address[:at], strings.ToLower(address[at+1:])
+	if strings.ContainsAny(domainName, "*?[]/ ") {
+		return nil, errors.New("the domain of an address cannot be a pattern")
+	}
+
+	a := &Address{Local: local, Domain: domainName}
+	switch {
+	case len(local) > 2 && strings.HasPrefix(local, "/") && strings.HasSuffix(local, "/"):
+		re, err := regexp.Compile(`(?i)^(?:` + local[1:len(local)-1] + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		a.Kind, a.re = KindPattern, re
+		return a, nil
+	case local == "*":
+		a.Kind = KindCatchAll
+	case len(local) > 2 && strings.HasSuffix(local, "+*") && !isGlob(strings.TrimSuffix(local, "+*")):
+		a.Kind = KindPlus
+	case isGlob(local):
+		if _, err := path.Match(local, ""); err != nil {
+			return nil, errors.New("invalid glob pattern")
+		}
+		a.Kind = KindPattern
+	default:
+		a.Kind = KindExact
+	}
+	a.Local = strings.ToLower(local)
+	return a, nil
+}
+
+// String returns the normalized address.
+func (a *Address) String() string {
+	return a.Local + "@" + a.Domain
+}
+
+// Match reports whether the recipient addr is accepted by a.
+func (a *Address) Match(addr string) bool {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 1 {
+		return false
+	}
+	local, domainName := strings.ToLower(addr[:at]), strings.ToLower(addr[at+1:])
+	if domainName != a.Domain {
+		return false
+	}
+
+	switch a.Kind {
+	case KindExact:
+		return local == a.Local
+	case KindPlus:
+		return strings.HasPrefix(local, strings.TrimSuffix(a.Local, "*"))
+	case KindCatchAll:
+		return true
+	}
+	if a.re != nil {
+		return a.re.MatchString(local)
+	}
+	ok, _ := path.Match(a.Local, local)
+	return ok
+}
+
+// Resolve returns the stream whose address best matches the recipient addr:
+// exact beats plus-tag beats pattern beats catch-all. Among streams of the
+// same kind the first one in the slice wins. Streams that are not email
+// streams or whose address does not parse are ignored.
+func Resolve(streams []models.Stream, addr string) *models.Stream {
+	var best *models.Stream
+	bestKind := Kind(-1)
+	for i := range streams {
+		st := &streams[i]
+		if st.Type != models.StreamTypeEmail {
+			continue
+		}
+		a, err := Parse(st.Address)
+		if err != nil || !a.Match(addr) {
+			continue
+		}
+		if best == nil || a.Kind < bestKind {
+			best, bestKind = st, a.Kind
+		}
+	}
+	return best
+}
+
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
@@ -0,0 +1,117 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+func TestParse_Kinds(t *testing.T) {
+	tests := []struct {
+		address string
+		kind    Kind
+	}{
+		{"Support@Example.com", KindExact},
+		{"support+*@example.com", KindPlus},
+		{"sales-*@example.com", KindPattern},
+		{"team?@example.com", KindPattern},
+		{"/^(sales|billing)$/@example.com", KindPattern},
+		{"*@example.com", KindCatchAll},
+	}
+	for _, tt := range tests {
+		a, err := Parse(tt.address)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.address, err)
+			continue
+		}
+		if a.Kind != tt.kind {
+			t.Errorf("Parse(%q).Kind = %s, want %s", tt.address, a.Kind, tt.kind)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, address := range []string{
+		"",
+		"support",
+		"@example.com",
+		"support@",
+		"*@*.example.com",
+		"/([a-z/@example.com",
+		"[abc@example.com",
+	} {
+		if _, err := Parse(address); err == nil {
+			t.Errorf("Parse(%q): expected error", address)
+		}
+	}
+}
+
+func TestAddress_Match(t *testing.T) {
+	tests := []struct {
+		pattern string
+		addr    string
+		want    bool
+	}{
+		{"support@example.com", "SUPPORT@example.com", true},
+		{"support@example.com", "support@example.org", false},
+		{"support+*@example.com", "support+billing@example.com", true},
+		{"support+*@example.com", "support@example.com", false},
+		{"support+*@example.com", "supporter+x@example.com", false},
+		{"sales-*@example.com", "sales-emea@example.com", true},
+		{"sales-*@example.com", "sales@example.com", false},
+		{"/^(sales|billing)$/@example.com", "Billing@example.com", true},
+		{"/^(sales|billing)$/@example.com", "billing2@example.com", false},
+		{"/sales|billing/@example.com", "billing2@example.com", false},
+		{"*@example.com", "anything@example.com", true},
+		{"*@example.com", "anything@sub.example.com", false},
+	}
+	for _, tt := range tests {
+		a, err := Parse(tt.pattern)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.pattern, err)
+		}
+		if got := a.Match(tt.addr); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.pattern, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestResolve_Precedence(t *testing.T) {
+	streams := []models.Stream{
+		{ID: 1, Type: models.StreamTypeEmail, Address: "*@example.com"},
+		{ID: 2, Type: models.StreamTypeEmail, Address: "support*@example.com"},
+		{ID: 3, Type: models.StreamTypeEmail, Address: "support+*@example.com"},
+		{ID: 4, Type: models.StreamTypeEmail, Address: "support@example.com"},
+		{ID: 5, Type: models.StreamTypeForm},
+	}
+
+	tests := []struct {
+		addr string
+		want int64
+	}{
+		{"support@example.com", 4},
+		{"support+billing@example.com", 3},
+		{"support-desk@example.com", 2},
+		{"hello@example.com", 1},
+	}
+	for _, tt := range tests {
+		got := Resolve(streams, tt.addr)
+		if got == nil || got.ID != tt.want {
+			t.Errorf("Resolve(%q) = %+v, want stream %d", tt.addr, got, tt.want)
+		}
+	}
+
+	if got := Resolve(streams, "support@example.org"); got != nil {
+		t.Errorf("expected no stream for another domain, got %d", got.ID)
+	}
+}
+
+func TestResolve_FirstStreamWinsWithinKind(t *testing.T) {
+	streams := []models.Stream{
+		{ID: 1, Type: models.StreamTypeEmail, Address: "sales-*@example.com"},
+		{ID: 2, Type: models.StreamTypeEmail, Address: "/sales-.*/@example.com"},
+	}
+	if got := Resolve(streams, "sales-emea@example.com"); got == nil || got.ID != 1 {
+		t.Errorf("expected stream 1, got %+v", got)
+	}
+}
@@ -0,0 +1,249 @@
+// Package sanitize makes the HTML body of an inbound email safe to display.
+//
+// It is a strict allowlist: only formatting elements and attributes survive,
+// links may only point to web and mail addresses, and images may only come
+// from the message itself unless remote images are explicitly allowed.
+// Everything else, including scripts, forms, frames, style sheets and
+// comments, is dropped. The output is meant to be shown in a sandboxed
+// iframe with a restrictive Content-Security-Policy as a second line of
+// defence.
+package sanitize
+
+import (
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Options controls how HTML is sanitised.
+type Options struct {
+	// AllowRemoteImages keeps http and https image sources. Otherwise they
+	// are removed, so that opening a message does not tell the sender.
+	AllowRemoteImages bool
+
+	// CID resolves the content ID of a cid: image source to the URL to show
+	// instead, or "" if the message has no such part. A nil CID drops all
+	// cid: images.
+	CID func(contentID string) string
+}
+
+// Result is sanitised HTML.
+type Result struct {
+	HTML string
+
+	// RemoteImages counts the remote images in the source, whether they
+	// were kept or removed.
+	RemoteImages int
+}
+
+// allowedElements are kept with their allowed attributes.
+var allowedElements = map[string]bool{
+	"a": true, "abbr": true, "address": true, "b": true, "big": true, "blockquote": true,
+	"br": true, "caption": true, "center": true, "cite": true, "code": true, "col": true,
+	"colgroup": true, "dd": true, "del": true, "div": true, "dl": true, "dt": true,
+	"em": true, "font": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "hr": true, "i": true, "img": true, "ins": true, "kbd": true, "li": true,
+	"mark": true, "ol": true, "p": true, "pre": true, "q": true, "s": true, "small": true,
+	"span": true, "strike": true, "strong": true, "sub": true, "sup": true, "table": true,
+	"tbody": true, "td": true, "tfoot": true, "th": true, "thead": true, "tr": true,
+	"tt": true, "u": true, "ul": true,
+}
+
+// droppedElements are removed together with everything inside them. Other
+// elements that are not allowed are removed but their content is kept.
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "title": true, "iframe": true,
+	"frame": true, "frameset": true, "object": true, "embed": true, "applet": true,
+	"noscript": true, "noembed": true, "noframes": true, "template": true, "svg": true,
+	"math": true, "textarea": true, "select": true, "button": true, "audio": true,
+	"video": true, "canvas": true, "xml": true,
+}
+
+// voidElements have no end tag.
+var voidElements = map[string]bool{"br": true, "col": true, "hr": true, "img": true}
+
+// allowedAttributes are kept on any allowed element. href and src are
+// handled separately.
+var allowedAttributes = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "color": true, "colspan": true, "dir": true, "face": true,
+	"height": true, "lang": true, "rowspan": true, "size": true, "span": true,
+	"start": true, "style": true, "summary": true, "title": true, "type": true,
+	"valign": true, "width": true,
+}
+
+var (
+	// inlineImageRe matches data: URLs of raster image types browsers
+	// cannot execute anything in.
+	inlineImageRe = regexp.MustCompile(`(?i)^data:image/(png|gif|jpeg|webp);base64,[a-z0-9+/=\s]+$`)
+
+	// unsafeStyleRe matches CSS that can load resources, run code or hide
+	// its intent behind escapes.
+	unsafeStyleRe = regexp.MustCompile(`(?i)url\s*\(|expression\s*\(|javascript:|@import|behavior\s*:|-moz-binding|\\`)
+)
+
+// HTML sanitises an HTML document or fragment.
+func HTML(src string, opts Options) Result {
+	var res Result
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(src))
+
+	// skip counts the open dropped elements we are inside of.
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				// The tokenizer only fails on read errors, which a
+				// strings.Reader does not have.
+				return res
+			}
+			res.HTML = b.String()
+			return res
+
+		case html.TextToken:
+			if skip == 0 {
+				b.WriteString(html.EscapeString(string(z.Text())))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			name := tok.Data
+			if droppedElements[name] {
+				if tt == html.StartTagToken && !voidElements[name] {
+					skip++
+				}
+				continue
+			}
+			if skip > 0 || !allowedElements[name] {
+				continue
+			}
+			if name == "img" && isRemote(attr(tok, "src")) {
+				res.RemoteImages++
+			}
+			writeStartTag(&b, tok, opts)
+
+		case html.EndTagToken:
+			tok := z.Token()
+			name := tok.Data
+			if droppedElements[name] {
+				if skip > 0 {
+					skip--
+				}
+				continue
+			}
+			if skip > 0 || !allowedElements[name] || voidElements[name] {
+				continue
+			}
+			b.WriteString("</" + name + ">")
+		}
+	}
+}
+
+// writeStartTag writes an allowed start tag with its allowed attributes.
+func writeStartTag(b *strings.Builder, tok html.Token, opts Options) {
+	name := tok.Data
+	var attrs []html.Attribute
+	for _, a := range tok.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case a.Namespace != "":
+			continue
+		case key == "href" && name == "a":
+			if href, ok := safeLink(a.Val); ok {
+				attrs = append(attrs, html.Attribute{Key: key, Val: href})
+			}
+		case key == "src" && name == "img":
+			if src, ok := safeImage(a.Val, opts); ok {
+				attrs = append(attrs, html.Attribute{Key: key, Val: src})
+			}
+		case key == "style":
+			if style := safeStyle(a.Val); style != "" {
+				attrs = append(attrs, html.Attribute{Key: key, Val: style})
+			}
+		case allowedAttributes[key]:
+			attrs = append(attrs, html.Attribute{Key: key, Val: a.Val})
+		}
+	}
+	if name == "a" {
+		// Links open outside the frame and without telling the target
+		// where they came from.
+		attrs = append(attrs,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer nofollow"},
+		)
+	}
+
+	b.WriteString("<" + name)
+	for _, a := range attrs {
+		b.WriteString(" " + a.Key + `="` + html.EscapeString(a.Val) + `"`)
+	}
+	b.WriteString(">")
+}
+
+func attr(tok html.Token, key string) string {
+	for _, a := range tok.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// safeLink returns href if it is a web or mail link.
+func safeLink(href string) (string, bool) {
+	href = strings.TrimSpace(href)
+	lower := strings.ToLower(href)
+	for _, scheme := range []string{"http://", "https://", "mailto:"} {
+		if strings.HasPrefix(lower, scheme) {
+			return href, true
+		}
+	}
+	// In-document anchors are harmless.
+	if strings.HasPrefix(href, "#") {
+		return href, true
+	}
+	return "", false
+}
+
+// safeImage returns the source to use for an image, resolving cid:
+// references and dropping remote images unless they are allowed.
+func safeImage(src string, opts Options) (string, bool) {
+	src = strings.TrimSpace(src)
+	lower := strings.ToLower(src)
+	switch {
+	case strings.HasPrefix(lower, "cid:"):
+		if opts.CID == nil {
+			return "", false
+		}
+		resolved := opts.CID(strings.Trim(src[len("cid:"):], "<>"))
+		return resolved, resolved != ""
+	case isRemote(src):
+		return src, opts.AllowRemoteImages
+	case inlineImageRe.MatchString(src):
+		return src, true
+	}
+	return "", false
+}
+
+func isRemote(src string) bool {
+	lower := strings.ToLower(strings.TrimSpace(src))
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "//")
+}
+
+// safeStyle keeps the declarations of an inline style that cannot load or
+// run anything.
+func safeStyle(style string) string {
+	var kept []string
+	for _, decl := range strings.Split(style, ";") {
+		decl = strings.TrimSpace(decl)
+		if decl == "" || !strings.Contains(decl, ":") || unsafeStyleRe.MatchString(decl) {
+			continue
+		}
+		kept = append(kept, decl)
+	}
+	return strings.Join(kept, "; ")
+}
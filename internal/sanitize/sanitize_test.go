@@ -0,0 +1,70 @@
+package sanitize
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTML_Allowlist(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"formatting kept", `<p align="center">Hi <b>there</b></p>`, `<p align="center">Hi <b>there</b></p>`},
+		{"tables kept", `<table cellpadding="4"><tr><td colspan="2">x</td></tr></table>`, `<table cellpadding="4"><tr><td colspan="2">x</td></tr></table>`},
+		{"document wrapper unwrapped", `<html><head><title>T</title><meta charset="utf-8"></head><body><p>x</p></body></html>`, `<p>x</p>`},
+		{"script dropped with content", `<p>a</p><script>alert(1)</script><p>b</p>`, `<p>a</p><p>b</p>`},
+		{"style element dropped", `<style>p{color:red}</style><p>x</p>`, `<p>x</p>`},
+		{"event handlers dropped", `<p onclick="alert(1)" class="x" id="y">x</p>`, `<p>x</p>`},
+		{"forms unwrapped", `<form action="https://evil.example"><input name="pw">Sign in</form>`, `Sign in`},
+		{"iframe dropped", `<iframe src="https://evil.example">fallback</iframe>ok`, `ok`},
+		{"comments dropped", `a<!-- <script>x</script> -->b`, `ab`},
+		{"text escaped", `<p>&lt;script&gt; &amp; "q"</p>`, `<p>&lt;script&gt; &amp; &#34;q&#34;</p>`},
+		{"javascript link dropped", `<a href="javascript:alert(1)">x</a>`, `<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"web link opens outside", `<a href="https://example.com/?a=1&amp;b=2">x</a>`, `<a href="https://example.com/?a=1&amp;b=2" target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"mailto kept", `<a href="mailto:a@example.com">x</a>`, `<a href="mailto:a@example.com" target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"unsafe style declarations dropped", `<div style="color: red; background: url(https://t.example/p.gif); width: expression(alert(1))">x</div>`, `<div style="color: red">x</div>`},
+		{"escaped style dropped", `<div style="background: u\72l(x)">x</div>`, `<div>x</div>`},
+		{"data image kept", `<img src="data:image/png;base64,iVBORw0KGgo=" alt="x">`, `<img src="data:image/png;base64,iVBORw0KGgo=" alt="x">`},
+		{"svg data image dropped", `<img src="data:image/svg+xml;base64,PHN2Zz4=">`, `<img>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTML(tt.src, Options{}).HTML; got != tt.want {
+				t.Errorf("HTML(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTML_RemoteImages(t *testing.T) {
+	src := `<img src="https://tracker.example/open.gif" width="1"><img src="//cdn.example/logo.png"><div><img src="cid:logo@example"></div>`
+
+	blocked := HTML(src, Options{})
+	if blocked.RemoteImages != 2 {
+		t.Errorf("expected 2 remote images, got %d", blocked.RemoteImages)
+	}
+	if strings.Contains(blocked.HTML, "tracker.example") || strings.Contains(blocked.HTML, "cdn.example") {
+		t.Errorf("expected remote images to be blocked, got %q", blocked.HTML)
+	}
+
+	loaded := HTML(src, Options{AllowRemoteImages: true})
+	if !strings.Contains(loaded.HTML, `src="https://tracker.example/open.gif"`) {
+		t.Errorf("expected remote images to be kept when allowed, got %q", loaded.HTML)
+	}
+}
+
+func TestHTML_ResolvesContentIDs(t *testing.T) {
+	src := `<img src="cid:logo@example" alt="Logo"><img src="CID:&lt;missing&gt;">`
+	res := HTML(src, Options{CID: func(id string) string {
+		if id == "logo@example" {
+			return "data:image/png;base64,AAAA"
+		}
+		return ""
+	}})
+	want := `<img src="data:image/png;base64,AAAA" alt="Logo"><img>`
+	if res.HTML != want {
+		t.Errorf("got %q, want %q", res.HTML, want)
+	}
+}
@@ -0,0 +1,124 @@
+package spam
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+const (
+	// minTraining is the number of spam and of ham messages a user must
+	// train before the classifier is used.
+	minTraining = 5
+
+	// interestingTokens is how many of the most decisive tokens are
+	// combined into the probability.
+	interestingTokens = 15
+
+	// maxTokenLength drops long runs such as encoded data.
+	maxTokenLength = 40
+)
+
+// Tokenize returns the distinct tokens the classifier learns from: words of
+// the subject (prefixed "subject:") and body, the sender's domain and the
+// hosts of linked URLs.
+func Tokenize(msg Message) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	words := func(prefix, text string) {
+		for _, w := range wordRe.FindAllString(strings.ToLower(text), -1) {
+			if len(w) >= 3 && len(w) <= maxTokenLength {
+				add(prefix + w)
+			}
+		}
+	}
+
+	words("subject:", msg.Subject)
+	for _, link := range urlRe.FindAllString(msg.Body, -1) {
+		if u, err := url.Parse(link); err == nil && u.Hostname() != "" {
+			add("url:" + strings.ToLower(u.Hostname()))
+		}
+	}
+	words("", urlRe.ReplaceAllString(msg.Body, " "))
+	if at := strings.LastIndexByte(msg.SenderAddress, '@'); at >= 0 {
+		add("from:" + strings.ToLower(msg.SenderAddress[at+1:]))
+	}
+	return tokens
+}
+
+// classify returns the classifier's contribution for msg, or ok=false if
+// the user has not trained enough messages.
+func (s *Service) classify(ctx context.Context, userID int64, msg Message) (Hit, bool, error) {
+	spamTotal, hamTotal, err := s.store.GetSpamTotals(ctx, userID)
+	if err != nil {
+		return Hit{}, false, err
+	}
+	if spamTotal < minTraining || hamTotal < minTraining {
+		return Hit{}, false, nil
+	}
+
+	counts, err := s.store.GetSpamTokens(ctx, userID, Tokenize(msg))
+	if err != nil {
+		return Hit{}, false, err
+	}
+	p := probability(counts, spamTotal, hamTotal)
+
+	switch {
+	case p >= 0.99:
+		return Hit{Rule: "BAYES_99", Score: 3.5}, true, nil
+	case p >= 0.9:
+		return Hit{Rule: "BAYES_90", Score: 2.0}, true, nil
+	case p <= 0.01:
+		return Hit{Rule: "BAYES_00", Score: -2.0}, true, nil
+	case p <= 0.1:
+		return Hit{Rule: "BAYES_10", Score: -1.0}, true, nil
+	}
+	return Hit{}, false, nil
+}
+
+// probability combines the spamminess of the most decisive known tokens
+// into the probability that a message is spam. Token probabilities use
+// Robinson's smoothing towards 0.5 for rarely seen tokens.
+func probability(counts map[string]models.SpamTokenCount, spamTotal, hamTotal int) float64 {
+	const strength, assumed = 1.0, 0.5
+
+	probs := make([]float64, 0, len(counts))
+	for _, c := range counts {
+		n := float64(c.Spam + c.Ham)
+		if n == 0 {
+			continue
+		}
+		spamFreq := float64(c.Spam) / float64(spamTotal)
+		hamFreq := float64(c.Ham) / float64(hamTotal)
+		p := spamFreq / (spamFreq + hamFreq)
+		probs = append(probs, (strength*assumed+n*p)/(strength+n))
+	}
+	if len(probs) == 0 {
+		return assumed
+	}
+
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > interestingTokens {
+		probs = probs[:interestingTokens]
+	}
+
+	// Sum logs to avoid underflow in the products.
+	var logSpam, logHam float64
+	for _, p := range probs {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
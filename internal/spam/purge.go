@@ -0,0 +1,27 @@
+package spam
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/blob"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// Purge deletes spam conversations untouched since before, together with
+// their raw messages and attachments, and returns how many were deleted.
+// Blobs that fail to delete are logged and left behind.
+func Purge(ctx context.Context, conversations store.ConversationStore, blobs blob.Store, before time.Time) (int, error) {
+	n, keys, err := conversations.PurgeSpamConversations(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil && !errors.Is(err, blob.ErrNotFound) {
+			slog.Warn("failed to delete blob of purged spam", "key", key, "error", err)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,193 @@
+package spam
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/znz-systems/deaddrop/internal/domain"
+)
+
+// Rules are the fixed heuristics applied to every message.
+type Rules struct {
+	Resolver   domain.DNSResolver
+	DNSBLZones []string
+}
+
+// badPhrases are matched case-insensitively against the subject and body.
+var badPhrases = []string{
+	"100% free",
+	"act now",
+	"bitcoin investment",
+	"cheap viagra",
+	"claim your prize",
+	"congratulations you have won",
+	"crypto investment",
+	"double your money",
+	"guaranteed income",
+	"lottery winner",
+	"make money fast",
+	"no credit check",
+	"risk-free",
+	"seo services",
+	"viagra",
+	"wire transfer",
+	"work from home",
+	"you have been selected",
+}
+
+// maxPhraseScore caps the points from bad phrases.
+const maxPhraseScore = 4.5
+
+var (
+	urlRe  = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"')\]]+`)
+	wordRe = regexp.MustCompile(`[\pL\pN]+`)
+)
+
+var shorteners = map[string]bool{
+	"bit.ly": true, "tinyurl.com": true, "goo.gl": true, "t.co": true,
+	"ow.ly": true, "is.gd": true, "buff.ly": true, "cutt.ly": true, "rebrand.ly": true,
+}
+
+// Evaluate returns the rules that match msg.
+func (r *Rules) Evaluate(msg Message) []Hit {
+	var hits []Hit
+	add := func(rule string, score float64) {
+		hits = append(hits, Hit{Rule: rule, Score: score})
+	}
+
+	if msg.Header != nil {
+		if msg.Header.Get("Message-ID") == "" {
+			add("MISSING_MESSAGE_ID", 1.0)
+		}
+		if msg.Header.Get("Date") == "" {
+			add("MISSING_DATE", 1.0)
+		}
+		if replyTo, err := mail.ParseAddress(msg.Header.Get("Reply-To")); err == nil {
+			if addrDomain(replyTo.Address) != addrDomain(msg.SenderAddress) {
+				add("REPLYTO_DIFFERS", 0.5)
+			}
+		}
+	}
+	if strings.Contains(msg.SenderName, "@") && !strings.Contains(strings.ToLower(msg.SenderName), addrDomain(msg.SenderAddress)) {
+		add("FROM_NAME_SPOOFS_ADDRESS", 1.5)
+	}
+
+	subject := strings.TrimSpace(msg.Subject)
+	if isShouting(subject) {
+		add("SUBJECT_ALL_CAPS", 1.5)
+	}
+	if strings.Contains(subject, "!!") || strings.Contains(subject, "$$") {
+		add("SUBJECT_EXCLAIM", 1.0)
+	}
+
+	hits = append(hits, linkHits(msg.Body)...)
+
+	text := strings.ToLower(subject + "\n" + msg.Body)
+	phraseScore := 0.0
+	for _, phrase := range badPhrases {
+		if strings.Contains(text, phrase) {
+			phraseScore += 1.5
+		}
+	}
+	if phraseScore > maxPhraseScore {
+		phraseScore = maxPhraseScore
+	}
+	if phraseScore > 0 {
+		add("BAD_PHRASES", phraseScore)
+	}
+
+	for _, zone := range r.listedOn(msg.IP) {
+		add("DNSBL_"+strings.ToUpper(zone), 3.0)
+	}
+	return hits
+}
+
+// linkHits scores the links in a body: many links, links making up most of
+// the text, links to bare IPs and to URL shorteners.
+func linkHits(body string) []Hit {
+	links := urlRe.FindAllString(body, -1)
+	if len(links) == 0 {
+		return nil
+	}
+
+	var hits []Hit
+	words := len(wordRe.FindAllString(urlRe.ReplaceAllString(body, " "), -1))
+	if len(links) >= 3 && words < 15*len(links) {
+		hits = append(hits, Hit{Rule: "LINK_DENSITY", Score: 2.0})
+	}
+	if len(links) > 10 {
+		hits = append(hits, Hit{Rule: "MANY_LINKS", Score: 1.5})
+	}
+
+	ipLink, shortLink := false, false
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if net.ParseIP(host) != nil {
+			ipLink = true
+		}
+		if shorteners[strings.TrimPrefix(host, "www.")] {
+			shortLink = true
+		}
+	}
+	if ipLink {
+		hits = append(hits, Hit{Rule: "LINK_TO_IP", Score: 1.5})
+	}
+	if shortLink {
+		hits = append(hits, Hit{Rule: "LINK_SHORTENER", Score: 1.0})
+	}
+	return hits
+}
+
+// listedOn returns the DNSBL zones that list ip. Only IPv4 addresses are
+// checked. Listings are answers in 127.0.0.0/8; 127.255.255.0/24 is used
+// for error codes such as "query refused" and does not count.
+func (r *Rules) listedOn(ip net.IP) []string {
+	v4 := ip.To4()
+	if r.Resolver == nil || v4 == nil {
+		return nil
+	}
+	reversed := fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+
+	var listed []string
+	for _, zone := range r.DNSBLZones {
+		ips, err := r.Resolver.LookupIP(reversed + "." + zone)
+		if err != nil {
+			continue
+		}
+		for _, answer := range ips {
+			if a := answer.To4(); a != nil && a[0] == 127 && !(a[1] == 255 && a[2] == 255) {
+				listed = append(listed, zone)
+				break
+			}
+		}
+	}
+	return listed
+}
+
+// isShouting reports whether s has at least ten letters, all upper case.
+func isShouting(s string) bool {
+	letters := 0
+	for _, c := range s {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+		if !unicode.IsUpper(c) {
+			return false
+		}
+		letters++
+	}
+	return letters >= 10
+}
+
+func addrDomain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+}
@@ -0,0 +1,123 @@
+// Package spam scores inbound email and form submissions with local rules
+// and a per-user naive-Bayes classifier trained from the dashboard.
+package spam
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// Labels a conversation can be trained with.
+const (
+	LabelSpam = "spam"
+	LabelHam  = "ham"
+)
+
+// Message is the content a verdict is based on.
+type Message struct {
+	Subject       string
+	Body          string
+	SenderAddress string
+	SenderName    string
+
+	// Header holds the email's header fields; nil for form submissions.
+	Header mail.Header
+	// IP is the address of the connecting client, if known.
+	IP net.IP
+}
+
+// Hit is a rule that matched and the points it added.
+type Hit struct {
+	Rule  string
+	Score float64
+}
+
+// Verdict is the result of checking one message.
+type Verdict struct {
+	Score float64
+	Hits  []Hit
+	Spam  bool
+}
+
+// Summary lists the rules that fired, e.g. "LINK_DENSITY=2.0, BAYES_99=3.5".
+func (v Verdict) Summary() string {
+	parts := make([]string, len(v.Hits))
+	for i, h := range v.Hits {
+		parts[i] = fmt.Sprintf("%s=%.1f", h.Rule, h.Score)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Service checks messages against the rules and the user's classifier.
+type Service struct {
+	store     store.SpamStore
+	rules     *Rules
+	threshold float64
+}
+
+// NewService creates a spam service. DNSBL lookups go through resolver to
+// each of dnsblZones; pass no zones to disable them.
+func NewService(spamStore store.SpamStore, resolver domain.DNSResolver, dnsblZones []string, threshold float64) *Service {
+	return &Service{
+		store:     spamStore,
+		rules:     &Rules{Resolver: resolver, DNSBLZones: dnsblZones},
+		threshold: threshold,
+	}
+}
+
+// Check scores msg for the user who owns the receiving mailbox. Failing to
+// read the classifier only drops its contribution.
+func (s *Service) Check(ctx context.Context, userID int64, msg Message) Verdict {
+	var v Verdict
+	v.Hits = s.rules.Evaluate(msg)
+
+	if hit, ok, err := s.classify(ctx, userID, msg); err != nil {
+		slog.Error("failed to run spam classifier", "user_id", userID, "error", err)
+	} else if ok {
+		v.Hits = append(v.Hits, hit)
+	}
+
+	for _, h := range v.Hits {
+		v.Score += h.Score
+	}
+	v.Spam = v.Score >= s.threshold
+	return v
+}
+
+// Train teaches the user's classifier that msg is spam or not. previous is
+// the label the message was last trained with ("spam", "ham" or empty),
+// which is unlearned first.
+func (s *Service) Train(ctx context.Context, userID int64, msg Message, isSpam bool, previous string) error {
+	label := LabelHam
+	if isSpam {
+		label = LabelSpam
+	}
+	if previous == label {
+		return nil
+	}
+
+	var spamDelta, hamDelta int
+	if isSpam {
+		spamDelta++
+	} else {
+		hamDelta++
+	}
+	switch previous {
+	case LabelSpam:
+		spamDelta--
+	case LabelHam:
+		hamDelta--
+	}
+
+	if err := s.store.UpdateSpamTokens(ctx, userID, Tokenize(msg), spamDelta, hamDelta); err != nil {
+		return fmt.Errorf("update spam tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package spam
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/blob"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/store"
+)
+
+// --- Mocks ---
+
+type mockSpamStore struct {
+	spamTotal, hamTotal int
+	tokens              map[string]models.SpamTokenCount
+
+	updated             []string
+	spamDelta, hamDelta int
+	updateCalls         int
+}
+
+func (m *mockSpamStore) GetSpamTotals(_ context.Context, _ int64) (int, int, error) {
+	return m.spamTotal, m.hamTotal, nil
+}
+
+func (m *mockSpamStore) GetSpamTokens(_ context.Context, _ int64, tokens []string) (map[string]models.SpamTokenCount, error) {
+	out := make(map[string]models.SpamTokenCount)
+	for _, t := range tokens {
+		if c, ok := m.tokens[t]; ok {
+			out[t] = c
+		}
+	}
+	return out, nil
+}
+
+func (m *mockSpamStore) UpdateSpamTokens(_ context.Context, _ int64, tokens []string, spamDelta, hamDelta int) error {
+	m.updateCalls++
+	m.updated = tokens
+	m.spamDelta, m.hamDelta = spamDelta, hamDelta
+	return nil
+}
+
+type mockDNSBL struct {
+	listed map[string][]net.IP
+}
+
+func (m *mockDNSBL) LookupTXT(string) ([]string, error) { return nil, nil }
+func (m *mockDNSBL) LookupMX(string) ([]*net.MX, error) { return nil, nil }
+func (m *mockDNSBL) LookupIP(host string) ([]net.IP, error) {
+	if ips, ok := m.listed[host]; ok {
+		return ips, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+type purgeStore struct {
+	store.ConversationStore
+	keys   []string
+	before time.Time
+}
+
+func (p *purgeStore) PurgeSpamConversations(_ context.Context, before time.Time) (int, []string, error) {
+	p.before = before
+	return 2, p.keys, nil
+}
+
+// --- Rules ---
+
+func ruleNames(hits []Hit) []string {
+	names := make([]string, len(hits))
+	for i, h := range hits {
+		names[i] = h.Rule
+	}
+	return names
+}
+
+func hasRule(hits []Hit, rule string) bool {
+	for _, h := range hits {
+		if h.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEvaluate_CleanMessage(t *testing.T) {
+	r := &Rules{}
+	hits := r.Evaluate(Message{
+		Subject:       "Question about my order",
+		Body:          "Hi, I ordered a blue mug last week and it has not arrived yet. Could you check? Thanks.",
+		SenderAddress: "alice@example.com",
+		SenderName:    "Alice",
+		Header: mail.Header{
+			"Message-Id": {"<1@example.com>"},
+			"Date":       {"Mon, 2 Jan 2006 15:04:05 -0700"},
+		},
+	})
+	if len(hits) != 0 {
+		t.Errorf("expected no hits, got %v", ruleNames(hits))
+	}
+}
+
+func TestEvaluate_Rules(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		rule string
+	}{
+		{"missing message id", Message{Header: mail.Header{"Date": {"x"}}}, "MISSING_MESSAGE_ID"},
+		{"missing date", Message{Header: mail.Header{"Message-Id": {"x"}}}, "MISSING_DATE"},
+		{"reply-to differs", Message{
+			SenderAddress: "a@example.com",
+			Header:        mail.Header{"Reply-To": {"b@other.test"}},
+		}, "REPLYTO_DIFFERS"},
+		{"display name spoof", Message{SenderAddress: "x@evil.test", SenderName: "support@bank.test"}, "FROM_NAME_SPOOFS_ADDRESS"},
+		{"shouting subject", Message{Subject: "URGENT ACCOUNT NOTICE"}, "SUBJECT_ALL_CAPS"},
+		{"exclamations", Message{Subject: "Great deal!!"}, "SUBJECT_EXCLAIM"},
+		{"link density", Message{Body: "see https://a.test https://b.test https://c.test"}, "LINK_DENSITY"},
+		{"link to ip", Message{Body: "login at http://192.0.2.1/login now"}, "LINK_TO_IP"},
+		{"shortener", Message{Body: "click https://bit.ly/abc"}, "LINK_SHORTENER"},
+		{"bad phrase", Message{Body: "Work from home and double your money"}, "BAD_PHRASES"},
+	}
+	r := &Rules{}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hits := r.Evaluate(tc.msg)
+			if !hasRule(hits, tc.rule) {
+				t.Errorf("expected %s, got %v", tc.rule, ruleNames(hits))
+			}
+		})
+	}
+}
+
+func TestEvaluate_BadPhrasesCapped(t *testing.T) {
+	r := &Rules{}
+	hits := r.Evaluate(Message{Body: strings.Join(badPhrases, ". ")})
+	for _, h := range hits {
+		if h.Rule == "BAD_PHRASES" && h.Score != maxPhraseScore {
+			t.Errorf("expected BAD_PHRASES capped at %.1f, got %.1f", maxPhraseScore, h.Score)
+		}
+	}
+}
+
+func TestEvaluate_DNSBL(t *testing.T) {
+	r := &Rules{
+		Resolver: &mockDNSBL{listed: map[string][]net.IP{
+			"4.3.2.192.zen.example":    {net.ParseIP("127.0.0.2")},
+			"4.3.2.192.refuse.example": {net.ParseIP("127.255.255.254")},
+		}},
+		DNSBLZones: []string{"zen.example", "refuse.example", "clean.example"},
+	}
+
+	hits := r.Evaluate(Message{IP: net.ParseIP("192.2.3.4")})
+	if got := ruleNames(hits); len(got) != 1 || got[0] != "DNSBL_ZEN.EXAMPLE" {
+		t.Errorf("expected only DNSBL_ZEN.EXAMPLE, got %v", got)
+	}
+
+	if hits := r.Evaluate(Message{IP: net.ParseIP("2001:db8::1")}); len(hits) != 0 {
+		t.Errorf("expected IPv6 clients to be skipped, got %v", ruleNames(hits))
+	}
+}
+
+// --- Bayes ---
+
+func TestTokenize(t *testing.T) {
+	tokens := Tokenize(Message{
+		Subject:       "Cheap Pills",
+		Body:          "Buy pills at https://Pharma.example/buy now, buy now",
+		SenderAddress: "bot@Spam.Example",
+	})
+	want := map[string]bool{
+		"subject:cheap": true, "subject:pills": true,
+		"url:pharma.example": true,
+		"buy":                true, "pills": true, "now": true,
+		"from:spam.example": true,
+	}
+	if len(tokens) != len(want) {
+		t.Errorf("expected %d tokens, got %v", len(want), tokens)
+	}
+	for _, tok := range tokens {
+		if !want[tok] {
+			t.Errorf("unexpected token %q", tok)
+		}
+	}
+}
+
+func TestProbability(t *testing.T) {
+	spammy := map[string]models.SpamTokenCount{
+		"viagra": {Spam: 40, Ham: 0},
+		"cheap":  {Spam: 30, Ham: 1},
+	}
+	if p := probability(spammy, 50, 50); p < 0.99 {
+		t.Errorf("expected spam probability >= 0.99, got %f", p)
+	}
+
+	hammy := map[string]models.SpamTokenCount{
+		"invoice": {Spam: 0, Ham: 30},
+		"meeting": {Spam: 1, Ham: 25},
+	}
+	if p := probability(hammy, 50, 50); p > 0.01 {
+		t.Errorf("expected spam probability <= 0.01, got %f", p)
+	}
+
+	if p := probability(nil, 50, 50); p != 0.5 {
+		t.Errorf("expected 0.5 without known tokens, got %f", p)
+	}
+}
+
+func TestCheck_UntrainedClassifierIgnored(t *testing.T) {
+	st := &mockSpamStore{
+		spamTotal: 3, hamTotal: 50,
+		tokens: map[string]models.SpamTokenCount{"viagra": {Spam: 3}},
+	}
+	svc := NewService(st, nil, nil, 5.0)
+
+	v := svc.Check(context.Background(), 1, Message{Body: "viagra"})
+	for _, h := range v.Hits {
+		if strings.HasPrefix(h.Rule, "BAYES_") {
+			t.Errorf("expected no classifier hit before %d spam messages, got %s", minTraining, h.Rule)
+		}
+	}
+}
+
+func TestCheck_Threshold(t *testing.T) {
+	st := &mockSpamStore{
+		spamTotal: 20, hamTotal: 20,
+		tokens: map[string]models.SpamTokenCount{
+			"subject:winner": {Spam: 20},
+			"lottery":        {Spam: 18},
+		},
+	}
+	svc := NewService(st, nil, nil, 5.0)
+
+	v := svc.Check(context.Background(), 1, Message{
+		Subject: "WINNER WINNER WINNER",
+		Body:    "lottery winner, claim your prize",
+	})
+	if !hasRule(v.Hits, "BAYES_99") {
+		t.Errorf("expected BAYES_99, got %v", ruleNames(v.Hits))
+	}
+	if !v.Spam {
+		t.Errorf("expected spam verdict, score %.1f (%s)", v.Score, v.Summary())
+	}
+
+	v = svc.Check(context.Background(), 1, Message{Subject: "Hello", Body: "Are you open on Sunday?"})
+	if v.Spam || v.Score != 0 {
+		t.Errorf("expected clean verdict, got score %.1f (%s)", v.Score, v.Summary())
+	}
+}
+
+func TestVerdictSummary(t *testing.T) {
+	v := Verdict{Hits: []Hit{{"LINK_DENSITY", 2}, {"BAYES_00", -2}}}
+	if got, want := v.Summary(), "LINK_DENSITY=2.0, BAYES_00=-2.0"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestTrain_Deltas(t *testing.T) {
+	tests := []struct {
+		name                string
+		isSpam              bool
+		previous            string
+		spamDelta, hamDelta int
+		calls               int
+	}{
+		{"new spam", true, "", 1, 0, 1},
+		{"new ham", false, "", 0, 1, 1},
+		{"ham to spam", true, LabelHam, 1, -1, 1},
+		{"spam to ham", false, LabelSpam, -1, 1, 1},
+		{"already spam", true, LabelSpam, 0, 0, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &mockSpamStore{}
+			svc := NewService(st, nil, nil, 5.0)
+			if err := svc.Train(context.Background(), 1, Message{Body: "hello there"}, tc.isSpam, tc.previous); err != nil {
+				t.Fatalf("Train: %v", err)
+			}
+			if st.updateCalls != tc.calls {
+				t.Fatalf("expected %d updates, got %d", tc.calls, st.updateCalls)
+			}
+			if st.spamDelta != tc.spamDelta || st.hamDelta != tc.hamDelta {
+				t.Errorf("expected deltas %d/%d, got %d/%d", tc.spamDelta, tc.hamDelta, st.spamDelta, st.hamDelta)
+			}
+		})
+	}
+}
+
+// --- Purge ---
+
+func TestPurge_DeletesBlobs(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := blob.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFSStore: %v", err)
+	}
+	if err := blobs.Put(ctx, "raw/1.eml", strings.NewReader("raw")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	st := &purgeStore{keys: []string{"raw/1.eml", "attachments/missing"}}
+	before := time.Now().Add(-time.Hour)
+	n, err := Purge(ctx, st, blobs, before)
+	if err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 purged conversations, got %d", n)
+	}
+	if !st.before.Equal(before) {
+		t.Errorf("expected cutoff %v, got %v", before, st.before)
+	}
+	if _, err := blobs.Get(ctx, "raw/1.eml"); !errors.Is(err, blob.ErrNotFound) {
+		t.Errorf("expected raw blob to be deleted, got %v", err)
+	}
+}
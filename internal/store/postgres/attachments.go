@@ -0,0 +1,74 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+type AttachmentStore struct {
+	db *sql.DB
+}
+
+func NewAttachmentStore(db *sql.DB) *AttachmentStore {
+	return &AttachmentStore{db: db}
+}
+
+func (s *AttachmentStore) CreateAttachment(ctx context.Context, a *models.Attachment) error {
+	return insertAttachment(ctx, s.db, a)
+}
+
+func insertAttachment(ctx context.Context, q queryer, a *models.Attachment) error {
+	a.PublicID = uuid.New()
+	return q.QueryRowContext(ctx,
+		`INSERT INTO attachments (public_id, conversation_message_id, filename, content_type, size_bytes, storage_key, content_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING id, created_at`,
+		a.PublicID, a.ConversationMessageID, a.Filename, a.ContentType, a.SizeBytes, a.StorageKey, a.ContentID,
+	).Scan(&a.ID, &a.CreatedAt)
+}
+
+const attachmentColumns = `a.id, a.public_id, a.conversation_message_id, a.filename, a.content_type, a.size_bytes, a.storage_key, a.content_id, a.created_at`
+
+func scanAttachment(row rowScanner, a *models.Attachment) error {
+	return row.Scan(&a.ID, &a.PublicID, &a.ConversationMessageID, &a.Filename, &a.ContentType, &a.SizeBytes, &a.StorageKey, &a.ContentID, &a.CreatedAt)
+}
+
+func (s *AttachmentStore) GetAttachmentByPublicID(ctx context.Context, publicID uuid.UUID) (*models.Attachment, error) {
+	a := &models.Attachment{}
+	err := scanAttachment(s.db.QueryRowContext(ctx,
+		`SELECT `+attachmentColumns+` FROM attachments a WHERE a.public_id = $1`, publicID), a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *AttachmentStore) GetAttachmentsByConversationID(ctx context.Context, conversationID int64) ([]models.Attachment, error) {
+	return queryAttachments(ctx, s.db,
+		`SELECT `+attachmentColumns+`
+		 FROM attachments a
+		 JOIN conversation_messages m ON m.id = a.conversation_message_id
+		 WHERE m.conversation_id = $1
+		 ORDER BY a.id`, conversationID)
+}
+
+func queryAttachments(ctx context.Context, db *sql.DB, query string, args ...any) ([]models.Attachment, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []models.Attachment
+	for rows.Next() {
+		var a models.Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
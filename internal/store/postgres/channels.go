@@ -0,0 +1,203 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// ChannelStore keeps mailboxes' notification channels and the events
+// queued for and delivered to them.
+type ChannelStore struct {
+	db *sql.DB
+}
+
+func NewChannelStore(db *sql.DB) *ChannelStore {
+	return &ChannelStore{db: db}
+}
+
+const channelColumns = `c.id, c.public_id, c.mailbox_id, c.type, c.name, c.url, c.token, c.room, c.template,
+		c.max_attempts, c.retry_seconds, c.enabled, c.created_at`
+
+func scanChannel(row rowScanner, ch *models.NotificationChannel) error {
+	var retrySeconds int
+	err := row.Scan(&ch.ID, &ch.PublicID, &ch.MailboxID, &ch.Type, &ch.Name, &ch.URL, &ch.Token, &ch.Room, &ch.Template,
+		&ch.MaxAttempts, &retrySeconds, &ch.Enabled, &ch.CreatedAt)
+	ch.RetryInterval = time.Duration(retrySeconds) * time.Second
+	return err
+}
+
+func (s *ChannelStore) CreateChannel(ctx context.Context, ch *models.NotificationChannel) error {
+	if ch.PublicID == uuid.Nil {
+		ch.PublicID = uuid.New()
+	}
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO notification_channels (public_id, mailbox_id, type, name, url, token, room, template, max_attempts, retry_seconds, enabled)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		 RETURNING id, created_at`,
+		ch.PublicID, ch.MailboxID, ch.Type, ch.Name, ch.URL, ch.Token, ch.Room, ch.Template,
+		ch.MaxAttempts, int(ch.RetryInterval/time.Second), ch.Enabled,
+	).Scan(&ch.ID, &ch.CreatedAt)
+}
+
+func (s *ChannelStore) GetChannelsByMailboxID(ctx context.Context, mailboxID int64) ([]models.NotificationChannel, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+channelColumns+` FROM notification_channels c
+		 WHERE c.mailbox_id = $1 ORDER BY c.id`, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []models.NotificationChannel
+	for rows.Next() {
+		var ch models.NotificationChannel
+		if err := scanChannel(rows, &ch); err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, rows.Err()
+}
+
+func (s *ChannelStore) GetChannelByPublicID(ctx context.Context, publicID uuid.UUID) (*models.NotificationChannel, error) {
+	ch := &models.NotificationChannel{}
+	err := scanChannel(s.db.QueryRowContext(ctx,
+		`SELECT `+channelColumns+` FROM notification_channels c WHERE c.public_id = $1`, publicID,
+	), ch)
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (s *ChannelStore) UpdateChannelEnabled(ctx context.Context, id int64, enabled bool) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE notification_channels SET enabled = $1 WHERE id = $2`, enabled, id)
+	return err
+}
+
+// DeleteChannel deletes a channel with its delivery log and the events
+// still queued for it.
+func (s *ChannelStore) DeleteChannel(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM notification_channels WHERE id = $1`, id)
+	return err
+}
+
+const channelDeliveryColumns = `d.id, d.channel_id, d.event_type, d.event, d.status, d.attempts, d.response_code, d.last_error,
+		d.next_attempt_at, d.delivered_at, d.created_at`
+
+func scanChannelDelivery(row rowScanner, d *models.ChannelDelivery) error {
+	return row.Scan(&d.ID, &d.ChannelID, &d.EventType, &d.Event, &d.Status, &d.Attempts, &d.ResponseCode, &d.LastError,
+		&d.NextAttemptAt, &d.DeliveredAt, &d.CreatedAt)
+}
+
+// EnqueueChannelDelivery adds a delivery that is due immediately and fills
+// in the generated fields.
+func (s *ChannelStore) EnqueueChannelDelivery(ctx context.Context, d *models.ChannelDelivery) error {
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO channel_deliveries (channel_id, event_type, event)
+		 VALUES ($1, $2, $3)
+		 RETURNING id, status, next_attempt_at, created_at`,
+		d.ChannelID, d.EventType, d.Event,
+	).Scan(&d.ID, &d.Status, &d.NextAttemptAt, &d.CreatedAt)
+}
+
+// ClaimChannelDelivery takes the oldest due delivery, with its channel, and
+// counts the attempt. The claim expires after lease, so the delivery of a
+// worker that died is picked up again. Concurrent workers never get the
+// same delivery. It returns sql.ErrNoRows if nothing is due.
+func (s *ChannelStore) ClaimChannelDelivery(ctx context.Context, lease time.Duration) (*models.ChannelDelivery, error) {
+	d := &models.ChannelDelivery{}
+	err := scanChannelDelivery(s.db.QueryRowContext(ctx,
+		`UPDATE channel_deliveries d SET status = 'processing', attempts = attempts + 1,
+		     locked_until = NOW() + make_interval(secs => $1)
+		 WHERE id = (
+		     SELECT id FROM channel_deliveries
+		     WHERE (status = 'pending' AND next_attempt_at <= NOW())
+		        OR (status = 'processing' AND locked_until < NOW())
+		     ORDER BY next_attempt_at, id
+		     LIMIT 1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING `+channelDeliveryColumns,
+		lease.Seconds(),
+	), d)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Channel = &models.NotificationChannel{}
+	err = scanChannel(s.db.QueryRowContext(ctx,
+		`SELECT `+channelColumns+` FROM notification_channels c WHERE c.id = $1`, d.ChannelID,
+	), d.Channel)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *ChannelStore) CompleteChannelDelivery(ctx context.Context, id int64, responseCode int) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE channel_deliveries SET status = 'delivered', response_code = $2, last_error = '',
+		     locked_until = NULL, delivered_at = NOW()
+		 WHERE id = $1`,
+		id, responseCode)
+	return err
+}
+
+// RetryChannelDelivery releases a delivery that failed temporarily to be
+// tried again at next.
+func (s *ChannelStore) RetryChannelDelivery(ctx context.Context, id int64, next time.Time, responseCode int, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE channel_deliveries SET status = 'pending', next_attempt_at = $2, response_code = $3, last_error = $4,
+		     locked_until = NULL
+		 WHERE id = $1`,
+		id, next, responseCode, lastError)
+	return err
+}
+
+func (s *ChannelStore) FailChannelDelivery(ctx context.Context, id int64, responseCode int, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE channel_deliveries SET status = 'failed', response_code = $2, last_error = $3, locked_until = NULL
+		 WHERE id = $1`,
+		id, responseCode, lastError)
+	return err
+}
+
+// GetChannelDeliveries returns a channel's latest deliveries, newest first.
+func (s *ChannelStore) GetChannelDeliveries(ctx context.Context, channelID int64, limit int) ([]models.ChannelDelivery, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+channelDeliveryColumns+` FROM channel_deliveries d
+		 WHERE d.channel_id = $1 ORDER BY d.created_at DESC, d.id DESC LIMIT $2`,
+		channelID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.ChannelDelivery
+	for rows.Next() {
+		var d models.ChannelDelivery
+		if err := scanChannelDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// DeleteChannelDeliveries deletes delivered and failed deliveries created
+// before the given time and returns how many were deleted.
+func (s *ChannelStore) DeleteChannelDeliveries(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM channel_deliveries WHERE status IN ('delivered', 'failed') AND created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
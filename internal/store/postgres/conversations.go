@@ -3,8 +3,10 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/znz-systems/deaddrop/internal/models"
 )
 
@@ -16,32 +18,52 @@ func NewConversationStore(db *sql.DB) *ConversationStore {
 	return &ConversationStore{db: db}
 }
 
-func (s *ConversationStore) CreateConversation(ctx context.Context, mailboxID, streamID int64, subject string) (*models.Conversation, error) {
-	c := &models.Conversation{
-		PublicID:  uuid.New(),
-		MailboxID: mailboxID,
-		StreamID:  streamID,
-		Subject:   subject,
-		Status:    models.ConversationOpen,
+const conversationColumns = `id, public_id, mailbox_id, stream_id, subject, status, created_at, updated_at, recipient, spam_label, tags`
+
+const qualifiedConversationColumns = `c.id, c.public_id, c.mailbox_id, c.stream_id, c.subject, c.status, c.created_at, c.updated_at, c.recipient, c.spam_label, c.tags`
+
+func scanConversation(row rowScanner, c *models.Conversation) error {
+	return row.Scan(&c.ID, &c.PublicID, &c.MailboxID, &c.StreamID, &c.Subject, &c.Status, &c.CreatedAt, &c.UpdatedAt, &c.Recipient, &c.SpamLabel, pq.Array(&c.Tags))
+}
+
+// CreateConversation creates a conversation with the mailbox, stream,
+// subject, recipient and status set in c, open if unset, together with its
+// first message in one transaction, so that no conversation is left
+// without a message. The generated fields of both are filled in.
+func (s *ConversationStore) CreateConversation(ctx context.Context, c *models.Conversation, first *models.ConversationMessage) error {
+	if c.Status == "" {
+		c.Status = models.ConversationOpen
 	}
-	err := s.db.QueryRowContext(ctx,
-		`INSERT INTO conversations (public_id, mailbox_id, stream_id, subject)
-		 VALUES ($1, $2, $3, $4)
-		 RETURNING id, status, created_at, updated_at`,
-		c.PublicID, c.MailboxID, c.StreamID, c.Subject,
-	).Scan(&c.ID, &c.Status, &c.CreatedAt, &c.UpdatedAt)
+	c.PublicID = uuid.New()
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return c, nil
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO conversations (public_id, mailbox_id, stream_id, subject, recipient, status)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id, created_at, updated_at`,
+		c.PublicID, c.MailboxID, c.StreamID, c.Subject, c.Recipient, c.Status,
+	).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	first.ConversationID = c.ID
+	if err := insertMessage(ctx, tx, first); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *ConversationStore) GetConversationByID(ctx context.Context, id int64) (*models.Conversation, error) {
 	c := &models.Conversation{}
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, public_id, mailbox_id, stream_id, subject, status, created_at, updated_at
+	err := scanConversation(s.db.QueryRowContext(ctx,
+		`SELECT `+conversationColumns+`
 		 FROM conversations WHERE id = $1`, id,
-	).Scan(&c.ID, &c.PublicID, &c.MailboxID, &c.StreamID, &c.Subject, &c.Status, &c.CreatedAt, &c.UpdatedAt)
+	), c)
 	if err != nil {
 		return nil, err
 	}
@@ -50,31 +72,51 @@ func (s *ConversationStore) GetConversationByID(ctx context.Context, id int64) (
 
 func (s *ConversationStore) GetConversationByPublicID(ctx context.Context, publicID uuid.UUID) (*models.Conversation, error) {
 	c := &models.Conversation{}
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, public_id, mailbox_id, stream_id, subject, status, created_at, updated_at
+	err := scanConversation(s.db.QueryRowContext(ctx,
+		`SELECT `+conversationColumns+`
 		 FROM conversations WHERE public_id = $1`, publicID,
-	).Scan(&c.ID, &c.PublicID, &c.MailboxID, &c.StreamID, &c.Subject, &c.Status, &c.CreatedAt, &c.UpdatedAt)
+	), c)
 	if err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
+// GetConversationsByMailboxID lists the conversations in a mailbox, newest
+// activity first. Spam is left out; see GetConversationsByStatus.
 func (s *ConversationStore) GetConversationsByMailboxID(ctx context.Context, mailboxID int64, limit, offset int) ([]models.Conversation, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, public_id, mailbox_id, stream_id, subject, status, created_at, updated_at
-		 FROM conversations WHERE mailbox_id = $1
+		`SELECT `+conversationColumns+`
+		 FROM conversations WHERE mailbox_id = $1 AND status != 'spam'
 		 ORDER BY updated_at DESC LIMIT $2 OFFSET $3`,
 		mailboxID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
+	return scanConversations(rows)
+}
+
+// GetConversationsByStatus lists the conversations in a mailbox with the
+// given status, newest activity first.
+func (s *ConversationStore) GetConversationsByStatus(ctx context.Context, mailboxID int64, status string, limit, offset int) ([]models.Conversation, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+conversationColumns+`
+		 FROM conversations WHERE mailbox_id = $1 AND status = $2
+		 ORDER BY updated_at DESC LIMIT $3 OFFSET $4`,
+		mailboxID, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanConversations(rows)
+}
+
+func scanConversations(rows *sql.Rows) ([]models.Conversation, error) {
 	defer rows.Close()
 
 	var convos []models.Conversation
 	for rows.Next() {
 		var c models.Conversation
-		if err := rows.Scan(&c.ID, &c.PublicID, &c.MailboxID, &c.StreamID, &c.Subject, &c.Status, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		if err := scanConversation(rows, &c); err != nil {
 			return nil, err
 		}
 		convos = append(convos, c)
@@ -82,6 +124,14 @@ func (s *ConversationStore) GetConversationsByMailboxID(ctx context.Context, mai
 	return convos, rows.Err()
 }
 
+// SetConversationTags replaces the tags of a conversation.
+func (s *ConversationStore) SetConversationTags(ctx context.Context, id int64, tags []string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE conversations SET tags = $1 WHERE id = $2`,
+		pq.Array(tags), id)
+	return err
+}
+
 func (s *ConversationStore) UpdateConversationStatus(ctx context.Context, id int64, status string) error {
 	_, err := s.db.ExecContext(ctx,
 		`UPDATE conversations SET status = $1, updated_at = NOW() WHERE id = $2`,
@@ -89,6 +139,70 @@ func (s *ConversationStore) UpdateConversationStatus(ctx context.Context, id int
 	return err
 }
 
+func (s *ConversationStore) UpdateConversationSpamLabel(ctx context.Context, id int64, label string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE conversations SET spam_label = $1 WHERE id = $2`,
+		label, id)
+	return err
+}
+
+// MarkConversationRead records that the owner opened the conversation.
+func (s *ConversationStore) MarkConversationRead(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE conversations SET read_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// PurgeSpamConversations deletes spam conversations that have not changed
+// since before. It returns the number deleted and the blob keys of their raw
+// messages and attachments, which the caller should remove.
+func (s *ConversationStore) PurgeSpamConversations(ctx context.Context, before time.Time) (int, []string, error) {
+	// Every part of the statement sees the rows as they were before the
+	// delete, so the keys can still be read from the cascaded tables. A raw
+	// message delivered to several mailboxes shares one blob, which is kept
+	// while another conversation still refers to it.
+	rows, err := s.db.QueryContext(ctx,
+		`WITH purged AS (
+		     DELETE FROM conversations WHERE status = 'spam' AND updated_at < $1
+		     RETURNING id
+		 )
+		 SELECT 'conversation', ''
+		 FROM purged
+		 UNION ALL
+		 SELECT DISTINCT 'blob', m.raw_key
+		 FROM conversation_messages m
+		 WHERE m.conversation_id IN (SELECT id FROM purged) AND m.raw_key != ''
+		   AND NOT EXISTS (
+		       SELECT 1 FROM conversation_messages o
+		       WHERE o.raw_key = m.raw_key AND o.conversation_id NOT IN (SELECT id FROM purged)
+		   )
+		 UNION ALL
+		 SELECT 'blob', a.storage_key
+		 FROM attachments a
+		 JOIN conversation_messages m ON m.id = a.conversation_message_id
+		 WHERE m.conversation_id IN (SELECT id FROM purged)`,
+		before)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var n int
+	var keys []string
+	for rows.Next() {
+		var kind, key string
+		if err := rows.Scan(&kind, &key); err != nil {
+			return 0, nil, err
+		}
+		if kind == "conversation" {
+			n++
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return n, keys, rows.Err()
+}
+
 func (s *ConversationStore) CountOpenByMailboxID(ctx context.Context, mailboxID int64) (int, error) {
 	var count int
 	err := s.db.QueryRowContext(ctx,
@@ -97,49 +211,128 @@ func (s *ConversationStore) CountOpenByMailboxID(ctx context.Context, mailboxID
 	return count, err
 }
 
-func (s *ConversationStore) CreateMessage(ctx context.Context, conversationID int64, direction, senderAddress, senderName, body string) (*models.ConversationMessage, error) {
-	m := &models.ConversationMessage{
-		PublicID:       uuid.New(),
-		ConversationID: conversationID,
-		Direction:      models.MessageDirection(direction),
-		SenderAddress:  senderAddress,
-		SenderName:     senderName,
-		Body:           body,
-	}
-	err := s.db.QueryRowContext(ctx,
-		`INSERT INTO conversation_messages (public_id, conversation_id, direction, sender_address, sender_name, body)
-		 VALUES ($1, $2, $3, $4, $5, $6)
-		 RETURNING id, created_at`,
-		m.PublicID, m.ConversationID, string(m.Direction), m.SenderAddress, m.SenderName, m.Body,
-	).Scan(&m.ID, &m.CreatedAt)
+// GetConversationByMessageID returns the conversation in the given mailbox that
+// contains a message with any of the given RFC 5322 Message-IDs.
+func (s *ConversationStore) GetConversationByMessageID(ctx context.Context, mailboxID int64, messageIDs []string) (*models.Conversation, error) {
+	c := &models.Conversation{}
+	err := scanConversation(s.db.QueryRowContext(ctx,
+		`SELECT `+qualifiedConversationColumns+`
+		 FROM conversations c
+		 JOIN conversation_messages m ON m.conversation_id = c.id
+		 WHERE c.mailbox_id = $1 AND m.message_id != '' AND m.message_id = ANY($2)
+		 ORDER BY m.created_at DESC LIMIT 1`,
+		mailboxID, pq.Array(messageIDs),
+	), c)
 	if err != nil {
 		return nil, err
 	}
+	return c, nil
+}
+
+func (s *ConversationStore) CreateMessage(ctx context.Context, m *models.ConversationMessage) error {
+	if err := insertMessage(ctx, s.db, m); err != nil {
+		return err
+	}
 
 	// Touch the conversation's updated_at
 	_, _ = s.db.ExecContext(ctx,
-		`UPDATE conversations SET updated_at = NOW() WHERE id = $1`, conversationID)
+		`UPDATE conversations SET updated_at = NOW() WHERE id = $1`, m.ConversationID)
 
-	return m, nil
+	return nil
 }
 
-func (s *ConversationStore) GetMessagesByConversationID(ctx context.Context, conversationID int64) ([]models.ConversationMessage, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, public_id, conversation_id, direction, sender_address, sender_name, body, created_at
-		 FROM conversation_messages WHERE conversation_id = $1
-		 ORDER BY created_at ASC`, conversationID)
-	if err != nil {
-		return nil, err
-	}
+// queryer is a *sql.DB or a *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func insertMessage(ctx context.Context, q queryer, m *models.ConversationMessage) error {
+	m.PublicID = uuid.New()
+	return q.QueryRowContext(ctx,
+		`INSERT INTO conversation_messages (public_id, conversation_id, direction, sender_address, sender_name, body, body_html, message_id, raw_key, remote_ip, helo, tls, auth_results, auth_verdict, spam_score, spam_rules, automated, delivery_status, inbound_job_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, NULLIF($19::BIGINT, 0))
+		 RETURNING id, created_at`,
+		m.PublicID, m.ConversationID, string(m.Direction), m.SenderAddress, m.SenderName, m.Body, m.BodyHTML, m.MessageID, m.RawKey, m.RemoteIP, m.Helo, m.TLS, m.AuthResults, m.AuthVerdict, m.SpamScore, m.SpamRules, m.Automated, string(m.DeliveryStatus), m.InboundJobID,
+	).Scan(&m.ID, &m.CreatedAt)
+}
+
+const messageColumns = `id, public_id, conversation_id, direction, sender_address, sender_name, body, body_html, message_id, raw_key, remote_ip, helo, tls, auth_results, auth_verdict, spam_score, spam_rules, automated, COALESCE(inbound_job_id, 0), bounced_at, bounce_reason, delivery_status, delivery_error, created_at`
+
+func scanMessages(rows *sql.Rows) ([]models.ConversationMessage, error) {
 	defer rows.Close()
 
 	var msgs []models.ConversationMessage
 	for rows.Next() {
 		var m models.ConversationMessage
-		if err := rows.Scan(&m.ID, &m.PublicID, &m.ConversationID, &m.Direction, &m.SenderAddress, &m.SenderName, &m.Body, &m.CreatedAt); err != nil {
+		if err := rows.Scan(&m.ID, &m.PublicID, &m.ConversationID, &m.Direction, &m.SenderAddress, &m.SenderName, &m.Body, &m.BodyHTML, &m.MessageID, &m.RawKey, &m.RemoteIP, &m.Helo, &m.TLS, &m.AuthResults, &m.AuthVerdict, &m.SpamScore, &m.SpamRules, &m.Automated, &m.InboundJobID, &m.BouncedAt, &m.BounceReason, &m.DeliveryStatus, &m.DeliveryError, &m.CreatedAt); err != nil {
 			return nil, err
 		}
 		msgs = append(msgs, m)
 	}
 	return msgs, rows.Err()
 }
+
+func (s *ConversationStore) GetMessagesByConversationID(ctx context.Context, conversationID int64) ([]models.ConversationMessage, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+messageColumns+`
+		 FROM conversation_messages WHERE conversation_id = $1
+		 ORDER BY created_at ASC`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// GetMessageByInboundJobID returns the message filed by an inbound queue
+// job, or sql.ErrNoRows if the job has not filed one.
+func (s *ConversationStore) GetMessageByInboundJobID(ctx context.Context, jobID int64) (*models.ConversationMessage, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+messageColumns+`
+		 FROM conversation_messages WHERE inbound_job_id = $1`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &msgs[0], nil
+}
+
+// GetMessagesWithRaw pages through messages that have stored raw source,
+// in ID order, starting after afterID.
+func (s *ConversationStore) GetMessagesWithRaw(ctx context.Context, afterID int64, limit int) ([]models.ConversationMessage, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+messageColumns+`
+		 FROM conversation_messages WHERE raw_key != '' AND id > $1
+		 ORDER BY id ASC LIMIT $2`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// MarkMessageBounced records that an outbound message of a conversation in
+// the mailbox bounced. It returns sql.ErrNoRows if there is no such message.
+func (s *ConversationStore) MarkMessageBounced(ctx context.Context, mailboxID int64, messageID, reason string) error {
+	var id int64
+	return s.db.QueryRowContext(ctx,
+		`UPDATE conversation_messages m SET bounced_at = NOW(), bounce_reason = $3, delivery_status = 'bounced'
+		 FROM conversations c
+		 WHERE m.conversation_id = c.id AND c.mailbox_id = $1
+		   AND m.message_id = $2 AND m.direction = 'outbound'
+		 RETURNING m.id`,
+		mailboxID, messageID, reason,
+	).Scan(&id)
+}
+
+func (s *ConversationStore) UpdateMessageContent(ctx context.Context, id int64, senderAddress, senderName, body, bodyHTML string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE conversation_messages SET sender_address = $1, sender_name = $2, body = $3, body_html = $4 WHERE id = $5`,
+		senderAddress, senderName, body, bodyHTML, id)
+	return err
+}
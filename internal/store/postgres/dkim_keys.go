@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// DKIMKeyStore holds the DKIM key pairs of domains.
+type DKIMKeyStore struct {
+	db *sql.DB
+}
+
+func NewDKIMKeyStore(db *sql.DB) *DKIMKeyStore {
+	return &DKIMKeyStore{db: db}
+}
+
+const dkimKeyColumns = `id, domain_id, selector, algorithm, private_key, public_key, status, verified_at, created_at`
+
+func scanDKIMKeys(rows *sql.Rows) ([]models.DKIMKey, error) {
+	defer rows.Close()
+
+	var keys []models.DKIMKey
+	for rows.Next() {
+		var k models.DKIMKey
+		if err := rows.Scan(&k.ID, &k.DomainID, &k.Selector, &k.Algorithm, &k.PrivateKey, &k.PublicKey, &k.Status, &k.VerifiedAt, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *DKIMKeyStore) CreateDKIMKey(ctx context.Context, k *models.DKIMKey) error {
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO dkim_keys (domain_id, selector, algorithm, private_key, public_key, status)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id, created_at`,
+		k.DomainID, k.Selector, k.Algorithm, k.PrivateKey, k.PublicKey, string(k.Status),
+	).Scan(&k.ID, &k.CreatedAt)
+}
+
+// GetDKIMKeysByDomainID returns the domain's keys, newest first.
+func (s *DKIMKeyStore) GetDKIMKeysByDomainID(ctx context.Context, domainID int64) ([]models.DKIMKey, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+dkimKeyColumns+`
+		 FROM dkim_keys WHERE domain_id = $1
+		 ORDER BY created_at DESC, id DESC`, domainID)
+	if err != nil {
+		return nil, err
+	}
+	return scanDKIMKeys(rows)
+}
+
+// GetActiveDKIMKeysByDomainName returns the active keys of the verified
+// domains with the given name, newest first.
+func (s *DKIMKeyStore) GetActiveDKIMKeysByDomainName(ctx context.Context, name string) ([]models.DKIMKey, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT k.id, k.domain_id, k.selector, k.algorithm, k.private_key, k.public_key, k.status, k.verified_at, k.created_at
+		 FROM dkim_keys k
+		 JOIN domains d ON d.id = k.domain_id
+		 WHERE lower(d.name) = lower($1) AND d.verified AND k.status = 'active'
+		 ORDER BY k.created_at DESC, k.id DESC`, name)
+	if err != nil {
+		return nil, err
+	}
+	return scanDKIMKeys(rows)
+}
+
+// MarkDKIMKeyVerified records that the key's DNS record was found.
+func (s *DKIMKeyStore) MarkDKIMKeyVerified(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE dkim_keys SET verified_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// ActivateDKIMKey makes a key of the domain active and retires the key of
+// the same algorithm that was active before it.
+func (s *DKIMKeyStore) ActivateDKIMKey(ctx context.Context, domainID, id int64) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE dkim_keys SET status = CASE WHEN id = $2 THEN 'active' ELSE 'retired' END
+		 WHERE domain_id = $1
+		   AND algorithm = (SELECT algorithm FROM dkim_keys WHERE id = $2 AND domain_id = $1)
+		   AND (id = $2 OR status = 'active')`,
+		domainID, id)
+	return err
+}
+
+// DeleteRetiredDKIMKey removes a retired key of the domain. It returns
+// sql.ErrNoRows if the domain has no such key.
+func (s *DKIMKeyStore) DeleteRetiredDKIMKey(ctx context.Context, domainID, id int64) error {
+	return s.db.QueryRowContext(ctx,
+		`DELETE FROM dkim_keys WHERE id = $1 AND domain_id = $2 AND status = 'retired'
+		 RETURNING id`,
+		id, domainID,
+	).Scan(&id)
+}
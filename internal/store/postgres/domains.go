@@ -27,9 +27,9 @@ func (s *DomainStore) CreateDomain(ctx context.Context, userID int64, name, veri
 	err := s.db.QueryRowContext(ctx,
 		`INSERT INTO domains (public_id, user_id, name, verification_token)
 		 VALUES ($1, $2, $3, $4)
-		 RETURNING id, verified, created_at, updated_at`,
+		 RETURNING id, verified, outbound_transport, created_at, updated_at`,
 		domain.PublicID, domain.UserID, domain.Name, domain.VerificationToken,
-	).Scan(&domain.ID, &domain.Verified, &domain.CreatedAt, &domain.UpdatedAt)
+	).Scan(&domain.ID, &domain.Verified, &domain.OutboundTransport, &domain.CreatedAt, &domain.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +39,7 @@ func (s *DomainStore) CreateDomain(ctx context.Context, userID int64, name, veri
 
 func (s *DomainStore) GetDomainsByUserID(ctx context.Context, userID int64) ([]models.Domain, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, public_id, user_id, name, verification_token, verified, created_at, updated_at
+		`SELECT id, public_id, user_id, name, verification_token, verified, outbound_transport, created_at, updated_at
 		 FROM domains WHERE user_id = $1 ORDER BY created_at DESC`,
 		userID,
 	)
@@ -51,7 +51,7 @@ func (s *DomainStore) GetDomainsByUserID(ctx context.Context, userID int64) ([]m
 	var domains []models.Domain
 	for rows.Next() {
 		var d models.Domain
-		if err := rows.Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		if err := rows.Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.OutboundTransport, &d.CreatedAt, &d.UpdatedAt); err != nil {
 			return nil, err
 		}
 		domains = append(domains, d)
@@ -62,10 +62,10 @@ func (s *DomainStore) GetDomainsByUserID(ctx context.Context, userID int64) ([]m
 func (s *DomainStore) GetDomainByID(ctx context.Context, id int64) (*models.Domain, error) {
 	d := &models.Domain{}
 	err := s.db.QueryRowContext(ctx,
-		`SELECT id, public_id, user_id, name, verification_token, verified, created_at, updated_at
+		`SELECT id, public_id, user_id, name, verification_token, verified, outbound_transport, created_at, updated_at
 		 FROM domains WHERE id = $1`,
 		id,
-	).Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.CreatedAt, &d.UpdatedAt)
+	).Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.OutboundTransport, &d.CreatedAt, &d.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -75,10 +75,10 @@ func (s *DomainStore) GetDomainByID(ctx context.Context, id int64) (*models.Doma
 func (s *DomainStore) GetDomainByPublicID(ctx context.Context, publicID uuid.UUID) (*models.Domain, error) {
 	d := &models.Domain{}
 	err := s.db.QueryRowContext(ctx,
-		`SELECT id, public_id, user_id, name, verification_token, verified, created_at, updated_at
+		`SELECT id, public_id, user_id, name, verification_token, verified, outbound_transport, created_at, updated_at
 		 FROM domains WHERE public_id = $1`,
 		publicID,
-	).Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.CreatedAt, &d.UpdatedAt)
+	).Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.OutboundTransport, &d.CreatedAt, &d.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -88,10 +88,10 @@ func (s *DomainStore) GetDomainByPublicID(ctx context.Context, publicID uuid.UUI
 func (s *DomainStore) GetDomainByName(ctx context.Context, name string) (*models.Domain, error) {
 	d := &models.Domain{}
 	err := s.db.QueryRowContext(ctx,
-		`SELECT id, public_id, user_id, name, verification_token, verified, created_at, updated_at
+		`SELECT id, public_id, user_id, name, verification_token, verified, outbound_transport, created_at, updated_at
 		 FROM domains WHERE name = $1`,
 		name,
-	).Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.CreatedAt, &d.UpdatedAt)
+	).Scan(&d.ID, &d.PublicID, &d.UserID, &d.Name, &d.VerificationToken, &d.Verified, &d.OutboundTransport, &d.CreatedAt, &d.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -104,6 +104,28 @@ func (s *DomainStore) MarkDomainVerified(ctx context.Context, id int64) error {
 	return err
 }
 
+// SetOutboundTransport sets how mail from the domain is delivered.
+func (s *DomainStore) SetOutboundTransport(ctx context.Context, id int64, transport models.OutboundTransport) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE domains SET outbound_transport = $2, updated_at = NOW() WHERE id = $1`,
+		id, string(transport))
+	return err
+}
+
+// GetOutboundTransportByName returns how mail from the verified domain
+// with the given name is delivered. It returns sql.ErrNoRows if there is
+// no such domain.
+func (s *DomainStore) GetOutboundTransportByName(ctx context.Context, name string) (models.OutboundTransport, error) {
+	var transport models.OutboundTransport
+	err := s.db.QueryRowContext(ctx,
+		`SELECT outbound_transport FROM domains
+		 WHERE lower(name) = lower($1) AND verified
+		 ORDER BY created_at LIMIT 1`,
+		name,
+	).Scan(&transport)
+	return transport, err
+}
+
 func (s *DomainStore) DeleteDomain(ctx context.Context, id int64) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM domains WHERE id = $1`, id)
 	return err
@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// FilterRuleStore holds the inbound filter rules of each mailbox.
+type FilterRuleStore struct {
+	db *sql.DB
+}
+
+func NewFilterRuleStore(db *sql.DB) *FilterRuleStore {
+	return &FilterRuleStore{db: db}
+}
+
+const filterRuleColumns = `id, mailbox_id, position, name, match_all, conditions, actions, stop, enabled, created_at`
+
+func scanFilterRule(row rowScanner, r *models.FilterRule) error {
+	var conditions, actions []byte
+	if err := row.Scan(&r.ID, &r.MailboxID, &r.Position, &r.Name, &r.MatchAll, &conditions, &actions, &r.Stop, &r.Enabled, &r.CreatedAt); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(conditions, &r.Conditions); err != nil {
+		return err
+	}
+	return json.Unmarshal(actions, &r.Actions)
+}
+
+// CreateFilterRule appends rule to the end of its mailbox's rules and fills
+// in the generated fields.
+func (s *FilterRuleStore) CreateFilterRule(ctx context.Context, rule *models.FilterRule) error {
+	conditions, err := json.Marshal(rule.Conditions)
+	if err != nil {
+		return err
+	}
+	actions, err := json.Marshal(rule.Actions)
+	if err != nil {
+		return err
+	}
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO filter_rules (mailbox_id, position, name, match_all, conditions, actions, stop, enabled)
+		 VALUES ($1, (SELECT COALESCE(MAX(position), 0) + 1 FROM filter_rules WHERE mailbox_id = $1), $2, $3, $4, $5, $6, $7)
+		 RETURNING id, position, created_at`,
+		rule.MailboxID, rule.Name, rule.MatchAll, conditions, actions, rule.Stop, rule.Enabled,
+	).Scan(&rule.ID, &rule.Position, &rule.CreatedAt)
+}
+
+// GetFilterRulesByMailboxID returns a mailbox's rules in the order they run.
+func (s *FilterRuleStore) GetFilterRulesByMailboxID(ctx context.Context, mailboxID int64) ([]models.FilterRule, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+filterRuleColumns+`
+		 FROM filter_rules WHERE mailbox_id = $1 ORDER BY position, id`, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []models.FilterRule
+	for rows.Next() {
+		var r models.FilterRule
+		if err := scanFilterRule(rows, &r); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *FilterRuleStore) UpdateFilterRuleEnabled(ctx context.Context, id int64, enabled bool) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE filter_rules SET enabled = $1 WHERE id = $2`, enabled, id)
+	return err
+}
+
+// ReorderFilterRules numbers the mailbox's rules in the order of ids. Rules
+// of other mailboxes are left alone.
+func (s *FilterRuleStore) ReorderFilterRules(ctx context.Context, mailboxID int64, ids []int64) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE filter_rules r SET position = o.position
+		 FROM unnest($2::bigint[]) WITH ORDINALITY AS o(id, position)
+		 WHERE r.id = o.id AND r.mailbox_id = $1`,
+		mailboxID, pq.Array(ids))
+	return err
+}
+
+func (s *FilterRuleStore) DeleteFilterRule(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM filter_rules WHERE id = $1`, id)
+	return err
+}
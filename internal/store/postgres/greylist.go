@@ -0,0 +1,47 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// GreylistStore remembers the delivery attempts inbound greylisting has
+// seen.
+type GreylistStore struct {
+	db *sql.DB
+}
+
+func NewGreylistStore(db *sql.DB) *GreylistStore {
+	return &GreylistStore{db: db}
+}
+
+// TouchGreylistTriplet records a delivery attempt for the triplet and
+// returns when it was first seen. A triplet not seen for longer than expiry
+// starts over as if it were new.
+func (s *GreylistStore) TouchGreylistTriplet(ctx context.Context, network, sender, recipient string, expiry time.Duration) (time.Time, error) {
+	var firstSeen time.Time
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO greylist (network, sender, recipient)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (network, sender, recipient) DO UPDATE SET
+		     first_seen = CASE WHEN greylist.last_seen < NOW() - make_interval(secs => $4)
+		                       THEN NOW() ELSE greylist.first_seen END,
+		     last_seen = NOW(),
+		     attempts = greylist.attempts + 1
+		 RETURNING first_seen`,
+		network, sender, recipient, expiry.Seconds(),
+	).Scan(&firstSeen)
+	return firstSeen, err
+}
+
+// DeleteStaleGreylistTriplets deletes triplets last seen before the given
+// time and returns how many were deleted.
+func (s *GreylistStore) DeleteStaleGreylistTriplets(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM greylist WHERE last_seen < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,136 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// InboundQueueStore holds accepted inbound email until a worker has filed
+// it into its mailbox.
+type InboundQueueStore struct {
+	db *sql.DB
+}
+
+func NewInboundQueueStore(db *sql.DB) *InboundQueueStore {
+	return &InboundQueueStore{db: db}
+}
+
+const inboundJobColumns = `id, mailbox_id, stream_id, recipient, reply_token, envelope_from, raw_key, remote_ip, helo, tls,
+		auth_results, auth_verdict, quarantine, status, attempts, last_error, next_attempt_at, created_at`
+
+func scanInboundJob(row rowScanner, j *models.InboundJob) error {
+	return row.Scan(&j.ID, &j.MailboxID, &j.StreamID, &j.Recipient, &j.ReplyToken, &j.EnvelopeFrom, &j.RawKey, &j.RemoteIP, &j.Helo, &j.TLS,
+		&j.AuthResults, &j.AuthVerdict, &j.Quarantine, &j.Status, &j.Attempts, &j.LastError, &j.NextAttemptAt, &j.CreatedAt)
+}
+
+// EnqueueInbound adds a job that is due immediately and fills in the
+// generated fields.
+func (s *InboundQueueStore) EnqueueInbound(ctx context.Context, j *models.InboundJob) error {
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO inbound_queue (mailbox_id, stream_id, recipient, reply_token, envelope_from, raw_key, remote_ip, helo, tls,
+		     auth_results, auth_verdict, quarantine)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		 RETURNING id, status, next_attempt_at, created_at`,
+		j.MailboxID, j.StreamID, j.Recipient, j.ReplyToken, j.EnvelopeFrom, j.RawKey, j.RemoteIP, j.Helo, j.TLS,
+		j.AuthResults, j.AuthVerdict, j.Quarantine,
+	).Scan(&j.ID, &j.Status, &j.NextAttemptAt, &j.CreatedAt)
+}
+
+// ClaimInbound takes the oldest due job for processing and counts the
+// attempt. The claim expires after lease, so the job of a worker that died
+// is picked up again. Concurrent workers never get the same job. It returns
+// sql.ErrNoRows if nothing is due.
+func (s *InboundQueueStore) ClaimInbound(ctx context.Context, lease time.Duration) (*models.InboundJob, error) {
+	j := &models.InboundJob{}
+	err := scanInboundJob(s.db.QueryRowContext(ctx,
+		`UPDATE inbound_queue SET status = 'processing', attempts = attempts + 1,
+		     locked_until = NOW() + make_interval(secs => $1)
+		 WHERE id = (
+		     SELECT id FROM inbound_queue
+		     WHERE (status = 'pending' AND next_attempt_at <= NOW())
+		        OR (status = 'processing' AND locked_until < NOW())
+		     ORDER BY next_attempt_at, id
+		     LIMIT 1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING `+inboundJobColumns,
+		lease.Seconds(),
+	), j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// CompleteInbound removes a delivered job.
+func (s *InboundQueueStore) CompleteInbound(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM inbound_queue WHERE id = $1`, id)
+	return err
+}
+
+// RetryInbound releases a failed job to be tried again at next.
+func (s *InboundQueueStore) RetryInbound(ctx context.Context, id int64, next time.Time, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE inbound_queue SET status = 'pending', next_attempt_at = $2, last_error = $3, locked_until = NULL
+		 WHERE id = $1`,
+		id, next, lastError)
+	return err
+}
+
+// FailInbound moves a job that will not be retried to the dead letters.
+func (s *InboundQueueStore) FailInbound(ctx context.Context, id int64, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE inbound_queue SET status = 'dead', last_error = $2, locked_until = NULL
+		 WHERE id = $1`,
+		id, lastError)
+	return err
+}
+
+// GetFailedInboundByMailboxID returns the mailbox's jobs that have failed
+// at least once, both those waiting for a retry and dead ones, oldest
+// first.
+func (s *InboundQueueStore) GetFailedInboundByMailboxID(ctx context.Context, mailboxID int64) ([]models.InboundJob, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+inboundJobColumns+`
+		 FROM inbound_queue WHERE mailbox_id = $1 AND last_error <> ''
+		 ORDER BY created_at, id`, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []models.InboundJob
+	for rows.Next() {
+		var j models.InboundJob
+		if err := scanInboundJob(rows, &j); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// RequeueInbound makes a failed job of the mailbox due immediately with a
+// fresh set of attempts. It returns sql.ErrNoRows if the mailbox has no
+// such job waiting.
+func (s *InboundQueueStore) RequeueInbound(ctx context.Context, mailboxID, id int64) error {
+	return s.db.QueryRowContext(ctx,
+		`UPDATE inbound_queue SET status = 'pending', attempts = 0, next_attempt_at = NOW(), locked_until = NULL
+		 WHERE id = $1 AND mailbox_id = $2 AND status <> 'processing'
+		 RETURNING id`,
+		id, mailboxID,
+	).Scan(&id)
+}
+
+// DeleteInbound drops a job of the mailbox that is not being processed. It
+// returns sql.ErrNoRows if the mailbox has no such job waiting.
+func (s *InboundQueueStore) DeleteInbound(ctx context.Context, mailboxID, id int64) error {
+	return s.db.QueryRowContext(ctx,
+		`DELETE FROM inbound_queue WHERE id = $1 AND mailbox_id = $2 AND status <> 'processing'
+		 RETURNING id`,
+		id, mailboxID,
+	).Scan(&id)
+}
@@ -0,0 +1,121 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// NotificationStore keeps users' notification settings and the
+// notifications waiting for a digest.
+type NotificationStore struct {
+	db *sql.DB
+}
+
+func NewNotificationStore(db *sql.DB) *NotificationStore {
+	return &NotificationStore{db: db}
+}
+
+// GetNotificationSettings returns the settings a user saved: their defaults,
+// if saved, and those of their mailboxes, with MailboxID 0 for the defaults.
+func (s *NotificationStore) GetNotificationSettings(ctx context.Context, userID int64) ([]models.NotificationSettings, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT user_id, COALESCE(mailbox_id, 0), mode, replies, quiet_start, quiet_end, timezone
+		 FROM notification_settings WHERE user_id = $1
+		 ORDER BY mailbox_id NULLS FIRST`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var settings []models.NotificationSettings
+	for rows.Next() {
+		var n models.NotificationSettings
+		if err := rows.Scan(&n.UserID, &n.MailboxID, &n.Mode, &n.Replies, &n.QuietStart, &n.QuietEnd, &n.Timezone); err != nil {
+			return nil, err
+		}
+		settings = append(settings, n)
+	}
+	return settings, rows.Err()
+}
+
+// SaveNotificationSettings creates or replaces the user's defaults, or the
+// settings of a mailbox if MailboxID is set.
+func (s *NotificationStore) SaveNotificationSettings(ctx context.Context, n *models.NotificationSettings) error {
+	conflict := `(user_id) WHERE mailbox_id IS NULL`
+	if n.MailboxID != 0 {
+		conflict = `(mailbox_id) WHERE mailbox_id IS NOT NULL`
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO notification_settings (user_id, mailbox_id, mode, replies, quiet_start, quiet_end, timezone)
+		 VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7)
+		 ON CONFLICT `+conflict+` DO UPDATE SET
+		     mode = EXCLUDED.mode,
+		     replies = EXCLUDED.replies,
+		     quiet_start = EXCLUDED.quiet_start,
+		     quiet_end = EXCLUDED.quiet_end,
+		     timezone = EXCLUDED.timezone,
+		     updated_at = NOW()`,
+		n.UserID, n.MailboxID, n.Mode, n.Replies, n.QuietStart, n.QuietEnd, n.Timezone)
+	return err
+}
+
+// DeleteNotificationSettings deletes the settings of a user's mailbox, so
+// that their defaults apply to it again.
+func (s *NotificationStore) DeleteNotificationSettings(ctx context.Context, userID, mailboxID int64) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM notification_settings WHERE user_id = $1 AND mailbox_id = $2`,
+		userID, mailboxID)
+	return err
+}
+
+func (s *NotificationStore) QueueNotification(ctx context.Context, n *models.PendingNotification) error {
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO pending_notifications (user_id, conversation_id, message_id, reply, due_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id, created_at`,
+		n.UserID, n.ConversationID, n.MessageID, n.Reply, n.DueAt,
+	).Scan(&n.ID, &n.CreatedAt)
+}
+
+// GetDueNotifications returns the pending notifications due before the
+// given time, by user and oldest first.
+func (s *NotificationStore) GetDueNotifications(ctx context.Context, before time.Time) ([]models.DigestEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT p.user_id, c.id, c.public_id, m.public_id, m.name, c.subject,
+		        cm.sender_name, cm.sender_address, cm.body, p.reply,
+		        c.status = 'open' AND (c.read_at IS NULL OR c.read_at < p.created_at),
+		        p.created_at
+		 FROM pending_notifications p
+		 JOIN conversations c ON c.id = p.conversation_id
+		 JOIN mailboxes m ON m.id = c.mailbox_id
+		 JOIN conversation_messages cm ON cm.id = p.message_id
+		 WHERE p.due_at <= $1
+		 ORDER BY p.user_id, p.created_at, p.id`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.DigestEntry
+	for rows.Next() {
+		e := models.DigestEntry{Messages: 1}
+		if err := rows.Scan(&e.UserID, &e.ConversationID, &e.ConversationPublicID, &e.MailboxPublicID, &e.MailboxName, &e.Subject,
+			&e.SenderName, &e.SenderAddress, &e.Body, &e.Reply, &e.Unread, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteDueNotifications deletes a user's pending notifications due before
+// the given time, once their digest has been sent.
+func (s *NotificationStore) DeleteDueNotifications(ctx context.Context, userID int64, before time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM pending_notifications WHERE user_id = $1 AND due_at <= $2`,
+		userID, before)
+	return err
+}
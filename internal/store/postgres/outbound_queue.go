@@ -0,0 +1,168 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// OutboundQueueStore holds outbound email until the mail transport has
+// accepted it, and keeps the delivery status of the conversation message
+// each email delivers up to date.
+type OutboundQueueStore struct {
+	db *sql.DB
+}
+
+func NewOutboundQueueStore(db *sql.DB) *OutboundQueueStore {
+	return &OutboundQueueStore{db: db}
+}
+
+const outboundJobColumns = `id, COALESCE(conversation_message_id, 0), to_address, from_address, from_name, reply_to, subject, body,
+		message_id, in_reply_to, message_references, auto_submitted, status, attempts, last_error, next_attempt_at, created_at`
+
+func scanOutboundJob(row rowScanner, j *models.OutboundJob) error {
+	return row.Scan(&j.ID, &j.ConversationMessageID, &j.To, &j.FromAddress, &j.FromName, &j.ReplyTo, &j.Subject, &j.Body,
+		&j.MessageID, &j.InReplyTo, &j.References, &j.AutoSubmitted, &j.Status, &j.Attempts, &j.LastError, &j.NextAttemptAt, &j.CreatedAt)
+}
+
+// EnqueueOutbound adds a job that is due immediately and fills in the
+// generated fields. msg, if not nil, is the conversation message the job
+// delivers. It is created in the same transaction, with the job's
+// attachments, so that a reply is never recorded without being queued or
+// queued without being recorded.
+func (s *OutboundQueueStore) EnqueueOutbound(ctx context.Context, j *models.OutboundJob, msg *models.ConversationMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if msg != nil {
+		if err := insertMessage(ctx, tx, msg); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE conversations SET updated_at = NOW() WHERE id = $1`, msg.ConversationID); err != nil {
+			return err
+		}
+		j.ConversationMessageID = msg.ID
+		for i := range j.Attachments {
+			j.Attachments[i].ConversationMessageID = msg.ID
+			if err := insertAttachment(ctx, tx, &j.Attachments[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO outbound_queue (conversation_message_id, to_address, from_address, from_name, reply_to, subject, body,
+		     message_id, in_reply_to, message_references, auto_submitted)
+		 VALUES (NULLIF($1::BIGINT, 0), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		 RETURNING id, status, next_attempt_at, created_at`,
+		j.ConversationMessageID, j.To, j.FromAddress, j.FromName, j.ReplyTo, j.Subject, j.Body,
+		j.MessageID, j.InReplyTo, j.References, j.AutoSubmitted,
+	).Scan(&j.ID, &j.Status, &j.NextAttemptAt, &j.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimOutbound takes the oldest due job for delivery and counts the
+// attempt. The claim expires after lease, so the job of a worker that died
+// is picked up again. Concurrent workers never get the same job. The job
+// comes with the attachments of its message. It returns sql.ErrNoRows if
+// nothing is due.
+func (s *OutboundQueueStore) ClaimOutbound(ctx context.Context, lease time.Duration) (*models.OutboundJob, error) {
+	j := &models.OutboundJob{}
+	err := scanOutboundJob(s.db.QueryRowContext(ctx,
+		`UPDATE outbound_queue SET status = 'processing', attempts = attempts + 1,
+		     locked_until = NOW() + make_interval(secs => $1)
+		 WHERE id = (
+		     SELECT id FROM outbound_queue
+		     WHERE (status = 'pending' AND next_attempt_at <= NOW())
+		        OR (status = 'processing' AND locked_until < NOW())
+		     ORDER BY next_attempt_at, id
+		     LIMIT 1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING `+outboundJobColumns,
+		lease.Seconds(),
+	), j)
+	if err != nil {
+		return nil, err
+	}
+	if j.ConversationMessageID != 0 {
+		j.Attachments, err = queryAttachments(ctx, s.db,
+			`SELECT `+attachmentColumns+` FROM attachments a WHERE a.conversation_message_id = $1 ORDER BY a.id`,
+			j.ConversationMessageID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// CompleteOutbound removes a delivered job and marks its message sent.
+func (s *OutboundQueueStore) CompleteOutbound(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx,
+		`WITH job AS (
+		     DELETE FROM outbound_queue WHERE id = $1 RETURNING conversation_message_id
+		 )
+		 UPDATE conversation_messages SET delivery_status = 'sent', delivery_error = ''
+		 WHERE id = (SELECT conversation_message_id FROM job)`,
+		id)
+	return err
+}
+
+// RetryOutbound releases a job that failed temporarily to be tried again
+// at next, and marks its message deferred.
+func (s *OutboundQueueStore) RetryOutbound(ctx context.Context, id int64, next time.Time, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`WITH job AS (
+		     UPDATE outbound_queue SET status = 'pending', next_attempt_at = $2, last_error = $3, locked_until = NULL
+		     WHERE id = $1
+		     RETURNING conversation_message_id
+		 )
+		 UPDATE conversation_messages SET delivery_status = 'deferred', delivery_error = $3
+		 WHERE id = (SELECT conversation_message_id FROM job)`,
+		id, next, lastError)
+	return err
+}
+
+// FailOutbound stops retrying a job and marks its message failed. A job
+// without a message, such as a forward, is removed instead, since nothing
+// would show it or retry it.
+func (s *OutboundQueueStore) FailOutbound(ctx context.Context, id int64, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`WITH dropped AS (
+		     DELETE FROM outbound_queue WHERE id = $1 AND conversation_message_id IS NULL
+		 ), job AS (
+		     UPDATE outbound_queue SET status = 'failed', last_error = $2, locked_until = NULL
+		     WHERE id = $1 AND conversation_message_id IS NOT NULL
+		     RETURNING conversation_message_id
+		 )
+		 UPDATE conversation_messages SET delivery_status = 'failed', delivery_error = $2
+		 WHERE id = (SELECT conversation_message_id FROM job)`,
+		id, lastError)
+	return err
+}
+
+// RequeueOutbound makes the job delivering a conversation message due
+// immediately with a fresh set of attempts, and marks the message queued.
+// It returns sql.ErrNoRows if the message has no job waiting.
+func (s *OutboundQueueStore) RequeueOutbound(ctx context.Context, messageID int64) error {
+	return s.db.QueryRowContext(ctx,
+		`WITH job AS (
+		     UPDATE outbound_queue SET status = 'pending', attempts = 0, next_attempt_at = NOW(), locked_until = NULL
+		     WHERE conversation_message_id = $1 AND status <> 'processing'
+		     RETURNING conversation_message_id
+		 )
+		 UPDATE conversation_messages SET delivery_status = 'queued', delivery_error = ''
+		 WHERE id = (SELECT conversation_message_id FROM job)
+		 RETURNING id`,
+		messageID,
+	).Scan(&messageID)
+}
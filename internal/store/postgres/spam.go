@@ -0,0 +1,89 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// SpamStore holds the per-user training data of the naive-Bayes spam
+// classifier.
+type SpamStore struct {
+	db *sql.DB
+}
+
+func NewSpamStore(db *sql.DB) *SpamStore {
+	return &SpamStore{db: db}
+}
+
+// GetSpamTotals returns how many messages the user has trained as spam and
+// as ham.
+func (s *SpamStore) GetSpamTotals(ctx context.Context, userID int64) (spam, ham int, err error) {
+	err = s.db.QueryRowContext(ctx,
+		`SELECT spam_count, ham_count FROM spam_training WHERE user_id = $1`, userID,
+	).Scan(&spam, &ham)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	return spam, ham, err
+}
+
+// GetSpamTokens returns the counts of the tokens the user has seen. Unseen
+// tokens are absent from the map.
+func (s *SpamStore) GetSpamTokens(ctx context.Context, userID int64, tokens []string) (map[string]models.SpamTokenCount, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT token, spam_count, ham_count FROM spam_tokens
+		 WHERE user_id = $1 AND token = ANY($2)`,
+		userID, pq.Array(tokens))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]models.SpamTokenCount)
+	for rows.Next() {
+		var token string
+		var c models.SpamTokenCount
+		if err := rows.Scan(&token, &c.Spam, &c.Ham); err != nil {
+			return nil, err
+		}
+		counts[token] = c
+	}
+	return counts, rows.Err()
+}
+
+// UpdateSpamTokens adds the deltas to the counts of every token and to the
+// user's message totals. Negative deltas unlearn a message; counts never
+// drop below zero.
+func (s *SpamStore) UpdateSpamTokens(ctx context.Context, userID int64, tokens []string, spamDelta, hamDelta int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO spam_tokens (user_id, token, spam_count, ham_count)
+		 SELECT $1, t, GREATEST($3, 0), GREATEST($4, 0) FROM unnest($2::text[]) AS t
+		 ON CONFLICT (user_id, token) DO UPDATE SET
+		     spam_count = GREATEST(spam_tokens.spam_count + $3, 0),
+		     ham_count = GREATEST(spam_tokens.ham_count + $4, 0)`,
+		userID, pq.Array(tokens), spamDelta, hamDelta); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO spam_training (user_id, spam_count, ham_count)
+		 VALUES ($1, GREATEST($2, 0), GREATEST($3, 0))
+		 ON CONFLICT (user_id) DO UPDATE SET
+		     spam_count = GREATEST(spam_training.spam_count + $2, 0),
+		     ham_count = GREATEST(spam_training.ham_count + $3, 0)`,
+		userID, spamDelta, hamDelta); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -16,21 +16,29 @@ func NewStreamStore(db *sql.DB) *StreamStore {
 	return &StreamStore{db: db}
 }
 
+const streamColumns = `id, public_id, mailbox_id, type, address, widget_id, enabled, created_at, updated_at,
+		max_attachment_bytes, allowed_attachment_types, auth_policy, max_message_bytes`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanStream(row rowScanner, st *models.Stream) error {
+	return row.Scan(&st.ID, &st.PublicID, &st.MailboxID, &st.Type, &st.Address, &st.WidgetID, &st.Enabled, &st.CreatedAt, &st.UpdatedAt,
+		&st.MaxAttachmentBytes, &st.AllowedAttachmentTypes, &st.AuthPolicy, &st.MaxMessageBytes)
+}
+
 func (s *StreamStore) CreateStream(ctx context.Context, mailboxID int64, streamType string, address string, widgetID uuid.UUID) (*models.Stream, error) {
-	st := &models.Stream{
-		PublicID:  uuid.New(),
-		MailboxID: mailboxID,
-		Type:      models.StreamType(streamType),
-		Address:   address,
-		WidgetID:  widgetID,
-		Enabled:   true,
-	}
-	err := s.db.QueryRowContext(ctx,
+	// Only form streams have a widget; the column is unique, so the others
+	// store NULL.
+	widget := uuid.NullUUID{UUID: widgetID, Valid: widgetID != uuid.Nil}
+	st := &models.Stream{}
+	err := scanStream(s.db.QueryRowContext(ctx,
 		`INSERT INTO streams (public_id, mailbox_id, type, address, widget_id)
 		 VALUES ($1, $2, $3, $4, $5)
-		 RETURNING id, enabled, created_at, updated_at`,
-		st.PublicID, st.MailboxID, string(st.Type), st.Address, st.WidgetID,
-	).Scan(&st.ID, &st.Enabled, &st.CreatedAt, &st.UpdatedAt)
+		 RETURNING `+streamColumns,
+		uuid.New(), mailboxID, streamType, address, widget,
+	), st)
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +47,7 @@ func (s *StreamStore) CreateStream(ctx context.Context, mailboxID int64, streamT
 
 func (s *StreamStore) GetStreamsByMailboxID(ctx context.Context, mailboxID int64) ([]models.Stream, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, public_id, mailbox_id, type, address, widget_id, enabled, created_at, updated_at
+		`SELECT `+streamColumns+`
 		 FROM streams WHERE mailbox_id = $1 ORDER BY created_at`, mailboxID)
 	if err != nil {
 		return nil, err
@@ -49,7 +57,7 @@ func (s *StreamStore) GetStreamsByMailboxID(ctx context.Context, mailboxID int64
 	var streams []models.Stream
 	for rows.Next() {
 		var st models.Stream
-		if err := rows.Scan(&st.ID, &st.PublicID, &st.MailboxID, &st.Type, &st.Address, &st.WidgetID, &st.Enabled, &st.CreatedAt, &st.UpdatedAt); err != nil {
+		if err := scanStream(rows, &st); err != nil {
 			return nil, err
 		}
 		streams = append(streams, st)
@@ -59,10 +67,10 @@ func (s *StreamStore) GetStreamsByMailboxID(ctx context.Context, mailboxID int64
 
 func (s *StreamStore) GetStreamByWidgetID(ctx context.Context, widgetID uuid.UUID) (*models.Stream, error) {
 	st := &models.Stream{}
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, public_id, mailbox_id, type, address, widget_id, enabled, created_at, updated_at
+	err := scanStream(s.db.QueryRowContext(ctx,
+		`SELECT `+streamColumns+`
 		 FROM streams WHERE widget_id = $1`, widgetID,
-	).Scan(&st.ID, &st.PublicID, &st.MailboxID, &st.Type, &st.Address, &st.WidgetID, &st.Enabled, &st.CreatedAt, &st.UpdatedAt)
+	), st)
 	if err != nil {
 		return nil, err
 	}
@@ -71,16 +79,62 @@ func (s *StreamStore) GetStreamByWidgetID(ctx context.Context, widgetID uuid.UUI
 
 func (s *StreamStore) GetStreamByAddress(ctx context.Context, address string) (*models.Stream, error) {
 	st := &models.Stream{}
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, public_id, mailbox_id, type, address, widget_id, enabled, created_at, updated_at
+	err := scanStream(s.db.QueryRowContext(ctx,
+		`SELECT `+streamColumns+`
 		 FROM streams WHERE address = $1 AND type = 'email'`, address,
-	).Scan(&st.ID, &st.PublicID, &st.MailboxID, &st.Type, &st.Address, &st.WidgetID, &st.Enabled, &st.CreatedAt, &st.UpdatedAt)
+	), st)
 	if err != nil {
 		return nil, err
 	}
 	return st, nil
 }
 
+// GetEmailStreamsByDomain returns every email stream whose address,
+// literal or pattern, is on the given domain, oldest first.
+func (s *StreamStore) GetEmailStreamsByDomain(ctx context.Context, domainName string) ([]models.Stream, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+streamColumns+`
+		 FROM streams
+		 WHERE type = 'email' AND lower(substring(address from '@([^@]*)$')) = lower($1)
+		 ORDER BY created_at, id`, domainName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var streams []models.Stream
+	for rows.Next() {
+		var st models.Stream
+		if err := scanStream(rows, &st); err != nil {
+			return nil, err
+		}
+		streams = append(streams, st)
+	}
+	return streams, rows.Err()
+}
+
+func (s *StreamStore) GetStreamByID(ctx context.Context, id int64) (*models.Stream, error) {
+	st := &models.Stream{}
+	err := scanStream(s.db.QueryRowContext(ctx,
+		`SELECT `+streamColumns+`
+		 FROM streams WHERE id = $1`, id,
+	), st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// UpdateStreamSettings saves the inbound email settings of a stream.
+func (s *StreamStore) UpdateStreamSettings(ctx context.Context, st *models.Stream) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE streams SET max_attachment_bytes = $1, allowed_attachment_types = $2, auth_policy = $3, max_message_bytes = $4,
+		     updated_at = NOW()
+		 WHERE id = $5`,
+		st.MaxAttachmentBytes, st.AllowedAttachmentTypes, string(st.AuthPolicy), st.MaxMessageBytes, st.ID)
+	return err
+}
+
 func (s *StreamStore) DeleteStream(ctx context.Context, id int64) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM streams WHERE id = $1`, id)
 	return err
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/znz-systems/deaddrop/internal/models"
@@ -27,9 +28,20 @@ type DomainStore interface {
 	GetDomainByPublicID(ctx context.Context, publicID uuid.UUID) (*models.Domain, error)
 	GetDomainByName(ctx context.Context, name string) (*models.Domain, error)
 	MarkDomainVerified(ctx context.Context, id int64) error
+	SetOutboundTransport(ctx context.Context, id int64, transport models.OutboundTransport) error
+	GetOutboundTransportByName(ctx context.Context, name string) (models.OutboundTransport, error)
 	DeleteDomain(ctx context.Context, id int64) error
 }
 
+type DKIMKeyStore interface {
+	CreateDKIMKey(ctx context.Context, k *models.DKIMKey) error
+	GetDKIMKeysByDomainID(ctx context.Context, domainID int64) ([]models.DKIMKey, error)
+	GetActiveDKIMKeysByDomainName(ctx context.Context, name string) ([]models.DKIMKey, error)
+	MarkDKIMKeyVerified(ctx context.Context, id int64) error
+	ActivateDKIMKey(ctx context.Context, domainID, id int64) error
+	DeleteRetiredDKIMKey(ctx context.Context, domainID, id int64) error
+}
+
 type MessageStore interface {
 	CreateMessage(ctx context.Context, domainID int64, senderName, senderEmail, body string) (*models.Message, error)
 	GetMessageByID(ctx context.Context, id int64) (*models.Message, error)
@@ -52,16 +64,98 @@ type StreamStore interface {
 	GetStreamsByMailboxID(ctx context.Context, mailboxID int64) ([]models.Stream, error)
 	GetStreamByWidgetID(ctx context.Context, widgetID uuid.UUID) (*models.Stream, error)
 	GetStreamByAddress(ctx context.Context, address string) (*models.Stream, error)
+	GetEmailStreamsByDomain(ctx context.Context, domain string) ([]models.Stream, error)
+	GetStreamByID(ctx context.Context, id int64) (*models.Stream, error)
+	UpdateStreamSettings(ctx context.Context, stream *models.Stream) error
 	DeleteStream(ctx context.Context, id int64) error
 }
 
 type ConversationStore interface {
-	CreateConversation(ctx context.Context, mailboxID, streamID int64, subject string) (*models.Conversation, error)
+	CreateConversation(ctx context.Context, c *models.Conversation, first *models.ConversationMessage) error
 	GetConversationByID(ctx context.Context, id int64) (*models.Conversation, error)
 	GetConversationByPublicID(ctx context.Context, publicID uuid.UUID) (*models.Conversation, error)
 	GetConversationsByMailboxID(ctx context.Context, mailboxID int64, limit, offset int) ([]models.Conversation, error)
+	GetConversationsByStatus(ctx context.Context, mailboxID int64, status string, limit, offset int) ([]models.Conversation, error)
 	UpdateConversationStatus(ctx context.Context, id int64, status string) error
+	UpdateConversationSpamLabel(ctx context.Context, id int64, label string) error
+	MarkConversationRead(ctx context.Context, id int64) error
+	SetConversationTags(ctx context.Context, id int64, tags []string) error
+	PurgeSpamConversations(ctx context.Context, before time.Time) (int, []string, error)
 	CountOpenByMailboxID(ctx context.Context, mailboxID int64) (int, error)
-	CreateMessage(ctx context.Context, conversationID int64, direction, senderAddress, senderName, body string) (*models.ConversationMessage, error)
+	GetConversationByMessageID(ctx context.Context, mailboxID int64, messageIDs []string) (*models.Conversation, error)
+	CreateMessage(ctx context.Context, m *models.ConversationMessage) error
+	GetMessageByInboundJobID(ctx context.Context, jobID int64) (*models.ConversationMessage, error)
 	GetMessagesByConversationID(ctx context.Context, conversationID int64) ([]models.ConversationMessage, error)
+	GetMessagesWithRaw(ctx context.Context, afterID int64, limit int) ([]models.ConversationMessage, error)
+	UpdateMessageContent(ctx context.Context, id int64, senderAddress, senderName, body, bodyHTML string) error
+	MarkMessageBounced(ctx context.Context, mailboxID int64, messageID, reason string) error
+}
+
+type AttachmentStore interface {
+	CreateAttachment(ctx context.Context, a *models.Attachment) error
+	GetAttachmentByPublicID(ctx context.Context, publicID uuid.UUID) (*models.Attachment, error)
+	GetAttachmentsByConversationID(ctx context.Context, conversationID int64) ([]models.Attachment, error)
+}
+
+type SpamStore interface {
+	GetSpamTotals(ctx context.Context, userID int64) (spam, ham int, err error)
+	GetSpamTokens(ctx context.Context, userID int64, tokens []string) (map[string]models.SpamTokenCount, error)
+	UpdateSpamTokens(ctx context.Context, userID int64, tokens []string, spamDelta, hamDelta int) error
+}
+
+type FilterRuleStore interface {
+	CreateFilterRule(ctx context.Context, rule *models.FilterRule) error
+	GetFilterRulesByMailboxID(ctx context.Context, mailboxID int64) ([]models.FilterRule, error)
+	UpdateFilterRuleEnabled(ctx context.Context, id int64, enabled bool) error
+	ReorderFilterRules(ctx context.Context, mailboxID int64, ids []int64) error
+	DeleteFilterRule(ctx context.Context, id int64) error
+}
+
+type InboundQueueStore interface {
+	EnqueueInbound(ctx context.Context, job *models.InboundJob) error
+	ClaimInbound(ctx context.Context, lease time.Duration) (*models.InboundJob, error)
+	CompleteInbound(ctx context.Context, id int64) error
+	RetryInbound(ctx context.Context, id int64, next time.Time, lastError string) error
+	FailInbound(ctx context.Context, id int64, lastError string) error
+	GetFailedInboundByMailboxID(ctx context.Context, mailboxID int64) ([]models.InboundJob, error)
+	RequeueInbound(ctx context.Context, mailboxID, id int64) error
+	DeleteInbound(ctx context.Context, mailboxID, id int64) error
+}
+
+type OutboundQueueStore interface {
+	EnqueueOutbound(ctx context.Context, job *models.OutboundJob, msg *models.ConversationMessage) error
+	ClaimOutbound(ctx context.Context, lease time.Duration) (*models.OutboundJob, error)
+	CompleteOutbound(ctx context.Context, id int64) error
+	RetryOutbound(ctx context.Context, id int64, next time.Time, lastError string) error
+	FailOutbound(ctx context.Context, id int64, lastError string) error
+	RequeueOutbound(ctx context.Context, messageID int64) error
+}
+
+type GreylistStore interface {
+	TouchGreylistTriplet(ctx context.Context, network, sender, recipient string, expiry time.Duration) (time.Time, error)
+	DeleteStaleGreylistTriplets(ctx context.Context, before time.Time) (int, error)
+}
+
+type NotificationStore interface {
+	GetNotificationSettings(ctx context.Context, userID int64) ([]models.NotificationSettings, error)
+	SaveNotificationSettings(ctx context.Context, settings *models.NotificationSettings) error
+	DeleteNotificationSettings(ctx context.Context, userID, mailboxID int64) error
+	QueueNotification(ctx context.Context, n *models.PendingNotification) error
+	GetDueNotifications(ctx context.Context, before time.Time) ([]models.DigestEntry, error)
+	DeleteDueNotifications(ctx context.Context, userID int64, before time.Time) error
+}
+
+type ChannelStore interface {
+	CreateChannel(ctx context.Context, ch *models.NotificationChannel) error
+	GetChannelsByMailboxID(ctx context.Context, mailboxID int64) ([]models.NotificationChannel, error)
+	GetChannelByPublicID(ctx context.Context, publicID uuid.UUID) (*models.NotificationChannel, error)
+	UpdateChannelEnabled(ctx context.Context, id int64, enabled bool) error
+	DeleteChannel(ctx context.Context, id int64) error
+	EnqueueChannelDelivery(ctx context.Context, d *models.ChannelDelivery) error
+	ClaimChannelDelivery(ctx context.Context, lease time.Duration) (*models.ChannelDelivery, error)
+	CompleteChannelDelivery(ctx context.Context, id int64, responseCode int) error
+	RetryChannelDelivery(ctx context.Context, id int64, next time.Time, responseCode int, lastError string) error
+	FailChannelDelivery(ctx context.Context, id int64, responseCode int, lastError string) error
+	GetChannelDeliveries(ctx context.Context, channelID int64, limit int) ([]models.ChannelDelivery, error)
+	DeleteChannelDeliveries(ctx context.Context, before time.Time) (int, error)
 }
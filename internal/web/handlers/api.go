@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 
 	"github.com/google/uuid"
@@ -82,11 +83,16 @@ func (h *APIHandler) HandleSubmitMessage(w http.ResponseWriter, r *http.Request)
 	}
 
 	// --- Start conversation via stream ---
-	if _, err := h.conversations.StartConversation(r.Context(), stream, subject, email, name, body); err != nil {
+	if _, err := h.conversations.StartConversation(r.Context(), stream, subject, email, name, body, clientIP(r)); err != nil {
 		if errors.Is(err, conversation.ErrStreamDisabled) {
 			writeJSON(w, http.StatusBadRequest, jsonResponse{Error: "domain not verified"})
 			return
 		}
+		// A discarded submission looks delivered to the sender.
+		if errors.Is(err, conversation.ErrDiscarded) {
+			writeJSON(w, http.StatusOK, jsonResponse{OK: true})
+			return
+		}
 		slog.Error("failed to start conversation", "widget_id", widgetID, "error", err)
 		writeJSON(w, http.StatusInternalServerError, jsonResponse{Error: "internal server error"})
 		return
@@ -95,6 +101,16 @@ func (h *APIHandler) HandleSubmitMessage(w http.ResponseWriter, r *http.Request)
 	writeJSON(w, http.StatusOK, jsonResponse{OK: true})
 }
 
+// clientIP returns the submitter's address. RemoteAddr has been rewritten
+// by the RealIP middleware when the app runs behind a proxy.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
 // jsonResponse is the envelope for all API JSON responses.
 type jsonResponse struct {
 	OK    bool   `json:"ok,omitempty"`
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -52,6 +53,18 @@ func (m *mockStreamStoreForAPI) GetStreamByAddress(_ context.Context, _ string)
 	return nil, errors.New("not implemented")
 }
 
+func (m *mockStreamStoreForAPI) GetEmailStreamsByDomain(_ context.Context, _ string) ([]models.Stream, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockStreamStoreForAPI) GetStreamByID(_ context.Context, _ int64) (*models.Stream, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockStreamStoreForAPI) UpdateStreamSettings(_ context.Context, _ *models.Stream) error {
+	return errors.New("not implemented")
+}
+
 func (m *mockStreamStoreForAPI) DeleteStream(_ context.Context, _ int64) error {
 	return errors.New("not implemented")
 }
@@ -72,20 +85,18 @@ func newMockConvStoreForAPI() *mockConvStoreForAPI {
 	}
 }
 
-func (m *mockConvStoreForAPI) CreateConversation(_ context.Context, mailboxID, streamID int64, subject string) (*models.Conversation, error) {
-	c := &models.Conversation{
-		ID:        m.nextID,
-		PublicID:  uuid.New(),
-		MailboxID: mailboxID,
-		StreamID:  streamID,
-		Subject:   subject,
-		Status:    models.ConversationOpen,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+func (m *mockConvStoreForAPI) CreateConversation(ctx context.Context, c *models.Conversation, first *models.ConversationMessage) error {
+	c.ID = m.nextID
+	c.PublicID = uuid.New()
+	if c.Status == "" {
+		c.Status = models.ConversationOpen
 	}
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
 	m.nextID++
 	m.conversations[c.ID] = c
-	return c, nil
+	first.ConversationID = c.ID
+	return m.CreateMessage(ctx, first)
 }
 
 func (m *mockConvStoreForAPI) GetConversationByID(_ context.Context, id int64) (*models.Conversation, error) {
@@ -104,34 +115,67 @@ func (m *mockConvStoreForAPI) GetConversationsByMailboxID(_ context.Context, _ i
 	return nil, nil
 }
 
+func (m *mockConvStoreForAPI) GetConversationsByStatus(_ context.Context, _ int64, _ string, _, _ int) ([]models.Conversation, error) {
+	return nil, nil
+}
+
 func (m *mockConvStoreForAPI) UpdateConversationStatus(_ context.Context, _ int64, _ string) error {
 	return nil
 }
 
+func (m *mockConvStoreForAPI) MarkConversationRead(_ context.Context, _ int64) error {
+	return nil
+}
+
+func (m *mockConvStoreForAPI) UpdateConversationSpamLabel(_ context.Context, _ int64, _ string) error {
+	return nil
+}
+
+func (m *mockConvStoreForAPI) SetConversationTags(_ context.Context, _ int64, _ []string) error {
+	return nil
+}
+
+func (m *mockConvStoreForAPI) MarkMessageBounced(_ context.Context, _ int64, _, _ string) error {
+	return sql.ErrNoRows
+}
+
+func (m *mockConvStoreForAPI) PurgeSpamConversations(_ context.Context, _ time.Time) (int, []string, error) {
+	return 0, nil, nil
+}
+
 func (m *mockConvStoreForAPI) CountOpenByMailboxID(_ context.Context, _ int64) (int, error) {
 	return 0, nil
 }
 
-func (m *mockConvStoreForAPI) CreateMessage(_ context.Context, conversationID int64, direction, senderAddress, senderName, body string) (*models.ConversationMessage, error) {
-	msg := &models.ConversationMessage{
-		ID:             m.nextMsgID,
-		PublicID:       uuid.New(),
-		ConversationID: conversationID,
-		Direction:      models.MessageDirection(direction),
-		SenderAddress:  senderAddress,
-		SenderName:     senderName,
-		Body:           body,
-		CreatedAt:      time.Now(),
-	}
+func (m *mockConvStoreForAPI) GetConversationByMessageID(_ context.Context, _ int64, _ []string) (*models.Conversation, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockConvStoreForAPI) CreateMessage(_ context.Context, msg *models.ConversationMessage) error {
+	msg.ID = m.nextMsgID
+	msg.PublicID = uuid.New()
+	msg.CreatedAt = time.Now()
 	m.nextMsgID++
-	m.messages[conversationID] = append(m.messages[conversationID], *msg)
-	return msg, nil
+	m.messages[msg.ConversationID] = append(m.messages[msg.ConversationID], *msg)
+	return nil
+}
+
+func (m *mockConvStoreForAPI) GetMessageByInboundJobID(_ context.Context, _ int64) (*models.ConversationMessage, error) {
+	return nil, sql.ErrNoRows
 }
 
 func (m *mockConvStoreForAPI) GetMessagesByConversationID(_ context.Context, conversationID int64) ([]models.ConversationMessage, error) {
 	return m.messages[conversationID], nil
 }
 
+func (m *mockConvStoreForAPI) GetMessagesWithRaw(_ context.Context, _ int64, _ int) ([]models.ConversationMessage, error) {
+	return nil, nil
+}
+
+func (m *mockConvStoreForAPI) UpdateMessageContent(_ context.Context, _ int64, _, _, _, _ string) error {
+	return nil
+}
+
 type mockMailboxStoreForAPI struct {
 	mailboxes map[int64]*models.Mailbox
 }
@@ -188,7 +232,7 @@ func makeAPIHandler(widgetID uuid.UUID, enabled bool) *APIHandler {
 		})
 	}
 
-	convService := conversation.NewService(cs, ms, &conversation.NoopNotifier{}, &conversation.NoopSender{})
+	convService := conversation.NewService(cs, nil, ms, &conversation.NoopNotifier{}, &conversation.NoopSender{}, &conversation.NoopSpamFilter{}, &conversation.NoopFilter{})
 	return NewAPIHandler(ss, convService)
 }
 
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/channel"
+	"github.com/znz-systems/deaddrop/internal/mailbox"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/web/middleware"
+	"github.com/znz-systems/deaddrop/internal/web/render"
+)
+
+// channelLogLength is how many deliveries the log of each channel shows.
+const channelLogLength = 10
+
+// ChannelHandler serves the notification channels of mailboxes.
+type ChannelHandler struct {
+	channels      *channel.Service
+	mailboxes     *mailbox.Service
+	render        *render.Renderer
+	secureCookies bool
+}
+
+// NewChannelHandler creates a new ChannelHandler.
+func NewChannelHandler(channels *channel.Service, mailboxes *mailbox.Service, r *render.Renderer, secureCookies bool) *ChannelHandler {
+	return &ChannelHandler{
+		channels:      channels,
+		mailboxes:     mailboxes,
+		render:        r,
+		secureCookies: secureCookies,
+	}
+}
+
+// ShowChannels lists a mailbox's channels with their latest deliveries.
+func (h *ChannelHandler) ShowChannels(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	mb, ok := h.mailboxFor(w, r)
+	if !ok {
+		return
+	}
+
+	channels, err := h.channels.List(r.Context(), mb.ID)
+	if err != nil {
+		slog.Error("failed to list channels", "mailbox_id", mb.ID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the host of a channel's URL is shown, since incoming webhook
+	// URLs are secrets.
+	type channelWithLog struct {
+		Channel    models.NotificationChannel
+		Host       string
+		Deliveries []models.ChannelDelivery
+	}
+	items := make([]channelWithLog, 0, len(channels))
+	for _, ch := range channels {
+		deliveries, err := h.channels.Deliveries(r.Context(), ch.ID, channelLogLength)
+		if err != nil {
+			slog.Error("failed to list channel deliveries", "channel_id", ch.ID, "error", err)
+		}
+		item := channelWithLog{Channel: ch, Deliveries: deliveries}
+		if u, err := url.Parse(ch.URL); err == nil {
+			item.Host = u.Host
+		}
+		items = append(items, item)
+	}
+
+	h.render.Render(w, r, "mailbox_channels.html", map[string]interface{}{
+		"User":        user,
+		"Mailbox":     mb,
+		"Channels":    items,
+		"MaxAttempts": channel.MaxAttempts,
+	})
+}
+
+// HandleCreateChannel adds a channel to a mailbox.
+func (h *ChannelHandler) HandleCreateChannel(w http.ResponseWriter, r *http.Request) {
+	mb, ok := h.mailboxFor(w, r)
+	if !ok {
+		return
+	}
+	channelsURL := "/mailboxes/" + mb.PublicID.String() + "/channels"
+
+	maxAttempts, err1 := strconv.Atoi(r.FormValue("max_attempts"))
+	retrySeconds, err2 := strconv.Atoi(r.FormValue("retry_seconds"))
+	if err1 != nil || err2 != nil {
+		setFlashError(w, "Attempts and retry interval must be numbers.", h.secureCookies)
+		http.Redirect(w, r, channelsURL, http.StatusSeeOther)
+		return
+	}
+
+	ch := &models.NotificationChannel{
+		MailboxID:     mb.ID,
+		Type:          models.ChannelType(r.FormValue("type")),
+		Name:          strings.TrimSpace(r.FormValue("name")),
+		URL:           strings.TrimSpace(r.FormValue("url")),
+		Token:         strings.TrimSpace(r.FormValue("token")),
+		Room:          strings.TrimSpace(r.FormValue("room")),
+		Template:      strings.TrimSpace(r.FormValue("template")),
+		MaxAttempts:   maxAttempts,
+		RetryInterval: time.Duration(retrySeconds) * time.Second,
+	}
+	if err := h.channels.Create(r.Context(), ch); err != nil {
+		switch {
+		case errors.Is(err, channel.ErrUnknownType):
+			setFlashError(w, "Unknown channel type.", h.secureCookies)
+		case errors.Is(err, channel.ErrInvalidURL):
+			setFlashError(w, "The URL must be an http or https URL.", h.secureCookies)
+		case errors.Is(err, channel.ErrInvalidPolicy):
+			setFlashError(w, "Attempts must be between 1 and "+strconv.Itoa(channel.MaxAttempts)+", and the retry interval between 1 and 3600 seconds.", h.secureCookies)
+		case errors.Is(err, channel.ErrInvalidSettings):
+			setFlashError(w, "Channel not added: "+err.Error()+".", h.secureCookies)
+		default:
+			slog.Error("failed to create channel", "mailbox_id", mb.ID, "error", err)
+			setFlashError(w, "Failed to add the channel.", h.secureCookies)
+		}
+		http.Redirect(w, r, channelsURL, http.StatusSeeOther)
+		return
+	}
+
+	setFlashSuccess(w, "Channel added.", h.secureCookies)
+	http.Redirect(w, r, channelsURL, http.StatusSeeOther)
+}
+
+// HandleToggleChannel turns a channel on or off.
+func (h *ChannelHandler) HandleToggleChannel(w http.ResponseWriter, r *http.Request) {
+	h.updateChannel(w, r, func(_ *models.Mailbox, ch *models.NotificationChannel) {
+		if err := h.channels.SetEnabled(r.Context(), ch.ID, !ch.Enabled); err != nil {
+			slog.Error("failed to toggle channel", "channel_id", ch.ID, "error", err)
+			setFlashError(w, "Failed to update the channel.", h.secureCookies)
+		}
+	})
+}
+
+// HandleTestChannel sends a test event to a channel.
+func (h *ChannelHandler) HandleTestChannel(w http.ResponseWriter, r *http.Request) {
+	h.updateChannel(w, r, func(mb *models.Mailbox, ch *models.NotificationChannel) {
+		if err := h.channels.Test(r.Context(), mb, ch); err != nil {
+			setFlashError(w, "Failed to queue the test event.", h.secureCookies)
+			return
+		}
+		setFlashSuccess(w, "Test event queued. Reload to see how it went.", h.secureCookies)
+	})
+}
+
+// HandleDeleteChannel deletes a channel and its delivery log.
+func (h *ChannelHandler) HandleDeleteChannel(w http.ResponseWriter, r *http.Request) {
+	h.updateChannel(w, r, func(_ *models.Mailbox, ch *models.NotificationChannel) {
+		if err := h.channels.Delete(r.Context(), ch.ID); err != nil {
+			slog.Error("failed to delete channel", "channel_id", ch.ID, "error", err)
+			setFlashError(w, "Failed to delete the channel.", h.secureCookies)
+			return
+		}
+		setFlashSuccess(w, "Channel deleted.", h.secureCookies)
+	})
+}
+
+// updateChannel looks up the channel in the URL, checks that it belongs to
+// the user's mailbox, runs update and returns to the channel list.
+func (h *ChannelHandler) updateChannel(w http.ResponseWriter, r *http.Request, update func(*models.Mailbox, *models.NotificationChannel)) {
+	mb, ok := h.mailboxFor(w, r)
+	if !ok {
+		return
+	}
+	chPublicID, err := uuid.Parse(chi.URLParam(r, "chid"))
+	if err != nil {
+		http.Error(w, "invalid channel id", http.StatusBadRequest)
+		return
+	}
+	ch, err := h.channels.GetByPublicID(r.Context(), chPublicID)
+	if err != nil || ch.MailboxID != mb.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	update(mb, ch)
+	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String()+"/channels", http.StatusSeeOther)
+}
+
+// mailboxFor returns the user's mailbox named in the URL, or writes the
+// response and returns false.
+func (h *ChannelHandler) mailboxFor(w http.ResponseWriter, r *http.Request) (*models.Mailbox, bool) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+	publicID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid mailbox id", http.StatusBadRequest)
+		return nil, false
+	}
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return nil, false
+	}
+	return mb, true
+}
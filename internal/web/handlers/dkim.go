@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/models"
+)
+
+// dkimKeyRow is a DKIM key with the DNS record that publishes it.
+type dkimKeyRow struct {
+	models.DKIMKey
+	Host   string
+	Record string
+}
+
+func dkimKeyRows(d *models.Domain, keys []models.DKIMKey) []dkimKeyRow {
+	rows := make([]dkimKeyRow, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, dkimKeyRow{DKIMKey: k, Host: domain.DKIMHost(d, k), Record: domain.DKIMRecord(k)})
+	}
+	return rows
+}
+
+// HandleCheckDKIM looks up the DNS records of the domain's DKIM keys and
+// activates the new keys that are published.
+func (h *DomainHandler) HandleCheckDKIM(w http.ResponseWriter, r *http.Request) {
+	h.updateVerifiedDomain(w, r, func(d *models.Domain) {
+		if err := h.domains.CheckDKIM(r.Context(), d); err != nil {
+			slog.Warn("dkim check failed", "domain", d.Name, "error", err)
+			setFlashError(w, "DKIM check failed: "+err.Error(), h.secureCookies)
+			return
+		}
+		setFlashSuccess(w, "DKIM records found.", h.secureCookies)
+	})
+}
+
+// HandleRotateDKIM creates a new DKIM key pair for the domain.
+func (h *DomainHandler) HandleRotateDKIM(w http.ResponseWriter, r *http.Request) {
+	h.updateVerifiedDomain(w, r, func(d *models.Domain) {
+		err := h.domains.RotateDKIM(r.Context(), d)
+		switch {
+		case errors.Is(err, domain.ErrDKIMRotationPending):
+			setFlashError(w, "Publish and check the new DKIM records before rotating again.", h.secureCookies)
+		case err != nil:
+			slog.Error("failed to rotate dkim keys", "domain", d.Name, "error", err)
+			setFlashError(w, "Failed to create new DKIM keys.", h.secureCookies)
+		default:
+			setFlashSuccess(w, "New DKIM keys created. Publish their records, then check them to start signing with them.", h.secureCookies)
+		}
+	})
+}
+
+// HandleDeleteDKIMKey removes a retired DKIM key.
+func (h *DomainHandler) HandleDeleteDKIMKey(w http.ResponseWriter, r *http.Request) {
+	h.updateVerifiedDomain(w, r, func(d *models.Domain) {
+		keyID, err := strconv.ParseInt(chi.URLParam(r, "kid"), 10, 64)
+		if err != nil {
+			setFlashError(w, "Invalid DKIM key.", h.secureCookies)
+			return
+		}
+		err = h.domains.DeleteDKIMKey(r.Context(), d, keyID)
+		switch {
+		case errors.Is(err, domain.ErrDKIMKeyNotRetired):
+			setFlashError(w, "Only retired DKIM keys can be removed.", h.secureCookies)
+		case err != nil:
+			slog.Error("failed to delete dkim key", "domain", d.Name, "key_id", keyID, "error", err)
+			setFlashError(w, "Failed to remove DKIM key.", h.secureCookies)
+		default:
+			setFlashSuccess(w, "DKIM key removed. You can delete its DNS record now.", h.secureCookies)
+		}
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/models"
 	"github.com/znz-systems/deaddrop/internal/store"
 	"github.com/znz-systems/deaddrop/internal/web/middleware"
 	"github.com/znz-systems/deaddrop/internal/web/render"
@@ -185,8 +186,18 @@ func (h *DomainHandler) ShowDomainDetail(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	var dkimKeys []dkimKeyRow
+	if d.Verified {
+		keys, err := h.domains.DKIMKeys(r.Context(), d)
+		if err != nil {
+			slog.Error("failed to get dkim keys", "domain", d.Name, "error", err)
+		}
+		dkimKeys = dkimKeyRows(d, keys)
+	}
+
 	h.render.Render(w, r, "domain_detail.html", map[string]interface{}{
 		"User":               user,
+		"DKIMKeys":           dkimKeys,
 		"Domain":             d,
 		"Messages":           messages,
 		"Mailbox":            mailbox,
@@ -234,6 +245,19 @@ func (h *DomainHandler) HandleVerifyDomain(w http.ResponseWriter, r *http.Reques
 	http.Redirect(w, r, "/domains/"+d.PublicID.String(), http.StatusSeeOther)
 }
 
+// HandleSetOutboundTransport sets how mail from the domain is delivered.
+func (h *DomainHandler) HandleSetOutboundTransport(w http.ResponseWriter, r *http.Request) {
+	h.updateVerifiedDomain(w, r, func(d *models.Domain) {
+		transport := models.OutboundTransport(r.FormValue("transport"))
+		if err := h.domains.SetOutboundTransport(r.Context(), d, transport); err != nil {
+			slog.Warn("failed to set outbound transport", "domain", d.Name, "error", err)
+			setFlashError(w, "Failed to change outbound delivery.", h.secureCookies)
+			return
+		}
+		setFlashSuccess(w, "Outbound delivery updated.", h.secureCookies)
+	})
+}
+
 // HandleDeleteDomain removes the domain and redirects to the dashboard.
 func (h *DomainHandler) HandleDeleteDomain(w http.ResponseWriter, r *http.Request) {
 	user := middleware.UserFromContext(r.Context())
@@ -269,3 +293,27 @@ func (h *DomainHandler) HandleDeleteDomain(w http.ResponseWriter, r *http.Reques
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// updateVerifiedDomain checks the verified domain in the URL, runs update
+// on it and redirects back to the domain.
+func (h *DomainHandler) updateVerifiedDomain(w http.ResponseWriter, r *http.Request, update func(d *models.Domain)) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	d, err := h.domains.GetByPublicID(r.Context(), publicID)
+	if err != nil || d.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if d.Verified {
+		update(d)
+	} else {
+		setFlashError(w, "Verify the domain first.", h.secureCookies)
+	}
+	http.Redirect(w, r, "/domains/"+d.PublicID.String(), http.StatusSeeOther)
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -20,6 +21,14 @@ func (t *testResolver) LookupTXT(_ string) ([]string, error) {
 	return nil, nil
 }
 
+func (t *testResolver) LookupIP(_ string) ([]net.IP, error) {
+	return nil, nil
+}
+
+func (t *testResolver) LookupMX(_ string) ([]*net.MX, error) {
+	return nil, nil
+}
+
 // injectUser is test middleware that sets the authenticated user in context.
 func injectUser(user *models.User) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -45,7 +54,7 @@ func setupDomainTestRouter(userA, userB *models.User) (*chi.Mux, *models.Domain)
 	}
 	ds.addDomain(domainB)
 
-	domainSvc := domain.NewService(ds, &testResolver{})
+	domainSvc := domain.NewService(ds, nil, &testResolver{})
 	handler := NewDomainHandler(domainSvc, ms, nil, nil, nil, "http://localhost:8080", false) // nil renderer: IDOR check triggers before render
 
 	r := chi.NewRouter()
@@ -117,7 +126,7 @@ func TestShowDomainDetail_OwnDomain_PassesOwnershipCheck(t *testing.T) {
 	}
 	ds.addDomain(domainA)
 
-	domainSvc := domain.NewService(ds, &testResolver{})
+	domainSvc := domain.NewService(ds, nil, &testResolver{})
 
 	// Use a handler that records whether the ownership check was passed
 	// by wrapping the handler with a sentinel: if we get past the check,
@@ -1,17 +1,29 @@
 package handlers
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/attachment"
 	"github.com/znz-systems/deaddrop/internal/conversation"
 	"github.com/znz-systems/deaddrop/internal/domain"
+	"github.com/znz-systems/deaddrop/internal/filter"
+	"github.com/znz-systems/deaddrop/internal/inbound"
 	"github.com/znz-systems/deaddrop/internal/mailbox"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/rawmail"
+	"github.com/znz-systems/deaddrop/internal/sanitize"
 	"github.com/znz-systems/deaddrop/internal/store"
 	"github.com/znz-systems/deaddrop/internal/web/middleware"
 	"github.com/znz-systems/deaddrop/internal/web/render"
@@ -20,7 +32,12 @@ import (
 type MailboxHandler struct {
 	mailboxes     *mailbox.Service
 	conversations *conversation.Service
+	filters       *filter.Service
 	domains       *domain.Service
+	attachments   *attachment.Service
+	replyLimits   attachment.ReplyLimits
+	queue         *inbound.Queue
+	archive       *rawmail.Archive
 	streams       store.StreamStore
 	convStore     store.ConversationStore
 	render        *render.Renderer
@@ -31,7 +48,12 @@ type MailboxHandler struct {
 func NewMailboxHandler(
 	mailboxes *mailbox.Service,
 	conversations *conversation.Service,
+	filters *filter.Service,
 	domains *domain.Service,
+	attachments *attachment.Service,
+	replyLimits attachment.ReplyLimits,
+	queue *inbound.Queue,
+	archive *rawmail.Archive,
 	streams store.StreamStore,
 	convStore store.ConversationStore,
 	r *render.Renderer,
@@ -41,7 +63,12 @@ func NewMailboxHandler(
 	return &MailboxHandler{
 		mailboxes:     mailboxes,
 		conversations: conversations,
+		filters:       filters,
 		domains:       domains,
+		attachments:   attachments,
+		replyLimits:   replyLimits,
+		queue:         queue,
+		archive:       archive,
 		streams:       streams,
 		convStore:     convStore,
 		render:        r,
@@ -182,13 +209,27 @@ func (h *MailboxHandler) ShowMailboxDetail(w http.ResponseWriter, r *http.Reques
 
 	convos, _ := h.conversations.List(r.Context(), mb.ID, 50, 0)
 	streams, _ := h.streams.GetStreamsByMailboxID(r.Context(), mb.ID)
+	rules, _ := h.filters.List(r.Context(), mb.ID)
+
+	// Other mailboxes are offered as targets for moving conversations.
+	var others []models.Mailbox
+	mailboxes, _ := h.mailboxes.List(r.Context(), user.ID)
+	for _, other := range mailboxes {
+		if other.ID != mb.ID {
+			others = append(others, other)
+		}
+	}
 
 	h.render.Render(w, r, "mailbox_detail.html", map[string]interface{}{
-		"User":          user,
-		"Mailbox":       mb,
-		"Conversations": convos,
-		"Streams":       streams,
-		"BaseURL":       h.baseURL,
+		"User":           user,
+		"Mailbox":        mb,
+		"Conversations":  convos,
+		"Streams":        streams,
+		"Rules":          rules,
+		"OtherMailboxes": others,
+		"MailboxNames":   h.mailboxNames(r, user.ID),
+		"RuleRows":       ruleRows(),
+		"BaseURL":        h.baseURL,
 	})
 }
 
@@ -223,14 +264,314 @@ func (h *MailboxHandler) ShowConversation(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if err := h.conversations.MarkRead(r.Context(), conv.ID); err != nil {
+		slog.Error("failed to mark conversation read", "conversation_id", conv.ID, "error", err)
+	}
+
 	messages, _ := h.conversations.GetMessages(r.Context(), conv.ID)
+	attachments, err := h.attachments.ListByConversation(r.Context(), conv.ID)
+	if err != nil {
+		slog.Error("failed to list attachments", "conversation_id", conv.ID, "error", err)
+	}
+
+	// HTML bodies are shown in a frame; the page offers to load their
+	// remote images, which the frame blocks by default.
+	remoteImages := make(map[int64]int)
+	for _, m := range messages {
+		if m.BodyHTML != "" {
+			remoteImages[m.ID] = sanitize.HTML(m.BodyHTML, sanitize.Options{}).RemoteImages
+		}
+	}
 
 	h.render.Render(w, r, "conversation_detail.html", map[string]interface{}{
 		"User":         user,
 		"Mailbox":      mb,
 		"Conversation": conv,
 		"Messages":     messages,
+		"Attachments":  attachments,
+		"RemoteImages": remoteImages,
+		"ReplyLimits":  h.replyLimits,
+	})
+}
+
+func (h *MailboxHandler) HandleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mbPublicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), mbPublicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	convPublicID, _ := uuid.Parse(chi.URLParam(r, "cid"))
+	conv, err := h.conversations.GetByPublicID(r.Context(), convPublicID)
+	if err != nil || conv.MailboxID != mb.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	attPublicID, err := uuid.Parse(chi.URLParam(r, "aid"))
+	if err != nil {
+		http.Error(w, "invalid attachment id", http.StatusBadRequest)
+		return
+	}
+
+	att, err := h.attachments.GetByPublicID(r.Context(), attPublicID)
+	if err != nil || !h.messageInConversation(r, att.ConversationMessageID, conv.ID) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	content, err := h.attachments.Open(r.Context(), att)
+	if err != nil {
+		slog.Error("failed to open attachment", "attachment_id", att.ID, "error", err)
+		http.Error(w, "attachment unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	// Always download rather than render: attachment content is untrusted.
+	w.Header().Set("Content-Type", downloadContentType(att.ContentType))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename}))
+	w.Header().Set("Content-Length", strconv.FormatInt(att.SizeBytes, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, content); err != nil {
+		slog.Warn("failed to stream attachment", "attachment_id", att.ID, "error", err)
+	}
+}
+
+// safeDownloadTypes are the content types attachments are served with as
+// given: a browser that ignores Content-Disposition runs no script in them.
+var safeDownloadTypes = map[string]bool{
+	"application/pdf": true,
+	"application/zip": true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"text/csv":        true,
+	"text/plain":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+}
+
+// downloadContentType returns the media type an attachment of the given
+// content type is served with, application/octet-stream unless it is one
+// of safeDownloadTypes. Parameters are dropped.
+func downloadContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !safeDownloadTypes[strings.ToLower(mediaType)] {
+		return "application/octet-stream"
+	}
+	return strings.ToLower(mediaType)
+}
+
+// HandleRawMessage serves the original source of an inbound message, inline
+// as plain text or, with ?download=1, as an .eml file.
+func (h *MailboxHandler) HandleRawMessage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mbPublicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), mbPublicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	convPublicID, _ := uuid.Parse(chi.URLParam(r, "cid"))
+	conv, err := h.conversations.GetByPublicID(r.Context(), convPublicID)
+	if err != nil || conv.MailboxID != mb.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	msgPublicID, err := uuid.Parse(chi.URLParam(r, "mid"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.conversations.GetMessages(r.Context(), conv.ID)
+	if err != nil {
+		slog.Error("failed to get messages", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var rawKey string
+	for _, m := range messages {
+		if m.PublicID == msgPublicID {
+			rawKey = m.RawKey
+			break
+		}
+	}
+	if rawKey == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	content, err := h.archive.Open(r.Context(), rawKey)
+	if err != nil {
+		slog.Error("failed to open raw message", "key", rawKey, "error", err)
+		http.Error(w, "original message unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	// Never serve the source as message/rfc822 or HTML inline: it is untrusted.
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": msgPublicID.String() + ".eml"}))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, content); err != nil {
+		slog.Warn("failed to stream raw message", "key", rawKey, "error", err)
+	}
+}
+
+// maxInlineImageBytes caps the size of a cid: image embedded in a sanitised
+// HTML body.
+const maxInlineImageBytes = 5 << 20
+
+// HandleMessageHTML serves the sanitised HTML body of an inbound message for
+// the sandboxed frame in the conversation view. Remote images are removed
+// unless ?images=1 is given.
+func (h *MailboxHandler) HandleMessageHTML(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mbPublicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), mbPublicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	convPublicID, _ := uuid.Parse(chi.URLParam(r, "cid"))
+	conv, err := h.conversations.GetByPublicID(r.Context(), convPublicID)
+	if err != nil || conv.MailboxID != mb.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	msgPublicID, err := uuid.Parse(chi.URLParam(r, "mid"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.conversations.GetMessages(r.Context(), conv.ID)
+	if err != nil {
+		slog.Error("failed to get messages", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var msg *models.ConversationMessage
+	for i := range messages {
+		if messages[i].PublicID == msgPublicID {
+			msg = &messages[i]
+			break
+		}
+	}
+	if msg == nil || msg.BodyHTML == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	remote := r.URL.Query().Get("images") == "1"
+	res := sanitize.HTML(msg.BodyHTML, sanitize.Options{
+		AllowRemoteImages: remote,
+		CID:               h.inlineImages(r, conv.ID, msg.ID),
 	})
+
+	// The body is untrusted even after sanitising: no scripts, no
+	// plugins, no forms, and only the images allowed above.
+	imgSrc := "data:"
+	if remote {
+		imgSrc += " https: http:"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src "+imgSrc+"; style-src 'unsafe-inline'; base-uri 'none'; form-action 'none'; frame-ancestors 'self'")
+	w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "private, no-store")
+	fmt.Fprint(w, `<!DOCTYPE html><html><head><meta charset="utf-8"><meta name="referrer" content="no-referrer">`+
+		`<style>body{margin:0;font-family:sans-serif;font-size:14px;overflow-wrap:anywhere}img{max-width:100%;height:auto}</style>`+
+		`</head><body>`)
+	fmt.Fprint(w, res.HTML)
+	fmt.Fprint(w, `</body></html>`)
+}
+
+// inlineImages returns a resolver for the cid: images of a message. It embeds
+// the message's inline image parts as data: URLs, so the sandboxed frame
+// needs neither cookies nor network access to show them.
+func (h *MailboxHandler) inlineImages(r *http.Request, conversationID, messageID int64) func(string) string {
+	byMessage, err := h.attachments.ListByConversation(r.Context(), conversationID)
+	if err != nil {
+		slog.Error("failed to list attachments", "conversation_id", conversationID, "error", err)
+		return nil
+	}
+	parts := make(map[string]models.Attachment)
+	for _, a := range byMessage[messageID] {
+		if a.ContentID != "" {
+			parts[strings.ToLower(a.ContentID)] = a
+		}
+	}
+
+	return func(contentID string) string {
+		a, ok := parts[strings.ToLower(contentID)]
+		if !ok || a.SizeBytes > maxInlineImageBytes {
+			return ""
+		}
+		switch a.ContentType {
+		case "image/png", "image/gif", "image/jpeg", "image/webp":
+		default:
+			return ""
+		}
+		content, err := h.attachments.Open(r.Context(), &a)
+		if err != nil {
+			slog.Warn("failed to open inline image", "attachment_id", a.ID, "error", err)
+			return ""
+		}
+		defer content.Close()
+		data, err := io.ReadAll(io.LimitReader(content, maxInlineImageBytes))
+		if err != nil {
+			return ""
+		}
+		return "data:" + a.ContentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+func (h *MailboxHandler) messageInConversation(r *http.Request, messageID, conversationID int64) bool {
+	messages, err := h.conversations.GetMessages(r.Context(), conversationID)
+	if err != nil {
+		return false
+	}
+	for _, m := range messages {
+		if m.ID == messageID {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *MailboxHandler) HandleReply(w http.ResponseWriter, r *http.Request) {
@@ -254,23 +595,166 @@ func (h *MailboxHandler) HandleReply(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
+	// The limits are checked once the form is parsed; a body far beyond
+	// them is not read to the end first.
+	if h.replyLimits.MaxTotalBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.replyLimits.MaxTotalBytes+replyFormSlack)
+	}
+	if err := r.ParseMultipartForm(replyFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			http.Error(w, "reply too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
+	convURL := fmt.Sprintf("/mailboxes/%s/conversations/%s", mb.PublicID, conv.PublicID)
 
 	body := r.FormValue("body")
 	if body == "" {
 		setFlash(w, "Reply body cannot be empty", h.secureCookies)
-		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		http.Redirect(w, r, convURL, http.StatusSeeOther)
 		return
 	}
 
-	if _, err := h.conversations.Reply(r.Context(), conv.ID, body); err != nil {
+	uploads := replyUploads(r)
+	sizes := make([]int64, len(uploads))
+	for i, fh := range uploads {
+		sizes[i] = fh.Size
+	}
+	switch err := h.replyLimits.Check(sizes); {
+	case errors.Is(err, attachment.ErrReplyFileTooLarge):
+		setFlashError(w, fmt.Sprintf("Reply not sent: each attached file may be at most %d MB.", h.replyLimits.MaxFileBytes>>20), h.secureCookies)
+		http.Redirect(w, r, convURL, http.StatusSeeOther)
+		return
+	case errors.Is(err, attachment.ErrReplyTooLarge):
+		setFlashError(w, fmt.Sprintf("Reply not sent: attached files may be at most %d MB together.", h.replyLimits.MaxTotalBytes>>20), h.secureCookies)
+		http.Redirect(w, r, convURL, http.StatusSeeOther)
+		return
+	}
+
+	var staged []models.Attachment
+	for _, f := range uploadFiles(uploads) {
+		a, err := h.attachments.Stage(r.Context(), f)
+		if err != nil {
+			slog.Error("failed to store reply attachment", "filename", f.Filename, "error", err)
+			h.attachments.Discard(r.Context(), staged)
+			setFlashError(w, "Failed to store the attached files.", h.secureCookies)
+			http.Redirect(w, r, convURL, http.StatusSeeOther)
+			return
+		}
+		staged = append(staged, *a)
+	}
+
+	if _, err := h.conversations.Reply(r.Context(), conv.ID, body, staged); err != nil {
 		slog.Error("failed to send reply", "error", err)
+		h.attachments.Discard(r.Context(), staged)
 		setFlash(w, "Failed to send reply: "+err.Error(), h.secureCookies)
 	} else {
-		setFlash(w, "Reply sent!", h.secureCookies)
+		setFlash(w, "Reply queued for delivery.", h.secureCookies)
+	}
+
+	http.Redirect(w, r, convURL, http.StatusSeeOther)
+}
+
+// replyFormMemory is how much of a reply form is kept in memory; larger
+// attachments are spooled to temporary files while the form is parsed.
+const replyFormMemory = 8 << 20
+
+// replyFormSlack is how far a reply form may exceed the total attachment
+// limit, for the body text and the multipart framing.
+const replyFormSlack = 1 << 20
+
+// replyUploads returns the files uploaded with a reply form.
+func replyUploads(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	var uploads []*multipart.FileHeader
+	for _, fh := range r.MultipartForm.File["attachments"] {
+		if fh.Filename == "" && fh.Size == 0 {
+			// An empty file input.
+			continue
+		}
+		uploads = append(uploads, fh)
+	}
+	return uploads
+}
+
+// uploadFiles returns uploaded files as attachments, read from where the
+// form spooled them when they are stored.
+func uploadFiles(uploads []*multipart.FileHeader) []attachment.File {
+	files := make([]attachment.File, 0, len(uploads))
+	for _, fh := range uploads {
+		contentType := fh.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(fh.Filename))
+		}
+		files = append(files, attachment.File{
+			Filename:    fh.Filename,
+			ContentType: contentType,
+			Size:        fh.Size,
+			Source:      func() (io.ReadCloser, error) { return fh.Open() },
+		})
+	}
+	return files
+}
+
+// HandleRetryDelivery sends a deferred or failed outbound message again.
+func (h *MailboxHandler) HandleRetryDelivery(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mbPublicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), mbPublicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	convPublicID, _ := uuid.Parse(chi.URLParam(r, "cid"))
+	conv, err := h.conversations.GetByPublicID(r.Context(), convPublicID)
+	if err != nil || conv.MailboxID != mb.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	msgPublicID, err := uuid.Parse(chi.URLParam(r, "mid"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.conversations.GetMessages(r.Context(), conv.ID)
+	if err != nil {
+		slog.Error("failed to get messages", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var messageID int64
+	for _, m := range messages {
+		if m.PublicID == msgPublicID && m.Direction == models.MessageOutbound {
+			messageID = m.ID
+			break
+		}
+	}
+	if messageID == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.conversations.RetryDelivery(r.Context(), messageID)
+	switch {
+	case errors.Is(err, conversation.ErrNotQueued):
+		setFlashError(w, "That reply is no longer waiting to be sent.", h.secureCookies)
+	case err != nil:
+		slog.Error("failed to retry outbound message", "message_id", messageID, "error", err)
+		setFlashError(w, "Failed to retry the reply.", h.secureCookies)
+	default:
+		setFlashSuccess(w, "Reply queued for another attempt.", h.secureCookies)
 	}
 
 	http.Redirect(w, r, fmt.Sprintf("/mailboxes/%s/conversations/%s", mb.PublicID, conv.PublicID), http.StatusSeeOther)
@@ -301,6 +785,106 @@ func (h *MailboxHandler) HandleCloseConversation(w http.ResponseWriter, r *http.
 	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
 }
 
+func (h *MailboxHandler) HandleReleaseConversation(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mbPublicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), mbPublicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	convPublicID, _ := uuid.Parse(chi.URLParam(r, "cid"))
+	conv, err := h.conversations.GetByPublicID(r.Context(), convPublicID)
+	if err != nil || conv.MailboxID != mb.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if conv.Status == models.ConversationQuarantined {
+		_ = h.conversations.Release(r.Context(), conv.ID)
+	}
+	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String()+"/conversations/"+conv.PublicID.String(), http.StatusSeeOther)
+}
+
+func (h *MailboxHandler) HandleMarkSpam(w http.ResponseWriter, r *http.Request) {
+	h.markSpam(w, r, true)
+}
+
+func (h *MailboxHandler) HandleMarkNotSpam(w http.ResponseWriter, r *http.Request) {
+	h.markSpam(w, r, false)
+}
+
+func (h *MailboxHandler) markSpam(w http.ResponseWriter, r *http.Request, isSpam bool) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mbPublicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), mbPublicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	convPublicID, _ := uuid.Parse(chi.URLParam(r, "cid"))
+	conv, err := h.conversations.GetByPublicID(r.Context(), convPublicID)
+	if err != nil || conv.MailboxID != mb.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.conversations.MarkSpam(r.Context(), user.ID, conv.ID, isSpam); err != nil {
+		slog.Error("failed to mark conversation", "conversation_id", conv.ID, "spam", isSpam, "error", err)
+		setFlashError(w, "Failed to update conversation: "+err.Error(), h.secureCookies)
+		http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String()+"/conversations/"+conv.PublicID.String(), http.StatusSeeOther)
+		return
+	}
+
+	if isSpam {
+		setFlashSuccess(w, "Moved to spam. The filter will learn from it.", h.secureCookies)
+		http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+		return
+	}
+	setFlashSuccess(w, "Marked as not spam.", h.secureCookies)
+	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String()+"/conversations/"+conv.PublicID.String(), http.StatusSeeOther)
+}
+
+func (h *MailboxHandler) ShowSpam(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid mailbox id", http.StatusBadRequest)
+		return
+	}
+
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	convos, _ := h.conversations.ListSpam(r.Context(), mb.ID, 100, 0)
+
+	h.render.Render(w, r, "mailbox_spam.html", map[string]interface{}{
+		"User":          user,
+		"Mailbox":       mb,
+		"Conversations": convos,
+	})
+}
+
 func (h *MailboxHandler) HandleDeleteMailbox(w http.ResponseWriter, r *http.Request) {
 	user := middleware.UserFromContext(r.Context())
 	if user == nil {
@@ -342,8 +926,16 @@ func (h *MailboxHandler) HandleAddStream(w http.ResponseWriter, r *http.Request)
 	address := r.FormValue("address")
 
 	var widgetID uuid.UUID
-	if streamType == "form" {
+	switch streamType {
+	case "form":
 		widgetID = uuid.New()
+	case "email":
+		address, err = h.mailboxes.StreamAddress(r.Context(), mb, address)
+		if err != nil {
+			setFlashError(w, "Invalid stream address: "+err.Error(), h.secureCookies)
+			http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+			return
+		}
 	}
 
 	if _, err := h.streams.CreateStream(r.Context(), mb.ID, streamType, address, widgetID); err != nil {
@@ -354,6 +946,89 @@ func (h *MailboxHandler) HandleAddStream(w http.ResponseWriter, r *http.Request)
 	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
 }
 
+func (h *MailboxHandler) HandleUpdateStreamSettings(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	sid, err := strconv.ParseInt(chi.URLParam(r, "sid"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid stream id", http.StatusBadRequest)
+		return
+	}
+	stream := h.mailboxStream(r, sid, mb.ID)
+	if stream == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	maxMB, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("max_attachment_mb")), 64)
+	if err != nil || maxMB < 0 {
+		setFlashError(w, "Attachment size limit must be a non-negative number of megabytes.", h.secureCookies)
+		http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+		return
+	}
+
+	maxMessageMB, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("max_message_mb")), 64)
+	if err != nil || maxMessageMB < 0 {
+		setFlashError(w, "Message size limit must be a non-negative number of megabytes.", h.secureCookies)
+		http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+		return
+	}
+
+	policy := models.AuthPolicy(r.FormValue("auth_policy"))
+	switch policy {
+	case models.AuthPolicyAccept, models.AuthPolicyQuarantine, models.AuthPolicyReject:
+	default:
+		setFlashError(w, "Unknown authentication policy.", h.secureCookies)
+		http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+		return
+	}
+
+	stream.MaxAttachmentBytes = int64(maxMB * 1024 * 1024)
+	stream.MaxMessageBytes = int64(maxMessageMB * 1024 * 1024)
+	stream.AllowedAttachmentTypes = strings.TrimSpace(r.FormValue("allowed_attachment_types"))
+	stream.AuthPolicy = policy
+
+	if err := h.streams.UpdateStreamSettings(r.Context(), stream); err != nil {
+		slog.Error("failed to update stream settings", "stream_id", sid, "error", err)
+		setFlashError(w, "Failed to update stream settings.", h.secureCookies)
+	} else {
+		setFlashSuccess(w, "Stream settings updated.", h.secureCookies)
+	}
+
+	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+}
+
+// mailboxStream returns the stream with the given ID if it belongs to the
+// mailbox, or nil.
+func (h *MailboxHandler) mailboxStream(r *http.Request, streamID, mailboxID int64) *models.Stream {
+	streams, err := h.streams.GetStreamsByMailboxID(r.Context(), mailboxID)
+	if err != nil {
+		return nil
+	}
+	for i := range streams {
+		if streams[i].ID == streamID {
+			return &streams[i]
+		}
+	}
+	return nil
+}
+
 func (h *MailboxHandler) HandleDeleteStream(w http.ResponseWriter, r *http.Request) {
 	user := middleware.UserFromContext(r.Context())
 	if user == nil {
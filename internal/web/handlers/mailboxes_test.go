@@ -0,0 +1,24 @@
+package handlers
+
+import "testing"
+
+func TestDownloadContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"application/pdf", "application/pdf"},
+		{"IMAGE/PNG; name=scan.png", "image/png"},
+		{"text/plain; charset=utf-8", "text/plain"},
+		{"text/html", "application/octet-stream"},
+		{"image/svg+xml", "application/octet-stream"},
+		{"application/xhtml+xml", "application/octet-stream"},
+		{"", "application/octet-stream"},
+		{"not a type", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := downloadContentType(tt.contentType); got != tt.want {
+			t.Errorf("downloadContentType(%q) = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/mailbox"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/notify"
+	"github.com/znz-systems/deaddrop/internal/web/middleware"
+	"github.com/znz-systems/deaddrop/internal/web/render"
+)
+
+const notificationSettingsURL = "/settings/notifications"
+
+// NotificationHandler serves the notification settings.
+type NotificationHandler struct {
+	notifications *notify.Service
+	mailboxes     *mailbox.Service
+	render        *render.Renderer
+	secureCookies bool
+}
+
+// NewNotificationHandler creates a new NotificationHandler.
+func NewNotificationHandler(notifications *notify.Service, mailboxes *mailbox.Service, r *render.Renderer, secureCookies bool) *NotificationHandler {
+	return &NotificationHandler{
+		notifications: notifications,
+		mailboxes:     mailboxes,
+		render:        r,
+		secureCookies: secureCookies,
+	}
+}
+
+// ShowSettings renders the user's notification defaults and the settings
+// of each of their mailboxes.
+func (h *NotificationHandler) ShowSettings(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	settings, err := h.notifications.Settings(r.Context(), user.ID)
+	if err != nil {
+		slog.Error("failed to load notification settings", "user_id", user.ID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	mailboxes, err := h.mailboxes.List(r.Context(), user.ID)
+	if err != nil {
+		slog.Error("failed to list mailboxes", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	type mailboxSettings struct {
+		Mailbox  models.Mailbox
+		Settings *models.NotificationSettings // nil if the defaults apply
+	}
+	items := make([]mailboxSettings, 0, len(mailboxes))
+	for _, mb := range mailboxes {
+		item := mailboxSettings{Mailbox: mb}
+		if n, ok := settings.Mailboxes[mb.ID]; ok {
+			item.Settings = &n
+		}
+		items = append(items, item)
+	}
+
+	h.render.Render(w, r, "notification_settings.html", map[string]interface{}{
+		"User":       user,
+		"Defaults":   settings.Defaults,
+		"QuietStart": formatMinutes(settings.Defaults.QuietStart),
+		"QuietEnd":   formatMinutes(settings.Defaults.QuietEnd),
+		"Mailboxes":  items,
+	})
+}
+
+// HandleSaveDefaults saves the user's notification defaults.
+func (h *NotificationHandler) HandleSaveDefaults(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	quietStart, errStart := parseMinutes(r.FormValue("quiet_start"))
+	quietEnd, errEnd := parseMinutes(r.FormValue("quiet_end"))
+	if errStart != nil || errEnd != nil {
+		setFlashError(w, "Quiet hours must be times of day.", h.secureCookies)
+		http.Redirect(w, r, notificationSettingsURL, http.StatusSeeOther)
+		return
+	}
+
+	err := h.notifications.Save(r.Context(), &models.NotificationSettings{
+		UserID:     user.ID,
+		Mode:       models.NotifyMode(r.FormValue("mode")),
+		Replies:    r.FormValue("replies") == "on",
+		QuietStart: quietStart,
+		QuietEnd:   quietEnd,
+		Timezone:   r.FormValue("timezone"),
+	})
+	if err != nil {
+		h.saveFailed(w, r, err)
+		return
+	}
+	setFlashSuccess(w, "Notification settings saved.", h.secureCookies)
+	http.Redirect(w, r, notificationSettingsURL, http.StatusSeeOther)
+}
+
+// HandleSaveMailbox saves the notification settings of a mailbox, or
+// removes them so that the defaults apply if no mode is chosen.
+func (h *NotificationHandler) HandleSaveMailbox(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid mailbox id", http.StatusBadRequest)
+		return
+	}
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	mode := r.FormValue("mode")
+	if mode == "" {
+		err = h.notifications.ResetMailbox(r.Context(), user.ID, mb.ID)
+	} else {
+		err = h.notifications.Save(r.Context(), &models.NotificationSettings{
+			UserID:    user.ID,
+			MailboxID: mb.ID,
+			Mode:      models.NotifyMode(mode),
+			Replies:   r.FormValue("replies") == "on",
+		})
+	}
+	if err != nil {
+		h.saveFailed(w, r, err)
+		return
+	}
+	setFlashSuccess(w, fmt.Sprintf("Notification settings for %s saved.", mb.Name), h.secureCookies)
+	http.Redirect(w, r, notificationSettingsURL, http.StatusSeeOther)
+}
+
+func (h *NotificationHandler) saveFailed(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, notify.ErrInvalidMode):
+		setFlashError(w, "Unknown notification mode.", h.secureCookies)
+	case errors.Is(err, notify.ErrInvalidTimezone):
+		setFlashError(w, "Unknown time zone. Use a name such as Europe/Berlin.", h.secureCookies)
+	case errors.Is(err, notify.ErrInvalidQuietHours):
+		setFlashError(w, "Quiet hours must be times of day.", h.secureCookies)
+	default:
+		slog.Error("failed to save notification settings", "error", err)
+		setFlashError(w, "Failed to save notification settings.", h.secureCookies)
+	}
+	http.Redirect(w, r, notificationSettingsURL, http.StatusSeeOther)
+}
+
+// formatMinutes formats minutes after midnight as the value of a time
+// input.
+func formatMinutes(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// parseMinutes parses the value of a time input as minutes after midnight;
+// an empty value is midnight.
+func parseMinutes(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
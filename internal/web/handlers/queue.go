@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/inbound"
+	"github.com/znz-systems/deaddrop/internal/web/middleware"
+)
+
+// ShowQueue lists the mailbox's inbound messages that failed to be filed:
+// those waiting for another attempt and the dead letters.
+func (h *MailboxHandler) ShowQueue(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid mailbox id", http.StatusBadRequest)
+		return
+	}
+
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	jobs, err := h.queue.Failed(r.Context(), mb.ID)
+	if err != nil {
+		slog.Error("failed to list queued inbound email", "mailbox_id", mb.ID, "error", err)
+	}
+
+	h.render.Render(w, r, "mailbox_queue.html", map[string]interface{}{
+		"User":    user,
+		"Mailbox": mb,
+		"Jobs":    jobs,
+	})
+}
+
+// HandleRetryQueued tries a failed message again right away.
+func (h *MailboxHandler) HandleRetryQueued(w http.ResponseWriter, r *http.Request) {
+	h.updateQueued(w, r, "Message queued for another attempt.", func(mailboxID, jobID int64) error {
+		return h.queue.Retry(r.Context(), mailboxID, jobID)
+	})
+}
+
+// HandleDeleteQueued gives up on a failed message.
+func (h *MailboxHandler) HandleDeleteQueued(w http.ResponseWriter, r *http.Request) {
+	h.updateQueued(w, r, "Message deleted.", func(mailboxID, jobID int64) error {
+		return h.queue.Delete(r.Context(), mailboxID, jobID)
+	})
+}
+
+// updateQueued checks the mailbox and queued message in the URL and runs
+// update on them.
+func (h *MailboxHandler) updateQueued(w http.ResponseWriter, r *http.Request, success string, update func(mailboxID, jobID int64) error) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	jobID, err := strconv.ParseInt(chi.URLParam(r, "qid"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid queue id", http.StatusBadRequest)
+		return
+	}
+
+	if err := update(mb.ID, jobID); err != nil {
+		if errors.Is(err, inbound.ErrJobNotFound) {
+			setFlashError(w, "That message is no longer waiting in the queue.", h.secureCookies)
+		} else {
+			slog.Error("failed to update queued inbound email", "job_id", jobID, "error", err)
+			setFlashError(w, "Failed to update queued message.", h.secureCookies)
+		}
+	} else {
+		setFlashSuccess(w, success, h.secureCookies)
+	}
+	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String()+"/queue", http.StatusSeeOther)
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/znz-systems/deaddrop/internal/filter"
+	"github.com/znz-systems/deaddrop/internal/models"
+	"github.com/znz-systems/deaddrop/internal/web/middleware"
+)
+
+const (
+	// ruleFormRows is how many condition and action rows the new rule form
+	// has.
+	ruleFormRows = 3
+
+	// dryRunLimit is how many recent conversations the rule tester runs
+	// against.
+	dryRunLimit = 50
+)
+
+// ruleRows numbers the rows of the new rule form for the template.
+func ruleRows() []int {
+	rows := make([]int, ruleFormRows)
+	for i := range rows {
+		rows[i] = i
+	}
+	return rows
+}
+
+// HandleCreateRule adds a filter rule from the form on the mailbox page.
+func (h *MailboxHandler) HandleCreateRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	rule := ruleFromForm(r)
+	if err := h.filters.Create(r.Context(), mb, rule); err != nil {
+		setFlashError(w, "Invalid rule: "+err.Error(), h.secureCookies)
+	} else {
+		setFlashSuccess(w, "Rule added.", h.secureCookies)
+	}
+	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+}
+
+// ruleFromForm reads a rule from the new rule form. Condition and action
+// rows left on "none" are skipped.
+func ruleFromForm(r *http.Request) *models.FilterRule {
+	rule := &models.FilterRule{
+		Name:     r.FormValue("name"),
+		MatchAll: r.FormValue("match") != "any",
+		Stop:     r.FormValue("stop") == "on",
+	}
+	for i := 0; i < ruleFormRows; i++ {
+		n := strconv.Itoa(i)
+		if field := r.FormValue("cond_field_" + n); field != "" {
+			rule.Conditions = append(rule.Conditions, models.FilterCondition{
+				Field:  models.FilterField(field),
+				Header: r.FormValue("cond_header_" + n),
+				Op:     models.FilterOp(r.FormValue("cond_op_" + n)),
+				Value:  r.FormValue("cond_value_" + n),
+				Not:    r.FormValue("cond_not_"+n) == "on",
+			})
+		}
+	}
+	for i := 0; i < ruleFormRows; i++ {
+		n := strconv.Itoa(i)
+		if typ := r.FormValue("action_type_" + n); typ != "" {
+			rule.Actions = append(rule.Actions, models.FilterAction{
+				Type:  models.FilterActionType(typ),
+				Value: r.FormValue("action_value_" + n),
+			})
+		}
+	}
+	if target := r.FormValue("move_to"); target != "" {
+		rule.Actions = append(rule.Actions, models.FilterAction{Type: models.FilterMove, Value: target})
+	}
+	return rule
+}
+
+// HandleToggleRule enables or disables a rule.
+func (h *MailboxHandler) HandleToggleRule(w http.ResponseWriter, r *http.Request) {
+	h.updateRule(w, r, func(mailboxID, ruleID int64) error {
+		return h.filters.SetEnabled(r.Context(), mailboxID, ruleID, r.FormValue("enabled") == "true")
+	})
+}
+
+// HandleMoveRule moves a rule up or down in the run order.
+func (h *MailboxHandler) HandleMoveRule(w http.ResponseWriter, r *http.Request) {
+	h.updateRule(w, r, func(mailboxID, ruleID int64) error {
+		return h.filters.Move(r.Context(), mailboxID, ruleID, r.FormValue("direction") == "up")
+	})
+}
+
+// HandleDeleteRule deletes a rule.
+func (h *MailboxHandler) HandleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	h.updateRule(w, r, func(mailboxID, ruleID int64) error {
+		return h.filters.Delete(r.Context(), mailboxID, ruleID)
+	})
+}
+
+// updateRule checks the mailbox and rule in the URL and runs update on them.
+func (h *MailboxHandler) updateRule(w http.ResponseWriter, r *http.Request, update func(mailboxID, ruleID int64) error) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, _ := uuid.Parse(chi.URLParam(r, "id"))
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	ruleID, err := strconv.ParseInt(chi.URLParam(r, "rid"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid rule id", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if err := update(mb.ID, ruleID); err != nil {
+		if errors.Is(err, filter.ErrRuleNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		slog.Error("failed to update rule", "rule_id", ruleID, "error", err)
+		setFlashError(w, "Failed to update rule.", h.secureCookies)
+	}
+	http.Redirect(w, r, "/mailboxes/"+mb.PublicID.String(), http.StatusSeeOther)
+}
+
+// ShowRuleTest shows what the mailbox's rules would do with its recent
+// conversations, without changing anything.
+func (h *MailboxHandler) ShowRuleTest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.UserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	publicID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid mailbox id", http.StatusBadRequest)
+		return
+	}
+
+	mb, err := h.mailboxes.GetByPublicID(r.Context(), publicID)
+	if err != nil || mb.UserID != user.ID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	results, err := h.filters.DryRun(r.Context(), mb.ID, dryRunLimit)
+	if err != nil {
+		slog.Error("failed to dry-run rules", "mailbox_id", mb.ID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	matched := 0
+	for _, res := range results {
+		if len(res.Result.Matched) > 0 {
+			matched++
+		}
+	}
+
+	h.render.Render(w, r, "mailbox_rule_test.html", map[string]interface{}{
+		"User":         user,
+		"Mailbox":      mb,
+		"Results":      results,
+		"Matched":      matched,
+		"MailboxNames": h.mailboxNames(r, user.ID),
+	})
+}
+
+// mailboxNames maps the public IDs of the user's mailboxes to their names,
+// for showing the targets of move actions.
+func (h *MailboxHandler) mailboxNames(r *http.Request, userID int64) map[string]string {
+	mailboxes, err := h.mailboxes.List(r.Context(), userID)
+	if err != nil {
+		return nil
+	}
+	names := make(map[string]string, len(mailboxes))
+	for _, mb := range mailboxes {
+		names[mb.PublicID.String()] = mb.Name
+	}
+	return names
+}
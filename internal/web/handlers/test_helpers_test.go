@@ -98,6 +98,17 @@ func (m *mockDomainStore) GetDomainByName(_ context.Context, _ string) (*models.
 }
 func (m *mockDomainStore) MarkDomainVerified(_ context.Context, _ int64) error { return nil }
 func (m *mockDomainStore) DeleteDomain(_ context.Context, _ int64) error       { return nil }
+func (m *mockDomainStore) SetOutboundTransport(_ context.Context, id int64, transport models.OutboundTransport) error {
+	for _, d := range m.domains {
+		if d.ID == id {
+			d.OutboundTransport = transport
+		}
+	}
+	return nil
+}
+func (m *mockDomainStore) GetOutboundTransportByName(_ context.Context, _ string) (models.OutboundTransport, error) {
+	return "", errors.New("not implemented")
+}
 
 type mockNotifier struct {
 	called atomic.Int32
@@ -1,11 +1,13 @@
 package render
 
 import (
+	"fmt"
 	"html/template"
 	"io/fs"
 	"log/slog"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -45,7 +47,7 @@ func NewRenderer(fsys fs.FS) *Renderer {
 		files = append(files, partials...)
 		files = append(files, page)
 
-		tmpl, err := template.New("").ParseFS(fsys, files...)
+		tmpl, err := template.New("").Funcs(funcs).ParseFS(fsys, files...)
 		if err != nil {
 			slog.Error("failed to parse template", "page", name, "error", err)
 			continue
@@ -93,12 +95,38 @@ func (r *Renderer) Render(w http.ResponseWriter, req *http.Request, tmpl string,
 	}
 }
 
+var funcs = template.FuncMap{
+	"formatBytes": formatBytes,
+	"megabytes":   megabytes,
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 MB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// megabytes converts a byte count to megabytes for form inputs.
+func megabytes(n int64) string {
+	return strconv.FormatFloat(float64(n)/(1024*1024), 'f', -1, 64)
+}
+
 func activeNav(path string) string {
 	switch {
 	case path == "/" || strings.HasPrefix(path, "/domains"):
 		return "domains"
 	case strings.HasPrefix(path, "/mailboxes"):
 		return "mailboxes"
+	case strings.HasPrefix(path, "/settings"):
+		return "settings"
 	default:
 		return ""
 	}
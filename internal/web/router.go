@@ -17,17 +17,19 @@ import (
 
 // RouterDeps holds all dependencies needed to build the router.
 type RouterDeps struct {
-	AuthHandler    *handlers.AuthHandler
-	DomainHandler  *handlers.DomainHandler
-	MessageHandler *handlers.MessageHandler
-	APIHandler     *handlers.APIHandler
-	MailboxHandler *handlers.MailboxHandler
-	AuthService    *auth.Service
-	Renderer       *render.Renderer
-	Limiter        *ratelimit.Limiter
-	StaticFS       fs.FS
-	SecureCookies  bool
-	DB             interface{ PingContext(ctx context.Context) error }
+	AuthHandler         *handlers.AuthHandler
+	DomainHandler       *handlers.DomainHandler
+	MessageHandler      *handlers.MessageHandler
+	APIHandler          *handlers.APIHandler
+	MailboxHandler      *handlers.MailboxHandler
+	NotificationHandler *handlers.NotificationHandler
+	ChannelHandler      *handlers.ChannelHandler
+	AuthService         *auth.Service
+	Renderer            *render.Renderer
+	Limiter             *ratelimit.Limiter
+	StaticFS            fs.FS
+	SecureCookies       bool
+	DB                  interface{ PingContext(ctx context.Context) error }
 }
 
 // NewRouter wires all routes into a Chi router.
@@ -74,6 +76,10 @@ func NewRouter(deps RouterDeps) *chi.Mux {
 		r.Get("/domains/{id}", deps.DomainHandler.ShowDomainDetail)
 		r.Post("/domains/{id}/verify", deps.DomainHandler.HandleVerifyDomain)
 		r.Post("/domains/{id}/delete", deps.DomainHandler.HandleDeleteDomain)
+		r.Post("/domains/{id}/transport", deps.DomainHandler.HandleSetOutboundTransport)
+		r.Post("/domains/{id}/dkim/check", deps.DomainHandler.HandleCheckDKIM)
+		r.Post("/domains/{id}/dkim/rotate", deps.DomainHandler.HandleRotateDKIM)
+		r.Post("/domains/{id}/dkim/{kid}/delete", deps.DomainHandler.HandleDeleteDKIMKey)
 
 		r.Post("/messages/{messageID}/read", deps.MessageHandler.HandleMarkRead)
 		r.Delete("/messages/{messageID}", deps.MessageHandler.HandleDeleteMessage)
@@ -85,10 +91,37 @@ func NewRouter(deps RouterDeps) *chi.Mux {
 		r.Get("/mailboxes/{id}", deps.MailboxHandler.ShowMailboxDetail)
 		r.Post("/mailboxes/{id}/delete", deps.MailboxHandler.HandleDeleteMailbox)
 		r.Post("/mailboxes/{id}/streams", deps.MailboxHandler.HandleAddStream)
+		r.Post("/mailboxes/{id}/streams/{sid}/settings", deps.MailboxHandler.HandleUpdateStreamSettings)
 		r.Post("/mailboxes/{id}/streams/{sid}/delete", deps.MailboxHandler.HandleDeleteStream)
+		r.Get("/mailboxes/{id}/spam", deps.MailboxHandler.ShowSpam)
+		r.Get("/mailboxes/{id}/queue", deps.MailboxHandler.ShowQueue)
+		r.Post("/mailboxes/{id}/queue/{qid}/retry", deps.MailboxHandler.HandleRetryQueued)
+		r.Post("/mailboxes/{id}/queue/{qid}/delete", deps.MailboxHandler.HandleDeleteQueued)
+		r.Get("/mailboxes/{id}/channels", deps.ChannelHandler.ShowChannels)
+		r.Post("/mailboxes/{id}/channels", deps.ChannelHandler.HandleCreateChannel)
+		r.Post("/mailboxes/{id}/channels/{chid}/test", deps.ChannelHandler.HandleTestChannel)
+		r.Post("/mailboxes/{id}/channels/{chid}/toggle", deps.ChannelHandler.HandleToggleChannel)
+		r.Post("/mailboxes/{id}/channels/{chid}/delete", deps.ChannelHandler.HandleDeleteChannel)
+		r.Post("/mailboxes/{id}/rules", deps.MailboxHandler.HandleCreateRule)
+		r.Get("/mailboxes/{id}/rules/test", deps.MailboxHandler.ShowRuleTest)
+		r.Post("/mailboxes/{id}/rules/{rid}/toggle", deps.MailboxHandler.HandleToggleRule)
+		r.Post("/mailboxes/{id}/rules/{rid}/move", deps.MailboxHandler.HandleMoveRule)
+		r.Post("/mailboxes/{id}/rules/{rid}/delete", deps.MailboxHandler.HandleDeleteRule)
 		r.Get("/mailboxes/{id}/conversations/{cid}", deps.MailboxHandler.ShowConversation)
+		r.Get("/mailboxes/{id}/conversations/{cid}/attachments/{aid}", deps.MailboxHandler.HandleDownloadAttachment)
+		r.Get("/mailboxes/{id}/conversations/{cid}/messages/{mid}/raw", deps.MailboxHandler.HandleRawMessage)
+		r.Get("/mailboxes/{id}/conversations/{cid}/messages/{mid}/html", deps.MailboxHandler.HandleMessageHTML)
+		r.Post("/mailboxes/{id}/conversations/{cid}/messages/{mid}/retry", deps.MailboxHandler.HandleRetryDelivery)
 		r.Post("/mailboxes/{id}/conversations/{cid}/reply", deps.MailboxHandler.HandleReply)
 		r.Post("/mailboxes/{id}/conversations/{cid}/close", deps.MailboxHandler.HandleCloseConversation)
+		r.Post("/mailboxes/{id}/conversations/{cid}/release", deps.MailboxHandler.HandleReleaseConversation)
+		r.Post("/mailboxes/{id}/conversations/{cid}/spam", deps.MailboxHandler.HandleMarkSpam)
+		r.Post("/mailboxes/{id}/conversations/{cid}/not-spam", deps.MailboxHandler.HandleMarkNotSpam)
+
+		// Settings routes
+		r.Get("/settings/notifications", deps.NotificationHandler.ShowSettings)
+		r.Post("/settings/notifications", deps.NotificationHandler.HandleSaveDefaults)
+		r.Post("/settings/notifications/mailboxes/{id}", deps.NotificationHandler.HandleSaveMailbox)
 	})
 
 	// Public widget API (CORS, rate limited, no CSRF)
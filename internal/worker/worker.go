@@ -0,0 +1,58 @@
+// Package worker drains the durable queues: inbound mail waiting to be
+// filed, outbound mail waiting for the relay and events waiting for a
+// notification channel. Each queue claims one due job at a time under a
+// lease and reschedules a failed one with exponential backoff; this package
+// holds the parts they share.
+package worker
+
+import (
+	"context"
+	"time"
+)
+
+// PollInterval is how often an idle worker looks for jobs that became due
+// without anyone signalling it, such as retries.
+const PollInterval = 5 * time.Second
+
+// Backoff is a retry schedule: the first retry waits Base and each further
+// one twice as long as the one before, up to Max.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns how long to wait before the next attempt after the given
+// number of failed ones.
+func (b Backoff) Delay(attempts int) time.Duration {
+	d := b.Base
+	for i := 1; i < attempts && d < b.Max; i++ {
+		d *= 2
+	}
+	return min(d, b.Max)
+}
+
+// Run calls next until ctx is cancelled. next processes one due job and
+// reports whether there was one; when there was none, Run waits for a
+// signal on wake or for PollInterval.
+func Run(ctx context.Context, wake <-chan struct{}, next func(context.Context) bool) {
+	for {
+		if next(ctx) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// Signal wakes a worker waiting in Run on wake, if there is one. wake
+// should be buffered so the signal is kept while every worker is busy.
+func Signal(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
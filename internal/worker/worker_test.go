@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: time.Minute, Max: 2 * time.Hour}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{7, 64 * time.Minute},
+		{8, 2 * time.Hour},
+		{30, 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := b.Delay(tt.attempts); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRun_DrainsThenWaitsForSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wake := make(chan struct{}, 1)
+	jobs := make(chan int, 10)
+	for i := range 3 {
+		jobs <- i
+	}
+	done := make(chan int)
+	go func() {
+		Run(ctx, wake, func(context.Context) bool {
+			select {
+			case j := <-jobs:
+				done <- j
+				return true
+			default:
+				return false
+			}
+		})
+		close(done)
+	}()
+
+	for i := range 3 {
+		if j := <-done; j != i {
+			t.Fatalf("expected job %d, got %d", i, j)
+		}
+	}
+	jobs <- 3
+	Signal(wake)
+	select {
+	case j := <-done:
+		if j != 3 {
+			t.Fatalf("expected job 3, got %d", j)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected signal to wake the worker before the poll interval")
+	}
+
+	cancel()
+	if _, ok := <-done; ok {
+		t.Error("expected Run to return when ctx is cancelled")
+	}
+}
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_conv_messages_message_id;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS message_id;
@@ -0,0 +1,3 @@
+ALTER TABLE conversation_messages ADD COLUMN message_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_conv_messages_message_id ON conversation_messages(message_id) WHERE message_id != '';
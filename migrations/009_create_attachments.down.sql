@@ -0,0 +1,3 @@
+ALTER TABLE streams DROP COLUMN IF EXISTS allowed_attachment_types;
+ALTER TABLE streams DROP COLUMN IF EXISTS max_attachment_bytes;
+DROP TABLE IF EXISTS attachments;
@@ -0,0 +1,15 @@
+CREATE TABLE attachments (
+    id                      BIGSERIAL PRIMARY KEY,
+    public_id               UUID NOT NULL UNIQUE,
+    conversation_message_id BIGINT NOT NULL REFERENCES conversation_messages(id) ON DELETE CASCADE,
+    filename                TEXT NOT NULL DEFAULT '',
+    content_type            TEXT NOT NULL DEFAULT 'application/octet-stream',
+    size_bytes              BIGINT NOT NULL DEFAULT 0,
+    storage_key             TEXT NOT NULL,
+    created_at              TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_attachments_message ON attachments(conversation_message_id);
+
+ALTER TABLE streams ADD COLUMN max_attachment_bytes BIGINT NOT NULL DEFAULT 10485760;
+ALTER TABLE streams ADD COLUMN allowed_attachment_types TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE conversation_messages ADD COLUMN raw_key TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE conversation_messages ADD COLUMN tls TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+UPDATE conversations SET status = 'open' WHERE status = 'quarantined';
+ALTER TABLE conversations DROP CONSTRAINT IF EXISTS conversations_status_check;
+ALTER TABLE conversations ADD CONSTRAINT conversations_status_check
+    CHECK (status IN ('open', 'closed'));
+
+ALTER TABLE streams DROP COLUMN IF EXISTS auth_policy;
+
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS auth_verdict;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS auth_results;
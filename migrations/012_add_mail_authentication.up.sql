@@ -0,0 +1,9 @@
+ALTER TABLE conversation_messages ADD COLUMN auth_results TEXT NOT NULL DEFAULT '';
+ALTER TABLE conversation_messages ADD COLUMN auth_verdict TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE streams ADD COLUMN auth_policy TEXT NOT NULL DEFAULT 'accept'
+    CHECK (auth_policy IN ('accept', 'quarantine', 'reject'));
+
+ALTER TABLE conversations DROP CONSTRAINT IF EXISTS conversations_status_check;
+ALTER TABLE conversations ADD CONSTRAINT conversations_status_check
+    CHECK (status IN ('open', 'closed', 'quarantined'));
@@ -0,0 +1,3 @@
+ALTER TABLE conversations DROP COLUMN IF EXISTS recipient;
+
+DROP INDEX IF EXISTS idx_streams_email_domain;
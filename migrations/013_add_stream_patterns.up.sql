@@ -0,0 +1,8 @@
+-- Email streams have no widget; store NULL so several email streams can
+-- coexist under the unique widget_id constraint.
+UPDATE streams SET widget_id = NULL WHERE type = 'email';
+
+CREATE INDEX idx_streams_email_domain ON streams (lower(substring(address from '@([^@]*)$')))
+    WHERE type = 'email';
+
+ALTER TABLE conversations ADD COLUMN recipient TEXT NOT NULL DEFAULT '';
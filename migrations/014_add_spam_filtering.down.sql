@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS spam_training;
+DROP TABLE IF EXISTS spam_tokens;
+
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS spam_rules;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS spam_score;
+
+DROP INDEX IF EXISTS idx_conversations_spam;
+ALTER TABLE conversations DROP COLUMN IF EXISTS spam_label;
+
+UPDATE conversations SET status = 'quarantined' WHERE status = 'spam';
+ALTER TABLE conversations DROP CONSTRAINT IF EXISTS conversations_status_check;
+ALTER TABLE conversations ADD CONSTRAINT conversations_status_check
+    CHECK (status IN ('open', 'closed', 'quarantined'));
@@ -0,0 +1,27 @@
+ALTER TABLE conversations DROP CONSTRAINT IF EXISTS conversations_status_check;
+ALTER TABLE conversations ADD CONSTRAINT conversations_status_check
+    CHECK (status IN ('open', 'closed', 'quarantined', 'spam'));
+
+-- spam_label records how the user last trained the filter with this
+-- conversation, so that changing their mind can undo it.
+ALTER TABLE conversations ADD COLUMN spam_label TEXT NOT NULL DEFAULT ''
+    CHECK (spam_label IN ('', 'spam', 'ham'));
+
+CREATE INDEX idx_conversations_spam ON conversations(updated_at) WHERE status = 'spam';
+
+ALTER TABLE conversation_messages ADD COLUMN spam_score DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE conversation_messages ADD COLUMN spam_rules TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE spam_tokens (
+    user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token      TEXT NOT NULL,
+    spam_count INTEGER NOT NULL DEFAULT 0,
+    ham_count  INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, token)
+);
+
+CREATE TABLE spam_training (
+    user_id    BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    spam_count INTEGER NOT NULL DEFAULT 0,
+    ham_count  INTEGER NOT NULL DEFAULT 0
+);
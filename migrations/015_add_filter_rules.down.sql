@@ -0,0 +1,2 @@
+ALTER TABLE conversations DROP COLUMN IF EXISTS tags;
+DROP TABLE IF EXISTS filter_rules;
@@ -0,0 +1,18 @@
+-- Conditions and actions are small lists edited as a whole with the rule,
+-- so they are kept as JSON rather than in tables of their own.
+CREATE TABLE filter_rules (
+    id          BIGSERIAL PRIMARY KEY,
+    mailbox_id  BIGINT NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+    position    INTEGER NOT NULL,
+    name        TEXT NOT NULL,
+    match_all   BOOLEAN NOT NULL DEFAULT TRUE,
+    conditions  JSONB NOT NULL DEFAULT '[]',
+    actions     JSONB NOT NULL DEFAULT '[]',
+    stop        BOOLEAN NOT NULL DEFAULT FALSE,
+    enabled     BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_filter_rules_mailbox ON filter_rules(mailbox_id, position);
+
+ALTER TABLE conversations ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
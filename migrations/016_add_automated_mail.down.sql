@@ -0,0 +1,3 @@
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS bounce_reason;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS bounced_at;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS automated;
@@ -0,0 +1,7 @@
+-- automated records why an inbound message was recognised as machine
+-- generated: 'bounce', 'auto-reply' or 'bulk'; empty for everything else.
+ALTER TABLE conversation_messages ADD COLUMN automated TEXT NOT NULL DEFAULT '';
+
+-- Outbound messages a delivery status notification reported as failed.
+ALTER TABLE conversation_messages ADD COLUMN bounced_at TIMESTAMPTZ;
+ALTER TABLE conversation_messages ADD COLUMN bounce_reason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE attachments DROP COLUMN IF EXISTS content_id;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS body_html;
@@ -0,0 +1,8 @@
+-- body_html keeps the HTML rendition of an inbound email as received,
+-- converted to UTF-8 but not sanitised; it is sanitised when displayed.
+-- body remains the plain text rendition.
+ALTER TABLE conversation_messages ADD COLUMN body_html TEXT NOT NULL DEFAULT '';
+
+-- content_id is the Content-ID of an inline part, without angle brackets,
+-- for resolving cid: references in the HTML body.
+ALTER TABLE attachments ADD COLUMN content_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,31 @@
+-- inbound_queue holds accepted inbound email until it has been filed into
+-- its mailbox. Each row is one message for one mailbox; the source itself
+-- is in the raw message archive under raw_key. The SMTP session's results
+-- are kept so that the worker does not need the connection.
+--
+-- status is 'pending' or 'processing' while the message is being delivered
+-- and 'dead' once it has failed too often; dead rows stay until retried or
+-- deleted from the dashboard.
+CREATE TABLE inbound_queue (
+    id              BIGSERIAL PRIMARY KEY,
+    mailbox_id      BIGINT NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+    stream_id       BIGINT NOT NULL REFERENCES streams(id) ON DELETE CASCADE,
+    recipient       TEXT NOT NULL,
+    reply_token     TEXT NOT NULL DEFAULT '',
+    envelope_from   TEXT NOT NULL DEFAULT '',
+    raw_key         TEXT NOT NULL,
+    remote_ip       TEXT NOT NULL DEFAULT '',
+    tls             TEXT NOT NULL DEFAULT '',
+    auth_results    TEXT NOT NULL DEFAULT '',
+    auth_verdict    TEXT NOT NULL DEFAULT '',
+    quarantine      BOOLEAN NOT NULL DEFAULT FALSE,
+    status          TEXT NOT NULL DEFAULT 'pending',
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_inbound_queue_due ON inbound_queue(next_attempt_at) WHERE status <> 'dead';
+CREATE INDEX idx_inbound_queue_mailbox ON inbound_queue(mailbox_id);
@@ -0,0 +1,3 @@
+-- max_message_bytes limits the size of inbound email to the stream, below
+-- the server-wide limit; 0 applies only the server's.
+ALTER TABLE streams ADD COLUMN max_message_bytes BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,14 @@
+-- greylist remembers (client network, sender, recipient) triplets of inbound
+-- delivery attempts. A triplet is let through once first_seen is older than
+-- the greylisting delay; rows not seen for a while are pruned.
+CREATE TABLE greylist (
+    network    TEXT NOT NULL,
+    sender     TEXT NOT NULL,
+    recipient  TEXT NOT NULL,
+    first_seen TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_seen  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    attempts   INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (network, sender, recipient)
+);
+
+CREATE INDEX idx_greylist_last_seen ON greylist(last_seen);
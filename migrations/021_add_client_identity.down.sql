@@ -0,0 +1,3 @@
+ALTER TABLE inbound_queue DROP COLUMN IF EXISTS helo;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS helo;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS remote_ip;
@@ -0,0 +1,5 @@
+-- The real client address and HELO name of inbound email, as seen through
+-- any trusted proxy.
+ALTER TABLE conversation_messages ADD COLUMN remote_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE conversation_messages ADD COLUMN helo TEXT NOT NULL DEFAULT '';
+ALTER TABLE inbound_queue ADD COLUMN helo TEXT NOT NULL DEFAULT '';
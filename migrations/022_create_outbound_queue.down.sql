@@ -0,0 +1,3 @@
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS delivery_error;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS delivery_status;
+DROP TABLE IF EXISTS outbound_queue;
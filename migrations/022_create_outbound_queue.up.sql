@@ -0,0 +1,37 @@
+-- outbound_queue holds outbound email until the mail transport has accepted
+-- it. Each row is one email, composed as it will be sent, so a retry sends
+-- the same message with the same Message-ID. Replies point at the
+-- conversation message they deliver; forwards have none.
+--
+-- status is 'pending' or 'processing' while the email is being delivered
+-- and 'failed' once it was rejected or failed too often; failed rows stay
+-- until retried from the conversation. Delivered rows are deleted.
+CREATE TABLE outbound_queue (
+    id                      BIGSERIAL PRIMARY KEY,
+    conversation_message_id BIGINT UNIQUE REFERENCES conversation_messages(id) ON DELETE CASCADE,
+    to_address              TEXT NOT NULL,
+    from_address            TEXT NOT NULL,
+    from_name               TEXT NOT NULL DEFAULT '',
+    reply_to                TEXT NOT NULL DEFAULT '',
+    subject                 TEXT NOT NULL DEFAULT '',
+    body                    TEXT NOT NULL DEFAULT '',
+    message_id              TEXT NOT NULL DEFAULT '',
+    auto_submitted          TEXT NOT NULL DEFAULT '',
+    status                  TEXT NOT NULL DEFAULT 'pending',
+    attempts                INTEGER NOT NULL DEFAULT 0,
+    last_error              TEXT NOT NULL DEFAULT '',
+    next_attempt_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until            TIMESTAMPTZ,
+    created_at              TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_outbound_queue_due ON outbound_queue(next_attempt_at) WHERE status <> 'failed';
+
+-- delivery_status is one of queued, sent, deferred, failed or bounced for
+-- outbound messages and empty for inbound ones. Replies sent before the
+-- queue existed were sent inline.
+ALTER TABLE conversation_messages ADD COLUMN delivery_status TEXT NOT NULL DEFAULT '';
+ALTER TABLE conversation_messages ADD COLUMN delivery_error TEXT NOT NULL DEFAULT '';
+UPDATE conversation_messages
+   SET delivery_status = CASE WHEN bounced_at IS NULL THEN 'sent' ELSE 'bounced' END
+ WHERE direction = 'outbound';
@@ -0,0 +1,19 @@
+-- DKIM key pairs of verified domains. Each domain signs with one active
+-- RSA and one active Ed25519 key. A rotation adds a pending pair under new
+-- selectors, which takes over once its DNS records are found; the old
+-- pair is retired but kept, so its records can stay published while mail
+-- signed with it is still being delivered.
+CREATE TABLE dkim_keys (
+    id          BIGSERIAL PRIMARY KEY,
+    domain_id   BIGINT NOT NULL REFERENCES domains(id) ON DELETE CASCADE,
+    selector    TEXT NOT NULL,
+    algorithm   TEXT NOT NULL,
+    private_key BYTEA NOT NULL,
+    public_key  TEXT NOT NULL,
+    status      TEXT NOT NULL DEFAULT 'pending',
+    verified_at TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE(domain_id, selector)
+);
+
+CREATE INDEX idx_dkim_keys_domain_id ON dkim_keys(domain_id);
@@ -0,0 +1,4 @@
+-- How mail from the domain is delivered: through the configured relay
+-- ('relay'), straight to the recipient's MX ('direct'), or as the server
+-- is configured ('').
+ALTER TABLE domains ADD COLUMN outbound_transport TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE outbound_queue DROP COLUMN IF EXISTS message_references;
+ALTER TABLE outbound_queue DROP COLUMN IF EXISTS in_reply_to;
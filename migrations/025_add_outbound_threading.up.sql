@@ -0,0 +1,3 @@
+-- The In-Reply-To and References headers of queued replies.
+ALTER TABLE outbound_queue ADD COLUMN in_reply_to TEXT NOT NULL DEFAULT '';
+ALTER TABLE outbound_queue ADD COLUMN message_references TEXT NOT NULL DEFAULT '';
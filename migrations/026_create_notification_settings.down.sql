@@ -0,0 +1,3 @@
+ALTER TABLE conversations DROP COLUMN IF EXISTS read_at;
+DROP TABLE IF EXISTS pending_notifications;
+DROP TABLE IF EXISTS notification_settings;
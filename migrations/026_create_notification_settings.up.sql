@@ -0,0 +1,37 @@
+-- notification_settings decide how users hear about new conversations and
+-- replies. A row without mailbox_id holds a user's defaults; a row for a
+-- mailbox replaces their mode and replies for its mail. Quiet hours, in
+-- minutes after midnight in timezone, are taken from the defaults; equal
+-- start and end mean none.
+CREATE TABLE notification_settings (
+    id          BIGSERIAL PRIMARY KEY,
+    user_id     BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    mailbox_id  BIGINT REFERENCES mailboxes(id) ON DELETE CASCADE,
+    mode        TEXT NOT NULL DEFAULT 'instant',
+    replies     BOOLEAN NOT NULL DEFAULT FALSE,
+    quiet_start INTEGER NOT NULL DEFAULT 0,
+    quiet_end   INTEGER NOT NULL DEFAULT 0,
+    timezone    TEXT NOT NULL DEFAULT 'UTC',
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_notification_settings_user ON notification_settings(user_id) WHERE mailbox_id IS NULL;
+CREATE UNIQUE INDEX idx_notification_settings_mailbox ON notification_settings(mailbox_id) WHERE mailbox_id IS NOT NULL;
+
+-- pending_notifications are new conversations and replies waiting for a
+-- digest, or for quiet hours to end. Rows are deleted once their digest is
+-- sent, or skipped because the conversation was read in the meantime.
+CREATE TABLE pending_notifications (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    message_id      BIGINT NOT NULL REFERENCES conversation_messages(id) ON DELETE CASCADE,
+    reply           BOOLEAN NOT NULL DEFAULT FALSE,
+    due_at          TIMESTAMPTZ NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_pending_notifications_due ON pending_notifications(due_at);
+
+-- read_at is when the owner last opened the conversation.
+ALTER TABLE conversations ADD COLUMN read_at TIMESTAMPTZ;
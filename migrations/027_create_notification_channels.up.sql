@@ -0,0 +1,49 @@
+-- notification_channels are where a mailbox announces new conversations
+-- besides email: a generic webhook, a Slack or Mattermost incoming webhook,
+-- a Matrix room, or an ntfy or Gotify server. token is the secret each type
+-- needs, if any; room is only used by Matrix and template only by webhooks.
+-- A failed delivery is tried up to max_attempts times, waiting
+-- retry_seconds before the second attempt and twice as long each time
+-- after.
+CREATE TABLE notification_channels (
+    id            BIGSERIAL PRIMARY KEY,
+    public_id     UUID NOT NULL UNIQUE,
+    mailbox_id    BIGINT NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+    type          TEXT NOT NULL,
+    name          TEXT NOT NULL DEFAULT '',
+    url           TEXT NOT NULL,
+    token         TEXT NOT NULL DEFAULT '',
+    room          TEXT NOT NULL DEFAULT '',
+    template      TEXT NOT NULL DEFAULT '',
+    max_attempts  INTEGER NOT NULL DEFAULT 5,
+    retry_seconds INTEGER NOT NULL DEFAULT 60,
+    enabled       BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_notification_channels_mailbox ON notification_channels(mailbox_id);
+
+-- channel_deliveries queue the events sent to channels and, once sent or
+-- given up on, are their delivery log. event is the event as JSON, so that
+-- a retry sends what the first attempt did.
+--
+-- status is 'pending' or 'processing' while the event is being delivered,
+-- then 'delivered' or 'failed'. response_code is the HTTP status of the
+-- last attempt, 0 if there was no response.
+CREATE TABLE channel_deliveries (
+    id              BIGSERIAL PRIMARY KEY,
+    channel_id      BIGINT NOT NULL REFERENCES notification_channels(id) ON DELETE CASCADE,
+    event_type      TEXT NOT NULL,
+    event           JSONB NOT NULL,
+    status          TEXT NOT NULL DEFAULT 'pending',
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    response_code   INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until    TIMESTAMPTZ,
+    delivered_at    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_channel_deliveries_due ON channel_deliveries(next_attempt_at) WHERE status IN ('pending', 'processing');
+CREATE INDEX idx_channel_deliveries_channel ON channel_deliveries(channel_id, created_at DESC);
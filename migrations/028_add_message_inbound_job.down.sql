@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_conversation_messages_inbound_job;
+ALTER TABLE conversation_messages DROP COLUMN IF EXISTS inbound_job_id;
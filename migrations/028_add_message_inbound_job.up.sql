@@ -0,0 +1,7 @@
+-- inbound_job_id is the inbound queue job that filed a message. A job whose
+-- worker died after filing it is claimed again; the unique index lets the
+-- next attempt see that the message is already there instead of filing it
+-- twice.
+ALTER TABLE conversation_messages ADD COLUMN inbound_job_id BIGINT;
+
+CREATE UNIQUE INDEX idx_conversation_messages_inbound_job ON conversation_messages(inbound_job_id) WHERE inbound_job_id IS NOT NULL;
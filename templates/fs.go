@@ -2,5 +2,5 @@ package templates
 
 import "embed"
 
-//go:embed *.html partials/*.html
+//go:embed *.html partials/*.html email/*
 var FS embed.FS